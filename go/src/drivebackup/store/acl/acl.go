@@ -0,0 +1,197 @@
+// Package acl enforces per-bucket access control on a filesystem service.
+//
+// An ACL grants principals a Permission on buckets. A caller presents a
+// Token, minted by an Issuer, naming its principal and the Scope of
+// operations it may perform; an operation is allowed only if both the
+// token's scope and the principal's permission on the bucket cover it. A
+// token can so be narrower than its principal: an append-only backup token
+// can commit to a bucket its principal administers, but not prune or delete
+// it.
+package acl
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Permission is what a principal may do with a bucket. Each permission
+// includes the ones before it.
+type Permission int
+
+const (
+	None  Permission = iota
+	Read             // select, list snapshots and describe the bucket
+	Write            // commit and create refs
+	Admin            // delete versions, move and delete refs, create, rename and delete the bucket
+)
+
+func (p Permission) String() string {
+	switch p {
+	case None:
+		return "none"
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case Admin:
+		return "admin"
+	}
+	return fmt.Sprintf("Permission(%d)", int(p))
+}
+
+// Scope is a set of operations a token allows.
+type Scope int
+
+const (
+	ScopeRead   Scope = 1 << iota // selecting, listing and describing
+	ScopeCommit                   // committing transactions and creating refs
+	ScopePrune                    // deleting versions, moving and deleting refs
+	ScopeManage                   // creating, renaming and deleting buckets
+
+	ReadOnly   = ScopeRead
+	AppendOnly = ScopeRead | ScopeCommit
+	FullAccess = ScopeRead | ScopeCommit | ScopePrune | ScopeManage
+)
+
+// Op names an operation checked against the ACL.
+type Op string
+
+const (
+	ReadOp           Op = "read"
+	CommitOp         Op = "commit to"
+	DeleteVersionsOp Op = "delete versions of"
+	CreateRefOp      Op = "create refs in"
+	MoveRefOp        Op = "move or delete refs in"
+	CreateBucketOp   Op = "create"
+	RenameBucketOp   Op = "rename"
+	DeleteBucketOp   Op = "delete"
+)
+
+// requirements are the scope and permission each operation needs.
+var requirements = map[Op]struct {
+	scope      Scope
+	permission Permission
+}{
+	ReadOp:           {ScopeRead, Read},
+	CommitOp:         {ScopeCommit, Write},
+	DeleteVersionsOp: {ScopePrune, Admin},
+	CreateRefOp:      {ScopeCommit, Write},
+	MoveRefOp:        {ScopePrune, Admin}, // refs protect versions from pruning
+	CreateBucketOp:   {ScopeManage, Admin},
+	RenameBucketOp:   {ScopeManage, Admin},
+	DeleteBucketOp:   {ScopeManage, Admin},
+}
+
+// Token is the credential of a caller. Callers hold it as minted by an
+// Issuer, so that they can't forge or widen it.
+type Token struct {
+	Principal string
+	Scope     Scope
+	// Buckets, if set, are the only buckets the token may access, whatever
+	// its principal's permissions.
+	Buckets []string
+}
+
+func (t Token) covers(bucket string) bool {
+	if len(t.Buckets) == 0 {
+		return true
+	}
+	for _, b := range t.Buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessError is returned when a token may not perform an operation.
+type AccessError struct {
+	Principal string
+	Bucket    string
+	Op        Op
+}
+
+func (e *AccessError) Error() string {
+	return fmt.Sprintf("access denied: %s may not %s bucket %q", e.Principal, e.Op, e.Bucket)
+}
+
+// IsAccessError reports whether err is an *AccessError.
+func IsAccessError(err error) bool {
+	_, ok := err.(*AccessError)
+	return ok
+}
+
+// AnyBucket grants a permission on every bucket.
+const AnyBucket = "*"
+
+// ACL holds the permissions of principals on buckets. It is safe for
+// concurrent use.
+type ACL struct {
+	mu     sync.RWMutex
+	grants map[string]map[string]Permission // bucket, principal
+}
+
+func NewACL() *ACL {
+	return &ACL{grants: map[string]map[string]Permission{}}
+}
+
+// Grant sets the permission of principal on bucket, or on every bucket for
+// AnyBucket. Granting None revokes it.
+func (a *ACL) Grant(bucket, principal string, permission Permission) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if permission == None {
+		delete(a.grants[bucket], principal)
+		if len(a.grants[bucket]) == 0 {
+			delete(a.grants, bucket)
+		}
+		return
+	}
+	if a.grants[bucket] == nil {
+		a.grants[bucket] = map[string]Permission{}
+	}
+	a.grants[bucket][principal] = permission
+}
+
+// Permission returns the permission of principal on bucket: the higher of
+// its grants on the bucket and on AnyBucket.
+func (a *ACL) Permission(bucket, principal string) Permission {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	permission := a.grants[bucket][principal]
+	if any := a.grants[AnyBucket][principal]; any > permission {
+		permission = any
+	}
+	return permission
+}
+
+// Check returns an *AccessError unless token may perform op on bucket.
+func (a *ACL) Check(token Token, bucket string, op Op) error {
+	req, ok := requirements[op]
+	if !ok {
+		return fmt.Errorf("unknown operation %q", op)
+	}
+	if token.Scope&req.scope == 0 || !token.covers(bucket) || a.Permission(bucket, token.Principal) < req.permission {
+		return &AccessError{Principal: token.Principal, Bucket: bucket, Op: op}
+	}
+	return nil
+}
+
+// rename moves the grants on a bucket to its new name.
+func (a *ACL) rename(from, to string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if grants, ok := a.grants[from]; ok {
+		a.grants[to] = grants
+		delete(a.grants, from)
+	} else {
+		delete(a.grants, to)
+	}
+}
+
+// drop removes the grants on a bucket.
+func (a *ACL) drop(bucket string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.grants, bucket)
+}
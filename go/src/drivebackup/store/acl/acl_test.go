@@ -0,0 +1,180 @@
+package acl_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"drivebackup/store/acl"
+	"drivebackup/store/filesystem"
+	fsmock "drivebackup/store/filesystem/mock"
+)
+
+var ref = filesystem.BlobRef{Store: "store_a", Name: "abcd"}
+
+func commit(fs filesystem.FilesystemService, bucket string) error {
+	tx := fs.Bucket(bucket).NewPutTransaction()
+	tx.File("a", ref)
+	return tx.Commit()
+}
+
+func newIssuer(t *testing.T, key byte) *acl.Issuer {
+	issuer, err := acl.NewIssuer(bytes.Repeat([]byte{key}, 32))
+	if err != nil {
+		t.Fatalf("error creating issuer: %v", err)
+	}
+	return issuer
+}
+
+// connect returns service as seen by the holder of token, minted by issuer.
+func connect(t *testing.T, service filesystem.FilesystemService, a *acl.ACL, issuer *acl.Issuer, token acl.Token) *acl.FilesystemService {
+	minted, err := issuer.Mint(token)
+	if err != nil {
+		t.Fatalf("error minting token: %v", err)
+	}
+	fs, err := acl.NewFilesystemService(service, a, issuer, minted)
+	if err != nil {
+		t.Fatalf("error verifying token: %v", err)
+	}
+	return fs
+}
+
+func expectDenied(t *testing.T, what string, err error) {
+	if !acl.IsAccessError(err) {
+		t.Errorf("%s: got %v, want an access error", what, err)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	service := &fsmock.MockFilesystemService{}
+	a := acl.NewACL()
+	a.Grant("photos", "alice", acl.Admin)
+	a.Grant("photos", "bob", acl.Write)
+	a.Grant(acl.AnyBucket, "carol", acl.Read)
+	a.Grant(acl.AnyBucket, "root", acl.Admin)
+	issuer := newIssuer(t, 1)
+
+	root := connect(t, service, a, issuer, acl.Token{Principal: "root", Scope: acl.FullAccess})
+	for _, name := range []string{"photos", "docs"} {
+		if _, err := root.CreateBucket(name, filesystem.BucketOptions{}); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+	}
+
+	// An append-only token commits but neither prunes nor deletes.
+	backup := connect(t, service, a, issuer, acl.Token{Principal: "alice", Scope: acl.AppendOnly})
+	if err := commit(backup, "photos"); err != nil {
+		t.Fatalf("error committing with append-only token: %v", err)
+	}
+	versions, err := backup.Bucket("photos").Select().Versions()
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got versions %v, %v, want one", versions, err)
+	}
+	expectDenied(t, "append-only DeleteVersions", backup.Bucket("photos").DeleteVersions(versions[0]))
+	expectDenied(t, "append-only DeleteBucket", backup.DeleteBucket("photos", "photos"))
+	expectDenied(t, "commit to a bucket without a grant", commit(backup, "docs"))
+
+	// Write permission commits but doesn't prune, whatever the scope.
+	bob := connect(t, service, a, issuer, acl.Token{Principal: "bob", Scope: acl.FullAccess})
+	if err := commit(bob, "photos"); err != nil {
+		t.Errorf("error committing with write permission: %v", err)
+	}
+	expectDenied(t, "write DeleteVersions", bob.Bucket("photos").DeleteVersions(versions[0]))
+
+	// Creating a ref needs write permission, but moving or deleting one
+	// unprotects a version, so it needs the same as pruning.
+	if err := backup.Bucket("photos").SetRef("pre-migration", versions[0]); err != nil {
+		t.Errorf("error creating ref with append-only token: %v", err)
+	}
+	expectDenied(t, "append-only ref move", backup.Bucket("photos").SetRef("pre-migration", versions[0]))
+	expectDenied(t, "append-only ref delete", backup.Bucket("photos").DeleteRef("pre-migration"))
+	if err := connect(t, service, a, issuer, acl.Token{Principal: "alice", Scope: acl.FullAccess}).Bucket("photos").DeleteRef("pre-migration"); err != nil {
+		t.Errorf("error deleting ref with admin permission: %v", err)
+	}
+
+	carol := connect(t, service, a, issuer, acl.Token{Principal: "carol", Scope: acl.FullAccess})
+	if infos, err := carol.Buckets(); err != nil || len(infos) != 2 {
+		t.Errorf("got buckets %+v, %v, want both", infos, err)
+	}
+	if snapshots, err := carol.Bucket("photos").Snapshots(); err != nil || len(snapshots) != 2 {
+		t.Errorf("got snapshots %+v, %v, want two", snapshots, err)
+	}
+	expectDenied(t, "read-only commit", commit(carol, "docs"))
+
+	// Without a grant, nothing is visible.
+	dave := connect(t, service, a, issuer, acl.Token{Principal: "dave", Scope: acl.FullAccess})
+	if infos, err := dave.Buckets(); err != nil || len(infos) != 0 {
+		t.Errorf("got buckets %+v, %v, want none", infos, err)
+	}
+	_, err = dave.Bucket("photos").Select().File("a").Versions()
+	expectDenied(t, "Versions without a grant", err)
+	_, err = dave.Bucket("photos").Select().Tag("daily").File("a").Versions()
+	expectDenied(t, "tag without a grant", err)
+	_, err = dave.DescribeBucket("photos")
+	expectDenied(t, "DescribeBucket without a grant", err)
+
+	// A token can be restricted to some buckets.
+	scoped := connect(t, service, a, issuer, acl.Token{Principal: "root", Scope: acl.ReadOnly, Buckets: []string{"docs"}})
+	if infos, err := scoped.Buckets(); err != nil || len(infos) != 1 || infos[0].Name != "docs" {
+		t.Errorf("got buckets %+v, %v, want docs", infos, err)
+	}
+
+	// Revoking a grant affects open transactions.
+	tx := bob.Bucket("photos").NewPutTransaction()
+	tx.File("b", ref)
+	a.Grant("photos", "bob", acl.None)
+	expectDenied(t, "commit after revoking", tx.Commit())
+
+	// Grants follow a renamed bucket, and are dropped with a deleted one.
+	admin := connect(t, service, a, issuer, acl.Token{Principal: "alice", Scope: acl.FullAccess})
+	expectDenied(t, "rename to a name without admin", admin.RenameBucket("photos", "pictures"))
+	if err := root.RenameBucket("photos", "pictures"); err != nil {
+		t.Fatalf("error renaming: %v", err)
+	}
+	if got := a.Permission("pictures", "alice"); got != acl.Admin {
+		t.Errorf("got %v for alice on the renamed bucket, want admin", got)
+	}
+	if err := admin.Bucket("pictures").DeleteVersions(versions[0]); err != nil {
+		t.Errorf("error deleting versions with admin permission: %v", err)
+	}
+	if err := admin.DeleteBucket("pictures", "pictures"); err != nil {
+		t.Fatalf("error deleting bucket: %v", err)
+	}
+	if got := a.Permission("pictures", "alice"); got != acl.None {
+		t.Errorf("got %v for alice on the deleted bucket, want none", got)
+	}
+}
+
+func TestForgedTokensAreRejected(t *testing.T) {
+	if _, err := acl.NewIssuer([]byte("short")); err == nil {
+		t.Errorf("created an issuer with a short key")
+	}
+	service := &fsmock.MockFilesystemService{}
+	a := acl.NewACL()
+	a.Grant(acl.AnyBucket, "root", acl.Admin)
+	issuer := newIssuer(t, 1)
+	minted, err := issuer.Mint(acl.Token{Principal: "bob", Scope: acl.ReadOnly})
+	if err != nil {
+		t.Fatalf("error minting token: %v", err)
+	}
+	other, err := newIssuer(t, 2).Mint(acl.Token{Principal: "root", Scope: acl.FullAccess})
+	if err != nil {
+		t.Fatalf("error minting token: %v", err)
+	}
+	// The payload of a token minted for root, with bob's signature.
+	widened := other[:strings.LastIndexByte(other, '.')] + minted[strings.LastIndexByte(minted, '.'):]
+
+	for name, token := range map[string]string{
+		"another issuer's token": other,
+		"widened token":          widened,
+		"unsigned token":         minted[:strings.LastIndexByte(minted, '.')],
+		"empty token":            "",
+	} {
+		if fs, err := acl.NewFilesystemService(service, a, issuer, token); err != acl.ErrInvalidToken {
+			t.Errorf("%s: got %v, %v, want ErrInvalidToken", name, fs, err)
+		}
+	}
+	if token, err := issuer.Verify(minted); err != nil || token.Principal != "bob" || token.Scope != acl.ReadOnly {
+		t.Errorf("got %+v, %v verifying a minted token", token, err)
+	}
+}
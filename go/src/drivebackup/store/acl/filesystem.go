@@ -0,0 +1,297 @@
+package acl
+
+import (
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/selector"
+)
+
+// FilesystemService wraps a filesystem.FilesystemService, checking every
+// operation of its token against an ACL. It and its buckets wrap each
+// method explicitly rather than embedding the service, so that a method
+// added to the interfaces can't bypass the checks.
+type FilesystemService struct {
+	service filesystem.FilesystemService
+	acl     *ACL
+	token   Token
+}
+
+var _ filesystem.FilesystemService = (*FilesystemService)(nil)
+
+// NewFilesystemService returns service as seen by the holder of token, which
+// must have been minted by issuer.
+func NewFilesystemService(service filesystem.FilesystemService, acl *ACL, issuer *Issuer, token string) (*FilesystemService, error) {
+	t, err := issuer.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return &FilesystemService{service: service, acl: acl, token: t}, nil
+}
+
+func (s *FilesystemService) check(bucket string, op Op) error {
+	return s.acl.Check(s.token, bucket, op)
+}
+
+// Bucket can't fail, so access is checked by the operations of the bucket
+// it returns.
+func (s *FilesystemService) Bucket(bucket string) filesystem.Bucket {
+	return &aclBucket{s.service.Bucket(bucket), s, bucket}
+}
+
+// Buckets lists only the buckets the token may read.
+func (s *FilesystemService) Buckets() ([]filesystem.BucketInfo, error) {
+	infos, err := s.service.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	var readable []filesystem.BucketInfo
+	for _, info := range infos {
+		if s.check(info.Name, ReadOp) == nil {
+			readable = append(readable, info)
+		}
+	}
+	return readable, nil
+}
+
+func (s *FilesystemService) CreateBucket(name string, opts filesystem.BucketOptions) (filesystem.Bucket, error) {
+	if err := s.check(name, CreateBucketOp); err != nil {
+		return nil, err
+	}
+	bucket, err := s.service.CreateBucket(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &aclBucket{bucket, s, name}, nil
+}
+
+func (s *FilesystemService) DescribeBucket(name string) (filesystem.BucketInfo, error) {
+	if err := s.check(name, ReadOp); err != nil {
+		return filesystem.BucketInfo{}, err
+	}
+	return s.service.DescribeBucket(name)
+}
+
+// RenameBucket needs admin permission on both names, and moves the grants
+// on the bucket to its new name.
+func (s *FilesystemService) RenameBucket(from, to string) error {
+	if err := s.check(from, RenameBucketOp); err != nil {
+		return err
+	}
+	if err := s.check(to, RenameBucketOp); err != nil {
+		return err
+	}
+	if err := s.service.RenameBucket(from, to); err != nil {
+		return err
+	}
+	s.acl.rename(from, to)
+	return nil
+}
+
+// DeleteBucket removes the grants on the bucket, so that a bucket later
+// created with the name doesn't inherit them.
+func (s *FilesystemService) DeleteBucket(name, confirm string) error {
+	if err := s.check(name, DeleteBucketOp); err != nil {
+		return err
+	}
+	if err := s.service.DeleteBucket(name, confirm); err != nil {
+		return err
+	}
+	s.acl.drop(name)
+	return nil
+}
+
+type aclBucket struct {
+	bucket  filesystem.Bucket
+	service *FilesystemService
+	name    string
+}
+
+func (b *aclBucket) check(op Op) error {
+	return b.service.check(b.name, op)
+}
+
+func (b *aclBucket) NewPutTransaction() filesystem.PutTransaction {
+	return &aclPutTransaction{b.bucket.NewPutTransaction(), b}
+}
+
+// Select checks access once, when the selector is created. A denied
+// selector fails with the access error even when it names a tag, which
+// would otherwise be resolved first.
+func (b *aclBucket) Select() filesystem.Selector {
+	if err := b.check(ReadOp); err != nil {
+		builder := selector.NewSelectorBuilder(func(q selector.Query) filesystem.SelectorOp {
+			return &deniedSelector{err}
+		})
+		builder.ResolveTag = func(string) (filesystem.Version, error) { return "", err }
+		return builder
+	}
+	return b.bucket.Select()
+}
+
+func (b *aclBucket) Snapshots() ([]filesystem.Snapshot, error) {
+	if err := b.check(ReadOp); err != nil {
+		return nil, err
+	}
+	return b.bucket.Snapshots()
+}
+
+func (b *aclBucket) Snapshot(version filesystem.Version) (filesystem.Snapshot, error) {
+	if err := b.check(ReadOp); err != nil {
+		return filesystem.Snapshot{}, err
+	}
+	return b.bucket.Snapshot(version)
+}
+
+// SetRef needs MoveRefOp if the ref exists, as moving it unprotects the
+// version it pointed at.
+func (b *aclBucket) SetRef(name string, version filesystem.Version) error {
+	op := CreateRefOp
+	if _, err := b.bucket.Ref(name); err == nil {
+		op = MoveRefOp
+	}
+	if err := b.check(op); err != nil {
+		return err
+	}
+	return b.bucket.SetRef(name, version)
+}
+
+func (b *aclBucket) Ref(name string) (filesystem.Version, error) {
+	if err := b.check(ReadOp); err != nil {
+		return "", err
+	}
+	return b.bucket.Ref(name)
+}
+
+func (b *aclBucket) Refs() ([]filesystem.Ref, error) {
+	if err := b.check(ReadOp); err != nil {
+		return nil, err
+	}
+	return b.bucket.Refs()
+}
+
+func (b *aclBucket) DeleteRef(name string) error {
+	if err := b.check(MoveRefOp); err != nil {
+		return err
+	}
+	return b.bucket.DeleteRef(name)
+}
+
+func (b *aclBucket) Head() (filesystem.Version, error) {
+	if err := b.check(ReadOp); err != nil {
+		return "", err
+	}
+	return b.bucket.Head()
+}
+
+func (b *aclBucket) DeleteVersions(versions ...filesystem.Version) error {
+	if err := b.check(DeleteVersionsOp); err != nil {
+		return err
+	}
+	return b.bucket.DeleteVersions(versions...)
+}
+
+func (b *aclBucket) ExportCommit(version filesystem.Version) (*filesystem.Commit, error) {
+	if err := b.check(ReadOp); err != nil {
+		return nil, err
+	}
+	return b.bucket.ExportCommit(version)
+}
+
+func (b *aclBucket) ImportCommit(commit *filesystem.Commit) error {
+	if err := b.check(CommitOp); err != nil {
+		return err
+	}
+	return b.bucket.ImportCommit(commit)
+}
+
+// aclPutTransaction only checks Commit: the other methods build the
+// transaction without reaching the store.
+type aclPutTransaction struct {
+	tx     filesystem.PutTransaction
+	bucket *aclBucket
+}
+
+func (tx *aclPutTransaction) Dir(path string) filesystem.PutTransactionPath {
+	return tx.tx.Dir(path)
+}
+
+func (tx *aclPutTransaction) File(name string, blobRef filesystem.BlobRef) {
+	tx.tx.File(name, blobRef)
+}
+
+func (tx *aclPutTransaction) FileWithMetadata(name string, blobRef filesystem.BlobRef, metadata filesystem.Metadata) {
+	tx.tx.FileWithMetadata(name, blobRef, metadata)
+}
+
+func (tx *aclPutTransaction) Symlink(name, target string, metadata filesystem.Metadata) {
+	tx.tx.Symlink(name, target, metadata)
+}
+
+func (tx *aclPutTransaction) Remove(name string) {
+	tx.tx.Remove(name)
+}
+
+func (tx *aclPutTransaction) RemoveAll(name string) {
+	tx.tx.RemoveAll(name)
+}
+
+func (tx *aclPutTransaction) Move(from, to string) {
+	tx.tx.Move(from, to)
+}
+
+func (tx *aclPutTransaction) Describe(snapshot filesystem.Snapshot) {
+	tx.tx.Describe(snapshot)
+}
+
+func (tx *aclPutTransaction) SetParent(parent filesystem.Version) {
+	tx.tx.SetParent(parent)
+}
+
+func (tx *aclPutTransaction) Version() filesystem.Version {
+	return tx.tx.Version()
+}
+
+// Commit checks access when committing, so that a transaction can't
+// outlive a revoked permission.
+func (tx *aclPutTransaction) Commit() error {
+	if err := tx.bucket.check(CommitOp); err != nil {
+		return err
+	}
+	return tx.tx.Commit()
+}
+
+// deniedSelector fails every operation with an *AccessError.
+type deniedSelector struct {
+	err error
+}
+
+func (s *deniedSelector) List() ([]string, error) {
+	return nil, s.err
+}
+
+func (s *deniedSelector) BlobRef() (filesystem.StoredBlobRef, error) {
+	return filesystem.StoredBlobRef{}, s.err
+}
+
+func (s *deniedSelector) Versions() ([]filesystem.Version, error) {
+	return nil, s.err
+}
+
+func (s *deniedSelector) IterVersions(opts filesystem.VersionOptions) filesystem.VersionIterator {
+	return filesystem.FailedVersionIterator(s.err)
+}
+
+func (s *deniedSelector) Match() ([]filesystem.MatchedFile, error) {
+	return nil, s.err
+}
+
+func (s *deniedSelector) ListEntries(opts filesystem.ListOptions) (*filesystem.EntryPage, error) {
+	return nil, s.err
+}
+
+func (s *deniedSelector) Walk(fn filesystem.WalkFunc) error {
+	return s.err
+}
+
+func (s *deniedSelector) Diff(v1, v2 filesystem.Version) ([]filesystem.Change, error) {
+	return nil, s.err
+}
@@ -0,0 +1,71 @@
+package acl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidToken is returned for a token its issuer didn't mint.
+var ErrInvalidToken = errors.New("invalid token")
+
+// minKeyBytes is the shortest key an Issuer accepts: the size of the HMAC.
+const minKeyBytes = sha256.Size
+
+// Issuer mints tokens and verifies them. A minted token is its Token,
+// JSON and base64 encoded, followed by an HMAC-SHA256 of the encoding under
+// the issuer's key, so only holders of the key can mint or alter tokens.
+type Issuer struct {
+	key []byte
+}
+
+// NewIssuer returns an issuer signing with key, which must be secret and
+// at least 32 bytes long.
+func NewIssuer(key []byte) (*Issuer, error) {
+	if len(key) < minKeyBytes {
+		return nil, fmt.Errorf("token key of %d bytes is shorter than %d", len(key), minKeyBytes)
+	}
+	return &Issuer{key: append([]byte(nil), key...)}, nil
+}
+
+func (i *Issuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, i.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Mint returns token in the form callers present to NewFilesystemService.
+func (i *Issuer) Mint(token Token) (string, error) {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + i.sign(payload), nil
+}
+
+// Verify returns the token minted as s, or ErrInvalidToken if the issuer
+// didn't mint s.
+func (i *Issuer) Verify(s string) (Token, error) {
+	dot := strings.LastIndexByte(s, '.')
+	if dot < 0 {
+		return Token{}, ErrInvalidToken
+	}
+	payload, sig := s[:dot], s[dot+1:]
+	if !hmac.Equal([]byte(sig), []byte(i.sign(payload))) {
+		return Token{}, ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	var token Token
+	if err := json.Unmarshal(b, &token); err != nil {
+		return Token{}, ErrInvalidToken
+	}
+	return token, nil
+}
@@ -0,0 +1,184 @@
+// Package archive exports the complete history of a bucket to a portable
+// archive, and imports such archives into any filesystem.FilesystemService.
+// Archives hold metadata only: the blobs the files reference must be copied
+// separately.
+//
+// # Format
+//
+// An archive is UTF-8 text. Its first line is the header
+//
+//	drivebackup bucket archive v1
+//
+// naming the format version. Every following line is a JSON object with
+// exactly one of these fields set:
+//
+//	{"Bucket": BucketInfo}    the bucket's metadata; always the first record
+//	{"Commit": Commit}        one per version, oldest first
+//	{"Ref": Ref}              one per ref, sorted by name, after the commits
+//	{"End": {"Commits": n, "Refs": m}}
+//	                          the last record, counting the records before it
+//
+// BucketInfo, Commit and Ref are the types of package filesystem, encoded
+// with encoding/json. Commit holds the snapshot of a version, with the dirs
+// and files it wrote, the paths it removed and the sources of the paths it
+// moved. The End record tells a complete archive from a truncated one.
+//
+// Readers reject archives of any other format version. Within a version,
+// fields may be added to the records; readers ignore fields they don't know.
+package archive
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"drivebackup/store/filesystem"
+)
+
+// Header is the first line of an archive, without its newline.
+const Header = "drivebackup bucket archive v1"
+
+const headerPrefix = "drivebackup bucket archive "
+
+// record is a line of an archive. Exactly one field is set.
+type record struct {
+	Bucket *filesystem.BucketInfo `json:",omitempty"`
+	Commit *filesystem.Commit     `json:",omitempty"`
+	Ref    *filesystem.Ref        `json:",omitempty"`
+	End    *end                   `json:",omitempty"`
+}
+
+type end struct {
+	Commits int
+	Refs    int
+}
+
+// Export writes an archive of the bucket name of service to w.
+func Export(w io.Writer, service filesystem.FilesystemService, name string) error {
+	info, err := service.DescribeBucket(name)
+	if err != nil {
+		return err
+	}
+	bucket := service.Bucket(name)
+	snapshots, err := bucket.Snapshots()
+	if err != nil {
+		return err
+	}
+	refs, err := bucket.Refs()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintln(bw, Header); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(&record{Bucket: &info}); err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		commit, err := bucket.ExportCommit(snapshot.Version)
+		if err != nil {
+			return fmt.Errorf("exporting version %s: %v", snapshot.Version, err)
+		}
+		if err := enc.Encode(&record{Commit: commit}); err != nil {
+			return err
+		}
+	}
+	for i := range refs {
+		if err := enc.Encode(&record{Ref: &refs[i]}); err != nil {
+			return err
+		}
+	}
+	if err := enc.Encode(&record{End: &end{Commits: len(snapshots), Refs: len(refs)}}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Import creates a bucket of service from the archive read from r, under
+// name, or under the name it was exported from if name is "". The bucket
+// must not exist. Its versions keep their exported versions, so a service
+// that had a bucket of that name before may reject them as older than its
+// head. If the import fails after creating the bucket, the bucket is
+// deleted again; if that fails too, the returned error says so and the
+// partly imported bucket is left behind.
+func Import(r io.Reader, service filesystem.FilesystemService, name string) (err error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	header = strings.TrimSuffix(header, "\n")
+	if header != Header {
+		if strings.HasPrefix(header, headerPrefix) {
+			return fmt.Errorf("unsupported archive format %q", strings.TrimPrefix(header, headerPrefix))
+		}
+		return errors.New("not a bucket archive")
+	}
+
+	dec := json.NewDecoder(br)
+	var bucket filesystem.Bucket
+	var commits, refs int
+	defer func() {
+		if err != nil && bucket != nil {
+			if deleteErr := service.DeleteBucket(name, name); deleteErr != nil {
+				err = fmt.Errorf("%v; deleting the partly imported bucket %q also failed: %v", err, name, deleteErr)
+			}
+		}
+	}()
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return errors.New("truncated archive: no end record")
+		} else if err != nil {
+			return fmt.Errorf("invalid archive record: %v", err)
+		}
+		switch {
+		case rec.Bucket != nil:
+			if bucket != nil {
+				return errors.New("invalid archive: more than one bucket record")
+			}
+			if name == "" {
+				name = rec.Bucket.Name
+			}
+			bucket, err = service.CreateBucket(name, filesystem.BucketOptions{
+				Description: rec.Bucket.Description,
+				Owner:       rec.Bucket.Owner,
+				Created:     rec.Bucket.Created,
+			})
+			if err != nil {
+				return err
+			}
+		case bucket == nil:
+			return errors.New("invalid archive: records before the bucket record")
+		case rec.Commit != nil:
+			if refs > 0 {
+				return errors.New("invalid archive: commit after refs")
+			}
+			if err := bucket.ImportCommit(rec.Commit); err != nil {
+				return fmt.Errorf("importing version %s: %v", rec.Commit.Snapshot.Version, err)
+			}
+			commits++
+		case rec.Ref != nil:
+			if err := bucket.SetRef(rec.Ref.Name, rec.Ref.Version); err != nil {
+				return fmt.Errorf("importing ref %q: %v", rec.Ref.Name, err)
+			}
+			refs++
+		case rec.End != nil:
+			if rec.End.Commits != commits || rec.End.Refs != refs {
+				return fmt.Errorf("truncated archive: read %d commits and %d refs, want %d and %d", commits, refs, rec.End.Commits, rec.End.Refs)
+			}
+			if dec.More() {
+				return errors.New("invalid archive: records after the end record")
+			}
+			return nil
+		default:
+			return errors.New("invalid archive: empty record")
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"drivebackup/store/archive"
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/datastore"
+	dsmock "drivebackup/store/filesystem/datastore/mock"
+	"drivebackup/store/filesystem/disk"
+	fsmock "drivebackup/store/filesystem/mock"
+)
+
+func commit(t *testing.T, bucket filesystem.Bucket, build func(tx filesystem.PutTransaction)) {
+	tx := bucket.NewPutTransaction()
+	build(tx)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+}
+
+// history fills the bucket photos of service with commits writing, moving
+// and removing files and dirs, and refs.
+func history(t *testing.T, service filesystem.FilesystemService) {
+	bucket, err := service.CreateBucket("photos", filesystem.BucketOptions{Description: "holiday photos", Owner: "alice"})
+	if err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	modTime := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	commit(t, bucket, func(tx filesystem.PutTransaction) {
+		tx.Describe(filesystem.Snapshot{Source: "/home/alice", Tags: []string{"daily"}, Message: "first"})
+		dir := tx.Dir("2016")
+		dir.FileWithMetadata("a.jpg", filesystem.BlobRef{Store: "blobs", Name: "a1"}, filesystem.Metadata{Size: 3, Mode: 0644, ModTime: modTime, Hash: "aa"})
+		dir.File("b.jpg", filesystem.BlobRef{Store: "blobs", Name: "b1"})
+		tx.Dir("docs").File("readme", filesystem.BlobRef{Store: "blobs", Name: "r1"})
+	})
+	commit(t, bucket, func(tx filesystem.PutTransaction) {
+		tx.Move("2016", "old/2016")
+		tx.Symlink("latest", "old/2016/a.jpg", filesystem.Metadata{ModTime: modTime})
+	})
+	commit(t, bucket, func(tx filesystem.PutTransaction) {
+		tx.RemoveAll("docs")
+		tx.Remove("old/2016/b.jpg")
+		tx.Dir("old/2016").FileWithMetadata("a.jpg", filesystem.BlobRef{Store: "blobs", Name: "a2"}, filesystem.Metadata{Size: 4, Hash: "bb"})
+	})
+	snapshots, err := bucket.Snapshots()
+	if err != nil || len(snapshots) != 3 {
+		t.Fatalf("unexpected snapshots %v: %v", snapshots, err)
+	}
+	if err := bucket.SetRef("before-move", snapshots[0].Version); err != nil {
+		t.Fatalf("error setting ref: %v", err)
+	}
+	if err := bucket.SetRef("current", snapshots[2].Version); err != nil {
+		t.Fatalf("error setting ref: %v", err)
+	}
+}
+
+func encode(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("error encoding %v: %v", v, err)
+	}
+	return string(data)
+}
+
+func walk(t *testing.T, selector filesystem.Selector) []filesystem.WalkEntry {
+	var entries []filesystem.WalkEntry
+	err := selector.Walk(func(entry filesystem.WalkEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error walking: %v", err)
+	}
+	return entries
+}
+
+// expectSame fails unless the bucket name of got has the same metadata,
+// history and refs as that of want.
+func expectSame(t *testing.T, got, want filesystem.FilesystemService, name string) {
+	gotInfo, err := got.DescribeBucket(name)
+	if err != nil {
+		t.Fatalf("error describing imported bucket: %v", err)
+	}
+	wantInfo, _ := want.DescribeBucket(name)
+	if encode(t, gotInfo) != encode(t, wantInfo) {
+		t.Errorf("got bucket info %+v, want %+v", gotInfo, wantInfo)
+	}
+	gotBucket, wantBucket := got.Bucket(name), want.Bucket(name)
+	snapshots, _ := wantBucket.Snapshots()
+	gotSnapshots, err := gotBucket.Snapshots()
+	if err != nil {
+		t.Fatalf("error fetching snapshots: %v", err)
+	}
+	if g, w := encode(t, gotSnapshots), encode(t, snapshots); g != w {
+		t.Errorf("got snapshots %s, want %s", g, w)
+	}
+	for _, snapshot := range snapshots {
+		gotCommit, err := gotBucket.ExportCommit(snapshot.Version)
+		if err != nil {
+			t.Fatalf("error exporting %s: %v", snapshot.Version, err)
+		}
+		wantCommit, _ := wantBucket.ExportCommit(snapshot.Version)
+		if g, w := encode(t, gotCommit), encode(t, wantCommit); g != w {
+			t.Errorf("got commit %s, want %s", g, w)
+		}
+		gotEntries := walk(t, gotBucket.Select().Version(snapshot.Version))
+		wantEntries := walk(t, wantBucket.Select().Version(snapshot.Version))
+		if g, w := encode(t, gotEntries), encode(t, wantEntries); g != w {
+			t.Errorf("got entries %s at %s, want %s", g, snapshot.Version, w)
+		}
+	}
+	if g, w := encode(t, walk(t, gotBucket.Select())), encode(t, walk(t, wantBucket.Select())); g != w {
+		t.Errorf("got live entries %s, want %s", g, w)
+	}
+	gotRefs, err := gotBucket.Refs()
+	if err != nil {
+		t.Fatalf("error fetching refs: %v", err)
+	}
+	wantRefs, _ := wantBucket.Refs()
+	if g, w := encode(t, gotRefs), encode(t, wantRefs); g != w {
+		t.Errorf("got refs %s, want %s", g, w)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	diskService, err := disk.Open(dir)
+	if err != nil {
+		t.Fatalf("error opening disk service: %v", err)
+	}
+	defer diskService.Close()
+
+	source := &fsmock.MockFilesystemService{}
+	history(t, source)
+	// The archive is copied from the mock to the persistent backends and
+	// back, each copy exported from the previous one.
+	services := []struct {
+		name    string
+		service filesystem.FilesystemService
+	}{
+		{"disk", diskService},
+		{"datastore", datastore.NewFilesystemService(context.Background(), &dsmock.MockClient{})},
+		{"mock", &fsmock.MockFilesystemService{}},
+	}
+	var first string
+	from := filesystem.FilesystemService(source)
+	for _, s := range services {
+		var buf bytes.Buffer
+		if err := archive.Export(&buf, from, "photos"); err != nil {
+			t.Fatalf("error exporting to %s: %v", s.name, err)
+		}
+		if first == "" {
+			first = buf.String()
+		} else if buf.String() != first {
+			t.Errorf("archive exported before %s differs from the first:\n%s\nwant:\n%s", s.name, buf.String(), first)
+		}
+		if err := archive.Import(&buf, s.service, ""); err != nil {
+			t.Fatalf("error importing into %s: %v", s.name, err)
+		}
+		expectSame(t, s.service, source, "photos")
+		from = s.service
+	}
+
+	// Imported buckets take new commits after the imported history.
+	bucket := services[1].service.Bucket("photos")
+	commit(t, bucket, func(tx filesystem.PutTransaction) {
+		tx.File("c.jpg", filesystem.BlobRef{Store: "blobs", Name: "c1"})
+	})
+	if snapshots, _ := bucket.Snapshots(); len(snapshots) != 4 {
+		t.Errorf("got %d snapshots after committing to the imported bucket, want 4", len(snapshots))
+	}
+}
+
+func TestImportUnderNewName(t *testing.T) {
+	source := &fsmock.MockFilesystemService{}
+	history(t, source)
+	var buf bytes.Buffer
+	if err := archive.Export(&buf, source, "photos"); err != nil {
+		t.Fatalf("error exporting: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Importing onto an existing bucket fails and leaves it alone.
+	if err := archive.Import(bytes.NewReader(data), source, ""); err != filesystem.ErrBucketExists {
+		t.Errorf("got %v importing onto an existing bucket, want ErrBucketExists", err)
+	}
+	if _, err := source.DescribeBucket("photos"); err != nil {
+		t.Errorf("existing bucket was deleted by a failed import: %v", err)
+	}
+	if err := archive.Import(bytes.NewReader(data), source, "copy"); err != nil {
+		t.Fatalf("error importing under a new name: %v", err)
+	}
+	versions, err := source.Bucket("copy").Select().File("old/2016/a.jpg").Versions()
+	if err != nil || len(versions) != 2 {
+		t.Errorf("got versions %v of the imported copy: %v", versions, err)
+	}
+}
+
+func TestRejectsInvalidArchives(t *testing.T) {
+	source := &fsmock.MockFilesystemService{}
+	history(t, source)
+	var buf bytes.Buffer
+	if err := archive.Export(&buf, source, "photos"); err != nil {
+		t.Fatalf("error exporting: %v", err)
+	}
+	valid := buf.String()
+	lines := strings.SplitAfter(valid, "\n")
+
+	for _, tc := range []struct {
+		name    string
+		archive string
+		want    string
+	}{
+		{"empty", "", "not a bucket archive"},
+		{"not an archive", "hello\n", "not a bucket archive"},
+		{"newer format", "drivebackup bucket archive v2\n" + strings.Join(lines[1:], ""), `unsupported archive format "v2"`},
+		{"truncated", strings.Join(lines[:len(lines)-3], ""), "truncated archive"},
+		{"cut mid record", valid[:len(valid)-10], "invalid archive record"},
+		{"missing commit", strings.Join(lines[:3], "") + strings.Join(lines[4:], ""), "truncated archive"},
+		{"no bucket record", lines[0] + strings.Join(lines[2:], ""), "records before the bucket record"},
+		{"trailing record", valid + lines[len(lines)-2], "records after the end record"},
+	} {
+		dst := &fsmock.MockFilesystemService{}
+		err := archive.Import(strings.NewReader(tc.archive), dst, "")
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.want)
+		}
+		if _, err := dst.DescribeBucket("photos"); err != filesystem.ErrNoSuchBucket {
+			t.Errorf("%s: failed import left the bucket behind: %v", tc.name, err)
+		}
+	}
+}
+
+// undeletableService fails every DeleteBucket.
+type undeletableService struct {
+	*fsmock.MockFilesystemService
+}
+
+func (s undeletableService) DeleteBucket(name, confirm string) error {
+	return errors.New("disk on fire")
+}
+
+func TestReportsFailedRollback(t *testing.T) {
+	source := &fsmock.MockFilesystemService{}
+	history(t, source)
+	var buf bytes.Buffer
+	if err := archive.Export(&buf, source, "photos"); err != nil {
+		t.Fatalf("error exporting: %v", err)
+	}
+	lines := strings.SplitAfter(buf.String(), "\n")
+	truncated := strings.Join(lines[:len(lines)-3], "")
+
+	err := archive.Import(strings.NewReader(truncated), undeletableService{&fsmock.MockFilesystemService{}}, "")
+	if err == nil || !strings.Contains(err.Error(), "truncated archive") || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("got error %v, want the import and the rollback errors", err)
+	}
+}
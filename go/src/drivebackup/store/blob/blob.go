@@ -5,4 +5,8 @@ import "io"
 type BlobService interface {
 	Put(name string, data io.Reader) error
 	Get(name string) (data io.Reader, err error)
+	// Stat returns the size of a blob without reading it. ok is false if
+	// the blob doesn't exist.
+	Stat(name string) (size int64, ok bool, err error)
+	Delete(name string) error // deleting a missing blob is not an error
 }
@@ -6,12 +6,17 @@ import (
 	"io/ioutil"
 	"bytes"
 	"drivebackup/store/blob/mock"
+	"drivebackup/store/fault"
 )
 
 func TestMockBlobService(t *testing.T) {
 	blobTest(t, &mock.MockBlobService{})
 }
 
+func TestFaultBlobService(t *testing.T) {
+	blobTest(t, fault.NewBlobService(&mock.MockBlobService{}, fault.NewInjector(0)))
+}
+
 func blobExpectMissing(t *testing.T, service blob.BlobService, name string) {
 	reader, err := service.Get(name)
 	if err != nil {
@@ -19,7 +24,7 @@ func blobExpectMissing(t *testing.T, service blob.BlobService, name string) {
 		return
 	}
 	if reader != nil {
-		t.Errorf("Get(%q) unexpectedly returned a blob")
+		t.Errorf("Get(%q) unexpectedly returned a blob", name)
 	}
 }
 
@@ -30,7 +35,7 @@ func blobExpect(t *testing.T, service blob.BlobService, name, data string) {
 		return
 	}
 	if reader == nil {
-		t.Errorf("Get(%q) unexpectedly returned nil")
+		t.Errorf("Get(%q) unexpectedly returned nil", name)
 		return
 	}
 	out, err := ioutil.ReadAll(reader)
@@ -49,15 +54,40 @@ func blobPut(t *testing.T, service blob.BlobService, name, data string) {
 	}
 }
 
+func blobExpectSize(t *testing.T, service blob.BlobService, name string, size int64, exists bool) {
+	gotSize, ok, err := service.Stat(name)
+	if err != nil {
+		t.Errorf("error in Stat(%q): %v", name, err)
+		return
+	}
+	if ok != exists || (ok && gotSize != size) {
+		t.Errorf("Stat(%q) = %d, %v, want %d, %v", name, gotSize, ok, size, exists)
+	}
+}
+
+func blobDelete(t *testing.T, service blob.BlobService, name string) {
+	if err := service.Delete(name); err != nil {
+		t.Errorf("error in Delete(%q): %v", name, err)
+	}
+}
+
 func blobTest(t *testing.T, service blob.BlobService) {
 	blobExpectMissing(t, service, "")
 	blobExpectMissing(t, service, "abcd")
 	blobPut(t, service, "abcd", "result_abcd")
 	blobExpect(t, service, "abcd", "result_abcd")
+	blobExpectSize(t, service, "abcd", int64(len("result_abcd")), true)
 	blobExpectMissing(t, service, "efgh")
+	blobExpectSize(t, service, "efgh", 0, false)
 	blobPut(t, service, "efgh", "result_efgh")
 	blobPut(t, service, "ijkl", "result_ijkl")
 	blobExpect(t, service, "abcd", "result_abcd")
 	blobExpect(t, service, "efgh", "result_efgh")
 	blobExpect(t, service, "ijkl", "result_ijkl")
+	blobDelete(t, service, "efgh")
+	blobExpectMissing(t, service, "efgh")
+	blobExpect(t, service, "abcd", "result_abcd")
+	blobDelete(t, service, "efgh")
+	blobPut(t, service, "efgh", "result_efgh2")
+	blobExpect(t, service, "efgh", "result_efgh2")
 }
\ No newline at end of file
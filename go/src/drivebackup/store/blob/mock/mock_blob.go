@@ -35,4 +35,12 @@ func (mock *MockBlobService) Get(name string) (io.Reader, error) {
 	} else {
 		return nil, nil
 	}
-}
\ No newline at end of file
+}
+func (mock *MockBlobService) Stat(name string) (int64, bool, error) {
+	data, ok := mock.m[name]
+	return int64(len(data)), ok, nil
+}
+func (mock *MockBlobService) Delete(name string) error {
+	delete(mock.m, name)
+	return nil
+}
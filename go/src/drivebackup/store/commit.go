@@ -0,0 +1,41 @@
+package store
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+	"google.golang.org/cloud/datastore"
+
+	"drivebackup/store/commit"
+)
+
+// Commits are staged, published and recovered by package commit; see there
+// for the protocol. This file adapts the Cloud Storage service to it.
+
+// Recover resolves commits interrupted by a crash. Commits staged less than
+// minAge ago are left alone, since they may still be in progress elsewhere.
+func Recover(ctx context.Context, client *datastore.Client, service *storage.Service, minAge time.Duration) error {
+	return commit.Recover(ctx, NewDatastoreClient(ctx, client), storageObjects{service}, time.Now().Add(-minAge))
+}
+
+// storageObjects reports which objects the backup bucket holds.
+type storageObjects struct {
+	service *storage.Service
+}
+
+func (o storageObjects) Exists(name string) (bool, error) {
+	if _, err := o.service.Objects.Get(BACKUP_BUCKET, name).Do(); err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == 404
+}
@@ -0,0 +1,462 @@
+// Package commit makes the versions of a category of the store visible
+// atomically, and recovers commits interrupted by a crash.
+//
+// A commit goes through these steps:
+//
+//  1. Stage writes a pending manifest listing every path and blob. The
+//     manifest is split into chunks so that no entity outgrows the
+//     datastore's size limit.
+//  2. The caller uploads the objects.
+//  3. Publish writes the blob refs, which readers ignore for now, and then
+//     in one transaction writes the commit record and marks the manifest
+//     committed. This makes the version visible.
+//
+// A crash before step 3 completes leaves a pending manifest, which Recover
+// either completes (if every object was uploaded) or rolls back.
+//
+// Every commit is named by a random id, so commits made at the same time
+// never share keys. Blob refs carry the id of their commit; refs written
+// before commits were atomic have none and are always visible.
+package commit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"drivebackup/store/filesystem/datastore"
+)
+
+const (
+	categoryKind = "Category"
+	manifestKind = "Manifest"
+	chunkKind    = "ManifestChunk"
+	commitKind   = "Commit"
+	refKind      = "BlobRef"
+)
+
+const (
+	manifestPending   = "pending"
+	manifestCommitted = "committed"
+)
+
+// maxChunkBytes bounds the encoded files of a manifest chunk, well below
+// the datastore's limit of 1 MB per entity.
+const maxChunkBytes = 512 << 10
+
+// Ref is the blob stored for a path by a commit.
+type Ref struct {
+	Path      string
+	Blob      string
+	Timestamp time.Time
+}
+
+// Objects reports whether the object store holds an object.
+type Objects interface {
+	Exists(name string) (bool, error)
+}
+
+// Pending is a staged commit.
+type Pending struct {
+	ID        string
+	Category  string
+	Timestamp time.Time
+	Files     map[string]string // path -> blob
+}
+
+type file struct {
+	Path string
+	Blob string
+}
+
+func categoryKey(category string) *datastore.Key {
+	return &datastore.Key{Kind: categoryKind, Name: category}
+}
+
+func manifestKey(category, id string) *datastore.Key {
+	return &datastore.Key{Kind: manifestKind, Name: id, Parent: categoryKey(category)}
+}
+
+func chunkKey(category, id string, n int) *datastore.Key {
+	return &datastore.Key{Kind: chunkKind, Name: strconv.Itoa(n), Parent: manifestKey(category, id)}
+}
+
+func commitKey(category, id string) *datastore.Key {
+	return &datastore.Key{Kind: commitKind, Name: id, Parent: categoryKey(category)}
+}
+
+// refKey names a ref by its commit and path, so writing the refs of a
+// commit again (e.g. during recovery) overwrites rather than duplicates them.
+func refKey(category, id, path string) *datastore.Key {
+	return &datastore.Key{Kind: refKind, Name: id + ":" + path, Parent: categoryKey(category)}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// chunks splits files, sorted by path, into chunks of at most maxChunkBytes
+// once encoded.
+func chunks(files map[string]string) ([]string, error) {
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var encoded []string
+	var chunk []file
+	size := 0
+	flush := func() error {
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, string(data))
+		chunk, size = nil, 0
+		return nil
+	}
+	for _, path := range paths {
+		f := file{Path: path, Blob: files[path]}
+		data, err := json.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) > 0 && size+len(data)+1 > maxChunkBytes {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		chunk = append(chunk, f)
+		size += len(data) + 1
+	}
+	if len(chunk) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return encoded, nil
+}
+
+func putBatched(ctx context.Context, client datastore.Client, entities []*datastore.Entity) error {
+	for len(entities) > 0 {
+		n := len(entities)
+		if n > datastore.MaxBatchSize {
+			n = datastore.MaxBatchSize
+		}
+		if err := client.PutMulti(ctx, entities[:n]); err != nil {
+			return err
+		}
+		entities = entities[n:]
+	}
+	return nil
+}
+
+func deleteBatched(ctx context.Context, client datastore.Client, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > datastore.MaxBatchSize {
+			n = datastore.MaxBatchSize
+		}
+		if err := client.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Stage writes the pending manifest of a commit of files (path -> blob) to
+// category. The manifest's header is written before its chunks, so Recover
+// finds every manifest that has any chunk.
+func Stage(ctx context.Context, client datastore.Client, category string, timestamp time.Time, files map[string]string) (*Pending, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := chunks(files)
+	if err != nil {
+		return nil, err
+	}
+	header := &datastore.Entity{
+		Key: manifestKey(category, id),
+		Properties: map[string]interface{}{
+			"Category":  category,
+			"Timestamp": timestamp,
+			"State":     manifestPending,
+			"Chunks":    int64(len(encoded)),
+		},
+	}
+	if err := client.PutMulti(ctx, []*datastore.Entity{header}); err != nil {
+		return nil, err
+	}
+	var entities []*datastore.Entity
+	for n, data := range encoded {
+		entities = append(entities, &datastore.Entity{
+			Key:        chunkKey(category, id, n),
+			Properties: map[string]interface{}{"Files": data},
+		})
+	}
+	if err := putBatched(ctx, client, entities); err != nil {
+		return nil, err
+	}
+	return &Pending{ID: id, Category: category, Timestamp: timestamp, Files: files}, nil
+}
+
+// Publish writes the blob refs of p and then makes them visible by writing
+// its commit record. Once the record is written the manifest's chunks are
+// no longer needed; they are deleted on a best effort basis.
+func (p *Pending) Publish(ctx context.Context, client datastore.Client) error {
+	var refs []*datastore.Entity
+	for path, blob := range p.Files {
+		refs = append(refs, &datastore.Entity{
+			Key: refKey(p.Category, p.ID, path),
+			Properties: map[string]interface{}{
+				"FilePath":     path,
+				"Timestamp":    p.Timestamp,
+				"BlobLocation": blob,
+				"Commit":       p.ID,
+			},
+		})
+	}
+	if err := putBatched(ctx, client, refs); err != nil {
+		return err
+	}
+	mkey := manifestKey(p.Category, p.ID)
+	err := client.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		m, err := tx.Get(mkey)
+		if err != nil {
+			return err
+		}
+		if state := m.Properties["State"]; state != manifestPending {
+			return fmt.Errorf("manifest %v is %v, not %s", mkey, state, manifestPending)
+		}
+		m.Properties["State"] = manifestCommitted
+		return tx.PutMulti([]*datastore.Entity{m, {
+			Key:        commitKey(p.Category, p.ID),
+			Properties: map[string]interface{}{"Timestamp": p.Timestamp},
+		}})
+	})
+	if err != nil {
+		return err
+	}
+	if keys, err := chunkKeys(ctx, client, p.Category, p.ID); err == nil {
+		deleteBatched(ctx, client, keys)
+	}
+	return nil
+}
+
+func chunkKeys(ctx context.Context, client datastore.Client, category, id string) ([]*datastore.Key, error) {
+	q := datastore.NewQuery(chunkKind).WithAncestor(manifestKey(category, id)).WithKeysOnly()
+	entities, err := client.GetAll(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*datastore.Key, len(entities))
+	for i, e := range entities {
+		keys[i] = e.Key
+	}
+	return keys, nil
+}
+
+// visibility tells committed refs from staged ones for one read, looking
+// up each commit record at most once.
+type visibility struct {
+	ctx       context.Context
+	client    datastore.Client
+	category  string
+	committed map[string]bool
+}
+
+func newVisibility(ctx context.Context, client datastore.Client, category string) *visibility {
+	return &visibility{ctx: ctx, client: client, category: category, committed: map[string]bool{}}
+}
+
+func (v *visibility) visible(ref *datastore.Entity) (bool, error) {
+	id, ok := ref.Properties["Commit"].(string)
+	if !ok {
+		// Written before commits were atomic.
+		return true, nil
+	}
+	if committed, ok := v.committed[id]; ok {
+		return committed, nil
+	}
+	_, err := v.client.Get(v.ctx, commitKey(v.category, id))
+	switch err {
+	case nil:
+		v.committed[id] = true
+	case datastore.ErrNoSuchEntity:
+		v.committed[id] = false
+	default:
+		return false, err
+	}
+	return v.committed[id], nil
+}
+
+func toRef(e *datastore.Entity) Ref {
+	ref := Ref{}
+	ref.Path, _ = e.Properties["FilePath"].(string)
+	ref.Blob, _ = e.Properties["BlobLocation"].(string)
+	ref.Timestamp, _ = e.Properties["Timestamp"].(time.Time)
+	return ref
+}
+
+// Latest returns the newest committed ref of path in category.
+func Latest(ctx context.Context, client datastore.Client, category, path string) (*Ref, error) {
+	q := datastore.NewQuery(refKind).
+		WithAncestor(categoryKey(category)).
+		Filter("FilePath", "=", path).
+		Order("-Timestamp")
+	entities, err := client.GetAll(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	v := newVisibility(ctx, client, category)
+	for _, e := range entities {
+		ok, err := v.visible(e)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ref := toRef(e)
+			return &ref, nil
+		}
+	}
+	return nil, fmt.Errorf("no committed version of %q", path)
+}
+
+// List returns the committed refs of category whose path starts with
+// prefix, in path order and oldest first for each path.
+func List(ctx context.Context, client datastore.Client, category, prefix string) ([]Ref, error) {
+	q := datastore.NewQuery(refKind).
+		WithAncestor(categoryKey(category)).
+		Filter("FilePath", ">=", prefix).
+		Order("FilePath").
+		Order("Timestamp")
+	if prefix != "" {
+		// The smallest string greater than every string with the prefix.
+		end := prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+		q = q.Filter("FilePath", "<", end)
+	}
+	entities, err := client.GetAll(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	v := newVisibility(ctx, client, category)
+	var refs []Ref
+	for _, e := range entities {
+		ok, err := v.visible(e)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			refs = append(refs, toRef(e))
+		}
+	}
+	return refs, nil
+}
+
+// Recover resolves commits interrupted by a crash. Pending manifests staged
+// before the given time (so that commits still in progress elsewhere are
+// left alone) are completed if all of their chunks were written and all of
+// their objects were uploaded, and rolled back otherwise. Uploaded objects
+// of rolled back commits are left in place: they are content addressed and
+// may be shared with other commits.
+func Recover(ctx context.Context, client datastore.Client, objects Objects, before time.Time) error {
+	q := datastore.NewQuery(manifestKind).Filter("State", "=", manifestPending)
+	manifests, err := client.GetAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, m := range manifests {
+		timestamp, _ := m.Properties["Timestamp"].(time.Time)
+		if !timestamp.Before(before) {
+			continue
+		}
+		p, complete, err := load(ctx, client, m)
+		if err != nil {
+			return err
+		}
+		if complete {
+			for _, blob := range p.Files {
+				ok, err := objects.Exists(blob)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					complete = false
+					break
+				}
+			}
+		}
+		if complete {
+			err = p.Publish(ctx, client)
+		} else {
+			err = rollback(ctx, client, p)
+		}
+		if err != nil {
+			return fmt.Errorf("recovering commit %s: %v", p.ID, err)
+		}
+	}
+	return nil
+}
+
+// load reads the pending commit described by the manifest header m. It
+// reports whether every chunk of the manifest was written.
+func load(ctx context.Context, client datastore.Client, m *datastore.Entity) (*Pending, bool, error) {
+	p := &Pending{ID: m.Key.Name, Files: map[string]string{}}
+	p.Category, _ = m.Properties["Category"].(string)
+	p.Timestamp, _ = m.Properties["Timestamp"].(time.Time)
+	want, _ := m.Properties["Chunks"].(int64)
+	q := datastore.NewQuery(chunkKind).WithAncestor(m.Key)
+	entities, err := client.GetAll(ctx, q)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, e := range entities {
+		data, _ := e.Properties["Files"].(string)
+		var files []file
+		if err := json.Unmarshal([]byte(data), &files); err != nil {
+			return nil, false, fmt.Errorf("invalid manifest chunk %v: %v", e.Key, err)
+		}
+		for _, f := range files {
+			p.Files[f.Path] = f.Blob
+		}
+	}
+	return p, int64(len(entities)) == want, nil
+}
+
+// rollback deletes the blob refs, manifest chunks and manifest of an
+// uncommitted commit. The header goes last so that a rollback interrupted
+// in turn is retried by the next Recover.
+func rollback(ctx context.Context, client datastore.Client, p *Pending) error {
+	q := datastore.NewQuery(refKind).
+		WithAncestor(categoryKey(p.Category)).
+		Filter("Commit", "=", p.ID).
+		WithKeysOnly()
+	refs, err := client.GetAll(ctx, q)
+	if err != nil {
+		return err
+	}
+	var keys []*datastore.Key
+	for _, e := range refs {
+		keys = append(keys, e.Key)
+	}
+	chunks, err := chunkKeys(ctx, client, p.Category, p.ID)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, chunks...)
+	if err := deleteBatched(ctx, client, keys); err != nil {
+		return err
+	}
+	return client.DeleteMulti(ctx, []*datastore.Key{manifestKey(p.Category, p.ID)})
+}
@@ -0,0 +1,257 @@
+package commit_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"drivebackup/store/commit"
+	"drivebackup/store/filesystem/datastore"
+	dsmock "drivebackup/store/filesystem/datastore/mock"
+)
+
+var errCrash = errors.New("crash")
+
+// crashingClient fails every write once crashed is set, as if the process
+// had died.
+type crashingClient struct {
+	*dsmock.MockClient
+	crashed bool
+}
+
+func (c *crashingClient) PutMulti(ctx context.Context, entities []*datastore.Entity) error {
+	if c.crashed {
+		return errCrash
+	}
+	return c.MockClient.PutMulti(ctx, entities)
+}
+
+func (c *crashingClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if c.crashed {
+		return errCrash
+	}
+	return c.MockClient.DeleteMulti(ctx, keys)
+}
+
+func (c *crashingClient) RunInTransaction(ctx context.Context, f func(tx datastore.Transaction) error) error {
+	if c.crashed {
+		return errCrash
+	}
+	return c.MockClient.RunInTransaction(ctx, f)
+}
+
+// objects is an object store holding the objects set to true.
+type objects map[string]bool
+
+func (o objects) Exists(name string) (bool, error) {
+	return o[name], nil
+}
+
+var (
+	t0 = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	t1 = t0.Add(time.Hour)
+)
+
+func stage(t *testing.T, client datastore.Client, timestamp time.Time, files map[string]string) *commit.Pending {
+	p, err := commit.Stage(context.Background(), client, "DRIVE", timestamp, files)
+	if err != nil {
+		t.Fatalf("error staging: %v", err)
+	}
+	return p
+}
+
+func publish(t *testing.T, client datastore.Client, p *commit.Pending) {
+	if err := p.Publish(context.Background(), client); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+}
+
+func expectBlob(t *testing.T, client datastore.Client, path, want string) {
+	ref, err := commit.Latest(context.Background(), client, "DRIVE", path)
+	switch {
+	case want == "" && err == nil:
+		t.Errorf("got blob %q for %s, want none", ref.Blob, path)
+	case want != "" && err != nil:
+		t.Errorf("error reading %s: %v", path, err)
+	case want != "" && ref.Blob != want:
+		t.Errorf("got blob %q for %s, want %q", ref.Blob, path, want)
+	}
+}
+
+func expectList(t *testing.T, client datastore.Client, prefix string, want ...string) {
+	refs, err := commit.List(context.Background(), client, "DRIVE", prefix)
+	if err != nil {
+		t.Fatalf("error listing %s: %v", prefix, err)
+	}
+	var got []string
+	for _, ref := range refs {
+		got = append(got, ref.Path+"="+ref.Blob)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v listing %s, want %v", got, prefix, want)
+	}
+}
+
+func count(t *testing.T, client datastore.Client, kind string) int {
+	entities, err := client.GetAll(context.Background(), datastore.NewQuery(kind).WithKeysOnly())
+	if err != nil {
+		t.Fatalf("error querying %s: %v", kind, err)
+	}
+	return len(entities)
+}
+
+func TestPublishMakesCommitVisible(t *testing.T) {
+	client := &dsmock.MockClient{}
+	p := stage(t, client, t0, map[string]string{"a/x": "x1", "a/y": "y1", "b": "b1"})
+	expectBlob(t, client, "a/x", "")
+	publish(t, client, p)
+	expectBlob(t, client, "a/x", "x1")
+	expectList(t, client, "a/", "a/x=x1", "a/y=y1")
+
+	publish(t, client, stage(t, client, t1, map[string]string{"a/x": "x2"}))
+	expectBlob(t, client, "a/x", "x2")
+	if n := count(t, client, "ManifestChunk"); n != 0 {
+		t.Errorf("got %d manifest chunks after publishing, want 0", n)
+	}
+}
+
+func TestCrashBeforePublishThenRecover(t *testing.T) {
+	client := &crashingClient{MockClient: &dsmock.MockClient{}}
+	publish(t, client, stage(t, client, t0, map[string]string{"a": "a1"}))
+
+	// The process dies after uploading the objects of the second commit.
+	p := stage(t, client, t1, map[string]string{"a": "a2", "b": "b2"})
+	client.crashed = true
+	if err := p.Publish(context.Background(), client); err != errCrash {
+		t.Fatalf("got %v publishing, want the crash", err)
+	}
+	client.crashed = false
+	expectBlob(t, client, "a", "a1")
+	expectBlob(t, client, "b", "")
+
+	// Manifests staged after the cutoff may still be in progress.
+	if err := commit.Recover(context.Background(), client, objects{"a2": true, "b2": true}, t1); err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+	expectBlob(t, client, "a", "a1")
+
+	if err := commit.Recover(context.Background(), client, objects{"a2": true, "b2": true}, t1.Add(time.Minute)); err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+	expectBlob(t, client, "a", "a2")
+	expectList(t, client, "", "a=a1", "a=a2", "b=b2")
+}
+
+func TestCrashDuringPublishThenRecover(t *testing.T) {
+	client := &crashingClient{MockClient: &dsmock.MockClient{}}
+	files := map[string]string{}
+	for i := 0; i < 700; i++ {
+		files[fmt.Sprintf("f%03d", i)] = fmt.Sprintf("blob%d", i)
+	}
+	p := stage(t, client, t0, files)
+	// The first batch of refs is written, then the process dies.
+	calls := 0
+	wrapped := &countingClient{crashingClient: client, after: 1, calls: &calls}
+	if err := p.Publish(context.Background(), wrapped); err != errCrash {
+		t.Fatalf("got %v publishing, want the crash", err)
+	}
+	client.crashed = false
+	if refs, err := commit.List(context.Background(), client, "DRIVE", ""); err != nil || len(refs) != 0 {
+		t.Errorf("got %d visible refs after a crash mid publish: %v", len(refs), err)
+	}
+
+	// An object is missing, so the commit is rolled back.
+	if err := commit.Recover(context.Background(), client, objects{"blob1": true}, t1); err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+	for _, kind := range []string{"BlobRef", "Manifest", "ManifestChunk", "Commit"} {
+		if n := count(t, client, kind); n != 0 {
+			t.Errorf("got %d %s entities after rolling back, want 0", n, kind)
+		}
+	}
+}
+
+// countingClient crashes its client after the given number of writes.
+type countingClient struct {
+	*crashingClient
+	after int
+	calls *int
+}
+
+func (c *countingClient) PutMulti(ctx context.Context, entities []*datastore.Entity) error {
+	if *c.calls++; *c.calls > c.after {
+		c.crashed = true
+	}
+	return c.crashingClient.PutMulti(ctx, entities)
+}
+
+func TestRecoverRollsBackPartlyStagedManifest(t *testing.T) {
+	client := &crashingClient{MockClient: &dsmock.MockClient{}}
+	files := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		files[fmt.Sprintf("photos/2016/img-%05d.jpg", i)] = fmt.Sprintf("%064d", i)
+	}
+	// The manifest is too large for one entity, so it's written in chunks.
+	p := stage(t, client, t0, files)
+	if n := count(t, client, "ManifestChunk"); n < 2 {
+		t.Fatalf("got %d manifest chunks, want several", n)
+	}
+	if err := client.DeleteMulti(context.Background(), []*datastore.Key{{Kind: "ManifestChunk", Name: "1", Parent: &datastore.Key{Kind: "Manifest", Name: p.ID, Parent: &datastore.Key{Kind: "Category", Name: "DRIVE"}}}}); err != nil {
+		t.Fatalf("error deleting chunk: %v", err)
+	}
+
+	// Even with every object uploaded, a manifest with a missing chunk
+	// can't be completed.
+	all := objects{}
+	for _, blob := range files {
+		all[blob] = true
+	}
+	if err := commit.Recover(context.Background(), client, all, t1); err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+	for _, kind := range []string{"Manifest", "ManifestChunk"} {
+		if n := count(t, client, kind); n != 0 {
+			t.Errorf("got %d %s entities after rolling back, want 0", n, kind)
+		}
+	}
+
+	// A complete large manifest is recovered in full.
+	stage(t, client, t0, files)
+	if err := commit.Recover(context.Background(), client, all, t1); err != nil {
+		t.Fatalf("error recovering: %v", err)
+	}
+	if refs, err := commit.List(context.Background(), client, "DRIVE", "photos/"); err != nil || len(refs) != len(files) {
+		t.Errorf("got %d refs after recovering, want %d: %v", len(refs), len(files), err)
+	}
+}
+
+func TestCommitsAtTheSameTimeAreDistinct(t *testing.T) {
+	client := &dsmock.MockClient{}
+	publish(t, client, stage(t, client, t0, map[string]string{"a": "a1"}))
+	// A commit staged at the same time that never publishes stays
+	// invisible.
+	stage(t, client, t0, map[string]string{"a": "a2"})
+	expectBlob(t, client, "a", "a1")
+}
+
+func TestRefsWithoutCommitAreVisible(t *testing.T) {
+	client := &dsmock.MockClient{}
+	// A ref written before commits were atomic.
+	legacy := &datastore.Entity{
+		Key: &datastore.Key{Kind: "BlobRef", Name: "legacy", Parent: &datastore.Key{Kind: "Category", Name: "DRIVE"}},
+		Properties: map[string]interface{}{
+			"FilePath":     "a",
+			"Timestamp":    t0,
+			"BlobLocation": "a0",
+		},
+	}
+	if err := client.PutMulti(context.Background(), []*datastore.Entity{legacy}); err != nil {
+		t.Fatalf("error writing legacy ref: %v", err)
+	}
+	expectBlob(t, client, "a", "a0")
+	stage(t, client, t1, map[string]string{"a": "a1"})
+	expectBlob(t, client, "a", "a0")
+	expectList(t, client, "", "a=a0")
+}
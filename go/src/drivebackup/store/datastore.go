@@ -3,99 +3,223 @@ package store
 import (
 	"golang.org/x/net/context"
 	"google.golang.org/cloud/datastore"
-	"google.golang.org/cloud/bigtable"
-	"time"
 	"strings"
+
+	"drivebackup/store/commit"
+	"drivebackup/store/filesystem"
+	fsdatastore "drivebackup/store/filesystem/datastore"
 )
 
-type blobRef struct {
-	FilePath string
-	Timestamp time.Time
-	BlobLocation string
-}
-
-// [category] -> { file, timestamp unix, blob hex name}
-// "DRIVE"    -> { "a/b/c/file.go", 23423421532151, "afd3495286f"}
-
-func putBlobRefs(ctx *context.Context, client *datastore.Client, timestamp time.Time, category Category, filenameMap map[string]string) error {
-	categoryKey := datastore.NewKey(ctx,
-		"Category",
-		"",
-		string(category),
-		nil)
-
-	for origFile, storedFile := range filenameMap {
-		refKey := datastore.NewKey(ctx,
-			"BlobRef",
-			"",
-			0,
-			categoryKey)
-		ref := &blobRef{
-			FilePath: origFile,
-			Timestamp: timestamp,
-			BlobLocation: storedFile,
-		}
-		if _, err := client.Put(ctx, refKey, ref); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func latestBlobRef(ctx *context.Context, client *datastore.Client, category Category, filepath string) (*blobRef, error) {
-	categoryKey := datastore.NewKey(ctx,
-		"Category",
-		"",
-		string(category),
-		nil)
-	query := datastore.NewQuery("BlobRef").
-		Ancestor(categoryKey).
-		Filter("FilePath =", filepath).
-		Order("-Timestamp").
-		Limit(1)
-	it := client.Run(ctx, query)
-	var ref blobRef
-	_, err := it.Next(&ref)
-	return &ref, err
-}
-
-
-func listDir(ctx *context.Context, client *datastore.Client, category Category, filepath string) ([]DirEntry, error) {
-	categoryKey := datastore.NewKey(ctx,
-		"Category",
-		"",
-		string(category),
-		nil)
+func listDir(ctx context.Context, client *datastore.Client, category Category, filepath string) ([]DirEntry, error) {
 	if filepath[len(filepath)-1] != '/' {
 		filepath += "/"
 	}
-	query := datastore.NewQuery("BlobRef").
-	Ancestor(categoryKey).
-	Filter("FilePath >=", filepath).
-	Filter("FilePath <", filepath[:len(filepath)-1]+"0")
-	it := client.Run(ctx, query)
+	refs, err := commit.List(ctx, NewDatastoreClient(ctx, client), string(category), filepath)
+	if err != nil {
+		return nil, err
+	}
 	seen := map[string]bool{}
 	var entries []DirEntry
-	for {
-		var ref blobRef
-		_, err := it.Next(&ref)
-		if err != nil {
-			return entries, err
-		}
-		tail := strings.TrimPrefix(ref.FilePath, filepath)
+	for _, ref := range refs {
+		tail := strings.TrimPrefix(ref.Path, filepath)
 		name := strings.Split(tail, "/")[0]
 		if seen[name] {
 			continue
 		}
 		seen[name] = true
-		t := FILE
-		if tail != name {
-			t = DIR
-		}
+		// Commits only store regular files.
 		entries = append(entries, DirEntry{
 			FilePath: filepath + name,
-			Type: t,
+			IsDir: tail != name,
+			Type: filesystem.RegularFile,
 			Category: category,
 		})
 	}
-}
\ No newline at end of file
+	return entries, nil
+}
+
+// NewDatastoreClient adapts a Cloud Datastore client for use by the
+// filesystem datastore service:
+//
+//	fs := fsdatastore.NewFilesystemService(ctx, NewDatastoreClient(ctx, client))
+func NewDatastoreClient(ctx context.Context, client *datastore.Client) fsdatastore.Client {
+	return &datastoreClient{client: client}
+}
+
+type datastoreClient struct {
+	client *datastore.Client
+}
+
+func toKey(ctx context.Context, key *fsdatastore.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	return datastore.NewKey(ctx, key.Kind, key.Name, 0, toKey(ctx, key.Parent))
+}
+
+func fromKey(key *datastore.Key) *fsdatastore.Key {
+	if key == nil {
+		return nil
+	}
+	return &fsdatastore.Key{Kind: key.Kind(), Name: key.Name(), Parent: fromKey(key.Parent())}
+}
+
+// maxIndexedBytes is the longest string Cloud Datastore indexes. Longer
+// values, such as manifest chunks, are stored unindexed.
+const maxIndexedBytes = 1500
+
+func toProperties(e *fsdatastore.Entity) datastore.PropertyList {
+	var props datastore.PropertyList
+	for name, value := range e.Properties {
+		s, ok := value.(string)
+		props = append(props, datastore.Property{Name: name, Value: value, NoIndex: ok && len(s) > maxIndexedBytes})
+	}
+	return props
+}
+
+func fromProperties(key *datastore.Key, props datastore.PropertyList) *fsdatastore.Entity {
+	e := &fsdatastore.Entity{Key: fromKey(key), Properties: map[string]interface{}{}}
+	for _, prop := range props {
+		e.Properties[prop.Name] = prop.Value
+	}
+	return e
+}
+
+func toQuery(ctx context.Context, q *fsdatastore.Query) *datastore.Query {
+	query := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		query = query.Ancestor(toKey(ctx, q.Ancestor))
+	}
+	for _, filter := range q.Filters {
+		query = query.Filter(filter.Property+" "+filter.Op, filter.Value)
+	}
+	for _, order := range q.Orders {
+		query = query.Order(order)
+	}
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+	if q.KeysOnly {
+		query = query.KeysOnly()
+	}
+	return query
+}
+
+func (c *datastoreClient) Get(ctx context.Context, key *fsdatastore.Key) (*fsdatastore.Entity, error) {
+	k := toKey(ctx, key)
+	var props datastore.PropertyList
+	if err := c.client.Get(ctx, k, &props); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, fsdatastore.ErrNoSuchEntity
+		}
+		return nil, err
+	}
+	return fromProperties(k, props), nil
+}
+
+func (c *datastoreClient) GetMulti(ctx context.Context, keys []*fsdatastore.Key) ([]*fsdatastore.Entity, error) {
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		dsKeys[i] = toKey(ctx, key)
+	}
+	props := make([]datastore.PropertyList, len(keys))
+	err := c.client.GetMulti(ctx, dsKeys, props)
+	multi, _ := err.(datastore.MultiError)
+	if err != nil && multi == nil {
+		return nil, err
+	}
+	entities := make([]*fsdatastore.Entity, len(keys))
+	for i, key := range dsKeys {
+		if multi != nil && multi[i] != nil {
+			if multi[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, multi[i]
+		}
+		entities[i] = fromProperties(key, props[i])
+	}
+	return entities, nil
+}
+
+func (c *datastoreClient) GetAll(ctx context.Context, q *fsdatastore.Query) ([]*fsdatastore.Entity, error) {
+	var props []datastore.PropertyList
+	var dst interface{} = &props
+	if q.KeysOnly {
+		dst = nil
+	}
+	keys, err := c.client.GetAll(ctx, toQuery(ctx, q), dst)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*fsdatastore.Entity, len(keys))
+	for i, key := range keys {
+		if q.KeysOnly {
+			entities[i] = fromProperties(key, nil)
+		} else {
+			entities[i] = fromProperties(key, props[i])
+		}
+	}
+	return entities, nil
+}
+
+func (c *datastoreClient) PutMulti(ctx context.Context, entities []*fsdatastore.Entity) error {
+	keys := make([]*datastore.Key, len(entities))
+	props := make([]datastore.PropertyList, len(entities))
+	for i, e := range entities {
+		keys[i] = toKey(ctx, e.Key)
+		props[i] = toProperties(e)
+	}
+	_, err := c.client.PutMulti(ctx, keys, props)
+	return err
+}
+
+func (c *datastoreClient) DeleteMulti(ctx context.Context, keys []*fsdatastore.Key) error {
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		dsKeys[i] = toKey(ctx, key)
+	}
+	return c.client.DeleteMulti(ctx, dsKeys)
+}
+
+func (c *datastoreClient) RunInTransaction(ctx context.Context, f func(tx fsdatastore.Transaction) error) error {
+	_, err := c.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(&datastoreTransaction{ctx: ctx, tx: tx})
+	})
+	return err
+}
+
+type datastoreTransaction struct {
+	ctx context.Context
+	tx  *datastore.Transaction
+}
+
+func (t *datastoreTransaction) Get(key *fsdatastore.Key) (*fsdatastore.Entity, error) {
+	k := toKey(t.ctx, key)
+	var props datastore.PropertyList
+	if err := t.tx.Get(k, &props); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, fsdatastore.ErrNoSuchEntity
+		}
+		return nil, err
+	}
+	return fromProperties(k, props), nil
+}
+
+func (t *datastoreTransaction) PutMulti(entities []*fsdatastore.Entity) error {
+	keys := make([]*datastore.Key, len(entities))
+	props := make([]datastore.PropertyList, len(entities))
+	for i, e := range entities {
+		keys[i] = toKey(t.ctx, e.Key)
+		props[i] = toProperties(e)
+	}
+	_, err := t.tx.PutMulti(keys, props)
+	return err
+}
+
+func (t *datastoreTransaction) DeleteMulti(keys []*fsdatastore.Key) error {
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		dsKeys[i] = toKey(t.ctx, key)
+	}
+	return t.tx.DeleteMulti(dsKeys)
+}
@@ -0,0 +1,72 @@
+package fault
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"drivebackup/store/blob"
+)
+
+// BlobService wraps a blob.BlobService, injecting faults into Put, Get, Stat
+// and Delete.
+type BlobService struct {
+	blob.BlobService
+	Injector *Injector
+}
+
+var _ blob.BlobService = (*BlobService)(nil)
+
+// NewBlobService returns service wrapped with injector.
+func NewBlobService(service blob.BlobService, injector *Injector) *BlobService {
+	return &BlobService{BlobService: service, Injector: injector}
+}
+
+func (s *BlobService) Put(name string, data io.Reader) error {
+	act := s.Injector.before(Put)
+	if act.err != nil {
+		return act.err
+	}
+	if act.transformsData() {
+		b, err := ioutil.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		data = bytes.NewReader(act.apply(b))
+	}
+	if err := s.BlobService.Put(name, data); err != nil {
+		return err
+	}
+	s.Injector.putDone()
+	return nil
+}
+
+func (s *BlobService) Get(name string) (io.Reader, error) {
+	act := s.Injector.before(Get)
+	if act.err != nil {
+		return nil, act.err
+	}
+	reader, err := s.BlobService.Get(name)
+	if err != nil || reader == nil || !act.transformsData() {
+		return reader, err
+	}
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(act.apply(b)), nil
+}
+
+func (s *BlobService) Stat(name string) (int64, bool, error) {
+	if act := s.Injector.before(Stat); act.err != nil {
+		return 0, false, act.err
+	}
+	return s.BlobService.Stat(name)
+}
+
+func (s *BlobService) Delete(name string) error {
+	if act := s.Injector.before(Delete); act.err != nil {
+		return act.err
+	}
+	return s.BlobService.Delete(name)
+}
@@ -0,0 +1,247 @@
+// Package fault wraps blob and filesystem services with configurable,
+// deterministic failures so that the backup tooling's error handling can be
+// exercised against the otherwise infallible mocks.
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by failing calls when the rule has no Err set.
+var ErrInjected = errors.New("injected fault")
+
+// Op names an operation that rules can target.
+type Op string
+
+const (
+	AnyOp    Op = ""
+	Put      Op = "put"      // blob.BlobService.Put
+	Get      Op = "get"      // blob.BlobService.Get
+	Stat     Op = "stat"     // blob.BlobService.Stat
+	Delete   Op = "delete"   // blob.BlobService.Delete
+	Commit   Op = "commit"   // filesystem.PutTransaction.Commit and Bucket.ImportCommit
+	Versions Op = "versions" // filesystem.SelectorOp.Versions and IterVersions
+	List     Op = "list"     // filesystem.SelectorOp.List and ListEntries
+	BlobRef  Op = "blobref"  // filesystem.SelectorOp.BlobRef
+	Match    Op = "match"    // filesystem.SelectorOp.Match
+	Walk     Op = "walk"     // filesystem.SelectorOp.Walk
+	Diff     Op = "diff"     // filesystem.SelectorOp.Diff
+)
+
+// Effect is what happens when a rule fires.
+type Effect int
+
+const (
+	Fail     Effect = iota // the call returns Rule.Err
+	Delay                  // the call is delayed by Rule.Latency
+	Truncate               // data passed through Put/Get is cut to Rule.Bytes bytes
+	Corrupt                // Rule.Bytes bytes (at least one) of Put/Get data are flipped
+)
+
+func (e Effect) String() string {
+	switch e {
+	case Fail:
+		return "fail"
+	case Delay:
+		return "delay"
+	case Truncate:
+		return "truncate"
+	case Corrupt:
+		return "corrupt"
+	}
+	panic("unknown effect")
+}
+
+// Rule describes a single fault. The trigger fields are combined: a rule
+// fires only if every trigger that is set matches. A rule with no triggers
+// fires on every matching call.
+type Rule struct {
+	Op     Op
+	Effect Effect
+
+	Nth         int     // fire on the Nth matching call only (1-based)
+	Probability float64 // fire with this probability
+	AfterPuts   int     // fire once at least this many blobs have been Put through the injector
+
+	Latency time.Duration // for Delay
+	Bytes   int64         // for Truncate and Corrupt
+	Err     error         // for Fail, defaults to ErrInjected
+}
+
+func (r Rule) String() string {
+	str := r.Effect.String()
+	if r.Op != AnyOp {
+		str += " " + string(r.Op)
+	}
+	if r.Nth > 0 {
+		str += fmt.Sprintf(" nth=%d", r.Nth)
+	}
+	if r.Probability > 0 {
+		str += fmt.Sprintf(" p=%v", r.Probability)
+	}
+	if r.AfterPuts > 0 {
+		str += fmt.Sprintf(" afterputs=%d", r.AfterPuts)
+	}
+	if r.Latency > 0 {
+		str += fmt.Sprintf(" latency=%v", r.Latency)
+	}
+	if r.Bytes > 0 {
+		str += fmt.Sprintf(" bytes=%d", r.Bytes)
+	}
+	return str
+}
+
+// Injector decides which calls fail. A single injector may be shared between
+// a blob service and a filesystem service so that rules such as AfterPuts can
+// see both.
+type Injector struct {
+	// Sleep is used for Delay effects. It defaults to time.Sleep and may be
+	// replaced in tests to avoid real waiting.
+	Sleep func(time.Duration)
+
+	mu     sync.Mutex
+	rules  []Rule
+	rand   *rand.Rand
+	calls  map[Op]int
+	puts   int
+	events []Event
+}
+
+// Event records a fired rule.
+type Event struct {
+	Op   Op
+	Call int // the call number for Op, 1-based
+	Rule Rule
+}
+
+// NewInjector returns an injector whose random decisions are derived from
+// seed, so that the same seed and the same sequence of calls always inject
+// the same faults.
+func NewInjector(seed int64, rules ...Rule) *Injector {
+	return &Injector{
+		Sleep: time.Sleep,
+		rules: rules,
+		rand:  rand.New(rand.NewSource(seed)),
+		calls: map[Op]int{},
+	}
+}
+
+// Add appends rules to the injector.
+func (in *Injector) Add(rules ...Rule) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.rules = append(in.rules, rules...)
+}
+
+// Calls returns the number of times op has been called.
+func (in *Injector) Calls(op Op) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.calls[op]
+}
+
+// Events returns the faults injected so far, in order.
+func (in *Injector) Events() []Event {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]Event(nil), in.events...)
+}
+
+// action is the combined result of all rules fired by a call.
+type action struct {
+	err      error
+	delay    time.Duration
+	truncate int64 // -1 if unset
+	corrupt  int64
+	offsets  []int64 // positions to corrupt, chosen from the seeded source
+}
+
+// before records a call to op and evaluates the rules for it. Delays are
+// applied before returning.
+func (in *Injector) before(op Op) action {
+	in.mu.Lock()
+	in.calls[op]++
+	call := in.calls[op]
+	act := action{truncate: -1}
+	for _, rule := range in.rules {
+		if rule.Op != AnyOp && rule.Op != op {
+			continue
+		}
+		if rule.Nth > 0 && rule.Nth != call {
+			continue
+		}
+		if rule.AfterPuts > 0 && in.puts < rule.AfterPuts {
+			continue
+		}
+		if rule.Probability > 0 && in.rand.Float64() >= rule.Probability {
+			continue
+		}
+		in.events = append(in.events, Event{Op: op, Call: call, Rule: rule})
+		switch rule.Effect {
+		case Fail:
+			if act.err == nil {
+				act.err = rule.Err
+				if act.err == nil {
+					act.err = ErrInjected
+				}
+			}
+		case Delay:
+			act.delay += rule.Latency
+		case Truncate:
+			if act.truncate < 0 || rule.Bytes < act.truncate {
+				act.truncate = rule.Bytes
+			}
+		case Corrupt:
+			n := rule.Bytes
+			if n < 1 {
+				n = 1
+			}
+			act.corrupt += n
+		}
+	}
+	for i := int64(0); i < act.corrupt; i++ {
+		act.offsets = append(act.offsets, in.rand.Int63())
+	}
+	sleep := in.Sleep
+	in.mu.Unlock()
+
+	if act.delay > 0 && sleep != nil {
+		sleep(act.delay)
+	}
+	return act
+}
+
+// putDone records a successful blob Put for AfterPuts triggers.
+func (in *Injector) putDone() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.puts++
+}
+
+// apply truncates and corrupts data according to act.
+func (act action) apply(data []byte) []byte {
+	if act.truncate >= 0 && act.truncate < int64(len(data)) {
+		data = data[:act.truncate]
+	}
+	if len(act.offsets) > 0 && len(data) > 0 {
+		data = append([]byte(nil), data...)
+		flipped := map[int64]bool{}
+		for _, offset := range act.offsets {
+			pos := offset % int64(len(data))
+			if !flipped[pos] {
+				data[pos] ^= 0xff
+				flipped[pos] = true
+			}
+		}
+	}
+	return data
+}
+
+// transformsData reports whether act modifies data passing through it.
+func (act action) transformsData() bool {
+	return act.truncate >= 0 || len(act.offsets) > 0
+}
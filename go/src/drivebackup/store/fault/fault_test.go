@@ -0,0 +1,185 @@
+package fault_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	blobmock "drivebackup/store/blob/mock"
+	"drivebackup/store/fault"
+	fsmock "drivebackup/store/filesystem/mock"
+)
+
+func putN(service *fault.BlobService, n int) []error {
+	var errs []error
+	for i := 0; i < n; i++ {
+		errs = append(errs, service.Put(string(rune('a'+i)), bytes.NewReader([]byte("data"))))
+	}
+	return errs
+}
+
+func TestFailNth(t *testing.T) {
+	service := fault.NewBlobService(&blobmock.MockBlobService{}, fault.NewInjector(0, fault.Rule{Op: fault.Put, Nth: 2}))
+	errs := putN(service, 3)
+	if errs[0] != nil || errs[1] != fault.ErrInjected || errs[2] != nil {
+		t.Errorf("got errors %v, want only the second put to fail", errs)
+	}
+	if r, err := service.Get("b"); err != nil || r != nil {
+		t.Errorf("failed put stored a blob")
+	}
+}
+
+func TestProbabilityIsDeterministic(t *testing.T) {
+	run := func(seed int64) []bool {
+		injector := fault.NewInjector(seed, fault.Rule{Op: fault.Put, Probability: 0.5})
+		var failed []bool
+		for _, err := range putN(fault.NewBlobService(&blobmock.MockBlobService{}, injector), 20) {
+			failed = append(failed, err != nil)
+		}
+		return failed
+	}
+	a, b := run(42), run(42)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("same seed gave different faults: %v vs %v", a, b)
+	}
+	var count int
+	for _, failed := range a {
+		if failed {
+			count++
+		}
+	}
+	if count == 0 || count == len(a) {
+		t.Errorf("expected some but not all puts to fail, got %v", a)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	injector := fault.NewInjector(0, fault.Rule{Op: fault.Get, Effect: fault.Delay, Latency: time.Second})
+	var slept time.Duration
+	injector.Sleep = func(d time.Duration) { slept += d }
+	service := fault.NewBlobService(&blobmock.MockBlobService{}, injector)
+	putN(service, 1)
+	service.Get("a")
+	service.Get("a")
+	if slept != 2*time.Second {
+		t.Errorf("slept %v, want %v", slept, 2*time.Second)
+	}
+}
+
+func TestTruncateAndCorrupt(t *testing.T) {
+	data := []byte("0123456789")
+	injector := fault.NewInjector(7,
+		fault.Rule{Op: fault.Get, Effect: fault.Truncate, Nth: 1, Bytes: 4},
+		fault.Rule{Op: fault.Get, Effect: fault.Corrupt, Nth: 2, Bytes: 3})
+	service := fault.NewBlobService(&blobmock.MockBlobService{}, injector)
+	if err := service.Put("a", bytes.NewReader(data)); err != nil {
+		t.Fatalf("error in Put: %v", err)
+	}
+
+	r, _ := service.Get("a")
+	out, _ := ioutil.ReadAll(r)
+	if string(out) != "0123" {
+		t.Errorf("got %q, want truncated %q", out, "0123")
+	}
+
+	r, _ = service.Get("a")
+	out, _ = ioutil.ReadAll(r)
+	var diffs int
+	for i := range out {
+		if out[i] != data[i] {
+			diffs++
+		}
+	}
+	if len(out) != len(data) || diffs != 3 {
+		t.Errorf("got %q, want %q with 3 corrupted bytes", out, data)
+	}
+
+	r, _ = service.Get("a")
+	out, _ = ioutil.ReadAll(r)
+	if !bytes.Equal(out, data) {
+		t.Errorf("got %q, want unmodified %q", out, data)
+	}
+}
+
+func TestCommitAfterPuts(t *testing.T) {
+	injector := fault.NewInjector(0, fault.Rule{Op: fault.Commit, AfterPuts: 2})
+	blobs := fault.NewBlobService(&blobmock.MockBlobService{}, injector)
+	bucket := fault.NewFilesystemService(&fsmock.MockFilesystemService{}, injector).Bucket("bucket")
+
+	putN(blobs, 1)
+	tx := bucket.NewPutTransaction()
+	tx.Dir("a")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("unexpected error committing after one put: %v", err)
+	}
+
+	putN(blobs, 2)
+	tx = bucket.NewPutTransaction()
+	tx.Dir("b")
+	if err := tx.Commit(); err != fault.ErrInjected {
+		t.Fatalf("got %v, want injected commit failure", err)
+	}
+
+	versions, err := bucket.Select().Dir("b").Versions()
+	if err != nil {
+		t.Fatalf("error in Versions: %v", err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("failed commit left versions %v", versions)
+	}
+	if got := len(injector.Events()); got != 1 {
+		t.Errorf("got %d events, want 1", got)
+	}
+}
+
+func TestSelectorFaults(t *testing.T) {
+	injector := fault.NewInjector(0, fault.Rule{Op: fault.List, Nth: 1})
+	bucket := fault.NewFilesystemService(&fsmock.MockFilesystemService{}, injector).Bucket("bucket")
+	tx := bucket.NewPutTransaction()
+	tx.Dir("a")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if _, err := bucket.Select().Dir("a").List(); err != fault.ErrInjected {
+		t.Errorf("got %v, want injected list failure", err)
+	}
+	if _, err := bucket.Select().Dir("a").List(); err != nil {
+		t.Errorf("unexpected error on second list: %v", err)
+	}
+	if _, err := bucket.Select().Dir("a").Versions(); err != nil {
+		t.Errorf("unexpected error in Versions: %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	rules, err := fault.Parse(`fail put nth=3; delay get latency=20ms p=0.5
+		# comment
+		truncate bytes=10
+		fail commit afterputs=2 err="disk full"`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if len(rules) != 4 {
+		t.Fatalf("got %d rules, want 4: %v", len(rules), rules)
+	}
+	if rules[0].Op != fault.Put || rules[0].Effect != fault.Fail || rules[0].Nth != 3 {
+		t.Errorf("bad rule 0: %v", rules[0])
+	}
+	if rules[1].Op != fault.Get || rules[1].Effect != fault.Delay || rules[1].Latency != 20*time.Millisecond || rules[1].Probability != 0.5 {
+		t.Errorf("bad rule 1: %v", rules[1])
+	}
+	if rules[2].Op != fault.AnyOp || rules[2].Effect != fault.Truncate || rules[2].Bytes != 10 {
+		t.Errorf("bad rule 2: %v", rules[2])
+	}
+	if rules[3].Op != fault.Commit || rules[3].AfterPuts != 2 || rules[3].Err.Error() != "disk full" {
+		t.Errorf("bad rule 3: %v", rules[3])
+	}
+
+	for _, bad := range []string{"explode", "fail nosuchop", "fail put nth=x", "fail put unknown=1", `fail err="open`} {
+		if _, err := fault.Parse(bad); err == nil {
+			t.Errorf("expected error parsing %q", bad)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package fault
+
+import (
+	"time"
+
+	"drivebackup/store/filesystem"
+)
+
+// FilesystemService wraps a filesystem.FilesystemService, injecting faults
+// into commits and selector operations of every bucket it returns.
+type FilesystemService struct {
+	filesystem.FilesystemService
+	Injector *Injector
+}
+
+var _ filesystem.FilesystemService = (*FilesystemService)(nil)
+
+// NewFilesystemService returns service wrapped with injector.
+func NewFilesystemService(service filesystem.FilesystemService, injector *Injector) *FilesystemService {
+	return &FilesystemService{FilesystemService: service, Injector: injector}
+}
+
+func (s *FilesystemService) Bucket(bucket string) filesystem.Bucket {
+	return &faultBucket{s.FilesystemService.Bucket(bucket), s.Injector}
+}
+
+func (s *FilesystemService) CreateBucket(name string, opts filesystem.BucketOptions) (filesystem.Bucket, error) {
+	bucket, err := s.FilesystemService.CreateBucket(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &faultBucket{bucket, s.Injector}, nil
+}
+
+type faultBucket struct {
+	filesystem.Bucket
+	injector *Injector
+}
+
+func (b *faultBucket) NewPutTransaction() filesystem.PutTransaction {
+	return &faultPutTransaction{b.Bucket.NewPutTransaction(), b.injector}
+}
+
+func (b *faultBucket) Select() filesystem.Selector {
+	return &faultSelector{b.Bucket.Select(), b.injector}
+}
+
+// ImportCommit fails like Commit.
+func (b *faultBucket) ImportCommit(commit *filesystem.Commit) error {
+	if act := b.injector.before(Commit); act.err != nil {
+		return act.err
+	}
+	return b.Bucket.ImportCommit(commit)
+}
+
+type faultPutTransaction struct {
+	filesystem.PutTransaction
+	injector *Injector
+}
+
+// Commit fails before reaching the wrapped transaction, so a failed commit
+// leaves no version behind; blobs already Put remain in the blob service.
+func (tx *faultPutTransaction) Commit() error {
+	if act := tx.injector.before(Commit); act.err != nil {
+		return act.err
+	}
+	return tx.PutTransaction.Commit()
+}
+
+type faultSelector struct {
+	filesystem.Selector
+	injector *Injector
+}
+
+func (s *faultSelector) Version(version filesystem.Version) filesystem.Selector {
+	return &faultSelector{s.Selector.Version(version), s.injector}
+}
+
+func (s *faultSelector) Tag(name string) filesystem.Selector {
+	return &faultSelector{s.Selector.Tag(name), s.injector}
+}
+
+func (s *faultSelector) Latest() filesystem.Selector {
+	return &faultSelector{s.Selector.Latest(), s.injector}
+}
+
+func (s *faultSelector) AsOf(t time.Time) filesystem.Selector {
+	return &faultSelector{s.Selector.AsOf(t), s.injector}
+}
+
+func (s *faultSelector) Before(t time.Time) filesystem.Selector {
+	return &faultSelector{s.Selector.Before(t), s.injector}
+}
+
+func (s *faultSelector) After(t time.Time) filesystem.Selector {
+	return &faultSelector{s.Selector.After(t), s.injector}
+}
+
+func (s *faultSelector) Since(v filesystem.Version) filesystem.Selector {
+	return &faultSelector{s.Selector.Since(v), s.injector}
+}
+
+func (s *faultSelector) Until(v filesystem.Version) filesystem.Selector {
+	return &faultSelector{s.Selector.Until(v), s.injector}
+}
+
+func (s *faultSelector) Between(a, b filesystem.Version) filesystem.Selector {
+	return &faultSelector{s.Selector.Between(a, b), s.injector}
+}
+
+func (s *faultSelector) Last(n int) filesystem.Selector {
+	return &faultSelector{s.Selector.Last(n), s.injector}
+}
+
+func (s *faultSelector) Dir(path string) filesystem.Selector {
+	return &faultSelector{s.Selector.Dir(path), s.injector}
+}
+
+func (s *faultSelector) File(name string) filesystem.Selector {
+	return &faultSelector{s.Selector.File(name), s.injector}
+}
+
+func (s *faultSelector) Glob(pattern string) filesystem.Selector {
+	return &faultSelector{s.Selector.Glob(pattern), s.injector}
+}
+
+func (s *faultSelector) Follow() filesystem.Selector {
+	return &faultSelector{s.Selector.Follow(), s.injector}
+}
+
+func (s *faultSelector) Versions() ([]filesystem.Version, error) {
+	if act := s.injector.before(Versions); act.err != nil {
+		return nil, act.err
+	}
+	return s.Selector.Versions()
+}
+
+// IterVersions fails before the first version.
+func (s *faultSelector) IterVersions(opts filesystem.VersionOptions) filesystem.VersionIterator {
+	if act := s.injector.before(Versions); act.err != nil {
+		return filesystem.FailedVersionIterator(act.err)
+	}
+	return s.Selector.IterVersions(opts)
+}
+
+func (s *faultSelector) List() ([]string, error) {
+	if act := s.injector.before(List); act.err != nil {
+		return nil, act.err
+	}
+	return s.Selector.List()
+}
+
+func (s *faultSelector) ListEntries(opts filesystem.ListOptions) (*filesystem.EntryPage, error) {
+	if act := s.injector.before(List); act.err != nil {
+		return nil, act.err
+	}
+	return s.Selector.ListEntries(opts)
+}
+
+// Walk fails before the walk starts, so fn is called for every entry or
+// none.
+func (s *faultSelector) Walk(fn filesystem.WalkFunc) error {
+	if act := s.injector.before(Walk); act.err != nil {
+		return act.err
+	}
+	return s.Selector.Walk(fn)
+}
+
+func (s *faultSelector) Diff(v1, v2 filesystem.Version) ([]filesystem.Change, error) {
+	if act := s.injector.before(Diff); act.err != nil {
+		return nil, act.err
+	}
+	return s.Selector.Diff(v1, v2)
+}
+
+func (s *faultSelector) BlobRef() (filesystem.StoredBlobRef, error) {
+	if act := s.injector.before(BlobRef); act.err != nil {
+		return filesystem.StoredBlobRef{}, act.err
+	}
+	return s.Selector.BlobRef()
+}
+
+func (s *faultSelector) Match() ([]filesystem.MatchedFile, error) {
+	if act := s.injector.before(Match); act.err != nil {
+		return nil, act.err
+	}
+	return s.Selector.Match()
+}
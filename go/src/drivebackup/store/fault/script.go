@@ -0,0 +1,123 @@
+package fault
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse reads rules from a script. Rules are separated by newlines or
+// semicolons and have the form
+//
+//	<effect> [op] [key=value ...]
+//
+// where effect is one of fail, delay, truncate or corrupt, op is one of put,
+// get, stat, delete, commit, versions, list, blobref, match, walk or diff (all ops
+// if omitted), and
+// the keys are nth, p, afterputs, latency, bytes and err. For example:
+//
+//	fail put nth=3
+//	delay get latency=20ms p=0.5
+//	fail commit afterputs=2 err="disk full"
+func Parse(script string) ([]Rule, error) {
+	var rules []Rule
+	for _, line := range strings.FieldsFunc(script, func(r rune) bool { return r == '\n' || r == ';' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(line string) (Rule, error) {
+	var rule Rule
+	fields, err := splitFields(line)
+	if err != nil {
+		return rule, err
+	}
+	switch fields[0] {
+	case "fail":
+		rule.Effect = Fail
+	case "delay":
+		rule.Effect = Delay
+	case "truncate":
+		rule.Effect = Truncate
+	case "corrupt":
+		rule.Effect = Corrupt
+	default:
+		return rule, fmt.Errorf("unknown effect %q", fields[0])
+	}
+	fields = fields[1:]
+	if len(fields) > 0 && !strings.Contains(fields[0], "=") {
+		switch op := Op(fields[0]); op {
+		case Put, Get, Stat, Delete, Commit, Versions, List, BlobRef, Match, Walk, Diff:
+			rule.Op = op
+		default:
+			return rule, fmt.Errorf("unknown op %q", fields[0])
+		}
+		fields = fields[1:]
+	}
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return rule, fmt.Errorf("expected key=value, got %q", field)
+		}
+		key, value := parts[0], parts[1]
+		var err error
+		switch key {
+		case "nth":
+			rule.Nth, err = strconv.Atoi(value)
+		case "p":
+			rule.Probability, err = strconv.ParseFloat(value, 64)
+		case "afterputs":
+			rule.AfterPuts, err = strconv.Atoi(value)
+		case "latency":
+			rule.Latency, err = time.ParseDuration(value)
+		case "bytes":
+			rule.Bytes, err = strconv.ParseInt(value, 10, 64)
+		case "err":
+			rule.Err = errors.New(value)
+		default:
+			return rule, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+	}
+	return rule, nil
+}
+
+// splitFields splits on spaces, keeping double-quoted values together.
+func splitFields(line string) ([]string, error) {
+	var fields []string
+	var field []rune
+	var quoted bool
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if len(field) > 0 {
+				fields = append(fields, string(field))
+				field = nil
+			}
+		default:
+			field = append(field, r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if len(field) > 0 {
+		fields = append(fields, string(field))
+	}
+	return fields, nil
+}
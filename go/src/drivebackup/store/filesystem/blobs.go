@@ -0,0 +1,12 @@
+package filesystem
+
+// WalkBlobRefs calls fn with the blob of every file written by version of
+// bucket. Symlinks and special files have no blob and are skipped.
+func WalkBlobRefs(bucket Bucket, version Version, fn func(BlobRef)) error {
+	return bucket.Select().Version(version).Walk(func(entry WalkEntry) error {
+		if !entry.IsDir && entry.BlobRef != (BlobRef{}) {
+			fn(entry.BlobRef)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,37 @@
+package filesystem
+
+import (
+	"errors"
+	"time"
+)
+
+// BucketInfo describes a bucket.
+type BucketInfo struct {
+	Name        string
+	Description string
+	Owner       string
+	// Created is when CreateBucket was called, or for a bucket created by
+	// its first commit, the time of that commit.
+	Created time.Time
+}
+
+// BucketOptions are the metadata given to CreateBucket.
+type BucketOptions struct {
+	Description string
+	Owner       string
+	// Created defaults to the time of creation. Imports set it to keep the
+	// creation time of the exported bucket.
+	Created time.Time
+}
+
+var (
+	// ErrBucketExists is returned when creating a bucket, or renaming one,
+	// to a name already in use.
+	ErrBucketExists = errors.New("bucket already exists")
+	// ErrNoSuchBucket is returned for operations on a bucket that was
+	// neither created nor committed to.
+	ErrNoSuchBucket = errors.New("no such bucket")
+	// ErrNotConfirmed is returned by DeleteBucket when the confirmation
+	// isn't the name of the bucket.
+	ErrNotConfirmed = errors.New("deletion not confirmed")
+)
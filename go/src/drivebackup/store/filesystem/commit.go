@@ -0,0 +1,24 @@
+package filesystem
+
+// Commit is everything one commit wrote, as given by Bucket.ExportCommit
+// and taken by Bucket.ImportCommit: enough to replay the commit in another
+// bucket, of any service.
+type Commit struct {
+	Snapshot Snapshot        // Snapshot.Version is the version of the commit
+	Dirs     []string        // every dir written, including parents, sorted
+	Files    []CommittedFile // sorted by path
+	Removed  []string        // paths that were live and were removed, sorted
+	Renames  []Rename        // paths written by moves, with their sources
+}
+
+// CommittedFile is a file written by a commit.
+type CommittedFile struct {
+	Path     string
+	BlobRef  BlobRef
+	Metadata Metadata
+}
+
+// Rename records that a move wrote To from the newest version of From.
+type Rename struct {
+	From, To string
+}
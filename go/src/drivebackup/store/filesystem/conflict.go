@@ -0,0 +1,170 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictError is returned by Commit when the bucket moved on from the
+// parent version the transaction declared.
+type ConflictError struct {
+	Parent Version
+	Head   Version
+	// Changed are the files written and the paths removed or moved to by
+	// the commits since Parent, sorted. Dirs only written as the parents of
+	// other paths are left out.
+	Changed []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting commit: parent %q, but the bucket is at %q", e.Parent, e.Head)
+}
+
+// IsConflict reports whether err is a *ConflictError.
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+// CommitWithRetry commits the writes build makes to a transaction, declaring
+// the head of bucket as its parent. If the commit conflicts with commits
+// that changed none of the paths the transaction writes, removes or moves,
+// the writes are rebased: replayed on a new transaction whose parent is the
+// new head. build is called once. A conflict on a path the transaction
+// touches, or after attempts commits, is returned as a *ConflictError.
+func CommitWithRetry(bucket Bucket, attempts int, build func(tx PutTransaction) error) error {
+	head, err := bucket.Head()
+	if err != nil {
+		return err
+	}
+	rec := &recordedTransaction{}
+	if err := build(rec); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		tx := bucket.NewPutTransaction()
+		tx.SetParent(head)
+		for _, op := range rec.ops {
+			op(tx)
+		}
+		err := tx.Commit()
+		conflict, ok := err.(*ConflictError)
+		if !ok || attempt >= attempts || rec.overlaps(conflict.Changed) {
+			return err
+		}
+		head = conflict.Head
+	}
+}
+
+// recordedTransaction records the writes made to it, to be replayed on
+// real transactions.
+type recordedTransaction struct {
+	ops     []func(tx PutTransaction)
+	touched []string // the paths written, removed and moved
+}
+
+// at returns the path of tx at path, which is relative to the root.
+func at(tx PutTransaction, path string) PutTransactionPath {
+	if path == "" {
+		return tx
+	}
+	return tx.Dir(path)
+}
+
+func (r *recordedTransaction) record(op func(tx PutTransaction), touched ...string) {
+	r.ops = append(r.ops, op)
+	r.touched = append(r.touched, touched...)
+}
+
+// overlaps reports whether any of changed is, or is above or below, a path
+// the transaction touched.
+func (r *recordedTransaction) overlaps(changed []string) bool {
+	for _, c := range changed {
+		for _, t := range r.touched {
+			if c == t || isBelow(c, t) || isBelow(t, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isBelow(path, dir string) bool {
+	return dir == "" || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+func (r *recordedTransaction) Dir(path string) PutTransactionPath {
+	return recordedPath{r, ""}.Dir(path)
+}
+
+func (r *recordedTransaction) File(name string, blobRef BlobRef) {
+	recordedPath{r, ""}.File(name, blobRef)
+}
+
+func (r *recordedTransaction) FileWithMetadata(name string, blobRef BlobRef, metadata Metadata) {
+	recordedPath{r, ""}.FileWithMetadata(name, blobRef, metadata)
+}
+
+func (r *recordedTransaction) Symlink(name, target string, metadata Metadata) {
+	recordedPath{r, ""}.Symlink(name, target, metadata)
+}
+
+func (r *recordedTransaction) Remove(name string) {
+	recordedPath{r, ""}.Remove(name)
+}
+
+func (r *recordedTransaction) RemoveAll(name string) {
+	recordedPath{r, ""}.RemoveAll(name)
+}
+
+func (r *recordedTransaction) Move(from, to string) {
+	r.record(func(tx PutTransaction) { tx.Move(from, to) }, filepath.Clean(from), filepath.Clean(to))
+}
+
+func (r *recordedTransaction) Describe(snapshot Snapshot) {
+	r.record(func(tx PutTransaction) { tx.Describe(snapshot) })
+}
+
+// SetParent is ignored: CommitWithRetry sets the parent of each attempt.
+func (r *recordedTransaction) SetParent(parent Version) {}
+
+func (r *recordedTransaction) Commit() error {
+	return fmt.Errorf("transactions are committed by CommitWithRetry")
+}
+
+func (r *recordedTransaction) Version() Version {
+	return ""
+}
+
+type recordedPath struct {
+	r    *recordedTransaction
+	path string
+}
+
+func (p recordedPath) Dir(path string) PutTransactionPath {
+	dir := filepath.Join(p.path, path)
+	p.r.record(func(tx PutTransaction) { at(tx, dir) })
+	return recordedPath{p.r, dir}
+}
+
+func (p recordedPath) File(name string, blobRef BlobRef) {
+	p.r.record(func(tx PutTransaction) { at(tx, p.path).File(name, blobRef) }, filepath.Join(p.path, name))
+}
+
+func (p recordedPath) FileWithMetadata(name string, blobRef BlobRef, metadata Metadata) {
+	p.r.record(func(tx PutTransaction) { at(tx, p.path).FileWithMetadata(name, blobRef, metadata) }, filepath.Join(p.path, name))
+}
+
+func (p recordedPath) Symlink(name, target string, metadata Metadata) {
+	p.r.record(func(tx PutTransaction) { at(tx, p.path).Symlink(name, target, metadata) }, filepath.Join(p.path, name))
+}
+
+func (p recordedPath) Remove(name string) {
+	p.r.record(func(tx PutTransaction) { at(tx, p.path).Remove(name) }, filepath.Join(p.path, name))
+}
+
+func (p recordedPath) RemoveAll(name string) {
+	p.r.record(func(tx PutTransaction) { at(tx, p.path).RemoveAll(name) }, filepath.Join(p.path, name))
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNoSuchEntity is returned by Get for a missing key.
+var ErrNoSuchEntity = errors.New("datastore: no such entity")
+
+// Key identifies an entity. Only named keys are used.
+type Key struct {
+	Kind   string
+	Name   string
+	Parent *Key
+}
+
+func (k *Key) String() string {
+	if k == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v/%s,%q", k.Parent, k.Kind, k.Name)
+}
+
+// HasAncestor reports whether ancestor is k or one of its parents.
+func (k *Key) HasAncestor(ancestor *Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *Key) Equal(o *Key) bool {
+	for k != nil && o != nil {
+		if k.Kind != o.Kind || k.Name != o.Name {
+			return false
+		}
+		k, o = k.Parent, o.Parent
+	}
+	return k == nil && o == nil
+}
+
+// Entity is a key and its properties. Property values are string, int64,
+// bool or time.Time.
+type Entity struct {
+	Key        *Key
+	Properties map[string]interface{}
+}
+
+// Filter restricts a query to entities whose property compares to Value.
+// Op is one of "=", "<", "<=", ">" or ">=".
+type Filter struct {
+	Property string
+	Op       string
+	Value    interface{}
+}
+
+// Query selects entities of one kind.
+type Query struct {
+	Kind     string
+	Ancestor *Key
+	Filters  []Filter
+	Orders   []string // property names, prefixed with "-" for descending
+	Limit    int      // 0 for no limit
+	KeysOnly bool
+}
+
+func NewQuery(kind string) *Query {
+	return &Query{Kind: kind}
+}
+
+func (q *Query) WithAncestor(ancestor *Key) *Query {
+	q.Ancestor = ancestor
+	return q
+}
+
+func (q *Query) Filter(property, op string, value interface{}) *Query {
+	q.Filters = append(q.Filters, Filter{Property: property, Op: op, Value: value})
+	return q
+}
+
+func (q *Query) Order(order string) *Query {
+	q.Orders = append(q.Orders, order)
+	return q
+}
+
+func (q *Query) WithLimit(limit int) *Query {
+	q.Limit = limit
+	return q
+}
+
+func (q *Query) WithKeysOnly() *Query {
+	q.KeysOnly = true
+	return q
+}
+
+// Client is the subset of the Cloud Datastore API the filesystem service
+// needs. store.NewDatastoreClient adapts a Cloud Datastore client, and
+// datastore/mock provides an in-process stand-in.
+type Client interface {
+	Get(ctx context.Context, key *Key) (*Entity, error)
+	// GetMulti returns the entities of keys, in order, with nil for the
+	// keys that have none. At most MaxBatchSize keys are read per call.
+	GetMulti(ctx context.Context, keys []*Key) ([]*Entity, error)
+	GetAll(ctx context.Context, q *Query) ([]*Entity, error)
+	PutMulti(ctx context.Context, entities []*Entity) error
+	DeleteMulti(ctx context.Context, keys []*Key) error
+	// RunInTransaction runs f atomically: either all of its writes are
+	// applied or none are.
+	RunInTransaction(ctx context.Context, f func(tx Transaction) error) error
+}
+
+// Transaction is the view of the datastore inside RunInTransaction.
+type Transaction interface {
+	Get(key *Key) (*Entity, error)
+	PutMulti(entities []*Entity) error
+	DeleteMulti(keys []*Key) error
+}
+
+// MaxBatchSize is the largest number of entities read by GetMulti or
+// written by one call.
+const MaxBatchSize = 500
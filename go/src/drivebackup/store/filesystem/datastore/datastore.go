@@ -0,0 +1,1401 @@
+// Package datastore implements a filesystem.FilesystemService on Cloud
+// Datastore.
+//
+// Each bucket is a root entity of kind "Bucket". Under it, every file or dir
+// written by a commit is an "Entry" entity, and every commit is a "Commit"
+// entity named by its version. Entries are written before their commit
+// entity, in batches, and a version only becomes visible once its commit
+// entity exists, so an interrupted commit is never seen by readers. A removed
+// file or dir gets an entry with the Removed property set, a tombstone, at the
+// version that removed it. Refs are "Ref" entities named by the ref, holding
+// the version they point at.
+//
+// Versions are handed out by a transaction on the bucket's "Reservation"
+// entity, which holds the newest version reserved, before any entry is
+// written. Concurrent commits therefore never write entries under the same
+// version, and the entries of a commit that fails stay invisible.
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/index"
+	"drivebackup/store/filesystem/selector"
+)
+
+const (
+	bucketKind = "Bucket"
+	commitKind = "Commit"
+	entryKind  = "Entry"
+	refKind    = "Ref"
+
+	reservationKind = "Reservation"
+
+	fileEntry = "file"
+	dirEntry  = "dir"
+)
+
+type FilesystemService struct {
+	// Clock assigns versions. It defaults to filesystem.SystemClock.
+	Clock filesystem.Clock
+
+	ctx    context.Context
+	client Client
+}
+
+var _ filesystem.FilesystemService = (*FilesystemService)(nil)
+
+// NewFilesystemService returns a service storing its data through client.
+// ctx is used for all datastore calls.
+func NewFilesystemService(ctx context.Context, client Client) *FilesystemService {
+	return &FilesystemService{ctx: ctx, client: client}
+}
+
+func (s *FilesystemService) Bucket(bucket string) filesystem.Bucket {
+	return &dsBucket{
+		service: s,
+		key:     &Key{Kind: bucketKind, Name: bucket},
+	}
+}
+
+type dsBucket struct {
+	service *FilesystemService
+	key     *Key
+}
+
+func (b *dsBucket) ctx() context.Context {
+	return b.service.ctx
+}
+
+func (b *dsBucket) client() Client {
+	return b.service.client
+}
+
+func (b *dsBucket) entryKey(kind, path string, version filesystem.Version) *Key {
+	return &Key{Kind: entryKind, Name: fmt.Sprintf("%s:%s@%s", kind, path, version), Parent: b.key}
+}
+
+func (b *dsBucket) commitKey(version filesystem.Version) *Key {
+	return &Key{Kind: commitKind, Name: string(version), Parent: b.key}
+}
+
+// parentDir returns the dir containing path. The bucket root has no parent.
+func parentDir(path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	parent := filepath.Dir(path)
+	if parent == "." {
+		parent = ""
+	}
+	return parent, true
+}
+
+func (b *dsBucket) newEntry(kind, path string, version filesystem.Version) *Entity {
+	e := &Entity{
+		Key: b.entryKey(kind, path, version),
+		Properties: map[string]interface{}{
+			"Kind":    kind,
+			"Path":    path,
+			"Version": string(version),
+		},
+	}
+	if parent, ok := parentDir(path); ok {
+		e.Properties["Parent"] = parent
+	}
+	return e
+}
+
+func (b *dsBucket) NewPutTransaction() filesystem.PutTransaction {
+	return index.NewPutTransaction(b.clock(), b.commit)
+}
+
+// commit expands the removals and moves of rec against the newest committed
+// state, assigns it a version and writes it.
+func (b *dsBucket) commit(rec *index.Record) error {
+	latest, err := b.latestVersion()
+	if err != nil {
+		return err
+	}
+	// The parent is checked before writing entries, to fail early, and
+	// again when committing.
+	if rec.HasParent && rec.Parent != latest {
+		return b.conflict(rec.Parent, latest)
+	}
+	commits := b.commits()
+	// Tombstones are written for each kind of entry a removed path has.
+	live := map[string][]string{}
+	liveNodes := func(path string) ([]index.Node, error) {
+		nodes, err := b.liveNodes(path, commits)
+		for _, node := range nodes {
+			kind := dirEntry
+			if node.IsFile {
+				kind = fileEntry
+			}
+			live[node.Path] = append(live[node.Path], kind)
+		}
+		return nodes, err
+	}
+	if err := index.ExpandMoves(rec, liveNodes); err != nil {
+		return err
+	}
+	removed, err := index.ExpandRemovals(rec, liveNodes)
+	if err != nil {
+		return err
+	}
+	rec.Removed = removed
+	version, err := b.reserve(func(newest filesystem.Version) (filesystem.Version, error) {
+		return filesystem.NextVersion(b.clock(), newest), nil
+	})
+	if err != nil {
+		return err
+	}
+	rec.SetVersion(version)
+	return b.write(rec, live)
+}
+
+func (b *dsBucket) reservationKey() *Key {
+	return &Key{Kind: reservationKind, Name: "latest", Parent: b.key}
+}
+
+// reserve assigns a version in a transaction, recording it in the
+// reservation entity. next is given the newest version committed or reserved
+// before, "" if there is none, and returns the version to reserve.
+func (b *dsBucket) reserve(next func(newest filesystem.Version) (filesystem.Version, error)) (filesystem.Version, error) {
+	var version filesystem.Version
+	err := b.client().RunInTransaction(b.ctx(), func(tx Transaction) error {
+		newest, err := b.newestVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version, err = next(newest); err != nil {
+			return err
+		}
+		return tx.PutMulti([]*Entity{{
+			Key:        b.reservationKey(),
+			Properties: map[string]interface{}{"Version": string(version)},
+		}})
+	})
+	return version, err
+}
+
+// newestVersion returns the newer of the bucket's latest version and its
+// reserved version.
+func (b *dsBucket) newestVersion(tx Transaction) (filesystem.Version, error) {
+	var newest filesystem.Version
+	for _, key := range []*Key{b.key, b.reservationKey()} {
+		e, err := tx.Get(key)
+		if err == ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		version, _ := e.Properties["LatestVersion"].(string)
+		if key.Kind == reservationKind {
+			version, _ = e.Properties["Version"].(string)
+		}
+		if newest == "" || filesystem.Version(version).Compare(newest) > 0 {
+			newest = filesystem.Version(version)
+		}
+	}
+	return newest, nil
+}
+
+// write writes the entries of rec, with tombstones of the kinds in live for
+// its removed paths, then makes them visible by writing the commit entity
+// and advancing the bucket's latest version in a transaction. The version of
+// rec must have been reserved. If the transaction fails, the entries are
+// deleted again; any left behind are invisible, as their version has no
+// commit entity.
+//
+// A commit without a parent is published even if a newer version was
+// published since its version was reserved: the latest version stays the
+// newer one, as if the commits had been published in version order. A
+// commit with a parent fails with a *filesystem.ConflictError instead.
+func (b *dsBucket) write(rec *index.Record, live map[string][]string) error {
+	version := rec.Version
+	commit, err := b.commitEntity(rec.Snapshot)
+	if err != nil {
+		return err
+	}
+	movedFrom := map[string]string{}
+	for _, rename := range rec.Renames {
+		movedFrom[rename.To] = rename.From
+	}
+
+	var entities []*Entity
+	for _, path := range rec.Dirs {
+		e := b.newEntry(dirEntry, path, version)
+		if from, ok := movedFrom[path]; ok {
+			e.Properties["MovedFrom"] = from
+		}
+		entities = append(entities, e)
+	}
+	for _, f := range rec.Files {
+		e := b.newEntry(fileEntry, f.Path, version)
+		e.Properties["Store"] = f.BlobRef.Store
+		e.Properties["BlobName"] = f.BlobRef.Name
+		if err := setMetadata(e, f.Metadata); err != nil {
+			return err
+		}
+		if from, ok := movedFrom[f.Path]; ok {
+			e.Properties["MovedFrom"] = from
+		}
+		entities = append(entities, e)
+	}
+	for _, path := range rec.Removed {
+		for _, kind := range uniqueKinds(live[path]) {
+			e := b.newEntry(kind, path, version)
+			e.Properties["Removed"] = true
+			entities = append(entities, e)
+		}
+	}
+	if err := b.putEntities(entities); err != nil {
+		return err
+	}
+
+	err = b.client().RunInTransaction(b.ctx(), func(tx Transaction) error {
+		bucket, err := tx.Get(b.key)
+		if err == ErrNoSuchEntity {
+			bucket = &Entity{Key: b.key, Properties: map[string]interface{}{
+				"Description": "",
+				"Owner":       "",
+				"Created":     version.Time(),
+			}}
+		} else if err != nil {
+			return err
+		}
+		latest, _ := bucket.Properties["LatestVersion"].(string)
+		if rec.HasParent && filesystem.Version(latest) != rec.Parent {
+			return errConflict
+		}
+		if latest == "" || filesystem.Version(latest).Compare(version) < 0 {
+			bucket.Properties["LatestVersion"] = string(version)
+		}
+		return tx.PutMulti([]*Entity{bucket, commit})
+	})
+	if err == nil {
+		return nil
+	}
+	keys := make([]*Key, len(entities))
+	for i, e := range entities {
+		keys[i] = e.Key
+	}
+	b.deleteKeys(keys)
+	if err == errConflict {
+		latest, err := b.latestVersion()
+		if err != nil {
+			return err
+		}
+		return b.conflict(rec.Parent, latest)
+	}
+	return err
+}
+
+// errConflict aborts a commit transaction whose parent isn't the head.
+var errConflict = errors.New("conflicting commit")
+
+// conflict returns the error of a commit declaring parent to a bucket whose
+// head is head.
+func (b *dsBucket) conflict(parent, head filesystem.Version) error {
+	q := NewQuery(commitKind).WithAncestor(b.key).WithKeysOnly()
+	if parent != "" {
+		q = q.Filter("Version", ">", string(parent))
+	}
+	newer, err := b.client().GetAll(b.ctx(), q)
+	if err != nil {
+		return err
+	}
+	changed := map[string]bool{}
+	for _, commit := range newer {
+		entries, err := b.client().GetAll(b.ctx(), NewQuery(entryKind).
+			WithAncestor(b.key).
+			Filter("Version", "=", commit.Key.Name))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			movedFrom, _ := e.Properties["MovedFrom"].(string)
+			if e.Properties["Kind"] == fileEntry || isRemoved(e) || movedFrom != "" {
+				changed[e.Properties["Path"].(string)] = true
+			}
+		}
+	}
+	conflict := &filesystem.ConflictError{Parent: parent, Head: head}
+	for path := range changed {
+		conflict.Changed = append(conflict.Changed, path)
+	}
+	sort.Strings(conflict.Changed)
+	return conflict
+}
+
+func (b *dsBucket) Head() (filesystem.Version, error) {
+	return b.latestVersion()
+}
+
+// DeleteVersions deletes the commit entities first, which hides the
+// versions at once; a deletion interrupted after that only leaves invisible
+// entries behind.
+func (b *dsBucket) DeleteVersions(versions ...filesystem.Version) error {
+	committed := b.commits()
+	refs, err := b.Refs()
+	if err != nil {
+		return err
+	}
+	var commits []*Key
+	for _, version := range versions {
+		if ok, err := committed.has(version); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("no version %q", version)
+		}
+		for _, ref := range refs {
+			if ref.Version == version {
+				return fmt.Errorf("version %q is tagged %q", version, ref.Name)
+			}
+		}
+		commits = append(commits, b.commitKey(version))
+	}
+	if err := b.deleteKeys(commits); err != nil {
+		return err
+	}
+	for _, version := range versions {
+		entries, err := b.client().GetAll(b.ctx(), NewQuery(entryKind).
+			WithAncestor(b.key).
+			Filter("Version", "=", string(version)).
+			WithKeysOnly())
+		if err != nil {
+			return err
+		}
+		var keys []*Key
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if err := b.deleteKeys(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *dsBucket) putEntities(entities []*Entity) error {
+	for len(entities) > 0 {
+		n := len(entities)
+		if n > MaxBatchSize {
+			n = MaxBatchSize
+		}
+		if err := b.client().PutMulti(b.ctx(), entities[:n]); err != nil {
+			return err
+		}
+		entities = entities[n:]
+	}
+	return nil
+}
+
+func (b *dsBucket) deleteKeys(keys []*Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MaxBatchSize {
+			n = MaxBatchSize
+		}
+		if err := b.client().DeleteMulti(b.ctx(), keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// commitEntity returns the commit entity of a version, holding its snapshot.
+// Tags are JSON encoded, as property values can't be lists.
+func (b *dsBucket) commitEntity(snapshot filesystem.Snapshot) (*Entity, error) {
+	tags, err := json.Marshal(snapshot.Tags)
+	if err != nil {
+		return nil, err
+	}
+	return &Entity{
+		Key: b.commitKey(snapshot.Version),
+		Properties: map[string]interface{}{
+			"Version":   string(snapshot.Version),
+			"Committed": b.clock().Now(),
+			"Hostname":  snapshot.Hostname,
+			"User":      snapshot.User,
+			"Source":    snapshot.Source,
+			"Tags":      string(tags),
+			"Message":   snapshot.Message,
+			"Files":     int64(snapshot.Files),
+			"Bytes":     snapshot.Bytes,
+			"Started":   snapshot.Started,
+			"Duration":  int64(snapshot.Duration),
+		},
+	}, nil
+}
+
+// snapshotOf reads the snapshot held by a commit entity, as written by
+// commitEntity.
+func snapshotOf(e *Entity) (filesystem.Snapshot, error) {
+	snapshot := filesystem.Snapshot{
+		Version:  filesystem.Version(e.Key.Name),
+		Hostname: e.Properties["Hostname"].(string),
+		User:     e.Properties["User"].(string),
+		Source:   e.Properties["Source"].(string),
+		Message:  e.Properties["Message"].(string),
+		Files:    int(e.Properties["Files"].(int64)),
+		Bytes:    e.Properties["Bytes"].(int64),
+		Started:  e.Properties["Started"].(time.Time),
+		Duration: time.Duration(e.Properties["Duration"].(int64)),
+	}
+	if err := json.Unmarshal([]byte(e.Properties["Tags"].(string)), &snapshot.Tags); err != nil {
+		return filesystem.Snapshot{}, fmt.Errorf("invalid tags of %v: %v", e.Key, err)
+	}
+	return snapshot, nil
+}
+
+func (b *dsBucket) Snapshots() ([]filesystem.Snapshot, error) {
+	commits, err := b.client().GetAll(b.ctx(), NewQuery(commitKind).WithAncestor(b.key).Order("Version"))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []filesystem.Snapshot
+	for _, commit := range commits {
+		snapshot, err := snapshotOf(commit)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+func (b *dsBucket) Snapshot(version filesystem.Version) (filesystem.Snapshot, error) {
+	commit, err := b.client().Get(b.ctx(), b.commitKey(version))
+	if err == ErrNoSuchEntity {
+		return filesystem.Snapshot{}, fmt.Errorf("no snapshot of version %q", version)
+	}
+	if err != nil {
+		return filesystem.Snapshot{}, err
+	}
+	return snapshotOf(commit)
+}
+
+func (b *dsBucket) clock() filesystem.Clock {
+	if b.service.Clock != nil {
+		return b.service.Clock
+	}
+	return filesystem.SystemClock
+}
+
+func (b *dsBucket) latestVersion() (filesystem.Version, error) {
+	bucket, err := b.client().Get(b.ctx(), b.key)
+	if err == ErrNoSuchEntity {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	latest, _ := bucket.Properties["LatestVersion"].(string)
+	return filesystem.Version(latest), nil
+}
+
+// commits tells the versions whose commit completed from those of failed or
+// unfinished commits, whose entries must not be seen. It looks up the commit
+// entities of the versions it is asked about, each at most once, so that a
+// read checks only the versions of the entries it reads.
+type commits struct {
+	bucket *dsBucket
+	known  map[filesystem.Version]bool
+}
+
+func (b *dsBucket) commits() *commits {
+	return &commits{bucket: b, known: map[filesystem.Version]bool{}}
+}
+
+// load looks up the versions not yet known, MaxBatchSize at a time.
+func (c *commits) load(versions []filesystem.Version) error {
+	var keys []*Key
+	for _, version := range versions {
+		if _, ok := c.known[version]; !ok {
+			c.known[version] = false
+			keys = append(keys, c.bucket.commitKey(version))
+		}
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MaxBatchSize {
+			n = MaxBatchSize
+		}
+		entities, err := c.bucket.client().GetMulti(c.bucket.ctx(), keys[:n])
+		if err != nil {
+			for _, key := range keys {
+				delete(c.known, filesystem.Version(key.Name))
+			}
+			return err
+		}
+		for i, e := range entities {
+			c.known[filesystem.Version(keys[i].Name)] = e != nil
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// has reports whether version was committed.
+func (c *commits) has(version filesystem.Version) (bool, error) {
+	if err := c.load([]filesystem.Version{version}); err != nil {
+		return false, err
+	}
+	return c.known[version], nil
+}
+
+// filter returns the entries among entries whose version was committed.
+func (c *commits) filter(entries []*Entity) ([]*Entity, error) {
+	versions := make([]filesystem.Version, len(entries))
+	for i, e := range entries {
+		versions[i] = entryVersion(e)
+	}
+	if err := c.load(versions); err != nil {
+		return nil, err
+	}
+	var results []*Entity
+	for _, e := range entries {
+		if c.known[entryVersion(e)] {
+			results = append(results, e)
+		}
+	}
+	return results, nil
+}
+
+// entries returns the committed entries of a file or dir, oldest first,
+// including tombstones.
+func (b *dsBucket) entries(kind, path string, commits *commits) ([]*Entity, error) {
+	entries, err := b.client().GetAll(b.ctx(), NewQuery(entryKind).
+		WithAncestor(b.key).
+		Filter("Path", "=", path).
+		Filter("Kind", "=", kind).
+		Order("Version"))
+	if err != nil {
+		return nil, err
+	}
+	return commits.filter(entries)
+}
+
+// entryVersions returns the committed versions of a file or dir, oldest
+// first. Removals are left out.
+func (b *dsBucket) entryVersions(kind, path string, commits *commits) ([]filesystem.Version, error) {
+	entries, err := b.entries(kind, path, commits)
+	if err != nil {
+		return nil, err
+	}
+	var versions []filesystem.Version
+	for _, e := range entries {
+		if !isRemoved(e) {
+			versions = append(versions, entryVersion(e))
+		}
+	}
+	return versions, nil
+}
+
+// liveNodes returns the node at path and the nodes below it that exist in the
+// newest committed state.
+func (b *dsBucket) liveNodes(path string, commits *commits) ([]index.Node, error) {
+	exact, err := b.client().GetAll(b.ctx(), NewQuery(entryKind).
+		WithAncestor(b.key).
+		Filter("Path", "=", path))
+	if err != nil {
+		return nil, err
+	}
+	// Paths below path sort between path+"/" and path+"0", '0' being the
+	// character after '/'.
+	below, err := b.client().GetAll(b.ctx(), NewQuery(entryKind).
+		WithAncestor(b.key).
+		Filter("Path", ">=", path+"/").
+		Filter("Path", "<", path+"0"))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := commits.filter(append(exact, below...))
+	if err != nil {
+		return nil, err
+	}
+	var nodes []index.Node
+	for _, e := range newestEntries(entries) {
+		if isRemoved(e) {
+			continue
+		}
+		node := index.Node{Path: e.Properties["Path"].(string)}
+		if e.Properties["Kind"] == fileEntry {
+			node.IsFile = true
+			node.BlobRef = filesystem.BlobRef{
+				Store: e.Properties["Store"].(string),
+				Name:  e.Properties["BlobName"].(string),
+			}
+			if node.Metadata, err = metadataOf(e); err != nil {
+				return nil, err
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// newestEntries returns the newest entry of each file and dir among
+// committed entries.
+func newestEntries(entries []*Entity) []*Entity {
+	newest := map[string]*Entity{}
+	var ids []string
+	for _, e := range entries {
+		id := e.Properties["Kind"].(string) + ":" + e.Properties["Path"].(string)
+		n, ok := newest[id]
+		if !ok {
+			ids = append(ids, id)
+		}
+		if !ok || entryVersion(n).Compare(entryVersion(e)) < 0 {
+			newest[id] = e
+		}
+	}
+	sort.Strings(ids)
+	var results []*Entity
+	for _, id := range ids {
+		results = append(results, newest[id])
+	}
+	return results
+}
+
+// uniqueKinds drops repeated kinds, as liveNodes may see a path more than
+// once.
+func uniqueKinds(kinds []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, kind := range kinds {
+		if !seen[kind] {
+			seen[kind] = true
+			unique = append(unique, kind)
+		}
+	}
+	return unique
+}
+
+// setMetadata stores m in the properties of a file entry. Extended
+// attributes are JSON encoded, as property values can't be maps. Cloud
+// Datastore keeps ModTime to the microsecond.
+func setMetadata(e *Entity, m filesystem.Metadata) error {
+	e.Properties["Size"] = m.Size
+	e.Properties["Mode"] = int64(m.Mode)
+	e.Properties["ModTime"] = m.ModTime
+	e.Properties["Uid"] = int64(m.Uid)
+	e.Properties["Gid"] = int64(m.Gid)
+	e.Properties["Hash"] = m.Hash
+	e.Properties["FileType"] = int64(m.Type)
+	e.Properties["LinkTarget"] = m.LinkTarget
+	e.Properties["Device"] = int64(m.Device)
+	e.Properties["LinkGroup"] = m.LinkGroup
+	if len(m.Xattrs) > 0 {
+		xattrs, err := json.Marshal(m.Xattrs)
+		if err != nil {
+			return err
+		}
+		e.Properties["Xattrs"] = string(xattrs)
+	}
+	return nil
+}
+
+// metadataOf reads the metadata of a file entry, as stored by setMetadata.
+func metadataOf(e *Entity) (filesystem.Metadata, error) {
+	m := filesystem.Metadata{
+		Type:       filesystem.FileType(e.Properties["FileType"].(int64)),
+		Size:       e.Properties["Size"].(int64),
+		Mode:       os.FileMode(e.Properties["Mode"].(int64)),
+		ModTime:    e.Properties["ModTime"].(time.Time),
+		Uid:        int(e.Properties["Uid"].(int64)),
+		Gid:        int(e.Properties["Gid"].(int64)),
+		Hash:       e.Properties["Hash"].(string),
+		LinkTarget: e.Properties["LinkTarget"].(string),
+		Device:     uint64(e.Properties["Device"].(int64)),
+		LinkGroup:  e.Properties["LinkGroup"].(string),
+	}
+	if xattrs, ok := e.Properties["Xattrs"].(string); ok {
+		if err := json.Unmarshal([]byte(xattrs), &m.Xattrs); err != nil {
+			return filesystem.Metadata{}, fmt.Errorf("invalid xattrs of %v: %v", e.Key, err)
+		}
+	}
+	return m, nil
+}
+
+func entryVersion(e *Entity) filesystem.Version {
+	return filesystem.Version(e.Properties["Version"].(string))
+}
+
+func isRemoved(e *Entity) bool {
+	removed, _ := e.Properties["Removed"].(bool)
+	return removed
+}
+
+func (b *dsBucket) Select() filesystem.Selector {
+	builder := selector.NewSelectorBuilder(func(q selector.Query) filesystem.SelectorOp {
+		commits := b.commits()
+		version := q.Version
+		if q.Resolves() {
+			kind := dirEntry
+			if q.LatestIsFile {
+				kind = fileEntry
+			}
+			entries, err := b.entries(kind, q.LatestPath, commits)
+			if err != nil {
+				return &errSelector{err}
+			}
+			version = ""
+			if len(entries) > 0 {
+				var versions []filesystem.Version
+				for _, e := range entries {
+					versions = append(versions, entryVersion(e))
+				}
+				i := q.Pick(versions)
+				if i < 0 {
+					return &errSelector{fmt.Errorf("%q has no version %s", q.LatestPath, q.Describe())}
+				}
+				if isRemoved(entries[i]) {
+					return &errSelector{fmt.Errorf("%q was removed in version %s", q.LatestPath, versions[i])}
+				}
+				version = versions[i]
+			}
+		}
+		return &dsSelector{
+			bucket:  b,
+			path:    q.Path,
+			isFile:  q.IsFile,
+			version: version,
+			follow:  q.Follow,
+			rng:     q.Range,
+			glob:    q.Glob,
+			commits: commits,
+		}
+	})
+	builder.ResolveTag = b.Ref
+	return builder
+}
+
+type dsSelector struct {
+	bucket  *dsBucket
+	path    string
+	isFile  bool
+	version filesystem.Version
+	follow  bool
+	rng     selector.Range
+	glob    string
+	commits *commits
+}
+
+func (s *dsSelector) kind() string {
+	if s.isFile {
+		return fileEntry
+	}
+	return dirEntry
+}
+
+// revisions returns the revisions of a file or dir for index.Lineage.
+func (s *dsSelector) revisions(path string) ([]index.Revision, error) {
+	entries, err := s.bucket.entries(s.kind(), path, s.commits)
+	if err != nil {
+		return nil, err
+	}
+	var revs []index.Revision
+	for _, e := range entries {
+		movedFrom, _ := e.Properties["MovedFrom"].(string)
+		revs = append(revs, index.Revision{
+			Path:      path,
+			Version:   entryVersion(e),
+			Removed:   isRemoved(e),
+			MovedFrom: movedFrom,
+		})
+	}
+	return revs, nil
+}
+
+// resolve returns the path selected at s.version. It is s.path unless the
+// selector follows moves.
+func (s *dsSelector) resolve() (string, error) {
+	if !s.follow || s.version == "" {
+		return s.path, nil
+	}
+	lineage, err := index.Lineage(s.path, s.revisions)
+	if err != nil {
+		return "", err
+	}
+	for _, rev := range lineage {
+		if rev.Version == s.version {
+			return rev.Path, nil
+		}
+	}
+	return s.path, nil
+}
+
+func (s *dsSelector) List() ([]string, error) {
+	if s.isFile {
+		return nil, fmt.Errorf("List() may only be applied to directories")
+	}
+	path, err := s.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDir(path); err != nil {
+		return nil, err
+	}
+	inRange, err := s.inRange()
+	if err != nil {
+		return nil, err
+	}
+	var results []string
+	err = s.children(path, "", inRange, listBatchSize, func(visible []*Entity) (bool, error) {
+		results = append(results, visible[0].Properties["Path"].(string))
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Walk lists each dir a batch at a time as it reaches it, so it holds the
+// batches of the dirs it is in rather than the whole tree.
+func (s *dsSelector) Walk(fn filesystem.WalkFunc) error {
+	if s.isFile {
+		return fmt.Errorf("Walk() may only be applied to directories")
+	}
+	path, err := s.resolve()
+	if err != nil {
+		return err
+	}
+	if err := s.checkDir(path); err != nil {
+		return err
+	}
+	inRange, err := s.inRange()
+	if err != nil {
+		return err
+	}
+	return s.walk(path, inRange, fn)
+}
+
+// walk calls fn for the entries below dir, handling filesystem.SkipDir like
+// index.Walk.
+func (s *dsSelector) walk(dir string, inRange map[filesystem.Version]bool, fn filesystem.WalkFunc) error {
+	return s.children(dir, "", inRange, listBatchSize, func(visible []*Entity) (bool, error) {
+		for _, e := range visible {
+			entry, err := walkEntryOf(e)
+			if err != nil {
+				return false, err
+			}
+			err = fn(entry)
+			if err == filesystem.SkipDir {
+				if !entry.IsDir {
+					return false, nil
+				}
+				continue
+			}
+			if err != nil {
+				return false, err
+			}
+			if entry.IsDir {
+				if err := s.walk(entry.Path, inRange, fn); err != nil {
+					return false, err
+				}
+			}
+		}
+		return true, nil
+	})
+}
+
+// Diff walks the dir at each version and compares the entries.
+func (s *dsSelector) Diff(v1, v2 filesystem.Version) ([]filesystem.Change, error) {
+	if s.isFile {
+		return nil, fmt.Errorf("Diff() may only be applied to directories")
+	}
+	before, after := *s, *s
+	before.version, after.version = v1, v2
+	var found bool
+	for _, v := range []filesystem.Version{v1, v2} {
+		e, err := s.bucket.client().Get(s.bucket.ctx(), s.bucket.entryKey(dirEntry, s.path, v))
+		if err != nil && err != ErrNoSuchEntity {
+			return nil, err
+		}
+		committed, cerr := s.commits.has(v)
+		if cerr != nil {
+			return nil, cerr
+		}
+		found = found || (err == nil && committed && !isRemoved(e))
+	}
+	if !found {
+		return nil, fmt.Errorf("dir %q not found at %s or %s", s.path, v1, v2)
+	}
+	beforeEntries, err := before.walkEntries(s.path)
+	if err != nil {
+		return nil, err
+	}
+	afterEntries, err := after.walkEntries(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return index.Diff(beforeEntries, afterEntries), nil
+}
+
+// walkEntries returns the entries below the dir at path that the selector
+// sees, in the order Walk visits them.
+func (s *dsSelector) walkEntries(path string) ([]filesystem.WalkEntry, error) {
+	inRange, err := s.inRange()
+	if err != nil {
+		return nil, err
+	}
+	var entries []filesystem.WalkEntry
+	err = s.walk(path, inRange, func(entry filesystem.WalkEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func walkEntryOf(e *Entity) (filesystem.WalkEntry, error) {
+	path := e.Properties["Path"].(string)
+	if e.Properties["Kind"] == dirEntry {
+		return filesystem.WalkEntry{
+			Path:          path,
+			IsDir:         true,
+			StoredBlobRef: filesystem.StoredBlobRef{Version: entryVersion(e)},
+		}, nil
+	}
+	ref, err := storedBlobRefOf(e)
+	if err != nil {
+		return filesystem.WalkEntry{}, err
+	}
+	return filesystem.WalkEntry{Path: path, StoredBlobRef: ref}, nil
+}
+
+// inRange returns the versions of s.path in s.rng, or nil if no range is
+// selected.
+func (s *dsSelector) inRange() (map[filesystem.Version]bool, error) {
+	if !s.rng.IsSet() {
+		return nil, nil
+	}
+	dirVersions, err := s.bucket.entryVersions(dirEntry, s.path, s.commits)
+	if err != nil {
+		return nil, err
+	}
+	inRange := map[filesystem.Version]bool{}
+	for _, version := range s.rng.Filter(dirVersions) {
+		inRange[version] = true
+	}
+	return inRange, nil
+}
+
+// listBatchSize is the most entries a listing fetches per query.
+const listBatchSize = 500
+
+// scanBatchSize is the most entries of one path scan fetches per query.
+// The newest committed entry usually decides what a selector sees, so
+// it is small.
+const scanBatchSize = 10
+
+// ListEntries lists the dir in batches of at most one more entry than the
+// page holds, so that a page reads a number of entries bounded by its size,
+// however long the history of the children.
+func (s *dsSelector) ListEntries(opts filesystem.ListOptions) (*filesystem.EntryPage, error) {
+	if s.isFile {
+		return nil, fmt.Errorf("ListEntries() may only be applied to directories")
+	}
+	after, err := index.PageStart(opts.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	path, err := s.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDir(path); err != nil {
+		return nil, err
+	}
+	inRange, err := s.inRange()
+	if err != nil {
+		return nil, err
+	}
+	maxBatch := listBatchSize
+	if opts.Limit > 0 && opts.Limit+1 < maxBatch {
+		maxBatch = opts.Limit + 1
+	}
+	var entries []filesystem.WalkEntry
+	err = s.children(path, after, inRange, maxBatch, func(visible []*Entity) (bool, error) {
+		// A name that is both a file and a dir is given as the newer.
+		newest := visible[0]
+		for _, e := range visible[1:] {
+			if entryVersion(newest).Compare(entryVersion(e)) < 0 {
+				newest = e
+			}
+		}
+		entry, err := walkEntryOf(newest)
+		if err != nil {
+			return false, err
+		}
+		entries = append(entries, entry)
+		return opts.Limit == 0 || len(entries) <= opts.Limit, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index.Page(entries, opts.Limit), nil
+}
+
+// checkDir fails if the dir at path has no committed entry, or, without a
+// version or range, if it is removed.
+func (s *dsSelector) checkDir(path string) error {
+	var newest *Entity
+	err := s.bucket.scan(s.commits, path, dirEntry, "", func(e *Entity) bool {
+		newest = e
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if newest == nil || (s.version == "" && !s.rng.IsSet() && isRemoved(newest)) {
+		return fmt.Errorf("dir not found: %v", s.path)
+	}
+	return nil
+}
+
+// children calls fn, in order of name from after, with the entries of each
+// child of dir that the selector sees: one, or a dir and a file of the same
+// name. It stops when fn returns false.
+//
+// The entries of dir's children are queried by path, and newest first
+// within a path, a batch of at most maxBatch at a time. The first committed
+// entries of a path decide what the selector sees of it: a path cut off by
+// the end of a full batch is decided by scanning it, and the next batch
+// starts after it. Each batch is sized to twice the paths the one before
+// held, so the children of a dir with long histories are read a few
+// entries each, and those with short ones in large batches.
+func (s *dsSelector) children(dir, after string, inRange map[filesystem.Version]bool, maxBatch int, fn func(visible []*Entity) (bool, error)) error {
+	var cursor string
+	if after != "" {
+		cursor = filepath.Join(dir, after)
+	}
+	batchSize := maxBatch
+	if batchSize > scanBatchSize {
+		batchSize = scanBatchSize
+	}
+	for {
+		q := NewQuery(entryKind).WithAncestor(s.bucket.key).Filter("Parent", "=", dir)
+		if s.version != "" {
+			q = q.Filter("Version", "=", string(s.version))
+		}
+		if cursor != "" {
+			q = q.Filter("Path", ">", cursor)
+		}
+		batch, err := s.bucket.client().GetAll(s.bucket.ctx(), q.Order("Path").Order("-Version").WithLimit(batchSize))
+		if err != nil {
+			return err
+		}
+		committed, err := s.commits.filter(batch)
+		if err != nil {
+			return err
+		}
+		full := len(batch) == batchSize
+		paths := 0
+		for start := 0; start < len(batch); {
+			paths++
+			path := batch[start].Properties["Path"].(string)
+			end := start + 1
+			for end < len(batch) && batch[end].Properties["Path"] == path {
+				end++
+			}
+			var visible []*Entity
+			for _, kind := range []string{dirEntry, fileEntry} {
+				e, decided := s.decideAmong(committed, path, kind, inRange)
+				if !decided && full && end == len(batch) {
+					if e, err = s.visible(path, kind, inRange); err != nil {
+						return err
+					}
+				}
+				if e != nil {
+					visible = append(visible, e)
+				}
+			}
+			if len(visible) > 0 {
+				if more, err := fn(visible); err != nil || !more {
+					return err
+				}
+			}
+			start = end
+		}
+		if !full {
+			return nil
+		}
+		cursor = batch[len(batch)-1].Properties["Path"].(string)
+		batchSize = 2 * paths
+		if batchSize > maxBatch {
+			batchSize = maxBatch
+		}
+	}
+}
+
+// decideAmong returns the entry of path and kind that the selector sees,
+// deciding from those among entries, newest first, and whether they
+// decided it.
+func (s *dsSelector) decideAmong(entries []*Entity, path, kind string, inRange map[filesystem.Version]bool) (*Entity, bool) {
+	for _, e := range entries {
+		if e.Properties["Path"] != path || e.Properties["Kind"] != kind {
+			continue
+		}
+		if e, decided := decide(e, inRange); decided {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// visible returns the entry of path and kind that the selector sees, or
+// nil: without a version the newest committed one unless it is a
+// tombstone, at a version the one written by it, and in a range the newest
+// written by a version in it.
+func (s *dsSelector) visible(path, kind string, inRange map[filesystem.Version]bool) (*Entity, error) {
+	var visible *Entity
+	err := s.bucket.scan(s.commits, path, kind, s.version, func(e *Entity) bool {
+		var decided bool
+		visible, decided = decide(e, inRange)
+		return decided
+	})
+	return visible, err
+}
+
+// decide returns what a selector sees given e, the newest committed entry
+// of its path and kind not yet passed over: the entry it sees or nil, and
+// whether that is decided, or older entries are to be considered.
+func decide(e *Entity, inRange map[filesystem.Version]bool) (*Entity, bool) {
+	switch {
+	case inRange != nil && (!inRange[entryVersion(e)] || isRemoved(e)):
+		return nil, false
+	case isRemoved(e):
+		return nil, true
+	}
+	return e, true
+}
+
+// scan calls fn with the committed entries of path and kind, newest first,
+// or only the one at version if it is set, until fn returns true.
+func (b *dsBucket) scan(commits *commits, path, kind string, version filesystem.Version, fn func(e *Entity) bool) error {
+	var cursor string
+	for {
+		q := NewQuery(entryKind).
+			WithAncestor(b.key).
+			Filter("Path", "=", path).
+			Filter("Kind", "=", kind).
+			Order("-Version").
+			WithLimit(scanBatchSize)
+		if version != "" {
+			q = q.Filter("Version", "=", string(version))
+		} else if cursor != "" {
+			q = q.Filter("Version", "<", cursor)
+		}
+		batch, err := b.client().GetAll(b.ctx(), q)
+		if err != nil {
+			return err
+		}
+		committed, err := commits.filter(batch)
+		if err != nil {
+			return err
+		}
+		for _, e := range committed {
+			if fn(e) {
+				return nil
+			}
+		}
+		if len(batch) < scanBatchSize {
+			return nil
+		}
+		cursor = string(entryVersion(batch[len(batch)-1]))
+	}
+}
+
+func (s *dsSelector) BlobRef() (filesystem.StoredBlobRef, error) {
+	if s.version == "" {
+		return filesystem.StoredBlobRef{}, fmt.Errorf("version must be specified for BlobRef()")
+	}
+	if !s.isFile {
+		return filesystem.StoredBlobRef{}, fmt.Errorf("BlobRef() may only be applied to files")
+	}
+	path, err := s.resolve()
+	if err != nil {
+		return filesystem.StoredBlobRef{}, err
+	}
+	e, err := s.bucket.client().Get(s.bucket.ctx(), s.bucket.entryKey(fileEntry, path, s.version))
+	if err != nil && err != ErrNoSuchEntity {
+		return filesystem.StoredBlobRef{}, err
+	}
+	committed, cerr := s.commits.has(s.version)
+	if cerr != nil {
+		return filesystem.StoredBlobRef{}, cerr
+	}
+	if err == ErrNoSuchEntity || !committed || isRemoved(e) {
+		return filesystem.StoredBlobRef{}, fmt.Errorf("file %q has no version %q", s.path, s.version)
+	}
+	return storedBlobRefOf(e)
+}
+
+// storedBlobRefOf returns the ref stored in a file entry.
+func storedBlobRefOf(e *Entity) (filesystem.StoredBlobRef, error) {
+	metadata, err := metadataOf(e)
+	if err != nil {
+		return filesystem.StoredBlobRef{}, err
+	}
+	return filesystem.StoredBlobRef{
+		BlobRef: filesystem.BlobRef{
+			Store: e.Properties["Store"].(string),
+			Name:  e.Properties["BlobName"].(string),
+		},
+		Version:  entryVersion(e),
+		Metadata: metadata,
+	}, nil
+}
+
+// Match walks the tree below the glob's root, so that it reads what a walk
+// does rather than every entry below the root.
+func (s *dsSelector) Match() ([]filesystem.MatchedFile, error) {
+	inRange, err := s.inRange()
+	if err != nil {
+		return nil, err
+	}
+	var results []filesystem.MatchedFile
+	err = s.walk(selector.GlobRoot(s.glob), inRange, func(entry filesystem.WalkEntry) error {
+		if !entry.IsDir && selector.MatchGlob(s.glob, entry.Path) {
+			results = append(results, filesystem.MatchedFile{Path: entry.Path, StoredBlobRef: entry.StoredBlobRef})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, nil
+}
+
+func (s *dsSelector) Versions() ([]filesystem.Version, error) {
+	var versions []filesystem.Version
+	var err error
+	if s.follow {
+		var lineage []index.Revision
+		lineage, err = index.Lineage(s.path, s.revisions)
+		for _, rev := range lineage {
+			versions = append(versions, rev.Version)
+		}
+	} else {
+		versions, err = s.bucket.entryVersions(s.kind(), s.path, s.commits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.version == "" || len(versions) == 0 {
+		return s.rng.Filter(versions), nil
+	}
+	for _, version := range versions {
+		if version == s.version {
+			return []filesystem.Version{version}, nil
+		}
+	}
+	return nil, fmt.Errorf("no results found")
+}
+
+func (s *dsSelector) IterVersions(opts filesystem.VersionOptions) filesystem.VersionIterator {
+	if s.follow || s.version != "" {
+		// A lineage spans several paths, and a single version needs no
+		// paging.
+		versions, err := s.Versions()
+		if err != nil {
+			return filesystem.FailedVersionIterator(err)
+		}
+		return index.NewVersionIterator(index.SlicePages(versions), selector.Range{}, opts)
+	}
+	return index.NewVersionIterator(s.pages, s.rng, opts)
+}
+
+// pages queries the entries of s.path in version order, n at a time.
+func (s *dsSelector) pages(newestFirst bool, after filesystem.Version, n int) ([]filesystem.Version, error) {
+	order := "Version"
+	if newestFirst {
+		order = "-Version"
+	}
+	cursor := after
+	var versions []filesystem.Version
+	for len(versions) < n {
+		q := NewQuery(entryKind).
+			WithAncestor(s.bucket.key).
+			Filter("Path", "=", s.path).
+			Filter("Kind", "=", s.kind()).
+			Order(order).
+			WithLimit(n)
+		if cursor != "" && newestFirst {
+			q = q.Filter("Version", "<", string(cursor))
+		} else if cursor != "" {
+			q = q.Filter("Version", ">", string(cursor))
+		}
+		batch, err := s.bucket.client().GetAll(s.bucket.ctx(), q)
+		if err != nil {
+			return nil, err
+		}
+		committed, err := s.commits.filter(batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range committed {
+			if !isRemoved(e) && len(versions) < n {
+				versions = append(versions, entryVersion(e))
+			}
+		}
+		if len(batch) < n {
+			break
+		}
+		cursor = entryVersion(batch[len(batch)-1])
+	}
+	return versions, nil
+}
+
+// errSelector fails every operation with the error hit while resolving the
+// selector.
+type errSelector struct {
+	err error
+}
+
+func (s *errSelector) List() ([]string, error) {
+	return nil, s.err
+}
+
+func (s *errSelector) BlobRef() (filesystem.StoredBlobRef, error) {
+	return filesystem.StoredBlobRef{}, s.err
+}
+
+func (s *errSelector) Versions() ([]filesystem.Version, error) {
+	return nil, s.err
+}
+
+func (s *errSelector) IterVersions(opts filesystem.VersionOptions) filesystem.VersionIterator {
+	return filesystem.FailedVersionIterator(s.err)
+}
+
+func (s *errSelector) Match() ([]filesystem.MatchedFile, error) {
+	return nil, s.err
+}
+
+func (s *errSelector) ListEntries(opts filesystem.ListOptions) (*filesystem.EntryPage, error) {
+	return nil, s.err
+}
+
+func (s *errSelector) Walk(fn filesystem.WalkFunc) error {
+	return s.err
+}
+
+func (s *errSelector) Diff(v1, v2 filesystem.Version) ([]filesystem.Change, error) {
+	return nil, s.err
+}
@@ -0,0 +1,296 @@
+package datastore_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/datastore"
+	"drivebackup/store/filesystem/datastore/mock"
+)
+
+// failingClient fails transactions, as a crash between writing a commit's
+// entries and its commit entity would.
+type failingClient struct {
+	*mock.MockClient
+	fail bool
+}
+
+func (c *failingClient) RunInTransaction(ctx context.Context, f func(tx datastore.Transaction) error) error {
+	if c.fail {
+		return errors.New("transaction failed")
+	}
+	return c.MockClient.RunInTransaction(ctx, f)
+}
+
+func TestInterruptedCommitIsInvisible(t *testing.T) {
+	client := &failingClient{MockClient: &mock.MockClient{}}
+	bucket := datastore.NewFilesystemService(context.Background(), client).Bucket("photos")
+
+	in1 := filesystem.BlobRef{Store: "store_a", Name: "abcd1"}
+	tx := bucket.NewPutTransaction()
+	tx.Dir("a").File("b", in1)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+
+	client.fail = true
+	tx = bucket.NewPutTransaction()
+	tx.Dir("a").File("b", filesystem.BlobRef{Store: "store_a", Name: "abcd2"})
+	tx.Dir("c")
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("expected commit to fail")
+	}
+	client.fail = false
+
+	versions, err := bucket.Select().Dir("a").File("b").Versions()
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got versions %v, %v, want one", versions, err)
+	}
+	ref, err := bucket.Select().Dir("a").File("b").Latest().BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref: %v", err)
+	}
+	if ref.BlobRef != in1 {
+		t.Errorf("got %v, want %v", ref.BlobRef, in1)
+	}
+	names, err := bucket.Select().List()
+	if err != nil || len(names) != 1 || names[0] != "a" {
+		t.Errorf("got listing %v, %v, want [a]", names, err)
+	}
+}
+
+// hookClient calls hook before the nth transaction, counting from 1.
+type hookClient struct {
+	*mock.MockClient
+	n     int
+	calls int
+	hook  func()
+}
+
+func (c *hookClient) RunInTransaction(ctx context.Context, f func(tx datastore.Transaction) error) error {
+	if c.calls++; c.calls == c.n {
+		c.hook()
+	}
+	return c.MockClient.RunInTransaction(ctx, f)
+}
+
+func TestConcurrentCommitsGetDistinctVersions(t *testing.T) {
+	client := &hookClient{MockClient: &mock.MockClient{}}
+	service := datastore.NewFilesystemService(context.Background(), client)
+	// A stopped clock makes every version the latest plus one.
+	service.Clock = &filesystem.StepClock{Start: time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)}
+	bucket := service.Bucket("photos")
+
+	newer := filesystem.BlobRef{Store: "store_a", Name: "newer"}
+	older := filesystem.BlobRef{Store: "store_a", Name: "older"}
+	// The second commit runs between the reservation and the publication
+	// of the first, so the first publishes the older version last.
+	client.n = 2
+	client.hook = func() {
+		tx := bucket.NewPutTransaction()
+		tx.Dir("a").File("b", newer)
+		if err := tx.Commit(); err != nil {
+			t.Errorf("error committing concurrently: %v", err)
+		}
+	}
+	tx := bucket.NewPutTransaction()
+	tx.Dir("a").File("b", older)
+	tx.Dir("c").File("d", older)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing the older version: %v", err)
+	}
+
+	versions, err := bucket.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+	if head, err := bucket.Head(); err != nil || head != versions[1] {
+		t.Errorf("got head %v, %v, want the newer version %v", head, err, versions[1])
+	}
+	if ref, err := bucket.Select().Dir("a").File("b").Latest().BlobRef(); err != nil || ref.BlobRef != newer {
+		t.Errorf("got %v, %v, want %v", &ref.BlobRef, err, &newer)
+	}
+	if names, err := bucket.Select().List(); err != nil || len(names) != 2 {
+		t.Errorf("got listing %v, %v, want [a c]", names, err)
+	}
+	for i, want := range []int{2, 1} {
+		commit, err := bucket.ExportCommit(versions[i])
+		if err != nil || len(commit.Files) != want {
+			t.Errorf("got commit %+v, %v, want %d files", commit, err, want)
+		}
+	}
+}
+
+func TestConcurrentCommitWithParentConflicts(t *testing.T) {
+	client := &hookClient{MockClient: &mock.MockClient{}}
+	bucket := datastore.NewFilesystemService(context.Background(), client).Bucket("photos")
+	tx := bucket.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "a1"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	parent, err := bucket.Head()
+	if err != nil {
+		t.Fatalf("error reading head: %v", err)
+	}
+
+	// Both commits are built against parent. The second one publishes
+	// between the reservation and the publication of the first.
+	client.calls, client.n = 0, 2
+	client.hook = func() {
+		tx := bucket.NewPutTransaction()
+		tx.SetParent(parent)
+		tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "won"})
+		if err := tx.Commit(); err != nil {
+			t.Errorf("error committing concurrently: %v", err)
+		}
+	}
+	tx = bucket.NewPutTransaction()
+	tx.SetParent(parent)
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "lost"})
+	err = tx.Commit()
+	if conflict, ok := err.(*filesystem.ConflictError); !ok || conflict.Parent != parent || !filesystem.IsConflict(err) {
+		t.Fatalf("got error %v, want a conflict with parent %v", err, parent)
+	}
+	if ref, err := bucket.Select().File("a").Latest().BlobRef(); err != nil || ref.BlobRef.Name != "won" {
+		t.Errorf("got %v, %v, want the concurrent commit's blob", &ref.BlobRef, err)
+	}
+	if versions, err := bucket.Select().Versions(); err != nil || len(versions) != 2 {
+		t.Errorf("got versions %v, %v, want two", versions, err)
+	}
+}
+
+// queryHookClient calls hook before every query of kind.
+type queryHookClient struct {
+	*mock.MockClient
+	kind string
+	hook func()
+}
+
+func (c *queryHookClient) GetAll(ctx context.Context, q *datastore.Query) ([]*datastore.Entity, error) {
+	if q.Kind == c.kind && c.hook != nil {
+		c.hook()
+	}
+	return c.MockClient.GetAll(ctx, q)
+}
+
+func TestExportCommitOfDeletedVersionFails(t *testing.T) {
+	client := &queryHookClient{MockClient: &mock.MockClient{}, kind: "Entry"}
+	bucket := datastore.NewFilesystemService(context.Background(), client).Bucket("photos")
+	for _, name := range []string{"a1", "a2"} {
+		tx := bucket.NewPutTransaction()
+		tx.Dir("a").File("b", filesystem.BlobRef{Store: "store_a", Name: name})
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+	versions, err := bucket.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+
+	// The first version is deleted between reading its commit entity and
+	// its entries.
+	client.hook = func() {
+		client.hook = nil
+		if err := bucket.DeleteVersions(versions[0]); err != nil {
+			t.Errorf("error deleting version: %v", err)
+		}
+	}
+	if c, err := bucket.ExportCommit(versions[0]); err == nil {
+		t.Errorf("got commit %+v of a deleted version, want an error", c)
+	}
+	if _, err := bucket.ExportCommit(versions[1]); err != nil {
+		t.Errorf("error exporting the remaining version: %v", err)
+	}
+}
+
+func TestIterVersionsReadsOnlyThePathsVersions(t *testing.T) {
+	client := &mock.MockClient{}
+	bucket := datastore.NewFilesystemService(context.Background(), client).Bucket("photos")
+	for i := 0; i < 300; i++ {
+		tx := bucket.NewPutTransaction()
+		name := "other"
+		if i%100 == 0 {
+			name = "a"
+		}
+		tx.File(name, filesystem.BlobRef{Store: "store_a", Name: fmt.Sprint(i)})
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+
+	before := client.Reads()
+	it := bucket.Select().File("a").IterVersions(filesystem.VersionOptions{NewestFirst: true, Limit: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := it.Next(); err != nil {
+			t.Fatalf("error iterating: %v", err)
+		}
+	}
+	// The three entries of "a" and the commits of their versions.
+	if reads := client.Reads() - before; reads > 6 {
+		t.Errorf("iterating two versions of one path read %d entities", reads)
+	}
+}
+
+func TestListingsReadBoundedEntries(t *testing.T) {
+	client := &mock.MockClient{}
+	bucket := datastore.NewFilesystemService(context.Background(), client).Bucket("photos")
+	// 20 files with 100 versions each.
+	for v := 0; v < 100; v++ {
+		tx := bucket.NewPutTransaction()
+		for i := 0; i < 20; i++ {
+			tx.Dir("d").File(fmt.Sprintf("f%02d", i), filesystem.BlobRef{Store: "store_a", Name: fmt.Sprint(v)})
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		maxReads int
+		read     func() (int, error)
+	}{
+		{"ListEntries", 40, func() (int, error) {
+			page, err := bucket.Select().Dir("d").ListEntries(filesystem.ListOptions{Limit: 3})
+			if err != nil {
+				return 0, err
+			}
+			return len(page.Entries), nil
+		}},
+		{"List", 100, func() (int, error) {
+			names, err := bucket.Select().Dir("d").List()
+			return len(names), err
+		}},
+		{"Walk", 100, func() (int, error) {
+			n := 0
+			err := bucket.Select().Dir("d").Walk(func(filesystem.WalkEntry) error {
+				n++
+				return nil
+			})
+			return n, err
+		}},
+		{"Match", 100, func() (int, error) {
+			files, err := bucket.Select().Dir("d").Glob("f1*").Match()
+			return len(files), err
+		}},
+	} {
+		before := client.Reads()
+		n, err := test.read()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if n == 0 {
+			t.Errorf("%s found nothing", test.name)
+		}
+		if reads := client.Reads() - before; reads > test.maxReads {
+			t.Errorf("%s of %d entries read %d entities, want at most %d", test.name, n, reads, test.maxReads)
+		}
+	}
+}
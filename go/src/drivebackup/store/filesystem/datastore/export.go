@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/index"
+)
+
+// ExportCommit reads the commit back from its commit entity and the entries
+// written at its version. Only committed versions are exported. Versions are
+// reserved before their entries are written, so the entries at a committed
+// version are all its commit's: those left behind by a failed commit are at
+// a version without a commit entity. DeleteVersions removes the commit
+// entity before the entries, so it is read again after them, and a version
+// deleted meanwhile isn't exported with part of its entries.
+func (b *dsBucket) ExportCommit(version filesystem.Version) (*filesystem.Commit, error) {
+	commit, err := b.client().Get(b.ctx(), b.commitKey(version))
+	if err == ErrNoSuchEntity {
+		return nil, fmt.Errorf("no version %q", version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := snapshotOf(commit)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := b.client().GetAll(b.ctx(), NewQuery(entryKind).
+		WithAncestor(b.key).
+		Filter("Version", "=", string(version)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.client().Get(b.ctx(), b.commitKey(version)); err == ErrNoSuchEntity {
+		return nil, fmt.Errorf("version %q was deleted while exporting it", version)
+	} else if err != nil {
+		return nil, err
+	}
+	c := &filesystem.Commit{Snapshot: snapshot}
+	removed := map[string]bool{}
+	for _, e := range entries {
+		path := e.Properties["Path"].(string)
+		if isRemoved(e) {
+			removed[path] = true
+			continue
+		}
+		if e.Properties["Kind"] == fileEntry {
+			ref, err := storedBlobRefOf(e)
+			if err != nil {
+				return nil, err
+			}
+			c.Files = append(c.Files, filesystem.CommittedFile{Path: path, BlobRef: ref.BlobRef, Metadata: ref.Metadata})
+		} else {
+			c.Dirs = append(c.Dirs, path)
+		}
+		if from, _ := e.Properties["MovedFrom"].(string); from != "" {
+			c.Renames = append(c.Renames, filesystem.Rename{From: from, To: path})
+		}
+	}
+	for path := range removed {
+		c.Removed = append(c.Removed, path)
+	}
+	sort.Strings(c.Dirs)
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Path < c.Files[j].Path })
+	sort.Strings(c.Removed)
+	sort.Slice(c.Renames, func(i, j int) bool { return c.Renames[i].To < c.Renames[j].To })
+	return c, nil
+}
+
+// ImportCommit writes the commit like a transaction, with tombstones for
+// the kinds of entry each removed path has in the newest committed state.
+// Its version must also be newer than any reserved by a failed commit.
+func (b *dsBucket) ImportCommit(c *filesystem.Commit) error {
+	commits := b.commits()
+	live := map[string][]string{}
+	for _, path := range c.Removed {
+		nodes, err := b.liveNodes(path, commits)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if node.Path != path {
+				continue
+			}
+			kind := dirEntry
+			if node.IsFile {
+				kind = fileEntry
+			}
+			live[path] = append(live[path], kind)
+		}
+	}
+	_, err := b.reserve(func(newest filesystem.Version) (filesystem.Version, error) {
+		return c.Snapshot.Version, index.CheckImport(c, newest)
+	})
+	if err != nil {
+		return err
+	}
+	return b.write(index.RecordOf(c), live)
+}
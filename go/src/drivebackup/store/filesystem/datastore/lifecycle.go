@@ -0,0 +1,189 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"drivebackup/store/filesystem"
+)
+
+// A bucket exists while its bucket entity does. CreateBucket writes it with
+// the bucket's metadata, and the first commit to a bucket writes it if it
+// is missing.
+
+func (s *FilesystemService) dsBucket(name string) *dsBucket {
+	return s.Bucket(name).(*dsBucket)
+}
+
+func bucketInfoOf(e *Entity) filesystem.BucketInfo {
+	return filesystem.BucketInfo{
+		Name:        e.Key.Name,
+		Description: e.Properties["Description"].(string),
+		Owner:       e.Properties["Owner"].(string),
+		Created:     e.Properties["Created"].(time.Time),
+	}
+}
+
+func (s *FilesystemService) Buckets() ([]filesystem.BucketInfo, error) {
+	buckets, err := s.client.GetAll(s.ctx, NewQuery(bucketKind))
+	if err != nil {
+		return nil, err
+	}
+	var infos []filesystem.BucketInfo
+	for _, bucket := range buckets {
+		if bucket.Key.Parent == nil {
+			infos = append(infos, bucketInfoOf(bucket))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *FilesystemService) CreateBucket(name string, opts filesystem.BucketOptions) (filesystem.Bucket, error) {
+	if name == "" {
+		return nil, errors.New("empty bucket name")
+	}
+	b := s.dsBucket(name)
+	created := opts.Created
+	if created.IsZero() {
+		created = b.clock().Now()
+	}
+	err := s.client.RunInTransaction(s.ctx, func(tx Transaction) error {
+		if _, err := tx.Get(b.key); err == nil {
+			return filesystem.ErrBucketExists
+		} else if err != ErrNoSuchEntity {
+			return err
+		}
+		return tx.PutMulti([]*Entity{{
+			Key: b.key,
+			Properties: map[string]interface{}{
+				"Description": opts.Description,
+				"Owner":       opts.Owner,
+				"Created":     created,
+			},
+		}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *FilesystemService) DescribeBucket(name string) (filesystem.BucketInfo, error) {
+	bucket, err := s.client.Get(s.ctx, s.dsBucket(name).key)
+	if err == ErrNoSuchEntity {
+		return filesystem.BucketInfo{}, filesystem.ErrNoSuchBucket
+	}
+	if err != nil {
+		return filesystem.BucketInfo{}, err
+	}
+	return bucketInfoOf(bucket), nil
+}
+
+// RenameBucket copies the entries and commits of the bucket under the new
+// name, then its bucket entity, and deletes the old bucket. If interrupted,
+// the versions copied so far are visible under the new name although the
+// bucket isn't listed yet, and the rename can be retried.
+func (s *FilesystemService) RenameBucket(from, to string) error {
+	if to == "" {
+		return errors.New("empty bucket name")
+	}
+	if from == to {
+		return filesystem.ErrBucketExists
+	}
+	src, dst := s.dsBucket(from), s.dsBucket(to)
+	bucket, err := s.client.Get(s.ctx, src.key)
+	if err == ErrNoSuchEntity {
+		return filesystem.ErrNoSuchBucket
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.Get(s.ctx, dst.key); err == nil {
+		return filesystem.ErrBucketExists
+	} else if err != ErrNoSuchEntity {
+		return err
+	}
+	// Entries are copied first, as they are only visible once their commit
+	// is.
+	for _, kind := range []string{entryKind, commitKind, refKind} {
+		entities, err := s.client.GetAll(s.ctx, NewQuery(kind).WithAncestor(src.key))
+		if err != nil {
+			return err
+		}
+		copies := make([]*Entity, len(entities))
+		for i, e := range entities {
+			copies[i] = &Entity{Key: &Key{Kind: e.Key.Kind, Name: e.Key.Name, Parent: dst.key}, Properties: e.Properties}
+		}
+		if err := dst.putEntities(copies); err != nil {
+			return err
+		}
+	}
+	// The versions reserved by the bucket move with it, as entries of
+	// failed commits under them were copied too.
+	var reserved filesystem.Version
+	err = s.client.RunInTransaction(s.ctx, func(tx Transaction) error {
+		var err error
+		reserved, err = src.newestVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dst.reserve(func(newest filesystem.Version) (filesystem.Version, error) {
+		if newest != "" && newest.Compare(reserved) > 0 {
+			return newest, nil
+		}
+		return reserved, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = s.client.RunInTransaction(s.ctx, func(tx Transaction) error {
+		if _, err := tx.Get(dst.key); err == nil {
+			return filesystem.ErrBucketExists
+		} else if err != ErrNoSuchEntity {
+			return err
+		}
+		return tx.PutMulti([]*Entity{{Key: dst.key, Properties: bucket.Properties}})
+	})
+	if err != nil {
+		return err
+	}
+	return src.deleteAll()
+}
+
+func (s *FilesystemService) DeleteBucket(name, confirm string) error {
+	if confirm != name {
+		return filesystem.ErrNotConfirmed
+	}
+	b := s.dsBucket(name)
+	if _, err := s.client.Get(s.ctx, b.key); err == ErrNoSuchEntity {
+		return filesystem.ErrNoSuchBucket
+	} else if err != nil {
+		return err
+	}
+	return b.deleteAll()
+}
+
+// deleteAll deletes the refs and commits of the bucket, which hides its
+// versions at once, then its entries and the bucket entity. The reservation
+// entity is kept, so that commits recreating the bucket still get newer
+// versions.
+func (b *dsBucket) deleteAll() error {
+	for _, kind := range []string{refKind, commitKind, entryKind} {
+		entities, err := b.client().GetAll(b.ctx(), NewQuery(kind).WithAncestor(b.key).WithKeysOnly())
+		if err != nil {
+			return err
+		}
+		keys := make([]*Key, len(entities))
+		for i, e := range entities {
+			keys[i] = e.Key
+		}
+		if err := b.deleteKeys(keys); err != nil {
+			return err
+		}
+	}
+	return b.client().DeleteMulti(b.ctx(), []*Key{b.key})
+}
@@ -0,0 +1,286 @@
+package mock
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"drivebackup/store/filesystem/datastore"
+)
+
+// MockClient is an in-process stand-in for Cloud Datastore. Queries are
+// strongly consistent and transactions are serialized.
+type MockClient struct {
+	mu       sync.Mutex
+	entities map[string]*datastore.Entity
+	reads    int
+}
+
+var _ datastore.Client = (*MockClient)(nil)
+
+func (m *MockClient) Get(ctx context.Context, key *datastore.Key) (*datastore.Entity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(key)
+}
+
+func (m *MockClient) get(key *datastore.Key) (*datastore.Entity, error) {
+	e, ok := m.entities[key.String()]
+	if !ok {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	m.reads++
+	return copyEntity(e, false), nil
+}
+
+func (m *MockClient) GetMulti(ctx context.Context, keys []*datastore.Key) ([]*datastore.Entity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(keys) > datastore.MaxBatchSize {
+		return nil, fmt.Errorf("too many keys in one call: %d", len(keys))
+	}
+	entities := make([]*datastore.Entity, len(keys))
+	for i, key := range keys {
+		e, err := m.get(key)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		entities[i] = e
+	}
+	return entities, nil
+}
+
+// Reads returns the number of entities read so far, by lookups and
+// queries.
+func (m *MockClient) Reads() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reads
+}
+
+func (m *MockClient) GetAll(ctx context.Context, q *datastore.Query) ([]*datastore.Entity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var results []*datastore.Entity
+	for _, e := range m.entities {
+		ok, err := matches(e, q)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results = append(results, e)
+		}
+	}
+	var sortErr error
+	sort.Slice(results, func(i, j int) bool {
+		for _, order := range q.Orders {
+			property := strings.TrimPrefix(order, "-")
+			c, err := compare(results[i].Properties[property], results[j].Properties[property])
+			if err != nil {
+				sortErr = err
+			}
+			if c != 0 {
+				return (c < 0) != strings.HasPrefix(order, "-")
+			}
+		}
+		return results[i].Key.String() < results[j].Key.String()
+	})
+	if sortErr != nil {
+		return nil, sortErr
+	}
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	for i, e := range results {
+		results[i] = copyEntity(e, q.KeysOnly)
+	}
+	m.reads += len(results)
+	return results, nil
+}
+
+func (m *MockClient) PutMulti(ctx context.Context, entities []*datastore.Entity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.putMulti(entities)
+}
+
+func (m *MockClient) putMulti(entities []*datastore.Entity) error {
+	if len(entities) > datastore.MaxBatchSize {
+		return fmt.Errorf("too many entities in one call: %d", len(entities))
+	}
+	for _, e := range entities {
+		for name, value := range e.Properties {
+			switch value.(type) {
+			case string, int64, bool, time.Time:
+			default:
+				return fmt.Errorf("property %q has unsupported type %T", name, value)
+			}
+		}
+	}
+	if m.entities == nil {
+		m.entities = map[string]*datastore.Entity{}
+	}
+	for _, e := range entities {
+		m.entities[e.Key.String()] = copyEntity(e, false)
+	}
+	return nil
+}
+
+func (m *MockClient) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteMulti(keys)
+	return nil
+}
+
+func (m *MockClient) deleteMulti(keys []*datastore.Key) {
+	for _, key := range keys {
+		delete(m.entities, key.String())
+	}
+}
+
+// RunInTransaction holds the client lock while f runs and applies its writes
+// only if f succeeds.
+func (m *MockClient) RunInTransaction(ctx context.Context, f func(tx datastore.Transaction) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := &mockTransaction{client: m}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for _, op := range tx.ops {
+		if err := op(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type mockTransaction struct {
+	client *MockClient
+	ops    []func() error
+}
+
+func (tx *mockTransaction) Get(key *datastore.Key) (*datastore.Entity, error) {
+	return tx.client.get(key)
+}
+
+func (tx *mockTransaction) PutMulti(entities []*datastore.Entity) error {
+	var copies []*datastore.Entity
+	for _, e := range entities {
+		copies = append(copies, copyEntity(e, false))
+	}
+	tx.ops = append(tx.ops, func() error { return tx.client.putMulti(copies) })
+	return nil
+}
+
+func (tx *mockTransaction) DeleteMulti(keys []*datastore.Key) error {
+	tx.ops = append(tx.ops, func() error {
+		tx.client.deleteMulti(keys)
+		return nil
+	})
+	return nil
+}
+
+func copyEntity(e *datastore.Entity, keysOnly bool) *datastore.Entity {
+	c := &datastore.Entity{Key: e.Key, Properties: map[string]interface{}{}}
+	if !keysOnly {
+		for name, value := range e.Properties {
+			c.Properties[name] = value
+		}
+	}
+	return c
+}
+
+func matches(e *datastore.Entity, q *datastore.Query) (bool, error) {
+	if e.Key.Kind != q.Kind {
+		return false, nil
+	}
+	if q.Ancestor != nil && !e.Key.HasAncestor(q.Ancestor) {
+		return false, nil
+	}
+	for _, filter := range q.Filters {
+		value, ok := e.Properties[filter.Property]
+		if !ok {
+			return false, nil
+		}
+		c, err := compare(value, filter.Value)
+		if err != nil {
+			return false, err
+		}
+		var match bool
+		switch filter.Op {
+		case "=":
+			match = c == 0
+		case "<":
+			match = c < 0
+		case "<=":
+			match = c <= 0
+		case ">":
+			match = c > 0
+		case ">=":
+			match = c >= 0
+		default:
+			return false, fmt.Errorf("unsupported filter operator %q", filter.Op)
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compare orders two property values of the same type. Missing values sort
+// first.
+func compare(a, b interface{}) (int, error) {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0, nil
+		case a == nil:
+			return -1, nil
+		default:
+			return 1, nil
+		}
+	}
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	case int64:
+		if b, ok := b.(int64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, nil
+			case !a:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1, nil
+			case a.After(b):
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %T with %T", a, b)
+}
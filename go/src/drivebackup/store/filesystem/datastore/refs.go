@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+
+	"drivebackup/store/filesystem"
+)
+
+func (b *dsBucket) refKey(name string) *Key {
+	return &Key{Kind: refKind, Name: name, Parent: b.key}
+}
+
+func (b *dsBucket) SetRef(name string, version filesystem.Version) error {
+	if name == "" {
+		return fmt.Errorf("empty ref name")
+	}
+	return b.client().RunInTransaction(b.ctx(), func(tx Transaction) error {
+		if _, err := tx.Get(b.commitKey(version)); err == ErrNoSuchEntity {
+			return fmt.Errorf("no version %q", version)
+		} else if err != nil {
+			return err
+		}
+		return tx.PutMulti([]*Entity{{
+			Key:        b.refKey(name),
+			Properties: map[string]interface{}{"Version": string(version)},
+		}})
+	})
+}
+
+func (b *dsBucket) Ref(name string) (filesystem.Version, error) {
+	ref, err := b.client().Get(b.ctx(), b.refKey(name))
+	if err == ErrNoSuchEntity {
+		return "", fmt.Errorf("no ref %q", name)
+	}
+	if err != nil {
+		return "", err
+	}
+	version, _ := ref.Properties["Version"].(string)
+	return filesystem.Version(version), nil
+}
+
+func (b *dsBucket) Refs() ([]filesystem.Ref, error) {
+	entities, err := b.client().GetAll(b.ctx(), NewQuery(refKind).WithAncestor(b.key))
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]filesystem.Ref, 0, len(entities))
+	for _, e := range entities {
+		version, _ := e.Properties["Version"].(string)
+		refs = append(refs, filesystem.Ref{Name: e.Key.Name, Version: filesystem.Version(version)})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs, nil
+}
+
+func (b *dsBucket) DeleteRef(name string) error {
+	return b.client().RunInTransaction(b.ctx(), func(tx Transaction) error {
+		if _, err := tx.Get(b.refKey(name)); err == ErrNoSuchEntity {
+			return fmt.Errorf("no ref %q", name)
+		} else if err != nil {
+			return err
+		}
+		return tx.DeleteMulti([]*Key{b.refKey(name)})
+	})
+}
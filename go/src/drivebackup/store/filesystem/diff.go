@@ -0,0 +1,40 @@
+package filesystem
+
+import "fmt"
+
+// ChangeKind says how a path differs between two versions.
+type ChangeKind int
+
+const (
+	Added       ChangeKind = iota // only in the newer version
+	Removed                       // only in the older version
+	Modified                      // a file of the same type with different content or link target
+	TypeChanged                   // a file became a dir or the reverse, or its FileType changed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case TypeChanged:
+		return "type changed"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
+
+// Change is a path that differs between two versions. Old is nil for added
+// paths and New for removed ones.
+type Change struct {
+	Path string
+	Kind ChangeKind
+	Old  *WalkEntry
+	New  *WalkEntry
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s", c.Kind, c.Path)
+}
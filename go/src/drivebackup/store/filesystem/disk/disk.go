@@ -0,0 +1,300 @@
+// Package disk implements a filesystem.FilesystemService persisted in a
+// directory on local disk, so that version history survives restarts.
+//
+// Every commit, deletion of versions, change to a ref and change to a
+// bucket's existence is appended to a checksummed journal and fsynced before
+// it becomes visible. On open the journal is replayed into an in-memory
+// index; a commit interrupted by a crash is discarded as a whole. Once most
+// of the journal is superseded, e.g. by deleted versions and buckets, Open
+// compacts it into a checkpoint of each bucket's current state.
+//
+// A directory is used by one service at a time: Open locks it until Close.
+package disk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/index"
+)
+
+const (
+	journalFile = "journal"
+	lockFile    = "lock"
+)
+
+// entry is the journal payload. Exactly one of the operation fields is set.
+type entry struct {
+	Bucket       string
+	Commit       *index.Record          `json:",omitempty"`
+	Delete       *index.Deletion        `json:",omitempty"`
+	Ref          *index.RefUpdate       `json:",omitempty"`
+	Create       *filesystem.BucketInfo `json:",omitempty"`
+	RenameTo     string                 `json:",omitempty"`
+	DeleteBucket bool                   `json:",omitempty"`
+	// Checkpoint and Version restore a bucket in a compacted journal.
+	Checkpoint *index.Checkpoint     `json:",omitempty"`
+	Version    *index.VersionEntries `json:",omitempty"`
+}
+
+type FilesystemService struct {
+	// Clock assigns versions; it defaults to filesystem.SystemClock. Set it
+	// before committing.
+	Clock filesystem.Clock
+
+	mu        sync.Mutex
+	lifecycle sync.Mutex // serializes creating, renaming and deleting buckets
+	journal   *journal
+	lock      *os.File
+	buckets   map[string]*index.Bucket
+}
+
+var _ filesystem.FilesystemService = (*FilesystemService)(nil)
+
+// Open opens the service stored in dir, creating it if necessary. It fails
+// if another service has dir open.
+func Open(dir string) (*FilesystemService, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	s := &FilesystemService{buckets: map[string]*index.Bucket{}, lock: lock}
+	j, err := openJournal(filepath.Join(dir, journalFile), s.replay)
+	if err == nil {
+		s.journal = j
+		err = s.compactIfSuperseded()
+	}
+	if err != nil {
+		if j != nil {
+			j.close()
+		}
+		unlockDir(lock)
+		return nil, err
+	}
+	return s, nil
+}
+
+// compactIfSuperseded rewrites the journal as checkpoints if they take
+// less than half of its frames. s must not yet be shared.
+func (s *FilesystemService) compactIfSuperseded() error {
+	entries := s.checkpoints()
+	if s.journal.frames <= 2*len(entries) {
+		return nil
+	}
+	return s.journal.rewrite(entries)
+}
+
+// checkpoints returns the entries that restore every bucket.
+// s.mu must be held, or s must not yet be shared.
+func (s *FilesystemService) checkpoints() []interface{} {
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var entries []interface{}
+	for _, name := range names {
+		cp, versions := s.buckets[name].Checkpoint()
+		if cp == nil {
+			continue
+		}
+		entries = append(entries, &entry{Bucket: name, Checkpoint: cp})
+		for _, version := range versions {
+			entries = append(entries, &entry{Bucket: name, Version: version})
+		}
+	}
+	return entries
+}
+
+func (s *FilesystemService) replay(payload []byte) error {
+	var e entry
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return err
+	}
+	switch {
+	case e.Commit != nil:
+		s.bucket(e.Bucket).Apply(e.Commit)
+	case e.Delete != nil:
+		s.bucket(e.Bucket).ApplyDeletion(e.Delete)
+	case e.Ref != nil:
+		s.bucket(e.Bucket).ApplyRef(e.Ref)
+	case e.Create != nil:
+		s.bucket(e.Bucket).ApplyCreate(*e.Create)
+	case e.RenameTo != "":
+		s.bucket(e.Bucket).ApplyMoveTo(s.bucket(e.RenameTo))
+	case e.DeleteBucket:
+		s.bucket(e.Bucket).ApplyDelete()
+	case e.Checkpoint != nil:
+		s.bucket(e.Bucket).ApplyCheckpoint(e.Checkpoint)
+	case e.Version != nil:
+		s.bucket(e.Bucket).ApplyVersionEntries(e.Version)
+	default:
+		return fmt.Errorf("unknown journal entry for bucket %q", e.Bucket)
+	}
+	return nil
+}
+
+// Close closes the journal and unlocks the directory. Later commits fail.
+func (s *FilesystemService) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.close()
+	if uerr := unlockDir(s.lock); err == nil {
+		err = uerr
+	}
+	s.journal = nil
+	return err
+}
+
+// append writes an entry to the journal.
+func (s *FilesystemService) append(e *entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return fmt.Errorf("filesystem service is closed")
+	}
+	return s.journal.append(e)
+}
+
+func (s *FilesystemService) Bucket(bucket string) filesystem.Bucket {
+	return s.lockedBucket(bucket)
+}
+
+func (s *FilesystemService) lockedBucket(name string) *index.Bucket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bucket(name)
+}
+
+// bucket returns the index of a bucket, creating it if necessary.
+// s.mu must be held, or s must not yet be shared.
+func (s *FilesystemService) bucket(name string) *index.Bucket {
+	if b, ok := s.buckets[name]; ok {
+		return b
+	}
+	b := index.NewBucket()
+	b.Clock = serviceClock{s}
+	b.Name = name
+	b.Persist = func(rec *index.Record) error {
+		return s.append(&entry{Bucket: name, Commit: rec})
+	}
+	b.PersistDeletion = func(del *index.Deletion) error {
+		return s.append(&entry{Bucket: name, Delete: del})
+	}
+	b.PersistRef = func(update *index.RefUpdate) error {
+		return s.append(&entry{Bucket: name, Ref: update})
+	}
+	s.buckets[name] = b
+	return b
+}
+
+func (s *FilesystemService) Buckets() ([]filesystem.BucketInfo, error) {
+	s.mu.Lock()
+	buckets := make([]*index.Bucket, 0, len(s.buckets))
+	for _, b := range s.buckets {
+		buckets = append(buckets, b)
+	}
+	s.mu.Unlock()
+	var infos []filesystem.BucketInfo
+	for _, b := range buckets {
+		if info, ok := b.Info(); ok {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *FilesystemService) CreateBucket(name string, opts filesystem.BucketOptions) (filesystem.Bucket, error) {
+	if name == "" {
+		return nil, errors.New("empty bucket name")
+	}
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	b := s.lockedBucket(name)
+	info := filesystem.BucketInfo{Description: opts.Description, Owner: opts.Owner, Created: opts.Created}
+	if info.Created.IsZero() {
+		info.Created = serviceClock{s}.Now()
+	}
+	err := b.Create(info, func() error {
+		return s.append(&entry{Bucket: name, Create: &info})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *FilesystemService) DescribeBucket(name string) (filesystem.BucketInfo, error) {
+	info, ok := s.lockedBucket(name).Info()
+	if !ok {
+		return filesystem.BucketInfo{}, filesystem.ErrNoSuchBucket
+	}
+	return info, nil
+}
+
+func (s *FilesystemService) RenameBucket(from, to string) error {
+	if to == "" {
+		return errors.New("empty bucket name")
+	}
+	if from == to {
+		return filesystem.ErrBucketExists
+	}
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	return s.lockedBucket(from).MoveTo(s.lockedBucket(to), func() error {
+		return s.append(&entry{Bucket: from, RenameTo: to})
+	})
+}
+
+func (s *FilesystemService) DeleteBucket(name, confirm string) error {
+	if confirm != name {
+		return filesystem.ErrNotConfirmed
+	}
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+	return s.lockedBucket(name).Delete(func() error {
+		return s.append(&entry{Bucket: name, DeleteBucket: true})
+	})
+}
+
+// serviceClock reads the clock of a service when it is used, as buckets are
+// created when the journal is replayed, before a clock can be injected.
+type serviceClock struct {
+	s *FilesystemService
+}
+
+func (c serviceClock) Now() time.Time {
+	if c.s.Clock != nil {
+		return c.s.Clock.Now()
+	}
+	return filesystem.SystemClock.Now()
+}
+
+func (s *FilesystemService) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	str := "buckets:\n"
+	for _, name := range names {
+		str += fmt.Sprintf("%q:\n%v\n", name, s.buckets[name])
+	}
+	return str
+}
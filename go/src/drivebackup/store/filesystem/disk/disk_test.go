@@ -0,0 +1,418 @@
+package disk_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/disk"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "disk_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	return dir
+}
+
+func open(t *testing.T, dir string) *disk.FilesystemService {
+	service, err := disk.Open(dir)
+	if err != nil {
+		t.Fatalf("error opening %s: %v", dir, err)
+	}
+	return service
+}
+
+func commitFile(t *testing.T, service filesystem.FilesystemService, bucket, dir, name string, ref filesystem.BlobRef) {
+	tx := service.Bucket(bucket).NewPutTransaction()
+	tx.Dir(dir).File(name, ref)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing %s/%s: %v", dir, name, err)
+	}
+}
+
+func expectVersions(t *testing.T, service filesystem.FilesystemService, bucket, dir, name string, n int) []filesystem.Version {
+	versions, err := service.Bucket(bucket).Select().Dir(dir).File(name).Versions()
+	if err != nil {
+		t.Fatalf("error fetching versions: %v", err)
+	}
+	if len(versions) != n {
+		t.Fatalf("got versions %v, want %d", versions, n)
+	}
+	return versions
+}
+
+func expectLatest(t *testing.T, service filesystem.FilesystemService, bucket, dir, name string, want filesystem.BlobRef) {
+	ref, err := service.Bucket(bucket).Select().Dir(dir).File(name).Latest().BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref: %v", err)
+	}
+	if ref.BlobRef != want {
+		t.Errorf("got %v, want %v", ref.BlobRef, want)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "abcd2"}
+	service := open(t, dir)
+	commitFile(t, service, "photos", "a/b", "c", ref1)
+	commitFile(t, service, "photos", "a/b", "c", ref2)
+	commitFile(t, service, "docs", "x", "y", ref1)
+	before := expectVersions(t, service, "photos", "a/b", "c", 2)
+	if err := service.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+
+	tx := service.Bucket("photos").NewPutTransaction()
+	tx.File("d", ref1)
+	if err := tx.Commit(); err == nil {
+		t.Errorf("expected error committing to closed service")
+	}
+
+	service = open(t, dir)
+	defer service.Close()
+	after := expectVersions(t, service, "photos", "a/b", "c", 2)
+	if !reflect.DeepEqual(before, after) {
+		t.Errorf("versions changed across reopen: %v vs %v", before, after)
+	}
+	expectLatest(t, service, "photos", "a/b", "c", ref2)
+	expectLatest(t, service, "docs", "x", "y", ref1)
+	snapshots, err := service.Bucket("photos").Snapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[1].Version != before[1] || snapshots[1].Files != 1 {
+		t.Errorf("got snapshots %+v, %v, want two", snapshots, err)
+	}
+
+	names, err := service.Bucket("photos").Select().Latest().List()
+	if err != nil || !reflect.DeepEqual(names, []string{"a"}) {
+		t.Errorf("got listing %v, %v, want [a]", names, err)
+	}
+
+	// New commits after reopening get newer versions.
+	commitFile(t, service, "photos", "a/b", "c", ref1)
+	versions := expectVersions(t, service, "photos", "a/b", "c", 3)
+	if versions[2] <= versions[1] {
+		t.Errorf("version after reopen %v not newer than %v", versions[2], versions[1])
+	}
+}
+
+func TestMovesAndRemovalsSurviveReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "abcd1"}
+	service := open(t, dir)
+	commitFile(t, service, "photos", "a", "b", ref1)
+	commitFile(t, service, "photos", "x", "y", ref1)
+	tx := service.Bucket("photos").NewPutTransaction()
+	tx.Move("a", "c")
+	tx.RemoveAll("x")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if err := service.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+
+	service = open(t, dir)
+	defer service.Close()
+	names, err := service.Bucket("photos").Select().List()
+	if err != nil || !reflect.DeepEqual(names, []string{"c"}) {
+		t.Errorf("got listing %v, %v, want [c]", names, err)
+	}
+	versions, err := service.Bucket("photos").Select().Dir("c").File("b").Follow().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Errorf("got versions %v, %v, want two", versions, err)
+	}
+}
+
+func TestDeletionSurvivesReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "abcd2"}
+	service := open(t, dir)
+	commitFile(t, service, "photos", "a", "b", ref1)
+	commitFile(t, service, "photos", "a", "b", ref2)
+	versions := expectVersions(t, service, "photos", "a", "b", 2)
+	if err := service.Bucket("photos").DeleteVersions(versions[1]); err != nil {
+		t.Fatalf("error deleting version: %v", err)
+	}
+	if err := service.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+
+	service = open(t, dir)
+	defer service.Close()
+	expectVersions(t, service, "photos", "a", "b", 1)
+	expectLatest(t, service, "photos", "a", "b", ref1)
+	commitFile(t, service, "photos", "a", "b", ref2)
+	after := expectVersions(t, service, "photos", "a", "b", 2)
+	if after[1].Compare(versions[1]) <= 0 {
+		t.Errorf("version after reopen %v not newer than deleted %v", after[1], versions[1])
+	}
+}
+
+func TestBucketLifecycleSurvivesReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "abcd1"}
+	service := open(t, dir)
+	if _, err := service.CreateBucket("photos", filesystem.BucketOptions{Owner: "alice"}); err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	commitFile(t, service, "photos", "a", "b", ref1)
+	commitFile(t, service, "docs", "a", "b", ref1)
+	tagged := expectVersions(t, service, "photos", "a", "b", 1)[0]
+	if err := service.Bucket("photos").SetRef("pre-migration", tagged); err != nil {
+		t.Fatalf("error setting ref: %v", err)
+	}
+	if err := service.RenameBucket("photos", "pictures"); err != nil {
+		t.Fatalf("error renaming bucket: %v", err)
+	}
+	if err := service.DeleteBucket("docs", "docs"); err != nil {
+		t.Fatalf("error deleting bucket: %v", err)
+	}
+	want, err := service.Buckets()
+	if err != nil {
+		t.Fatalf("error listing buckets: %v", err)
+	}
+	if err := service.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+
+	service = open(t, dir)
+	defer service.Close()
+	got, err := service.Buckets()
+	if err != nil || len(got) != 1 || got[0].Name != "pictures" || got[0].Owner != "alice" || !got[0].Created.Equal(want[0].Created) {
+		t.Errorf("got buckets %+v, %v after reopen, want %+v", got, err, want)
+	}
+	expectLatest(t, service, "pictures", "a", "b", ref1)
+	if version, err := service.Bucket("pictures").Ref("pre-migration"); err != nil || version != tagged {
+		t.Errorf("got ref %q, %v after reopen, want %q", version, err, tagged)
+	}
+}
+
+func TestTornWriteIsDiscarded(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "abcd2"}
+	service := open(t, dir)
+	commitFile(t, service, "photos", "a", "b", ref1)
+	info, err := os.Stat(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatalf("error reading journal: %v", err)
+	}
+	commitFile(t, service, "photos", "a", "b", ref2)
+	service.Close()
+
+	// Cut the last commit short, as a crash during its write would.
+	journal := filepath.Join(dir, "journal")
+	if err := os.Truncate(journal, info.Size()+5); err != nil {
+		t.Fatalf("error truncating journal: %v", err)
+	}
+
+	service = open(t, dir)
+	expectVersions(t, service, "photos", "a", "b", 1)
+	expectLatest(t, service, "photos", "a", "b", ref1)
+
+	// The torn frame is gone, so later commits are replayed after reopening.
+	commitFile(t, service, "photos", "a", "b", ref2)
+	service.Close()
+	service = open(t, dir)
+	defer service.Close()
+	expectVersions(t, service, "photos", "a", "b", 2)
+	expectLatest(t, service, "photos", "a", "b", ref2)
+}
+
+func TestCorruptTailIsDiscarded(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	ref := filesystem.BlobRef{Store: "store_a", Name: "abcd"}
+	service := open(t, dir)
+	commitFile(t, service, "photos", "a", "b", ref)
+	service.Close()
+
+	f, err := os.OpenFile(filepath.Join(dir, "journal"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("error opening journal: %v", err)
+	}
+	// A frame header promising 16 bytes with a bad checksum.
+	f.Write([]byte{0, 0, 0, 16, 1, 2, 3, 4, '{', '}', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Close()
+
+	service = open(t, dir)
+	defer service.Close()
+	expectVersions(t, service, "photos", "a", "b", 1)
+	expectLatest(t, service, "photos", "a", "b", ref)
+}
+
+func TestCorruptFrameBeforeOthersFailsOpen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	service := open(t, dir)
+	commitFile(t, service, "photos", "a", "b", filesystem.BlobRef{Store: "store_a", Name: "abcd1"})
+	commitFile(t, service, "photos", "a", "b", filesystem.BlobRef{Store: "store_a", Name: "abcd2"})
+	service.Close()
+
+	// Flip a byte in the payload of the first frame.
+	journal := filepath.Join(dir, "journal")
+	data, err := ioutil.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("error reading journal: %v", err)
+	}
+	data[len("drivebackup filesystem journal v1\n")+8+1] ^= 0xff
+	if err := ioutil.WriteFile(journal, data, 0600); err != nil {
+		t.Fatalf("error writing journal: %v", err)
+	}
+
+	if _, err := disk.Open(dir); err == nil {
+		t.Fatalf("expected an error opening a journal with a corrupt frame before others")
+	}
+	// The commits after the corrupt frame are kept for recovery.
+	if after, err := ioutil.ReadFile(journal); err != nil || len(after) != len(data) {
+		t.Errorf("journal was cut from %d to %d bytes: %v", len(data), len(after), err)
+	}
+}
+
+func TestNotAJournal(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "journal"), []byte("something else"), 0600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if _, err := disk.Open(dir); err == nil {
+		t.Errorf("expected error opening a file that is not a journal")
+	}
+}
+
+func TestSecondOpenFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	service := open(t, dir)
+	if second, err := disk.Open(dir); err == nil {
+		second.Close()
+		t.Fatalf("expected an error opening a directory that is open")
+	}
+	if err := service.Close(); err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	open(t, dir).Close()
+}
+
+// state returns what a reopened service must preserve of a bucket, as
+// JSON so that times are compared without their monotonic clock readings.
+func state(t *testing.T, service filesystem.FilesystemService, bucket string) string {
+	b := service.Bucket(bucket)
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		t.Fatalf("error fetching snapshots: %v", err)
+	}
+	refs, err := b.Refs()
+	if err != nil {
+		t.Fatalf("error fetching refs: %v", err)
+	}
+	st := []interface{}{snapshots, refs}
+	for _, snapshot := range snapshots {
+		c, err := b.ExportCommit(snapshot.Version)
+		if err != nil {
+			t.Fatalf("error exporting %s: %v", snapshot.Version, err)
+		}
+		st = append(st, c)
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		t.Fatalf("error encoding state: %v", err)
+	}
+	return string(data)
+}
+
+func TestCompactsSupersededJournal(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	service := open(t, dir)
+	for i := 0; i < 10; i++ {
+		commitFile(t, service, "photos", "a", fmt.Sprint(i%3), filesystem.BlobRef{Store: "store_a", Name: fmt.Sprint(i)})
+	}
+	tx := service.Bucket("photos").NewPutTransaction()
+	tx.Move("a/1", "b")
+	tx.Remove("a/2")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	versions := expectVersions(t, service, "photos", "a", "0", 4)
+	if err := service.Bucket("photos").SetRef("kept", versions[1]); err != nil {
+		t.Fatalf("error setting ref: %v", err)
+	}
+	all, err := service.Bucket("photos").Snapshots()
+	if err != nil {
+		t.Fatalf("error fetching snapshots: %v", err)
+	}
+	var deleted []filesystem.Version
+	for _, snapshot := range all[:9] {
+		if snapshot.Version != versions[1] {
+			deleted = append(deleted, snapshot.Version)
+		}
+	}
+	if err := service.Bucket("photos").DeleteVersions(deleted...); err != nil {
+		t.Fatalf("error deleting versions: %v", err)
+	}
+	commitFile(t, service, "docs", "x", "y", filesystem.BlobRef{Store: "store_a", Name: "doc"})
+	docs := expectVersions(t, service, "docs", "x", "y", 1)
+	if err := service.DeleteBucket("docs", "docs"); err != nil {
+		t.Fatalf("error deleting bucket: %v", err)
+	}
+	want := state(t, service, "photos")
+	service.Close()
+	journal := filepath.Join(dir, "journal")
+	before, err := os.Stat(journal)
+	if err != nil {
+		t.Fatalf("error reading journal: %v", err)
+	}
+
+	service = open(t, dir)
+	after, err := os.Stat(journal)
+	if err != nil {
+		t.Fatalf("error reading journal: %v", err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("journal of %d bytes wasn't compacted, has %d", before.Size(), after.Size())
+	}
+	service.Close()
+
+	// The compacted journal restores the same state, and later commits
+	// are kept after it.
+	service = open(t, dir)
+	if got := state(t, service, "photos"); got != want {
+		t.Errorf("got state %s after compaction, want %s", got, want)
+	}
+	if buckets, err := service.Buckets(); err != nil || len(buckets) != 1 {
+		t.Errorf("got buckets %+v, %v, want photos", buckets, err)
+	}
+	commitFile(t, service, "docs", "x", "y", filesystem.BlobRef{Store: "store_a", Name: "doc"})
+	if got := expectVersions(t, service, "docs", "x", "y", 1); got[0].Compare(docs[0]) <= 0 {
+		t.Errorf("version %v of a recreated bucket not newer than deleted %v", got[0], docs[0])
+	}
+	commitFile(t, service, "photos", "a", "0", filesystem.BlobRef{Store: "store_a", Name: "new"})
+	service.Close()
+	service = open(t, dir)
+	defer service.Close()
+	expectLatest(t, service, "photos", "a", "0", filesystem.BlobRef{Store: "store_a", Name: "new"})
+}
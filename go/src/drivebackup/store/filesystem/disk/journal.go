@@ -0,0 +1,222 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The journal is a header line followed by frames of
+//
+//	[4 byte big-endian payload length][4 byte CRC-32C of payload][payload]
+//
+// where each payload is a JSON encoded entry. A frame is written with a single
+// write followed by an fsync, so after a crash only the last frame can be
+// incomplete. An incomplete or corrupt last frame is dropped and the journal
+// truncated before it. A corrupt frame followed by others can't be the
+// result of a crash, and fails the replay rather than dropping the commits
+// after it.
+const journalHeader = "drivebackup filesystem journal v1\n"
+
+const frameHeaderSize = 8
+
+// maxFrameSize bounds the length read from a frame header, so that a corrupt
+// length is detected instead of allocating an arbitrary amount of memory.
+const maxFrameSize = 1 << 30
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type journal struct {
+	f      *os.File
+	offset int64 // end of the last complete frame
+	frames int   // number of complete frames
+}
+
+// openJournal opens or creates the journal at path and calls replay with the
+// payload of every complete frame, in order.
+func openJournal(path string, replay func(payload []byte) error) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f}
+	if err := j.load(replay); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) load(replay func(payload []byte) error) error {
+	info, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := j.f.Write([]byte(journalHeader)); err != nil {
+			return err
+		}
+		j.offset = int64(len(journalHeader))
+		return j.f.Sync()
+	}
+
+	r := bufio.NewReader(j.f)
+	header := make([]byte, len(journalHeader))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != journalHeader {
+		return fmt.Errorf("%s is not a filesystem journal", j.f.Name())
+	}
+	j.offset = int64(len(journalHeader))
+	for {
+		payload, end, err := readFrame(r, j.offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// An incomplete or corrupt last frame is what an interrupted
+			// write leaves behind: drop it.
+			if end >= info.Size() {
+				break
+			}
+			return fmt.Errorf("%s has a corrupt frame at offset %d, followed by %d more bytes: %v", j.f.Name(), j.offset, info.Size()-end, err)
+		}
+		if err := replay(payload); err != nil {
+			return fmt.Errorf("replaying %s at offset %d: %v", j.f.Name(), j.offset, err)
+		}
+		j.offset += frameHeaderSize + int64(len(payload))
+		j.frames++
+	}
+	if j.offset < info.Size() {
+		if err := j.f.Truncate(j.offset); err != nil {
+			return err
+		}
+		if err := j.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrame reads the frame at offset. It returns io.EOF at the end of the
+// journal, and otherwise the offset at which the frame ends, even if it is
+// incomplete or corrupt.
+func readFrame(r io.Reader, offset int64) (payload []byte, end int64, err error) {
+	var header [frameHeaderSize]byte
+	n, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, offset, io.EOF
+	}
+	if err != nil {
+		return nil, offset + int64(n), err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	end = offset + frameHeaderSize + int64(size)
+	if size > maxFrameSize {
+		return nil, end, fmt.Errorf("frame too large: %d", size)
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, end, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, end, fmt.Errorf("checksum mismatch")
+	}
+	return payload, end, nil
+}
+
+// encodeFrame encodes entry as a frame.
+func encodeFrame(entry interface{}) ([]byte, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[frameHeaderSize:], payload)
+	return frame, nil
+}
+
+// append durably writes an entry. If the write fails the journal is cut back
+// to its previous length so that no partial frame precedes later ones.
+func (j *journal) append(entry interface{}) error {
+	frame, err := encodeFrame(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.WriteAt(frame, j.offset); err != nil {
+		j.f.Truncate(j.offset)
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		j.f.Truncate(j.offset)
+		return err
+	}
+	j.offset += int64(len(frame))
+	j.frames++
+	return nil
+}
+
+// rewrite replaces the journal with one holding entries. The new journal is
+// written and synced next to the old one, then renamed over it, so a crash
+// leaves either of them in place.
+func (j *journal) rewrite(entries []interface{}) error {
+	path := j.f.Name()
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	offset, err := writeJournal(f, entries)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	j.f.Close()
+	j.f, j.offset, j.frames = f, offset, len(entries)
+	return nil
+}
+
+// writeJournal writes a header and entries to the empty file f and syncs
+// it. It returns the offset of the end of the last frame.
+func writeJournal(f *os.File, entries []interface{}) (int64, error) {
+	w := bufio.NewWriter(f)
+	w.WriteString(journalHeader)
+	offset := int64(len(journalHeader))
+	for _, entry := range entries {
+		frame, err := encodeFrame(entry)
+		if err != nil {
+			return 0, err
+		}
+		w.Write(frame)
+		offset += int64(len(frame))
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return offset, f.Sync()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package disk
+
+import (
+	"fmt"
+	"os"
+)
+
+// Without flock the lock is the existence of the lock file, which a crash
+// leaves behind: it must then be removed by hand.
+func lockDir(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%s is locked by another filesystem service, or left behind by a crash", path)
+	}
+	return f, err
+}
+
+func unlockDir(f *os.File) error {
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -1,7 +1,13 @@
 package filesystem
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
 
+// Version identifies a commit of a bucket. See version.go.
 type Version string
 
 type BlobRef struct {
@@ -15,37 +21,210 @@ func (r *BlobRef) String() string {
 
 type StoredBlobRef struct {
 	BlobRef
-	Version Version
+	Version  Version
+	Metadata Metadata
 }
 
 func (r *StoredBlobRef) String() string {
 	return fmt.Sprintf("%v@%s", r.BlobRef, r.Version)
 }
 
+// MatchedFile is a file selected by a glob.
+type MatchedFile struct {
+	Path string
+	StoredBlobRef
+}
+
+// WalkEntry is a file or dir visited by Walk. Dirs have only a Version.
+type WalkEntry struct {
+	Path  string
+	IsDir bool
+	StoredBlobRef
+}
+
+// Name returns the entry's name within its dir.
+func (e WalkEntry) Name() string {
+	return filepath.Base(e.Path)
+}
+
+// ListOptions selects a page of ListEntries.
+type ListOptions struct {
+	PageToken string // the NextPageToken of the previous page, "" for the first
+	Limit     int    // the most entries in the page, 0 for no limit
+}
+
+// EntryPage is a page of ListEntries.
+type EntryPage struct {
+	Entries       []WalkEntry
+	NextPageToken string // "" for the last page
+}
+
+// WalkFunc is called by Walk for each entry. If it returns SkipDir for a
+// dir, the dir's contents are skipped; for a file, the rest of the file's
+// dir is. Any other error stops the walk and is returned by Walk.
+type WalkFunc func(entry WalkEntry) error
+
+// SkipDir is returned by a WalkFunc to skip part of the walk. It is not
+// returned as an error by Walk.
+var SkipDir = errors.New("skip this directory")
+
+// VersionOptions controls the versions IterVersions gives.
+type VersionOptions struct {
+	NewestFirst bool // oldest first if unset
+	Limit       int  // the most versions to give, 0 for no limit
+}
+
+// VersionIterator gives versions one at a time.
+type VersionIterator interface {
+	// Next returns the next version, or Done after the last one.
+	Next() (Version, error)
+}
+
+// Done is returned by VersionIterator.Next after the last version.
+var Done = errors.New("no more versions")
+
+// FailedVersionIterator returns an iterator whose Next fails with err.
+func FailedVersionIterator(err error) VersionIterator {
+	return failedVersionIterator{err}
+}
+
+type failedVersionIterator struct {
+	err error
+}
+
+func (it failedVersionIterator) Next() (Version, error) {
+	return "", it.err
+}
+
+// FilesystemService stores buckets of versioned files and dirs.
+//
+// Versions carry no host id: an implementation must allocate the versions
+// of a bucket from one place, so that they are unique and ordered across
+// every host committing to it. The datastore service does so in the
+// datastore, so services on one datastore may run on any number of hosts.
+// The mock and disk services allocate in memory, so a bucket must only be
+// committed to through one of them; the disk service enforces this by
+// locking its directory.
 type FilesystemService interface {
+	// Bucket returns the bucket with the given name. A bucket that doesn't
+	// exist reads as empty, and is created by its first commit.
 	Bucket(bucket string) Bucket
+	// Buckets describes every bucket, sorted by name.
+	Buckets() ([]BucketInfo, error)
+	// CreateBucket creates an empty bucket, failing with ErrBucketExists if
+	// the name is in use.
+	CreateBucket(name string, opts BucketOptions) (Bucket, error)
+	// DescribeBucket fails with ErrNoSuchBucket for a bucket that doesn't
+	// exist.
+	DescribeBucket(name string) (BucketInfo, error)
+	// RenameBucket moves a bucket, with its history and metadata, to a name
+	// not in use. Buckets returned for either name before keep referring to
+	// the name.
+	RenameBucket(from, to string) error
+	// DeleteBucket deletes a bucket with its history and metadata. confirm
+	// must be the name of the bucket, guarding against deleting the wrong
+	// one. The blobs it references are left in place.
+	DeleteBucket(name, confirm string) error
 }
 
 type Bucket interface {
 	NewPutTransaction() PutTransaction
 	Select() Selector
+	// Snapshots returns the snapshots of every commit, oldest first.
+	Snapshots() ([]Snapshot, error)
+	Snapshot(version Version) (Snapshot, error)
+	// DeleteVersions drops versions from the history as if their commits
+	// had never been made: the paths they wrote fall back to their newest
+	// remaining version. The blobs they reference are left in place. It
+	// fails if a ref points at any of the versions.
+	DeleteVersions(versions ...Version) error
+	// SetRef points the ref name at a committed version, creating the ref
+	// or moving it.
+	SetRef(name string, version Version) error
+	// Ref returns the version the ref name points at.
+	Ref(name string) (Version, error)
+	// Refs returns every ref of the bucket, sorted by name.
+	Refs() ([]Ref, error)
+	DeleteRef(name string) error
+	// Head returns the version of the newest commit to the bucket, even if
+	// it was since deleted, or "" if there has been none. Transactions
+	// declare it as their parent to detect concurrent commits.
+	Head() (Version, error)
+	// ExportCommit returns what the commit of version wrote.
+	ExportCommit(version Version) (*Commit, error)
+	// ImportCommit replays a commit exported from another bucket, keeping
+	// its version and snapshot. The version must be newer than the head.
+	// Removals and renames are taken as given rather than expanded.
+	ImportCommit(commit *Commit) error
 }
 
 type PutTransaction interface {
 	PutTransactionPath
+	// Move moves a file or dir, with everything below it, keeping the link
+	// to its old path in the version history. Both paths are relative to
+	// the bucket root.
+	Move(from, to string)
+	// Describe sets the descriptive fields of the commit's snapshot:
+	// Hostname, User, Source, Tags and Message. Empty Hostname and User
+	// keep their defaults.
+	Describe(snapshot Snapshot)
+	// SetParent declares the head of the bucket the transaction was built
+	// against, "" for an empty bucket. Commit then fails with a
+	// *ConflictError if another commit was made since.
+	SetParent(parent Version)
 	Commit() error
+	// Version returns the version the transaction was committed as, or ""
+	// before it is committed.
+	Version() Version
 }
 
 type PutTransactionPath interface {
 	Dir(path string) PutTransactionPath
 	File(name string, blobRef BlobRef)
+	// FileWithMetadata is File, also storing the file's metadata. File
+	// stores empty metadata. FIFOs and device nodes are stored with an
+	// empty blobRef and their type in metadata.
+	FileWithMetadata(name string, blobRef BlobRef, metadata Metadata)
+	// Symlink stores a symlink to target.
+	Symlink(name, target string, metadata Metadata)
+	// Remove removes a file or an empty dir from the versions committed
+	// after this transaction. Earlier versions keep it.
+	Remove(name string)
+	// RemoveAll removes a file or a dir and everything below it.
+	RemoveAll(name string)
 }
 
 type Selector interface {
 	Version(version Version) Selector
+	// Tag selects the version the bucket's ref name points at when the
+	// selector is used.
+	Tag(name string) Selector
 	Latest() Selector
+	// AsOf selects the newest version at or before t, Before the newest
+	// version before t and After the oldest version after t. Like Latest,
+	// they select among the versions of the dir or file given before them.
+	AsOf(t time.Time) Selector
+	Before(t time.Time) Selector
+	After(t time.Time) Selector
+	// Since, Until, Between and Last restrict Versions() and List() to a
+	// range of versions: those at or after v, at or before v, from a to b
+	// inclusive, or the newest n. List() at a range lists the children
+	// written by any version in it. NewVersion turns a time into a bound.
+	Since(v Version) Selector
+	Until(v Version) Selector
+	Between(a, b Version) Selector
+	Last(n int) Selector
 	Dir(path string) Selector
 	File(name string) Selector
+	// Glob selects the files below the dir whose path relative to it
+	// matches pattern, for Match(). In a pattern, "*" matches any run of
+	// characters within a name, "?" one character, "[...]" a character
+	// class and a "**" segment any number of dirs, including none.
+	Glob(pattern string) Selector
+	// Follow makes the selector follow the history of the file or dir
+	// across moves: Versions() includes the versions under its old paths,
+	// and a version selects the path it had then.
+	Follow() Selector
 
 	SelectorOp
 }
@@ -53,13 +232,37 @@ type Selector interface {
 type SelectorOp interface {
 	DirSelectorOp
 	FileSelectorOp
+	GlobSelectorOp
 
 	Versions() ([]Version, error) // list all version of the file/dir
+	// IterVersions gives the versions Versions() would, fetched from
+	// storage a page at a time.
+	IterVersions(opts VersionOptions) VersionIterator
 }
 
 // DirSelectorOp only succeeds on dirs
 type DirSelectorOp interface{
 	List() ([]string, error)
+	// ListEntries returns a page of the entries List() would give, sorted
+	// by name. A dir is given at its newest version seen, and a name that
+	// was both a file and a dir as the newer of the two.
+	ListEntries(opts ListOptions) (*EntryPage, error)
+	// Walk calls fn for every file and dir below the dir, depth first,
+	// each dir before its contents and the contents of a dir by name. The
+	// entries are those List() would give at each level, fetched in bulk.
+	Walk(fn WalkFunc) error
+	// Diff returns the changes below the dir from v1 to v2, in the order
+	// Walk visits them. The contents of added and removed dirs are listed
+	// too. The selector may not select a version itself.
+	Diff(v1, v2 Version) ([]Change, error)
+}
+
+// GlobSelectorOp only succeeds on globs
+type GlobSelectorOp interface {
+	// Match returns the files matching the glob, sorted by path: without a
+	// version those that exist now, at a version those written by it, and
+	// in a range those written by a version in it, at the newest such.
+	Match() ([]MatchedFile, error)
 }
 
 // FileSelectorOp only succeeds on files
@@ -1,11 +1,20 @@
 package filesystem_test
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/datastore"
+	dsmock "drivebackup/store/filesystem/datastore/mock"
+	"drivebackup/store/filesystem/disk"
 	"drivebackup/store/filesystem/mock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
 	"reflect"
+	"time"
 )
 
 func TestMockFilesystemService(t *testing.T) {
@@ -14,6 +23,38 @@ func TestMockFilesystemService(t *testing.T) {
 	})
 }
 
+func TestDiskFilesystemService(t *testing.T) {
+	var services []*disk.FilesystemService
+	var dirs []string
+	defer func() {
+		for _, service := range services {
+			service.Close()
+		}
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	filesystemTest(t, func() filesystem.FilesystemService {
+		dir, err := ioutil.TempDir("", "disk_filesystem_test")
+		if err != nil {
+			t.Fatalf("error creating temp dir: %v", err)
+		}
+		dirs = append(dirs, dir)
+		service, err := disk.Open(dir)
+		if err != nil {
+			t.Fatalf("error opening service: %v", err)
+		}
+		services = append(services, service)
+		return service
+	})
+}
+
+func TestDatastoreFilesystemService(t *testing.T) {
+	filesystemTest(t, func() filesystem.FilesystemService {
+		return datastore.NewFilesystemService(context.Background(), &dsmock.MockClient{})
+	})
+}
+
 type T interface {
 	Errorf(format string, args ...interface{})
 	Fatalf(format string, args ...interface{})
@@ -349,6 +390,1364 @@ func referenceSameBucket(t T, service filesystem.FilesystemService) {
 	}
 }
 
+func removeFileTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	in := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd"}
+	tx1 := bucket1.NewPutTransaction()
+	tx1.Dir("a").File("b", in)
+	tx1.Dir("a").File("c", in)
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+	versions, err := bucket1.Select().Dir("a").File("b").Versions()
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got versions %v, %v, want one", versions, err)
+	}
+	v1 := versions[0]
+
+	tx2 := bucket1.NewPutTransaction()
+	tx2.Dir("a").Remove("b")
+	if err := tx2.Commit(); err != nil {
+		t.Fatalf("error committing tx2: %v", err)
+	}
+
+	storedRef, err := bucket1.Select().Version(v1).Dir("a").File("b").BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref at the earlier version: %v", err)
+	}
+	if storedRef.BlobRef != in {
+		t.Errorf("got %v, want %v", storedRef.BlobRef, in)
+	}
+	if _, err := bucket1.Select().Dir("a").File("b").Latest().BlobRef(); err == nil {
+		t.Errorf("expected an error fetching the latest version of a removed file")
+	}
+	versions, err = bucket1.Select().Dir("a").File("b").Versions()
+	if err != nil {
+		t.Fatalf("error fetching versions: %v", err)
+	}
+	if !reflect.DeepEqual(versions, []filesystem.Version{v1}) {
+		t.Errorf("got versions %v, want %v", versions, []filesystem.Version{v1})
+	}
+	names, err := bucket1.Select().Dir("a").List()
+	if err != nil {
+		t.Fatalf("error listing dir: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"a/c"}) {
+		t.Errorf("got dir listing %v, want %v", names, []string{"a/c"})
+	}
+	names, err = bucket1.Select().Version(v1).Dir("a").List()
+	if err != nil {
+		t.Fatalf("error listing dir: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"a/b", "a/c"}) {
+		t.Errorf("got dir listing %v, want %v", names, []string{"a/b", "a/c"})
+	}
+}
+
+func removeDirTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	in := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd"}
+	tx1 := bucket1.NewPutTransaction()
+	tx1.Dir("a").Dir("b").File("c", in)
+	tx1.Dir("d")
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+
+	tx2 := bucket1.NewPutTransaction()
+	tx2.Remove("a")
+	if err := tx2.Commit(); err == nil {
+		t.Errorf("expected an error removing a non-empty dir")
+	}
+
+	tx3 := bucket1.NewPutTransaction()
+	tx3.RemoveAll("a")
+	if err := tx3.Commit(); err != nil {
+		t.Fatalf("error committing tx3: %v", err)
+	}
+	names, err := bucket1.Select().List()
+	if err != nil {
+		t.Fatalf("error listing dir: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"d"}) {
+		t.Errorf("got dir listing %v, want %v", names, []string{"d"})
+	}
+	if _, err := bucket1.Select().Dir("a").Dir("b").File("c").Latest().BlobRef(); err == nil {
+		t.Errorf("expected an error fetching a file below a removed dir")
+	}
+	if _, err := bucket1.Select().Dir("a").List(); err == nil {
+		t.Errorf("expected an error listing a removed dir")
+	}
+
+	tx4 := bucket1.NewPutTransaction()
+	tx4.Dir("a").File("e", in)
+	if err := tx4.Commit(); err != nil {
+		t.Fatalf("error committing tx4: %v", err)
+	}
+	names, err = bucket1.Select().Latest().Dir("a").List()
+	if err != nil {
+		t.Fatalf("error listing dir: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"a/e"}) {
+		t.Errorf("got dir listing %v, want %v", names, []string{"a/e"})
+	}
+}
+
+func moveTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	in1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	tx1 := bucket1.NewPutTransaction()
+	tx1.Dir("a").File("b", in1)
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+	versions, err := bucket1.Select().Dir("a").File("b").Versions()
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got versions %v, %v, want one", versions, err)
+	}
+	v1 := versions[0]
+
+	tx2 := bucket1.NewPutTransaction()
+	tx2.Move("a", "c")
+	if err := tx2.Commit(); err != nil {
+		t.Fatalf("error committing tx2: %v", err)
+	}
+	versions, err = bucket1.Select().Dir("c").File("b").Versions()
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got versions %v, %v, want one", versions, err)
+	}
+	v2 := versions[0]
+
+	in3 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd3"}
+	tx3 := bucket1.NewPutTransaction()
+	tx3.Dir("c").File("b", in3)
+	if err := tx3.Commit(); err != nil {
+		t.Fatalf("error committing tx3: %v", err)
+	}
+
+	storedRef, err := bucket1.Select().Version(v2).Dir("c").File("b").BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref: %v", err)
+	}
+	if storedRef.BlobRef != in1 {
+		t.Errorf("got %v, want %v", storedRef.BlobRef, in1)
+	}
+	if _, err := bucket1.Select().Dir("a").Latest().List(); err == nil {
+		t.Errorf("expected an error listing a moved dir")
+	}
+	names, err := bucket1.Select().List()
+	if err != nil {
+		t.Fatalf("error listing dir: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"c"}) {
+		t.Errorf("got dir listing %v, want %v", names, []string{"c"})
+	}
+
+	versions, err = bucket1.Select().Dir("c").File("b").Follow().Versions()
+	if err != nil {
+		t.Fatalf("error fetching versions: %v", err)
+	}
+	if len(versions) != 3 || versions[0] != v1 || versions[1] != v2 {
+		t.Errorf("got versions %v, want %v, %v and a third", versions, v1, v2)
+	}
+	storedRef, err = bucket1.Select().Dir("c").File("b").Follow().Version(v1).BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref before the move: %v", err)
+	}
+	if storedRef.BlobRef != in1 {
+		t.Errorf("got %v, want %v", storedRef.BlobRef, in1)
+	}
+	if _, err := bucket1.Select().Dir("c").File("b").Version(v1).BlobRef(); err == nil {
+		t.Errorf("expected an error fetching the ref before the move without Follow()")
+	}
+
+	tx4 := bucket1.NewPutTransaction()
+	tx4.Move("missing", "d")
+	if err := tx4.Commit(); err == nil {
+		t.Errorf("expected an error moving a missing path")
+	}
+}
+
+func metadataTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	in := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd"}
+	metadata := filesystem.Metadata{
+		Size:    1234,
+		Mode:    0640,
+		ModTime: time.Unix(1500000000, 0).UTC(),
+		Uid:     1000,
+		Gid:     100,
+		Xattrs:  map[string][]byte{"user.origin": []byte("drive")},
+		Hash:    "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	}
+	tx1 := bucket1.NewPutTransaction()
+	tx1.Dir("a").FileWithMetadata("b", in, metadata)
+	tx1.Dir("a").File("c", in)
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+
+	storedRef, err := bucket1.Select().Dir("a").File("b").Latest().BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref: %v", err)
+	}
+	if storedRef.BlobRef != in || !reflect.DeepEqual(storedRef.Metadata, metadata) {
+		t.Errorf("got %v with %+v, want %v with %+v", storedRef.BlobRef, storedRef.Metadata, in, metadata)
+	}
+	storedRef, err = bucket1.Select().Dir("a").File("c").Latest().BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref: %v", err)
+	}
+	if !reflect.DeepEqual(storedRef.Metadata, filesystem.Metadata{}) {
+		t.Errorf("got metadata %+v for a file without any", storedRef.Metadata)
+	}
+
+	tx2 := bucket1.NewPutTransaction()
+	tx2.Move("a/b", "a/d")
+	if err := tx2.Commit(); err != nil {
+		t.Fatalf("error committing tx2: %v", err)
+	}
+	storedRef, err = bucket1.Select().Dir("a").File("d").Latest().BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching ref: %v", err)
+	}
+	if !reflect.DeepEqual(storedRef.Metadata, metadata) {
+		t.Errorf("got metadata %+v after moving, want %+v", storedRef.Metadata, metadata)
+	}
+}
+
+func specialFilesTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	in := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd"}
+	linked := filesystem.Metadata{Size: 4, Mode: 0644, LinkGroup: "2049:1234"}
+	fifo := filesystem.Metadata{Type: filesystem.FIFO, Mode: 0600}
+	device := filesystem.Metadata{Type: filesystem.CharDevice, Mode: 0666, Device: 0x103}
+	tx1 := bucket1.NewPutTransaction()
+	a := tx1.Dir("a")
+	a.FileWithMetadata("b", in, linked)
+	a.FileWithMetadata("c", in, linked)
+	a.Symlink("d", "b", filesystem.Metadata{Mode: 0777})
+	a.FileWithMetadata("e", filesystem.BlobRef{}, fifo)
+	a.FileWithMetadata("f", filesystem.BlobRef{}, device)
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+
+	names, err := bucket1.Select().Dir("a").List()
+	if err != nil {
+		t.Fatalf("error listing dir: %v", err)
+	}
+	if want := []string{"a/b", "a/c", "a/d", "a/e", "a/f"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got dir listing %v, want %v", names, want)
+	}
+	storedRef, err := bucket1.Select().Dir("a").File("d").Latest().BlobRef()
+	if err != nil {
+		t.Fatalf("error fetching symlink: %v", err)
+	}
+	if storedRef.Metadata.Type != filesystem.Symlink || storedRef.Metadata.LinkTarget != "b" || storedRef.BlobRef != (filesystem.BlobRef{}) {
+		t.Errorf("got %v with %+v, want a symlink to b", storedRef.BlobRef, storedRef.Metadata)
+	}
+	for name, want := range map[string]filesystem.Metadata{"c": linked, "e": fifo, "f": device} {
+		storedRef, err := bucket1.Select().Dir("a").File(name).Latest().BlobRef()
+		if err != nil {
+			t.Fatalf("error fetching %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(storedRef.Metadata, want) {
+			t.Errorf("got metadata %+v for %s, want %+v", storedRef.Metadata, name, want)
+		}
+	}
+}
+
+func snapshotsTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	tx1 := bucket1.NewPutTransaction()
+	tx1.Describe(filesystem.Snapshot{
+		Hostname: "laptop",
+		User:     "alice",
+		Source:   "/home/alice",
+		Tags:     []string{"daily"},
+		Message:  "first backup",
+	})
+	tx1.Dir("a").FileWithMetadata("b", filesystem.BlobRef{Store: "store_a", Name: "abcd1"}, filesystem.Metadata{Size: 10})
+	tx1.Dir("a").FileWithMetadata("c", filesystem.BlobRef{Store: "store_a", Name: "abcd2"}, filesystem.Metadata{Size: 5})
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+	tx2 := bucket1.NewPutTransaction()
+	tx2.Dir("d")
+	if err := tx2.Commit(); err != nil {
+		t.Fatalf("error committing tx2: %v", err)
+	}
+
+	snapshots, err := bucket1.Snapshots()
+	if err != nil {
+		t.Fatalf("error listing snapshots: %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("got snapshots %v, want two", snapshots)
+	}
+	versions, err := bucket1.Select().Dir("a").Versions()
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("got versions %v, %v, want one", versions, err)
+	}
+	snapshot, err := bucket1.Snapshot(versions[0])
+	if err != nil {
+		t.Fatalf("error fetching snapshot: %v", err)
+	}
+	if snapshot.Version != versions[0] || snapshot.Hostname != "laptop" || snapshot.User != "alice" ||
+		snapshot.Source != "/home/alice" || !reflect.DeepEqual(snapshot.Tags, []string{"daily"}) ||
+		snapshot.Message != "first backup" || snapshot.Files != 2 || snapshot.Bytes != 15 {
+		t.Errorf("got snapshot %+v", snapshot)
+	}
+	if snapshot.Started.IsZero() || snapshot.Duration < 0 {
+		t.Errorf("got start %v and duration %v", snapshot.Started, snapshot.Duration)
+	}
+	if snapshots[0].Version != versions[0] || snapshots[1].Files != 0 || snapshots[1].Hostname == "" {
+		t.Errorf("got snapshots %+v", snapshots)
+	}
+	if _, err := bucket1.Snapshot("missing"); err == nil {
+		t.Errorf("expected an error fetching a missing snapshot")
+	}
+}
+
+// setClock makes service read the time from clock.
+func setClock(t T, service filesystem.FilesystemService, clock filesystem.Clock) {
+	switch s := service.(type) {
+	case *mock.MockFilesystemService:
+		s.Clock = clock
+	case *datastore.FilesystemService:
+		s.Clock = clock
+	case *disk.FilesystemService:
+		s.Clock = clock
+	default:
+		t.Fatalf("can't set the clock of %T", service)
+	}
+}
+
+func snapshotTimesTest(t T, service filesystem.FilesystemService) {
+	start := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	clock := &filesystem.ManualClock{}
+	clock.Set(start)
+	setClock(t, service, clock)
+	bucket1 := service.Bucket("testbucket1")
+
+	tx := bucket1.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"})
+	clock.Set(start.Add(time.Minute))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	snapshots, err := bucket1.Snapshots()
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("got snapshots %v, %v, want one", snapshots, err)
+	}
+	if got := snapshots[0]; !got.Started.Equal(start) || got.Duration != time.Minute {
+		t.Errorf("got start %v and duration %v, want %v and a minute", got.Started, got.Duration, start)
+	}
+}
+
+func timeSelectionTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	in1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	in2 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd2"}
+	for _, in := range []filesystem.BlobRef{in1, in2} {
+		tx := bucket1.NewPutTransaction()
+		tx.Dir("a").File("b", in)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+	versions, err := bucket1.Select().Dir("a").File("b").Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+	t1, t2 := versions[0].Time(), versions[1].Time()
+
+	tests := []struct {
+		name     string
+		selector filesystem.Selector
+		want     filesystem.BlobRef
+	}{
+		{"AsOf first", bucket1.Select().Dir("a").File("b").AsOf(t1), in1},
+		{"AsOf between", bucket1.Select().Dir("a").File("b").AsOf(t2.Add(-time.Nanosecond)), in1},
+		{"AsOf second", bucket1.Select().Dir("a").File("b").AsOf(t2), in2},
+		{"AsOf later", bucket1.Select().Dir("a").File("b").AsOf(t2.Add(time.Hour)), in2},
+		{"Before second", bucket1.Select().Dir("a").File("b").Before(t2), in1},
+		{"After first", bucket1.Select().Dir("a").File("b").After(t1), in2},
+		{"After earlier", bucket1.Select().Dir("a").File("b").After(t1.Add(-time.Hour)), in1},
+		{"Dir AsOf", bucket1.Select().Dir("a").AsOf(t1).File("b"), in1},
+	}
+	for _, test := range tests {
+		storedRef, err := test.selector.BlobRef()
+		if err != nil {
+			t.Errorf("%s: error fetching ref: %v", test.name, err)
+		} else if storedRef.BlobRef != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, storedRef.BlobRef, test.want)
+		}
+	}
+
+	if _, err := bucket1.Select().Dir("a").File("b").Before(t1).BlobRef(); err == nil {
+		t.Errorf("expected an error selecting a version before the first")
+	}
+	if _, err := bucket1.Select().Dir("a").File("b").After(t2).BlobRef(); err == nil {
+		t.Errorf("expected an error selecting a version after the last")
+	}
+	if _, err := bucket1.Select().Dir("a").File("b").AsOf(t1).Latest().BlobRef(); err == nil {
+		t.Errorf("expected an error combining version constraints")
+	}
+	names, err := bucket1.Select().Dir("a").AsOf(t1).List()
+	if err != nil || !reflect.DeepEqual(names, []string{"a/b"}) {
+		t.Errorf("got listing %v, %v, want [a/b]", names, err)
+	}
+}
+
+func rangeSelectionTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	var refs []filesystem.BlobRef
+	for i, name := range []string{"b", "c", "b", "d"} {
+		ref := filesystem.BlobRef{Store: "store_a", Name: fmt.Sprintf("store_a_abcd%d", i)}
+		refs = append(refs, ref)
+		tx := bucket1.NewPutTransaction()
+		tx.Dir("a").File(name, ref)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+	versions, err := bucket1.Select().Dir("a").Versions()
+	if err != nil || len(versions) != 4 {
+		t.Fatalf("got versions %v, %v, want four", versions, err)
+	}
+
+	tests := []struct {
+		name     string
+		selector filesystem.Selector
+		want     []filesystem.Version
+	}{
+		{"Since", bucket1.Select().Dir("a").Since(versions[2]), versions[2:]},
+		{"Until", bucket1.Select().Dir("a").Until(versions[1]), versions[:2]},
+		{"Between", bucket1.Select().Dir("a").Between(versions[1], versions[2]), versions[1:3]},
+		{"Last", bucket1.Select().Dir("a").Last(3), versions[1:]},
+		{"Last more than all", bucket1.Select().Dir("a").Last(10), versions},
+		{"File Since", bucket1.Select().Dir("a").File("b").Since(versions[1]), versions[2:3]},
+		{"File Last", bucket1.Select().Dir("a").File("b").Last(1), versions[2:3]},
+		{"Empty range", bucket1.Select().Dir("a").File("c").Since(versions[2]), nil},
+	}
+	for _, test := range tests {
+		got, err := test.selector.Versions()
+		if err != nil {
+			t.Errorf("%s: error fetching versions: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got versions %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	listTests := []struct {
+		name     string
+		selector filesystem.Selector
+		want     []string
+	}{
+		{"Since", bucket1.Select().Dir("a").Since(versions[2]), []string{"a/b", "a/d"}},
+		{"Until", bucket1.Select().Dir("a").Until(versions[1]), []string{"a/b", "a/c"}},
+		{"Last", bucket1.Select().Dir("a").Last(1), []string{"a/d"}},
+		{"Root", bucket1.Select().Last(2), []string{"a"}},
+	}
+	for _, test := range listTests {
+		got, err := test.selector.List()
+		if err != nil {
+			t.Errorf("%s: error listing: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got listing %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	invalid := []struct {
+		name     string
+		selector filesystem.Selector
+	}{
+		{"Reversed", bucket1.Select().Dir("a").Between(versions[2], versions[1])},
+		{"Last zero", bucket1.Select().Dir("a").Last(0)},
+		{"Empty bound", bucket1.Select().Dir("a").Since("")},
+		{"Two ranges", bucket1.Select().Dir("a").Since(versions[1]).Last(1)},
+		{"Range and version", bucket1.Select().Latest().Dir("a").Last(1)},
+	}
+	for _, test := range invalid {
+		if _, err := test.selector.Versions(); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+	if _, err := bucket1.Select().Dir("a").File("b").Last(1).BlobRef(); err == nil {
+		t.Errorf("expected an error fetching a BlobRef with a range")
+	}
+}
+
+func globTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	ref := func(name string) filesystem.BlobRef {
+		return filesystem.BlobRef{Store: "store_a", Name: name}
+	}
+	tx := bucket1.NewPutTransaction()
+	tx.Dir("Photos/2016").File("a.jpg", ref("a"))
+	tx.Dir("Photos/2016").File("b.png", ref("b"))
+	tx.Dir("Photos/2016/trip").File("c.jpg", ref("c"))
+	tx.Dir("Photos/2015").File("d.jpg", ref("d"))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Dir("Photos/2016").File("e.jpg", ref("e"))
+	tx.Dir("Photos/2016/trip").Remove("c.jpg")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	versions, err := bucket1.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+
+	tests := []struct {
+		name     string
+		selector filesystem.Selector
+		want     []string
+	}{
+		{"Globstar", bucket1.Select().Dir("Photos/2016").Glob("**/*.jpg"), []string{"Photos/2016/a.jpg", "Photos/2016/e.jpg"}},
+		{"Wildcards", bucket1.Select().Dir("Photos").Glob("*/?.jpg"), []string{"Photos/2015/d.jpg", "Photos/2016/a.jpg", "Photos/2016/e.jpg"}},
+		{"Class", bucket1.Select().Glob("Photos/201[0-5]/*"), []string{"Photos/2015/d.jpg"}},
+		{"Empty globstar", bucket1.Select().Glob("Photos/**/2015/d.jpg"), []string{"Photos/2015/d.jpg"}},
+		{"No match", bucket1.Select().Glob("*.jpg"), nil},
+		{"Latest", bucket1.Select().Latest().Dir("Photos").Glob("**"), []string{"Photos/2016/e.jpg"}},
+		{"Version", bucket1.Select().Version(versions[0]).Glob("**/*.jpg"), []string{"Photos/2015/d.jpg", "Photos/2016/a.jpg", "Photos/2016/trip/c.jpg"}},
+		{"Range", bucket1.Select().Dir("Photos/2016").Glob("*").Since(versions[1]), []string{"Photos/2016/e.jpg"}},
+	}
+	for _, test := range tests {
+		files, err := test.selector.Match()
+		if err != nil {
+			t.Errorf("%s: error matching: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, file := range files {
+			got = append(got, file.Path)
+			if file.BlobRef.Name != filepath.Base(file.Path)[:1] || file.Version == "" {
+				t.Errorf("%s: got ref %v for %s", test.name, &file.StoredBlobRef, file.Path)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got matches %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	invalid := []struct {
+		name     string
+		selector filesystem.Selector
+	}{
+		{"Bad pattern", bucket1.Select().Glob("Photos/[")},
+		{"Glob and file", bucket1.Select().Glob("*").File("a")},
+		{"Version after glob", bucket1.Select().Glob("*").Latest()},
+		{"Follow", bucket1.Select().Glob("*").Follow()},
+		{"No glob", bucket1.Select().Dir("Photos")},
+	}
+	for _, test := range invalid {
+		if _, err := test.selector.Match(); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+	if _, err := bucket1.Select().Glob("*").List(); err == nil {
+		t.Errorf("expected an error listing a glob")
+	}
+}
+
+func walkTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	ref := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd"}
+	tx := bucket1.NewPutTransaction()
+	tx.Dir("a/b").File("c.txt", ref)
+	tx.Dir("a").File("d.txt", ref)
+	tx.Dir("a").Symlink("l", "d.txt", filesystem.Metadata{})
+	tx.Dir("a/e").File("f.txt", ref)
+	tx.File("g.txt", ref)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.RemoveAll("a/e")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	versions, err := bucket1.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+
+	// walk returns the visited paths, dirs with a trailing slash.
+	walk := func(selector filesystem.Selector, skip string) ([]string, error) {
+		var visited []string
+		err := selector.Walk(func(entry filesystem.WalkEntry) error {
+			if entry.Version == "" {
+				t.Errorf("no version for %s", entry.Path)
+			}
+			name := entry.Path
+			switch {
+			case entry.IsDir:
+				name += "/"
+			case entry.Metadata.Type == filesystem.Symlink:
+				name += "@"
+			case entry.BlobRef != ref:
+				t.Errorf("got ref %v for %s", &entry.BlobRef, entry.Path)
+			}
+			visited = append(visited, name)
+			if entry.Path == skip {
+				return filesystem.SkipDir
+			}
+			return nil
+		})
+		return visited, err
+	}
+
+	tests := []struct {
+		name     string
+		selector filesystem.Selector
+		skip     string
+		want     []string
+	}{
+		{"Now", bucket1.Select(), "", []string{"a/", "a/b/", "a/b/c.txt", "a/d.txt", "a/l@", "g.txt"}},
+		{"Version", bucket1.Select().Version(versions[0]).Dir("a"), "", []string{"a/b/", "a/b/c.txt", "a/d.txt", "a/e/", "a/e/f.txt", "a/l@"}},
+		{"Skip dir", bucket1.Select(), "a/b", []string{"a/", "a/b/", "a/d.txt", "a/l@", "g.txt"}},
+		{"Skip rest of dir", bucket1.Select(), "a/d.txt", []string{"a/", "a/b/", "a/b/c.txt", "a/d.txt", "g.txt"}},
+		{"Skip rest of root", bucket1.Select().Dir("a"), "a/d.txt", []string{"a/b/", "a/b/c.txt", "a/d.txt"}},
+	}
+	for _, test := range tests {
+		got, err := walk(test.selector, test.skip)
+		if err != nil {
+			t.Errorf("%s: error walking: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: visited %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	stop := fmt.Errorf("stop")
+	var visited int
+	err = bucket1.Select().Walk(func(entry filesystem.WalkEntry) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("got %v after %d entries, want the WalkFunc's error after one", err, visited)
+	}
+	if _, err := walk(bucket1.Select().Dir("a").File("d.txt"), ""); err == nil {
+		t.Errorf("expected an error walking a file")
+	}
+	if _, err := walk(bucket1.Select().Dir("a/e"), ""); err == nil {
+		t.Errorf("expected an error walking a removed dir")
+	}
+}
+
+func diffTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd2"}
+	tx := bucket1.NewPutTransaction()
+	tx.Dir("a").File("keep.txt", ref1)
+	tx.Dir("a").File("mod.txt", ref1)
+	tx.Dir("a").File("t", ref1)
+	tx.Dir("a").Symlink("link", "x", filesystem.Metadata{})
+	tx.Dir("a/gone").File("x.txt", ref1)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Dir("a").File("keep.txt", ref1)
+	tx.Dir("a").File("mod.txt", ref2)
+	tx.Dir("a").File("new.txt", ref2)
+	tx.Dir("a").Symlink("link", "y", filesystem.Metadata{})
+	tx.Dir("a/t").File("inner.txt", ref2)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	versions, err := bucket1.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+
+	changes, err := bucket1.Select().Dir("a").Diff(versions[0], versions[1])
+	if err != nil {
+		t.Fatalf("error diffing: %v", err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, change.String())
+	}
+	want := []string{
+		"removed a/gone",
+		"removed a/gone/x.txt",
+		"modified a/link",
+		"modified a/mod.txt",
+		"added a/new.txt",
+		"type changed a/t",
+		"added a/t/inner.txt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %v, want %v", got, want)
+	}
+	for _, change := range changes {
+		if change.Path == "a/mod.txt" && (change.Old.BlobRef != ref1 || change.New.BlobRef != ref2) {
+			t.Errorf("got %v to %v for a/mod.txt", &change.Old.BlobRef, &change.New.BlobRef)
+		}
+	}
+
+	changes, err = bucket1.Select().Diff(versions[1], versions[0])
+	if err != nil || len(changes) != len(want) || changes[0].Kind != filesystem.Added || changes[0].Path != "a/gone" {
+		t.Errorf("got reverse changes %v, %v", changes, err)
+	}
+	if changes, err := bucket1.Select().Dir("a").Diff(versions[1], versions[1]); err != nil || len(changes) != 0 {
+		t.Errorf("got changes %v, %v, want none", changes, err)
+	}
+
+	if _, err := bucket1.Select().Latest().Dir("a").Diff(versions[0], versions[1]); err == nil {
+		t.Errorf("expected an error diffing with a version constraint")
+	}
+	if _, err := bucket1.Select().Dir("a").File("keep.txt").Diff(versions[0], versions[1]); err == nil {
+		t.Errorf("expected an error diffing a file")
+	}
+	if _, err := bucket1.Select().Dir("b").Diff(versions[0], versions[1]); err == nil {
+		t.Errorf("expected an error diffing a missing dir")
+	}
+}
+
+func listEntriesTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd2"}
+	tx := bucket1.NewPutTransaction()
+	tx.Dir("d").File("a.txt", ref1)
+	tx.Dir("d/b").File("x", ref1)
+	tx.Dir("d").File("c.txt", ref1)
+	tx.Dir("d").File("e", ref1)
+	tx.Dir("d").File("f.txt", ref1)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Dir("d").File("c.txt", ref2)
+	tx.Dir("d/e").File("y", ref2)
+	tx.Dir("d").Remove("f.txt")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	versions, err := bucket1.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+
+	// describe gives each entry as name, "/" for dirs, "@" and the version
+	// index.
+	describe := func(entries []filesystem.WalkEntry) []string {
+		var got []string
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir {
+				name += "/"
+			}
+			for i, version := range versions {
+				if entry.Version == version {
+					name += fmt.Sprintf("@%d", i)
+				}
+			}
+			got = append(got, name)
+		}
+		return got
+	}
+	// pages lists d in pages of limit entries.
+	pages := func(selector func() filesystem.Selector, limit int) ([][]string, error) {
+		var got [][]string
+		opts := filesystem.ListOptions{Limit: limit}
+		for {
+			page, err := selector().ListEntries(opts)
+			if err != nil {
+				return got, err
+			}
+			got = append(got, describe(page.Entries))
+			if page.NextPageToken == "" {
+				return got, nil
+			}
+			opts.PageToken = page.NextPageToken
+		}
+	}
+
+	latest := func() filesystem.Selector { return bucket1.Select().Dir("d") }
+	first := func() filesystem.Selector { return bucket1.Select().Version(versions[0]).Dir("d") }
+	since := func() filesystem.Selector { return bucket1.Select().Dir("d").Since(versions[1]) }
+	tests := []struct {
+		name     string
+		selector func() filesystem.Selector
+		limit    int
+		want     [][]string
+	}{
+		{"All", latest, 0, [][]string{{"a.txt@0", "b/@0", "c.txt@1", "e/@1"}}},
+		{"Pages", latest, 2, [][]string{{"a.txt@0", "b/@0"}, {"c.txt@1", "e/@1"}}},
+		{"Short last page", latest, 3, [][]string{{"a.txt@0", "b/@0", "c.txt@1"}, {"e/@1"}}},
+		{"Version", first, 2, [][]string{{"a.txt@0", "b/@0"}, {"c.txt@0", "e@0"}, {"f.txt@0"}}},
+		{"Range", since, 1, [][]string{{"c.txt@1"}, {"e/@1"}}},
+	}
+	for _, test := range tests {
+		got, err := pages(test.selector, test.limit)
+		if err != nil {
+			t.Errorf("%s: error listing: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got pages %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	page, err := latest().ListEntries(filesystem.ListOptions{})
+	if err != nil || len(page.Entries) != 4 || page.Entries[2].BlobRef != ref2 || page.Entries[2].Path != "d/c.txt" {
+		t.Errorf("got page %+v, %v", page, err)
+	}
+	if _, err := latest().ListEntries(filesystem.ListOptions{PageToken: "!"}); err == nil {
+		t.Errorf("expected an error for an invalid page token")
+	}
+	if _, err := latest().ListEntries(filesystem.ListOptions{Limit: -1}); err == nil {
+		t.Errorf("expected an error for a negative limit")
+	}
+	if _, err := latest().File("a.txt").ListEntries(filesystem.ListOptions{}); err == nil {
+		t.Errorf("expected an error listing a file")
+	}
+}
+
+func iterVersionsTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	// More versions than a backend fetches at a time, with a removal in
+	// the middle.
+	ref := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd"}
+	for i := 0; i < 230; i++ {
+		tx := bucket1.NewPutTransaction()
+		if i == 120 {
+			tx.Dir("a").Remove("b")
+		} else {
+			tx.Dir("a").File("b", ref)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+	all, err := bucket1.Select().Dir("a").File("b").Versions()
+	if err != nil || len(all) != 229 {
+		t.Fatalf("got %d versions, %v, want 229", len(all), err)
+	}
+	reversed := func(versions []filesystem.Version) []filesystem.Version {
+		var results []filesystem.Version
+		for i := len(versions) - 1; i >= 0; i-- {
+			results = append(results, versions[i])
+		}
+		return results
+	}
+	collect := func(it filesystem.VersionIterator) ([]filesystem.Version, error) {
+		var versions []filesystem.Version
+		for {
+			version, err := it.Next()
+			if err == filesystem.Done {
+				// Done is sticky.
+				if _, err := it.Next(); err != filesystem.Done {
+					return versions, fmt.Errorf("got %v after Done", err)
+				}
+				return versions, nil
+			}
+			if err != nil {
+				return versions, err
+			}
+			versions = append(versions, version)
+		}
+	}
+
+	file := func() filesystem.Selector { return bucket1.Select().Dir("a").File("b") }
+	oldest := filesystem.VersionOptions{}
+	newest := filesystem.VersionOptions{NewestFirst: true}
+	tests := []struct {
+		name     string
+		selector filesystem.Selector
+		opts     filesystem.VersionOptions
+		want     []filesystem.Version
+	}{
+		{"Oldest first", file(), oldest, all},
+		{"Newest first", file(), newest, reversed(all)},
+		{"Limit", file(), filesystem.VersionOptions{Limit: 7}, all[:7]},
+		{"Newest first limit", file(), filesystem.VersionOptions{NewestFirst: true, Limit: 7}, reversed(all[len(all)-7:])},
+		{"Since", file().Since(all[150]), newest, reversed(all[150:])},
+		{"Between", file().Between(all[10], all[120]), oldest, all[10:121]},
+		{"Last", file().Last(5), oldest, all[len(all)-5:]},
+		{"Last limit", file().Last(5), filesystem.VersionOptions{NewestFirst: true, Limit: 2}, reversed(all[len(all)-2:])},
+		{"Version", file().Version(all[3]), newest, all[3:4]},
+		{"Dir", bucket1.Select().Dir("a").Last(2), newest, reversed(all[len(all)-2:])},
+		{"Missing", bucket1.Select().File("c"), oldest, nil},
+	}
+	for _, test := range tests {
+		got, err := collect(test.selector.IterVersions(test.opts))
+		if err != nil {
+			t.Errorf("%s: error iterating: %v", test.name, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %d versions %v, want %d %v", test.name, len(got), got, len(test.want), test.want)
+		}
+	}
+	if _, err := collect(file().IterVersions(filesystem.VersionOptions{Limit: -1})); err == nil {
+		t.Errorf("expected an error for a negative limit")
+	}
+	if _, err := collect(file().Latest().Last(1).IterVersions(oldest)); err == nil {
+		t.Errorf("expected an error for an invalid selector")
+	}
+}
+
+func deleteVersionsTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd2"}
+	tx := bucket1.NewPutTransaction()
+	tx.Dir("a").File("b", ref1)
+	tx.Dir("a").File("c", ref1)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Dir("a").File("b", ref2)
+	tx.Dir("a").Remove("c")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Dir("a").File("d", ref2)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	versions, err := bucket1.Select().Versions()
+	if err != nil || len(versions) != 3 {
+		t.Fatalf("got versions %v, %v, want three", versions, err)
+	}
+
+	if err := bucket1.DeleteVersions(versions[1]); err != nil {
+		t.Fatalf("error deleting version: %v", err)
+	}
+	// As if the second commit had never been made.
+	if got, err := bucket1.Select().Dir("a").File("b").Versions(); err != nil || !reflect.DeepEqual(got, versions[:1]) {
+		t.Errorf("got versions %v, %v, want %v", got, err, versions[:1])
+	}
+	if ref, err := bucket1.Select().Dir("a").File("b").Latest().BlobRef(); err != nil || ref.BlobRef != ref1 {
+		t.Errorf("got latest ref %v, %v, want %v", &ref.BlobRef, err, &ref1)
+	}
+	if names, err := bucket1.Select().Dir("a").List(); err != nil || !reflect.DeepEqual(names, []string{"a/b", "a/c", "a/d"}) {
+		t.Errorf("got listing %v, %v, want [a/b a/c a/d]", names, err)
+	}
+	if _, err := bucket1.Select().Version(versions[1]).Dir("a").File("b").BlobRef(); err == nil {
+		t.Errorf("expected an error selecting a deleted version")
+	}
+	snapshots, err := bucket1.Snapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[0].Version != versions[0] || snapshots[1].Version != versions[2] {
+		t.Errorf("got snapshots %+v, %v, want the first and third", snapshots, err)
+	}
+	if _, err := bucket1.Snapshot(versions[1]); err == nil {
+		t.Errorf("expected an error fetching the snapshot of a deleted version")
+	}
+	if err := bucket1.DeleteVersions(versions[1]); err == nil {
+		t.Errorf("expected an error deleting a deleted version")
+	}
+
+	// Commits after deleting the latest version still get newer versions.
+	if err := bucket1.DeleteVersions(versions[2]); err != nil {
+		t.Fatalf("error deleting version: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Dir("a").File("e", ref2)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	after, err := bucket1.Select().Versions()
+	if err != nil || len(after) != 2 || after[1].Compare(versions[2]) <= 0 {
+		t.Errorf("got versions %v, %v, want a version newer than %v", after, err, versions[2])
+	}
+}
+
+func bucketLifecycleTest(t T, service filesystem.FilesystemService) {
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	start := time.Now().Add(-time.Second)
+
+	// Merely selecting a bucket doesn't create it.
+	service.Bucket("unused").Select().Versions()
+	if infos, err := service.Buckets(); err != nil || len(infos) != 0 {
+		t.Errorf("got buckets %+v, %v, want none", infos, err)
+	}
+	if _, err := service.DescribeBucket("unused"); err != filesystem.ErrNoSuchBucket {
+		t.Errorf("got %v describing a missing bucket, want ErrNoSuchBucket", err)
+	}
+
+	created, err := service.CreateBucket("photos", filesystem.BucketOptions{Description: "family photos", Owner: "alice"})
+	if err != nil {
+		t.Fatalf("error creating bucket: %v", err)
+	}
+	if _, err := service.CreateBucket("photos", filesystem.BucketOptions{}); err != filesystem.ErrBucketExists {
+		t.Errorf("got %v creating an existing bucket, want ErrBucketExists", err)
+	}
+	tx := created.NewPutTransaction()
+	tx.Dir("a").File("b", ref1)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	// A commit creates a bucket implicitly.
+	tx = service.Bucket("docs").NewPutTransaction()
+	tx.File("c", ref1)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if _, err := service.CreateBucket("docs", filesystem.BucketOptions{}); err != filesystem.ErrBucketExists {
+		t.Errorf("got %v creating a committed bucket, want ErrBucketExists", err)
+	}
+
+	infos, err := service.Buckets()
+	if err != nil || len(infos) != 2 || infos[0].Name != "docs" || infos[1].Name != "photos" {
+		t.Fatalf("got buckets %+v, %v, want docs and photos", infos, err)
+	}
+	for _, info := range infos {
+		if info.Created.Before(start) || info.Created.After(time.Now()) {
+			t.Errorf("bucket %s created at %v, want after %v", info.Name, info.Created, start)
+		}
+	}
+	if infos[1].Description != "family photos" || infos[1].Owner != "alice" {
+		t.Errorf("got %+v, want the options photos was created with", infos[1])
+	}
+	if info, err := service.DescribeBucket("photos"); err != nil || info != infos[1] {
+		t.Errorf("got %+v, %v describing photos, want %+v", info, err, infos[1])
+	}
+
+	if err := service.RenameBucket("photos", "docs"); err != filesystem.ErrBucketExists {
+		t.Errorf("got %v renaming onto an existing bucket, want ErrBucketExists", err)
+	}
+	if err := service.RenameBucket("unused", "other"); err != filesystem.ErrNoSuchBucket {
+		t.Errorf("got %v renaming a missing bucket, want ErrNoSuchBucket", err)
+	}
+	if err := service.RenameBucket("photos", "pictures"); err != nil {
+		t.Fatalf("error renaming bucket: %v", err)
+	}
+	if info, err := service.DescribeBucket("pictures"); err != nil || info.Owner != "alice" || !info.Created.Equal(infos[1].Created) {
+		t.Errorf("got %+v, %v describing the renamed bucket, want %+v", info, err, infos[1])
+	}
+	if _, err := service.DescribeBucket("photos"); err != filesystem.ErrNoSuchBucket {
+		t.Errorf("got %v describing the old name, want ErrNoSuchBucket", err)
+	}
+	if ref, err := service.Bucket("pictures").Select().Dir("a").File("b").Latest().BlobRef(); err != nil || ref.BlobRef != ref1 {
+		t.Errorf("got %v, %v from the renamed bucket, want %v", &ref.BlobRef, err, &ref1)
+	}
+	// Existing handles keep referring to the old name.
+	if versions, err := created.Select().Versions(); err != nil || len(versions) != 0 {
+		t.Errorf("got versions %v, %v under the old name, want none", versions, err)
+	}
+
+	if err := service.DeleteBucket("pictures", "photos"); err != filesystem.ErrNotConfirmed {
+		t.Errorf("got %v deleting without confirmation, want ErrNotConfirmed", err)
+	}
+	if err := service.DeleteBucket("unused", "unused"); err != filesystem.ErrNoSuchBucket {
+		t.Errorf("got %v deleting a missing bucket, want ErrNoSuchBucket", err)
+	}
+	if err := service.DeleteBucket("pictures", "pictures"); err != nil {
+		t.Fatalf("error deleting bucket: %v", err)
+	}
+	if infos, err := service.Buckets(); err != nil || len(infos) != 1 || infos[0].Name != "docs" {
+		t.Errorf("got buckets %+v, %v, want only docs", infos, err)
+	}
+	if versions, err := service.Bucket("pictures").Select().Versions(); err != nil || len(versions) != 0 {
+		t.Errorf("got versions %v, %v of a deleted bucket, want none", versions, err)
+	}
+	if snapshots, err := service.Bucket("pictures").Snapshots(); err != nil || len(snapshots) != 0 {
+		t.Errorf("got snapshots %+v, %v of a deleted bucket, want none", snapshots, err)
+	}
+	// The name can be used again.
+	if _, err := service.CreateBucket("pictures", filesystem.BucketOptions{}); err != nil {
+		t.Errorf("error recreating bucket: %v", err)
+	}
+}
+
+func conflictTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd2"}
+
+	if head, err := bucket1.Head(); err != nil || head != "" {
+		t.Errorf("got head %q, %v of an empty bucket, want none", head, err)
+	}
+	tx1 := bucket1.NewPutTransaction()
+	tx1.SetParent("")
+	tx1.Dir("a").File("b", ref1)
+	tx2 := bucket1.NewPutTransaction()
+	tx2.SetParent("")
+	tx2.Dir("a").File("c", ref1)
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	head, err := bucket1.Head()
+	if err != nil || head == "" {
+		t.Fatalf("got head %q, %v, want the first commit", head, err)
+	}
+	err = tx2.Commit()
+	conflict, ok := err.(*filesystem.ConflictError)
+	if !ok {
+		t.Fatalf("got %v committing against an old parent, want a conflict", err)
+	}
+	if conflict.Parent != "" || conflict.Head != head || !reflect.DeepEqual(conflict.Changed, []string{"a/b"}) {
+		t.Errorf("got conflict %+v, want head %q and a/b changed", conflict, head)
+	}
+	if versions, err := bucket1.Select().Versions(); err != nil || len(versions) != 1 {
+		t.Errorf("got versions %v, %v, want only the first commit", versions, err)
+	}
+
+	// Without a parent, commits don't conflict.
+	tx := bucket1.NewPutTransaction()
+	tx.Dir("a").File("d", ref1)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+
+	// Another host commits while the transaction is built: as it changed
+	// other paths, the transaction is rebased onto it.
+	other := func(path string, ref filesystem.BlobRef) {
+		tx := bucket1.NewPutTransaction()
+		tx.File(path, ref)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+	err = filesystem.CommitWithRetry(bucket1, 3, func(tx filesystem.PutTransaction) error {
+		tx.Dir("a").File("b", ref2)
+		tx.Dir("a").Remove("d")
+		other("e", ref1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error committing with retry: %v", err)
+	}
+	if ref, err := bucket1.Select().Dir("a").File("b").Latest().BlobRef(); err != nil || ref.BlobRef != ref2 {
+		t.Errorf("got %v, %v, want the rebased write %v", &ref.BlobRef, err, &ref2)
+	}
+	if names, err := bucket1.Select().List(); err != nil || !reflect.DeepEqual(names, []string{"a", "e"}) {
+		t.Errorf("got listing %v, %v, want [a e]", names, err)
+	}
+
+	// A concurrent change to a path the transaction touches isn't rebased.
+	err = filesystem.CommitWithRetry(bucket1, 3, func(tx filesystem.PutTransaction) error {
+		tx.RemoveAll("a")
+		other("a/f", ref1)
+		return nil
+	})
+	if conflict, ok := err.(*filesystem.ConflictError); !ok || !reflect.DeepEqual(conflict.Changed, []string{"a/f"}) {
+		t.Errorf("got %v, want a conflict on a/f", err)
+	}
+	if _, err := bucket1.Select().Dir("a").File("f").Latest().BlobRef(); err != nil {
+		t.Errorf("error selecting the concurrent write: %v", err)
+	}
+}
+
+func refsTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd2"}
+	for _, ref := range []filesystem.BlobRef{ref1, ref2} {
+		tx := bucket1.NewPutTransaction()
+		tx.Dir("a").File("b", ref)
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+	versions, err := bucket1.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+
+	if err := bucket1.SetRef("pre-migration", versions[0]); err != nil {
+		t.Fatalf("error setting ref: %v", err)
+	}
+	if err := bucket1.SetRef("end-of-year", versions[1]); err != nil {
+		t.Fatalf("error setting ref: %v", err)
+	}
+	if err := bucket1.SetRef("bad", "000000000001.000000000.000000"); err == nil {
+		t.Errorf("expected an error setting a ref to an unknown version")
+	}
+	if err := bucket1.SetRef("", versions[0]); err == nil {
+		t.Errorf("expected an error setting an unnamed ref")
+	}
+	want := []filesystem.Ref{{Name: "end-of-year", Version: versions[1]}, {Name: "pre-migration", Version: versions[0]}}
+	if refs, err := bucket1.Refs(); err != nil || !reflect.DeepEqual(refs, want) {
+		t.Errorf("got refs %+v, %v, want %+v", refs, err, want)
+	}
+	if version, err := bucket1.Ref("pre-migration"); err != nil || version != versions[0] {
+		t.Errorf("got %q, %v, want %q", version, err, versions[0])
+	}
+	if _, err := bucket1.Ref("missing"); err == nil {
+		t.Errorf("expected an error looking up a missing ref")
+	}
+
+	// A tag selects a version like Version does.
+	if ref, err := bucket1.Select().Tag("pre-migration").Dir("a").File("b").BlobRef(); err != nil || ref.BlobRef != ref1 || ref.Version != versions[0] {
+		t.Errorf("got %v, %v at the tag, want %v", &ref, err, &ref1)
+	}
+	if ref, err := bucket1.Select().Dir("a").Tag("end-of-year").File("b").BlobRef(); err != nil || ref.BlobRef != ref2 {
+		t.Errorf("got %v, %v at the tag, want %v", &ref.BlobRef, err, &ref2)
+	}
+	if names, err := bucket1.Select().Tag("pre-migration").Dir("a").List(); err != nil || !reflect.DeepEqual(names, []string{"a/b"}) {
+		t.Errorf("got listing %v, %v at the tag, want [a/b]", names, err)
+	}
+	if _, err := bucket1.Select().Tag("missing").Dir("a").File("b").BlobRef(); err == nil {
+		t.Errorf("expected an error selecting a missing tag")
+	}
+	if _, err := bucket1.Select().Tag("").Dir("a").List(); err == nil {
+		t.Errorf("expected an error selecting an empty tag")
+	}
+	if _, err := bucket1.Select().Tag("pre-migration").Latest().Dir("a").List(); err == nil {
+		t.Errorf("expected an error combining a tag and another version constraint")
+	}
+
+	// Tagged versions can't be deleted until the ref is moved or deleted.
+	if err := bucket1.DeleteVersions(versions[0]); err == nil {
+		t.Errorf("expected an error deleting a tagged version")
+	}
+	if err := bucket1.SetRef("pre-migration", versions[1]); err != nil {
+		t.Fatalf("error moving ref: %v", err)
+	}
+	if ref, err := bucket1.Select().Tag("pre-migration").Dir("a").File("b").BlobRef(); err != nil || ref.BlobRef != ref2 {
+		t.Errorf("got %v, %v at the moved tag, want %v", &ref.BlobRef, err, &ref2)
+	}
+	if err := bucket1.DeleteVersions(versions[0]); err != nil {
+		t.Errorf("error deleting a version no longer tagged: %v", err)
+	}
+	if err := bucket1.DeleteRef("pre-migration"); err != nil {
+		t.Errorf("error deleting ref: %v", err)
+	}
+	if err := bucket1.DeleteRef("pre-migration"); err == nil {
+		t.Errorf("expected an error deleting a missing ref")
+	}
+
+	// Refs move with a renamed bucket.
+	if err := service.RenameBucket("testbucket1", "testbucket2"); err != nil {
+		t.Fatalf("error renaming bucket: %v", err)
+	}
+	if version, err := service.Bucket("testbucket2").Ref("end-of-year"); err != nil || version != versions[1] {
+		t.Errorf("got %q, %v from the renamed bucket, want %q", version, err, versions[1])
+	}
+	if refs, err := bucket1.Refs(); err != nil || len(refs) != 0 {
+		t.Errorf("got refs %+v, %v under the old name, want none", refs, err)
+	}
+}
+
+func exportImportTest(t T, service filesystem.FilesystemService) {
+	bucket1 := service.Bucket("testbucket1")
+	ref1 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd1"}
+	ref2 := filesystem.BlobRef{Store: "store_a", Name: "store_a_abcd2"}
+	tx := bucket1.NewPutTransaction()
+	tx.Describe(filesystem.Snapshot{Message: "first"})
+	tx.Dir("a").FileWithMetadata("b", ref1, filesystem.Metadata{Size: 3, Hash: "ab"})
+	tx.Dir("a").File("x", ref2)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Move("a", "c")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing move: %v", err)
+	}
+	tx = bucket1.NewPutTransaction()
+	tx.Remove("c/x")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing removal: %v", err)
+	}
+	snapshots, err := bucket1.Snapshots()
+	if err != nil || len(snapshots) != 3 {
+		t.Fatalf("got snapshots %v, %v, want three", snapshots, err)
+	}
+
+	var commits []*filesystem.Commit
+	for _, snapshot := range snapshots {
+		commit, err := bucket1.ExportCommit(snapshot.Version)
+		if err != nil {
+			t.Fatalf("error exporting %s: %v", snapshot.Version, err)
+		}
+		commits = append(commits, commit)
+	}
+	want := []filesystem.Commit{
+		{
+			Dirs: []string{"", "a"},
+			Files: []filesystem.CommittedFile{
+				{Path: "a/b", BlobRef: ref1, Metadata: filesystem.Metadata{Size: 3, Hash: "ab"}},
+				{Path: "a/x", BlobRef: ref2},
+			},
+		},
+		{
+			Dirs: []string{"", "c"},
+			Files: []filesystem.CommittedFile{
+				{Path: "c/b", BlobRef: ref1, Metadata: filesystem.Metadata{Size: 3, Hash: "ab"}},
+				{Path: "c/x", BlobRef: ref2},
+			},
+			Removed: []string{"a", "a/b", "a/x"},
+			Renames: []filesystem.Rename{{From: "a", To: "c"}, {From: "a/b", To: "c/b"}, {From: "a/x", To: "c/x"}},
+		},
+		{
+			Dirs:    []string{"", "c"},
+			Removed: []string{"c/x"},
+		},
+	}
+	for i, commit := range commits {
+		if commit.Snapshot.Version != snapshots[i].Version || commit.Snapshot.Files != len(want[i].Files) {
+			t.Errorf("got snapshot %+v in commit %d, want %+v", commit.Snapshot, i, snapshots[i])
+		}
+		got := *commit
+		got.Snapshot = filesystem.Snapshot{}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("got commit %d %+v, want %+v", i, got, want[i])
+		}
+	}
+	if commits[0].Snapshot.Message != "first" {
+		t.Errorf("got message %q, want first", commits[0].Snapshot.Message)
+	}
+	if _, err := bucket1.ExportCommit("000000000001.000000000.000000"); err == nil {
+		t.Errorf("expected an error exporting an unknown version")
+	}
+
+	// Replaying the commits into another bucket gives the same history.
+	bucket2 := service.Bucket("testbucket2")
+	for _, commit := range commits {
+		if err := bucket2.ImportCommit(commit); err != nil {
+			t.Fatalf("error importing %s: %v", commit.Snapshot.Version, err)
+		}
+	}
+	if err := bucket2.ImportCommit(commits[1]); err == nil {
+		t.Errorf("expected an error importing a version older than the head")
+	}
+	if head, err := bucket2.Head(); err != nil || head != snapshots[2].Version {
+		t.Errorf("got head %q, %v, want %q", head, err, snapshots[2].Version)
+	}
+	for i, snapshot := range snapshots {
+		commit, err := bucket2.ExportCommit(snapshot.Version)
+		if err != nil {
+			t.Fatalf("error exporting imported %s: %v", snapshot.Version, err)
+		}
+		commit.Snapshot = filesystem.Snapshot{}
+		if !reflect.DeepEqual(*commit, want[i]) {
+			t.Errorf("got imported commit %d %+v, want %+v", i, *commit, want[i])
+		}
+	}
+	if names, err := bucket2.Select().Dir("c").List(); err != nil || !reflect.DeepEqual(names, []string{"c/b"}) {
+		t.Errorf("got listing %v, %v of the imported bucket, want [c/b]", names, err)
+	}
+	if names, err := bucket2.Select().Version(snapshots[0].Version).Dir("a").List(); err != nil || !reflect.DeepEqual(names, []string{"a/b", "a/x"}) {
+		t.Errorf("got listing %v, %v of the first imported version, want [a/b a/x]", names, err)
+	}
+}
+
 func filesystemTest(t *testing.T, serviceFactory func() filesystem.FilesystemService) {
 	tests := []struct{
 		Name string
@@ -364,6 +1763,25 @@ func filesystemTest(t *testing.T, serviceFactory func() filesystem.FilesystemSer
 		{ "Directory Specifiers", directorySpecifiers},
 		{ "Independent Buckets", independentBuckets},
 		{ "Reference Same Bucket", referenceSameBucket},
+		{ "Remove File", removeFileTest},
+		{ "Remove Dir", removeDirTest},
+		{ "Move", moveTest},
+		{ "Metadata", metadataTest},
+		{ "Special Files", specialFilesTest},
+		{ "Snapshots", snapshotsTest},
+		{ "Snapshot Times", snapshotTimesTest},
+		{ "Time Selection", timeSelectionTest},
+		{ "Range Selection", rangeSelectionTest},
+		{ "Glob", globTest},
+		{ "Walk", walkTest},
+		{ "Diff", diffTest},
+		{ "List Entries", listEntriesTest},
+		{ "Iterate Versions", iterVersionsTest},
+		{ "Delete Versions", deleteVersionsTest},
+		{ "Bucket Lifecycle", bucketLifecycleTest},
+		{ "Conflict", conflictTest},
+		{ "Refs", refsTest},
+		{ "Export and Import", exportImportTest},
 	}
 	for _, test := range tests {
 		wrap := &tWrapper{name: test.Name, t: t}
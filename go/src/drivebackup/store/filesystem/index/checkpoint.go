@@ -0,0 +1,116 @@
+package index
+
+import (
+	"sort"
+
+	"drivebackup/store/filesystem"
+)
+
+// Checkpoint is the state of a bucket apart from its versions, which
+// Checkpoint gives as VersionEntries. Applying the checkpoint and then its
+// versions in order to an empty bucket restores the bucket, without the
+// changes that led to it.
+type Checkpoint struct {
+	Info          filesystem.BucketInfo
+	Exists        bool
+	LatestVersion filesystem.Version
+	Refs          map[string]filesystem.Version `json:",omitempty"`
+}
+
+// VersionEntries are the entries written at a version, as they are after
+// any deletions of other versions.
+type VersionEntries struct {
+	Snapshot filesystem.Snapshot
+	Dirs     []EntryRecord `json:",omitempty"`
+	Files    []EntryRecord `json:",omitempty"`
+}
+
+// EntryRecord is one entry of a VersionEntries.
+type EntryRecord struct {
+	Path      string
+	BlobRef   filesystem.BlobRef
+	Metadata  filesystem.Metadata
+	Removed   bool   `json:",omitempty"`
+	MovedFrom string `json:",omitempty"`
+}
+
+// Checkpoint returns the state of the bucket, and its versions oldest
+// first. It returns nil if there is nothing to restore.
+func (b *Bucket) Checkpoint() (*Checkpoint, []*VersionEntries) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if !b.exists && b.latestVersion == "" && len(b.refs) == 0 {
+		return nil, nil
+	}
+	cp := &Checkpoint{Info: b.info, Exists: b.exists, LatestVersion: b.latestVersion, Refs: map[string]filesystem.Version{}}
+	for name, version := range b.refs {
+		cp.Refs[name] = version
+	}
+	var versions []*VersionEntries
+	for _, snapshot := range b.snapshots {
+		ve := &VersionEntries{Snapshot: snapshot}
+		seen := map[string]bool{}
+		for _, path := range b.written[snapshot.Version] {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			ve.Dirs = append(ve.Dirs, entriesAt(b.dirVersions[path], path, snapshot.Version)...)
+			ve.Files = append(ve.Files, entriesAt(b.fileVersions[path], path, snapshot.Version)...)
+		}
+		sort.SliceStable(ve.Dirs, func(i, j int) bool { return ve.Dirs[i].Path < ve.Dirs[j].Path })
+		sort.SliceStable(ve.Files, func(i, j int) bool { return ve.Files[i].Path < ve.Files[j].Path })
+		versions = append(versions, ve)
+	}
+	return cp, versions
+}
+
+// entriesAt returns the entries of h written at version.
+func entriesAt(h *history, path string, version filesystem.Version) []EntryRecord {
+	if h == nil {
+		return nil
+	}
+	var records []EntryRecord
+	for _, e := range h.entries {
+		if e.Version == version {
+			records = append(records, EntryRecord{Path: path, BlobRef: e.BlobRef, Metadata: e.Metadata, Removed: e.removed, MovedFrom: e.movedFrom})
+		}
+	}
+	return records
+}
+
+// ApplyCheckpoint restores the state of a bucket from cp. Its versions are
+// applied after it with ApplyVersionEntries.
+func (b *Bucket) ApplyCheckpoint(cp *Checkpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.info = cp.Info
+	b.exists = cp.Exists
+	b.latestVersion = cp.LatestVersion
+	b.refs = map[string]filesystem.Version{}
+	for name, version := range cp.Refs {
+		b.refs[name] = version
+	}
+}
+
+// ApplyVersionEntries restores a version of a checkpoint. Versions must be
+// applied oldest first.
+func (b *Bucket) ApplyVersionEntries(ve *VersionEntries) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range ve.Dirs {
+		b.add(b.dirVersions, r.Path, r.entry(ve.Snapshot.Version))
+	}
+	for _, r := range ve.Files {
+		b.add(b.fileVersions, r.Path, r.entry(ve.Snapshot.Version))
+	}
+	b.snapshots = append(b.snapshots, ve.Snapshot)
+}
+
+func (r *EntryRecord) entry(version filesystem.Version) *entry {
+	return &entry{
+		StoredBlobRef: filesystem.StoredBlobRef{BlobRef: r.BlobRef, Version: version, Metadata: r.Metadata},
+		removed:       r.Removed,
+		movedFrom:     r.MovedFrom,
+	}
+}
@@ -0,0 +1,36 @@
+package index
+
+import (
+	"sort"
+
+	"drivebackup/store/filesystem"
+)
+
+// Diff compares the entries of a dir at two versions, as Walk would visit
+// them, and returns the changes in the order Walk would visit them.
+// Backends fetch both sides in bulk and compare them with it.
+func Diff(before, after []filesystem.WalkEntry) []filesystem.Change {
+	byPath := map[string]*filesystem.WalkEntry{}
+	for i := range before {
+		byPath[before[i].Path] = &before[i]
+	}
+	var changes []filesystem.Change
+	for i := range after {
+		n := &after[i]
+		o, ok := byPath[n.Path]
+		delete(byPath, n.Path)
+		switch {
+		case !ok:
+			changes = append(changes, filesystem.Change{Path: n.Path, Kind: filesystem.Added, New: n})
+		case o.IsDir != n.IsDir || (!o.IsDir && o.Metadata.Type != n.Metadata.Type):
+			changes = append(changes, filesystem.Change{Path: n.Path, Kind: filesystem.TypeChanged, Old: o, New: n})
+		case !o.IsDir && (o.BlobRef != n.BlobRef || o.Metadata.LinkTarget != n.Metadata.LinkTarget || o.Metadata.Device != n.Metadata.Device):
+			changes = append(changes, filesystem.Change{Path: n.Path, Kind: filesystem.Modified, Old: o, New: n})
+		}
+	}
+	for _, o := range byPath {
+		changes = append(changes, filesystem.Change{Path: o.Path, Kind: filesystem.Removed, Old: o})
+	}
+	sort.Slice(changes, func(i, j int) bool { return lessPath(changes[i].Path, changes[j].Path) })
+	return changes
+}
@@ -0,0 +1,159 @@
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"drivebackup/store/filesystem"
+)
+
+// Removal is a requested removal of a file or dir.
+type Removal struct {
+	Path      string
+	Recursive bool
+}
+
+// Covers reports whether path is removed by r.
+func (r Removal) Covers(path string) bool {
+	return path == r.Path || (r.Recursive && inDir(path, r.Path))
+}
+
+// Move is a requested move of a file or dir, with everything below it.
+type Move struct {
+	From, To string
+}
+
+// Rename records that a move wrote To from the newest version of From.
+type Rename = filesystem.Rename
+
+// Node is a file or dir that exists in the newest committed state of a
+// bucket.
+type Node struct {
+	Path    string
+	IsFile  bool
+	BlobRef  filesystem.BlobRef // unset for dirs
+	Metadata filesystem.Metadata
+}
+
+// ExpandMoves turns the moves requested by rec into writes of the moved files
+// and dirs under their new paths, renames linking them to their old paths and
+// recursive removals of the old paths. liveBelow returns the node at a path
+// and the nodes below it. Moves act on the state before the commit, so
+// writes of the transaction under a moved path aren't moved.
+func ExpandMoves(rec *Record, liveBelow func(path string) ([]Node, error)) error {
+	if len(rec.Moves) == 0 {
+		return nil
+	}
+	written := map[string]bool{}
+	for _, path := range rec.Dirs {
+		written[path] = true
+	}
+	for _, f := range rec.Files {
+		written[f.Path] = true
+	}
+	for _, move := range rec.Moves {
+		if move.From == "" || move.To == "" {
+			return fmt.Errorf("the bucket root can't be moved")
+		}
+		if move.To == move.From || inDir(move.To, move.From) {
+			return fmt.Errorf("can't move %q into itself", move.From)
+		}
+		nodes, err := liveBelow(move.From)
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("can't move %q: not found", move.From)
+		}
+		existing, err := liveBelow(move.To)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("can't move %q to %q: destination exists", move.From, move.To)
+		}
+		for _, node := range nodes {
+			to := move.To + strings.TrimPrefix(node.Path, move.From)
+			if written[to] {
+				return fmt.Errorf("can't move %q to %q: the transaction writes %q", move.From, move.To, to)
+			}
+			written[to] = true
+			if node.IsFile {
+				rec.Files = append(rec.Files, FileRecord{Path: to, BlobRef: node.BlobRef, Metadata: node.Metadata})
+			} else {
+				rec.Dirs = append(rec.Dirs, to)
+			}
+			rec.Renames = append(rec.Renames, Rename{From: node.Path, To: to})
+		}
+		rec.Removals = append(rec.Removals, Removal{Path: move.From, Recursive: true})
+	}
+	sort.Strings(rec.Dirs)
+	sort.Slice(rec.Files, func(i, j int) bool { return rec.Files[i].Path < rec.Files[j].Path })
+	sort.Slice(rec.Renames, func(i, j int) bool { return rec.Renames[i].To < rec.Renames[j].To })
+	return nil
+}
+
+// ExpandRemovals turns the removals requested by rec into the sorted list of
+// paths to tombstone: removed paths and, for recursive removals, everything
+// below them. liveBelow returns the node at a path and the nodes below it.
+// Paths that don't exist or that the transaction writes again are left out.
+// A non-recursive removal of a dir that still has entries below it is an
+// error.
+func ExpandRemovals(rec *Record, liveBelow func(path string) ([]Node, error)) ([]string, error) {
+	if len(rec.Removals) == 0 {
+		return nil, nil
+	}
+	written := map[string]bool{}
+	for _, path := range rec.Dirs {
+		written[path] = true
+	}
+	for _, f := range rec.Files {
+		written[f.Path] = true
+	}
+	removed := map[string]bool{}
+	below := map[string][]Node{}
+	for _, removal := range rec.Removals {
+		if removal.Path == "" {
+			return nil, fmt.Errorf("the bucket root can't be removed")
+		}
+		nodes, err := liveBelow(removal.Path)
+		if err != nil {
+			return nil, err
+		}
+		below[removal.Path] = nodes
+		for _, node := range nodes {
+			if removal.Covers(node.Path) {
+				removed[node.Path] = true
+			}
+		}
+	}
+	for _, removal := range rec.Removals {
+		if removal.Recursive {
+			continue
+		}
+		for _, node := range below[removal.Path] {
+			if !removed[node.Path] {
+				return nil, fmt.Errorf("can't remove %q: directory not empty", removal.Path)
+			}
+		}
+	}
+	var paths []string
+	for path := range removed {
+		if !written[path] {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// parentDir returns the dir containing path, "" for the bucket root.
+func parentDir(path string) string {
+	parent := filepath.Dir(path)
+	if parent == "." {
+		return ""
+	}
+	return parent
+}
@@ -0,0 +1,106 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+
+	"drivebackup/store/filesystem"
+)
+
+// ExportCommit reads the commit back from the entries written at version,
+// visiting only the paths it wrote. Tombstones become Removed, and the
+// sources of moved entries Renames.
+func (b *Bucket) ExportCommit(version filesystem.Version) (*filesystem.Commit, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	c := &filesystem.Commit{}
+	found := false
+	for _, snapshot := range b.snapshots {
+		if snapshot.Version == version {
+			c.Snapshot, found = snapshot, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no version %q", version)
+	}
+	removed := map[string]bool{}
+	seen := map[string]bool{}
+	for _, path := range b.written[version] {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if e := b.dirVersions[path].at(version); e != nil {
+			if e.removed {
+				removed[path] = true
+			} else {
+				c.Dirs = append(c.Dirs, path)
+				if e.movedFrom != "" {
+					c.Renames = append(c.Renames, Rename{From: e.movedFrom, To: path})
+				}
+			}
+		}
+		if e := b.fileVersions[path].at(version); e != nil {
+			if e.removed {
+				removed[path] = true
+			} else {
+				c.Files = append(c.Files, filesystem.CommittedFile{Path: path, BlobRef: e.BlobRef, Metadata: e.Metadata})
+				if e.movedFrom != "" {
+					c.Renames = append(c.Renames, Rename{From: e.movedFrom, To: path})
+				}
+			}
+		}
+	}
+	for path := range removed {
+		c.Removed = append(c.Removed, path)
+	}
+	sort.Strings(c.Dirs)
+	sort.Slice(c.Files, func(i, j int) bool { return c.Files[i].Path < c.Files[j].Path })
+	sort.Strings(c.Removed)
+	sort.Slice(c.Renames, func(i, j int) bool { return c.Renames[i].To < c.Renames[j].To })
+	return c, nil
+}
+
+// RecordOf returns the record of an imported commit.
+func RecordOf(c *filesystem.Commit) *Record {
+	rec := &Record{
+		Dirs:     append([]string(nil), c.Dirs...),
+		Removed:  append([]string(nil), c.Removed...),
+		Renames:  append([]Rename(nil), c.Renames...),
+		Snapshot: c.Snapshot,
+	}
+	for _, f := range c.Files {
+		rec.Files = append(rec.Files, FileRecord(f))
+	}
+	rec.SetVersion(c.Snapshot.Version)
+	return rec
+}
+
+// ImportCommit persists and applies the record of c, like a commit.
+func (b *Bucket) ImportCommit(c *filesystem.Commit) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := CheckImport(c, b.latestVersion); err != nil {
+		return err
+	}
+	rec := RecordOf(c)
+	if b.Persist != nil {
+		if err := b.Persist(rec); err != nil {
+			return err
+		}
+	}
+	b.apply(rec)
+	return nil
+}
+
+// CheckImport fails if c can't be imported into a bucket whose head is head.
+func CheckImport(c *filesystem.Commit, head filesystem.Version) error {
+	version := c.Snapshot.Version
+	if !version.Valid() {
+		return fmt.Errorf("importing commit of invalid version %q", version)
+	}
+	if head != "" && version.Compare(head) <= 0 {
+		return fmt.Errorf("importing version %s into a bucket at %s: versions must be newer than the head", version, head)
+	}
+	return nil
+}
@@ -0,0 +1,532 @@
+// Package index keeps the version history of a bucket in memory. It backs
+// both the mock filesystem service and the disk filesystem service, which
+// persists the records applied to the index and replays them on open.
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/selector"
+)
+
+// Record is one committed transaction.
+type Record struct {
+	Version filesystem.Version
+	Dirs    []string // every dir written, including parents, sorted
+	Files   []FileRecord
+	Removed []string `json:",omitempty"` // paths that were live and are now removed, sorted
+	Renames []Rename `json:",omitempty"` // links from the paths written by moves to their sources
+
+	// Removals and Moves are requested by the transaction. The backend
+	// expands them into the fields above when committing.
+	Removals []Removal `json:"-"`
+	Moves    []Move    `json:"-"`
+	// Parent, if HasParent, is the head the transaction was built against.
+	Parent    filesystem.Version `json:"-"`
+	HasParent bool               `json:"-"`
+
+	Snapshot filesystem.Snapshot
+}
+
+// SetVersion sets the version of rec and completes its snapshot. Backends
+// call it once the writes of rec are final.
+func (rec *Record) SetVersion(version filesystem.Version) {
+	rec.Version = version
+	rec.Snapshot.Version = version
+	rec.Snapshot.Files = len(rec.Files)
+	rec.Snapshot.Bytes = 0
+	for _, f := range rec.Files {
+		rec.Snapshot.Bytes += f.Metadata.Size
+	}
+}
+
+// Deletion is a call to DeleteVersions.
+type Deletion struct {
+	Versions []filesystem.Version
+}
+
+// FileRecord is a file written by a transaction.
+type FileRecord struct {
+	Path    string
+	BlobRef  filesystem.BlobRef
+	Metadata filesystem.Metadata
+}
+
+// entry is one version of a file or dir. A removed entry is a tombstone:
+// the path is absent from that version on, until it is written again.
+type entry struct {
+	filesystem.StoredBlobRef        // BlobRef is unset for dirs
+	removed                  bool
+	movedFrom                string // set if a move wrote the entry
+}
+
+// represents all versions of a particular file or dir, oldest first
+type history struct {
+	entries []*entry
+}
+
+func (h *history) String() string {
+	var str string
+	for i, entry := range h.entries {
+		if i > 0 {
+			str += ","
+		}
+		switch {
+		case entry.removed:
+			str += "-@" + string(entry.Version)
+		case entry.BlobRef != (filesystem.BlobRef{}):
+			str += entry.StoredBlobRef.String()
+		default:
+			str += "@" + string(entry.Version)
+		}
+	}
+	return str
+}
+
+// latest returns the newest entry, or nil if there are none.
+func (h *history) latest() *entry {
+	if h == nil || len(h.entries) == 0 {
+		return nil
+	}
+	return h.entries[len(h.entries)-1]
+}
+
+// live reports whether the path exists after the newest entry.
+func (h *history) live() bool {
+	latest := h.latest()
+	return latest != nil && !latest.removed
+}
+
+// at returns the entry written at version, or nil.
+func (h *history) at(version filesystem.Version) *entry {
+	if h == nil {
+		return nil
+	}
+	for _, entry := range h.entries {
+		if entry.Version == version {
+			return entry
+		}
+	}
+	return nil
+}
+
+// versions returns the versions at which the path was written, excluding
+// removals.
+func (h *history) versions() []filesystem.Version {
+	if h == nil {
+		return nil
+	}
+	var versions []filesystem.Version
+	for _, entry := range h.entries {
+		if !entry.removed {
+			versions = append(versions, entry.Version)
+		}
+	}
+	return versions
+}
+
+// Bucket is the in-memory history of one bucket. It is safe for concurrent
+// use.
+type Bucket struct {
+	// Persist, if set, is called with every record before it is applied.
+	// If it fails, the commit fails and the index is left unchanged.
+	Persist func(*Record) error
+	// PersistDeletion, if set, is called with every deletion before it is
+	// applied, like Persist.
+	PersistDeletion func(*Deletion) error
+	// PersistRef, if set, is called with every change to a ref before it
+	// is applied, like Persist.
+	PersistRef func(*RefUpdate) error
+	// Clock assigns versions. It defaults to filesystem.SystemClock.
+	Clock filesystem.Clock
+	// Name is the name of the bucket in its service.
+	Name string
+
+	mu            sync.RWMutex
+	fileVersions  map[string]*history
+	dirVersions   map[string]*history
+	children      map[string][]string             // dir -> sorted names of the paths below it with a history
+	written       map[filesystem.Version][]string // version -> paths it has an entry for
+	snapshots     []filesystem.Snapshot
+	refs          map[string]filesystem.Version
+	latestVersion filesystem.Version
+	info          filesystem.BucketInfo
+	exists        bool // created, or committed to
+}
+
+var _ filesystem.Bucket = (*Bucket)(nil)
+
+func NewBucket() *Bucket {
+	return &Bucket{
+		fileVersions: map[string]*history{},
+		dirVersions:  map[string]*history{},
+		children:     map[string][]string{},
+		written:      map[filesystem.Version][]string{},
+		refs:         map[string]filesystem.Version{},
+	}
+}
+
+func (b *Bucket) String() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keysSeen := map[string]bool{}
+	var keys []string
+	for path := range b.fileVersions {
+		keysSeen[path] = true
+		keys = append(keys, path)
+	}
+	for path := range b.dirVersions {
+		if !keysSeen[path] {
+			keys = append(keys, path)
+		}
+	}
+	sort.Strings(keys)
+
+	str := fmt.Sprintf("latest version: %s\n", b.latestVersion)
+	for _, key := range keys {
+		str += fmt.Sprintf("%s file versions: %v dir versions: %v\n", key, b.fileVersions[key], b.dirVersions[key])
+	}
+	return str
+}
+
+// LatestVersion returns the most recently committed version.
+func (b *Bucket) LatestVersion() filesystem.Version {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.latestVersion
+}
+
+func (b *Bucket) Snapshots() ([]filesystem.Snapshot, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]filesystem.Snapshot(nil), b.snapshots...), nil
+}
+
+func (b *Bucket) Snapshot(version filesystem.Version) (filesystem.Snapshot, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, snapshot := range b.snapshots {
+		if snapshot.Version == version {
+			return snapshot, nil
+		}
+	}
+	return filesystem.Snapshot{}, fmt.Errorf("no snapshot of version %q", version)
+}
+
+func (b *Bucket) NewPutTransaction() filesystem.PutTransaction {
+	return NewPutTransaction(b.Clock, b.commit)
+}
+
+func (b *Bucket) Select() filesystem.Selector {
+	builder := selector.NewSelectorBuilder(func(q selector.Query) filesystem.SelectorOp {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		version, err := b.computeVersion(q)
+		return &bucketSelector{
+			path:    q.Path,
+			isFile:  q.IsFile,
+			version: version,
+			follow:  q.Follow,
+			rng:     q.Range,
+			glob:    q.Glob,
+			err:     err,
+			bucket:  b,
+		}
+	})
+	builder.ResolveTag = b.Ref
+	return builder
+}
+
+// computeVersion resolves the version selected by q, or "" for all versions.
+// Latest() on a path that doesn't exist also gives "", but such selectors
+// find no entries anyway. Selecting a version at which the path was removed,
+// or a time with no version, is an error.
+// b.mu must be held.
+func (b *Bucket) computeVersion(q selector.Query) (filesystem.Version, error) {
+	if !q.Resolves() {
+		return q.Version, nil
+	}
+
+	h := b.dirVersions[q.LatestPath]
+	if q.LatestIsFile {
+		h = b.fileVersions[q.LatestPath]
+	}
+	if h == nil {
+		return "", nil
+	}
+	var versions []filesystem.Version
+	for _, entry := range h.entries {
+		versions = append(versions, entry.Version)
+	}
+	i := q.Pick(versions)
+	if i < 0 {
+		return "", fmt.Errorf("%q has no version %s", q.LatestPath, q.Describe())
+	}
+	if h.entries[i].removed {
+		return "", fmt.Errorf("%q was removed in version %s", q.LatestPath, h.entries[i].Version)
+	}
+	return h.entries[i].Version, nil
+}
+
+// nextVersion returns a version for a new commit.
+// b.mu must be held.
+func (b *Bucket) nextVersion() filesystem.Version {
+	clock := b.Clock
+	if clock == nil {
+		clock = filesystem.SystemClock
+	}
+	return filesystem.NextVersion(clock, b.latestVersion)
+}
+
+// commit assigns a version to rec, persists it and applies it.
+func (b *Bucket) commit(rec *Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rec.HasParent && rec.Parent != b.latestVersion {
+		return &filesystem.ConflictError{Parent: rec.Parent, Head: b.latestVersion, Changed: b.changedSince(rec.Parent)}
+	}
+	if err := ExpandMoves(rec, b.liveNodes); err != nil {
+		return err
+	}
+	removed, err := ExpandRemovals(rec, b.liveNodes)
+	if err != nil {
+		return err
+	}
+	rec.SetVersion(b.nextVersion())
+	rec.Removed = removed
+	if b.Persist != nil {
+		if err := b.Persist(rec); err != nil {
+			return err
+		}
+	}
+	b.apply(rec)
+	return nil
+}
+
+func (b *Bucket) Head() (filesystem.Version, error) {
+	return b.LatestVersion(), nil
+}
+
+// changedSince returns the paths written as files, removed or moved to by
+// the versions after parent, sorted.
+// b.mu must be held.
+func (b *Bucket) changedSince(parent filesystem.Version) []string {
+	changed := map[string]bool{}
+	for path, h := range b.fileVersions {
+		for _, e := range h.entries {
+			if parent == "" || e.Version.Compare(parent) > 0 {
+				changed[path] = true
+			}
+		}
+	}
+	for path, h := range b.dirVersions {
+		for _, e := range h.entries {
+			if (parent == "" || e.Version.Compare(parent) > 0) && (e.removed || e.movedFrom != "") {
+				changed[path] = true
+			}
+		}
+	}
+	paths := make([]string, 0, len(changed))
+	for path := range changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Apply adds a record that was committed earlier, e.g. when replaying
+// persisted records. Records must be applied in commit order.
+func (b *Bucket) Apply(rec *Record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.apply(rec)
+}
+
+func (b *Bucket) DeleteVersions(versions ...filesystem.Version) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, version := range versions {
+		if !b.hasVersion(version) {
+			return fmt.Errorf("no version %q", version)
+		}
+		if name := b.refTo(version); name != "" {
+			return fmt.Errorf("version %q is tagged %q", version, name)
+		}
+	}
+	del := &Deletion{Versions: versions}
+	if b.PersistDeletion != nil {
+		if err := b.PersistDeletion(del); err != nil {
+			return err
+		}
+	}
+	b.applyDeletion(del)
+	return nil
+}
+
+// ApplyDeletion applies a deletion made earlier, e.g. when replaying
+// persisted records. It must be applied in order with the records.
+func (b *Bucket) ApplyDeletion(del *Deletion) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.applyDeletion(del)
+}
+
+// b.mu must be held.
+func (b *Bucket) hasVersion(version filesystem.Version) bool {
+	for _, snapshot := range b.snapshots {
+		if snapshot.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDeletion drops the entries and snapshots of the deleted versions.
+// The latest version is kept, so that later commits still get newer
+// versions.
+// b.mu must be held.
+func (b *Bucket) applyDeletion(del *Deletion) {
+	deleted := map[filesystem.Version]bool{}
+	for _, version := range del.Versions {
+		deleted[version] = true
+	}
+	var dropped []string
+	for _, histories := range []map[string]*history{b.fileVersions, b.dirVersions} {
+		for path, h := range histories {
+			var entries []*entry
+			for _, e := range h.entries {
+				if !deleted[e.Version] {
+					entries = append(entries, e)
+				}
+			}
+			if len(entries) == 0 {
+				delete(histories, path)
+				dropped = append(dropped, path)
+			} else {
+				h.entries = entries
+			}
+		}
+	}
+	for _, path := range dropped {
+		b.removeChild(path)
+	}
+	for version := range deleted {
+		delete(b.written, version)
+	}
+	var snapshots []filesystem.Snapshot
+	for _, snapshot := range b.snapshots {
+		if !deleted[snapshot.Version] {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	b.snapshots = snapshots
+}
+
+// liveNodes returns the node at path and the nodes below it that exist in
+// the newest state of the bucket.
+// b.mu must be held.
+func (b *Bucket) liveNodes(path string) ([]Node, error) {
+	removal := Removal{Path: path, Recursive: true}
+	var nodes []Node
+	for p, h := range b.fileVersions {
+		if h.live() && removal.Covers(p) {
+			latest := h.latest()
+			nodes = append(nodes, Node{Path: p, IsFile: true, BlobRef: latest.BlobRef, Metadata: latest.Metadata})
+		}
+	}
+	for p, h := range b.dirVersions {
+		if h.live() && removal.Covers(p) {
+			nodes = append(nodes, Node{Path: p})
+		}
+	}
+	return nodes, nil
+}
+
+// b.mu must be held.
+func (b *Bucket) add(histories map[string]*history, path string, e *entry) {
+	h, ok := histories[path]
+	if !ok {
+		h = &history{}
+		histories[path] = h
+		b.addChild(path)
+	}
+	h.entries = append(h.entries, e)
+	b.written[e.Version] = append(b.written[e.Version], path)
+}
+
+// addChild adds path to the children of its dir.
+// b.mu must be held.
+func (b *Bucket) addChild(path string) {
+	if path == "" {
+		return
+	}
+	dir, name := parentDir(path), filepath.Base(path)
+	names := b.children[dir]
+	i := sort.SearchStrings(names, name)
+	if i < len(names) && names[i] == name {
+		return
+	}
+	names = append(names, "")
+	copy(names[i+1:], names[i:])
+	names[i] = name
+	b.children[dir] = names
+}
+
+// removeChild removes path from the children of its dir once it has no
+// file or dir history left.
+// b.mu must be held.
+func (b *Bucket) removeChild(path string) {
+	if b.fileVersions[path] != nil || b.dirVersions[path] != nil {
+		return
+	}
+	dir, name := parentDir(path), filepath.Base(path)
+	names := b.children[dir]
+	i := sort.SearchStrings(names, name)
+	if i == len(names) || names[i] != name {
+		return
+	}
+	names = append(names[:i], names[i+1:]...)
+	if len(names) == 0 {
+		delete(b.children, dir)
+	} else {
+		b.children[dir] = names
+	}
+}
+
+// b.mu must be held.
+func (b *Bucket) apply(rec *Record) {
+	version := rec.Version
+	for _, path := range rec.Dirs {
+		b.add(b.dirVersions, path, &entry{StoredBlobRef: filesystem.StoredBlobRef{Version: version}})
+	}
+	for _, f := range rec.Files {
+		b.add(b.fileVersions, f.Path, &entry{StoredBlobRef: filesystem.StoredBlobRef{BlobRef: f.BlobRef, Version: version, Metadata: f.Metadata}})
+	}
+	for _, rename := range rec.Renames {
+		if e := b.fileVersions[rename.To].at(version); e != nil {
+			e.movedFrom = rename.From
+		}
+		if e := b.dirVersions[rename.To].at(version); e != nil {
+			e.movedFrom = rename.From
+		}
+	}
+	for _, path := range rec.Removed {
+		tombstone := &entry{StoredBlobRef: filesystem.StoredBlobRef{Version: version}, removed: true}
+		if b.fileVersions[path].live() {
+			b.add(b.fileVersions, path, tombstone)
+		}
+		if b.dirVersions[path].live() {
+			b.add(b.dirVersions, path, tombstone)
+		}
+	}
+	b.snapshots = append(b.snapshots, rec.Snapshot)
+	b.latestVersion = version
+	if !b.exists {
+		b.exists = true
+		b.info = filesystem.BucketInfo{Created: version.Time()}
+	}
+}
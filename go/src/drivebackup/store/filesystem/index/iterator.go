@@ -0,0 +1,121 @@
+package index
+
+import (
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/selector"
+)
+
+// PageFunc returns up to n versions following after, or from the start if
+// after is "", oldest first unless newestFirst is set. Returning fewer than
+// n ends the iteration.
+type PageFunc func(newestFirst bool, after filesystem.Version, n int) ([]filesystem.Version, error)
+
+// versionPageSize is the number of versions an iterator fetches at a time.
+const versionPageSize = 100
+
+// NewVersionIterator returns an iterator over the versions in rng that page
+// gives. Backends implement IterVersions with it. Last(n) only holds the n
+// versions it gives.
+func NewVersionIterator(page PageFunc, rng selector.Range, opts filesystem.VersionOptions) filesystem.VersionIterator {
+	if rng.Last == 0 {
+		return &versionIterator{page: page, rng: rng, newestFirst: opts.NewestFirst, remaining: opts.Limit}
+	}
+	last := rng.Last
+	rng.Last = 0
+	newest := &versionIterator{page: page, rng: rng, newestFirst: true, remaining: last}
+	if opts.NewestFirst {
+		if opts.Limit > 0 && opts.Limit < last {
+			newest.remaining = opts.Limit
+		}
+		return newest
+	}
+	var versions []filesystem.Version
+	for {
+		version, err := newest.Next()
+		if err == filesystem.Done {
+			break
+		}
+		if err != nil {
+			return filesystem.FailedVersionIterator(err)
+		}
+		versions = append(versions, version)
+	}
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
+	return NewVersionIterator(SlicePages(versions), selector.Range{}, opts)
+}
+
+// SlicePages pages through versions, ordered oldest first.
+func SlicePages(versions []filesystem.Version) PageFunc {
+	return func(newestFirst bool, after filesystem.Version, n int) ([]filesystem.Version, error) {
+		i, step := 0, 1
+		if newestFirst {
+			i, step = len(versions)-1, -1
+		}
+		if after != "" {
+			for i >= 0 && i < len(versions) && versions[i] != after {
+				i += step
+			}
+			i += step
+		}
+		var results []filesystem.Version
+		for ; i >= 0 && i < len(versions) && len(results) < n; i += step {
+			results = append(results, versions[i])
+		}
+		return results, nil
+	}
+}
+
+type versionIterator struct {
+	page        PageFunc
+	rng         selector.Range
+	newestFirst bool
+	remaining   int // versions left to give, 0 for no limit
+
+	buf   []filesystem.Version
+	after filesystem.Version
+	last  bool // buf holds the last page
+	done  bool
+	err   error
+}
+
+func (it *versionIterator) Next() (filesystem.Version, error) {
+	for {
+		if it.err != nil {
+			return "", it.err
+		}
+		if it.done {
+			return "", filesystem.Done
+		}
+		if len(it.buf) == 0 {
+			if it.last {
+				it.done = true
+				continue
+			}
+			it.buf, it.err = it.page(it.newestFirst, it.after, versionPageSize)
+			it.last = len(it.buf) < versionPageSize
+			if len(it.buf) > 0 {
+				it.after = it.buf[len(it.buf)-1]
+			}
+			continue
+		}
+		version := it.buf[0]
+		it.buf = it.buf[1:]
+		// Versions come in order, so the first one past the far bound of the
+		// range ends the iteration.
+		if it.rng.Since != "" && version.Compare(it.rng.Since) < 0 {
+			it.done = it.newestFirst
+			continue
+		}
+		if it.rng.Until != "" && version.Compare(it.rng.Until) > 0 {
+			it.done = !it.newestFirst
+			continue
+		}
+		if it.remaining > 0 {
+			it.remaining--
+			it.done = it.remaining == 0
+		}
+		return version, nil
+	}
+}
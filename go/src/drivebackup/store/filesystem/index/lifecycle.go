@@ -0,0 +1,131 @@
+package index
+
+import (
+	"drivebackup/store/filesystem"
+)
+
+// The lifecycle methods take a persist func, called before the change is
+// applied; if it fails, the change fails and the index is left unchanged.
+// The Apply variants apply a change made earlier, e.g. when replaying
+// persisted changes. Services must serialize lifecycle changes.
+
+// Info describes the bucket, and reports whether it exists.
+func (b *Bucket) Info() (filesystem.BucketInfo, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	info := b.info
+	info.Name = b.Name
+	return info, b.exists
+}
+
+// Create creates the bucket with info, failing with
+// filesystem.ErrBucketExists if it exists.
+func (b *Bucket) Create(info filesystem.BucketInfo, persist func() error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exists {
+		return filesystem.ErrBucketExists
+	}
+	if persist != nil {
+		if err := persist(); err != nil {
+			return err
+		}
+	}
+	b.create(info)
+	return nil
+}
+
+func (b *Bucket) ApplyCreate(info filesystem.BucketInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.create(info)
+}
+
+// b.mu must be held.
+func (b *Bucket) create(info filesystem.BucketInfo) {
+	info.Name = ""
+	b.info = info
+	b.exists = true
+}
+
+// Delete empties the bucket and marks it as not existing, failing with
+// filesystem.ErrNoSuchBucket if it doesn't exist. The latest version is
+// kept, so that commits recreating the bucket still get newer versions.
+func (b *Bucket) Delete(persist func() error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.exists {
+		return filesystem.ErrNoSuchBucket
+	}
+	if persist != nil {
+		if err := persist(); err != nil {
+			return err
+		}
+	}
+	b.reset()
+	return nil
+}
+
+func (b *Bucket) ApplyDelete() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+}
+
+// b.mu must be held.
+func (b *Bucket) reset() {
+	b.fileVersions = map[string]*history{}
+	b.dirVersions = map[string]*history{}
+	b.children = map[string][]string{}
+	b.written = map[filesystem.Version][]string{}
+	b.snapshots = nil
+	b.refs = map[string]filesystem.Version{}
+	b.info = filesystem.BucketInfo{}
+	b.exists = false
+}
+
+// MoveTo moves the history and metadata of the bucket to dst, which must
+// not exist, and deletes the bucket.
+func (b *Bucket) MoveTo(dst *Bucket, persist func() error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	if !b.exists {
+		return filesystem.ErrNoSuchBucket
+	}
+	if dst.exists {
+		return filesystem.ErrBucketExists
+	}
+	if persist != nil {
+		if err := persist(); err != nil {
+			return err
+		}
+	}
+	b.moveTo(dst)
+	return nil
+}
+
+func (b *Bucket) ApplyMoveTo(dst *Bucket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	b.moveTo(dst)
+}
+
+// b.mu and dst.mu must be held.
+func (b *Bucket) moveTo(dst *Bucket) {
+	dst.fileVersions = b.fileVersions
+	dst.dirVersions = b.dirVersions
+	dst.children = b.children
+	dst.written = b.written
+	dst.snapshots = b.snapshots
+	dst.refs = b.refs
+	dst.info = b.info
+	dst.exists = true
+	if dst.latestVersion == "" || b.latestVersion.Compare(dst.latestVersion) > 0 {
+		dst.latestVersion = b.latestVersion
+	}
+	b.reset()
+}
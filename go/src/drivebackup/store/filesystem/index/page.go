@@ -0,0 +1,34 @@
+package index
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"drivebackup/store/filesystem"
+)
+
+// PageToken returns the token for the page following the entry name.
+func PageToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// PageStart returns the name of the entry a page token follows, or "" for
+// the first page.
+func PageStart(token string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || (token != "" && len(name) == 0) {
+		return "", fmt.Errorf("invalid page token %q", token)
+	}
+	return string(name), nil
+}
+
+// Page returns the first limit of entries, sorted by name and following the
+// previous page, with the token for the next page if any are left.
+func Page(entries []filesystem.WalkEntry, limit int) *filesystem.EntryPage {
+	page := &filesystem.EntryPage{Entries: entries}
+	if limit > 0 && len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.NextPageToken = PageToken(entries[limit-1].Name())
+	}
+	return page
+}
@@ -0,0 +1,101 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+
+	"drivebackup/store/filesystem"
+)
+
+// RefUpdate is a call to SetRef, or to DeleteRef if Version is "".
+type RefUpdate struct {
+	Name    string
+	Version filesystem.Version `json:",omitempty"`
+}
+
+func (b *Bucket) SetRef(name string, version filesystem.Version) error {
+	if name == "" {
+		return fmt.Errorf("empty ref name")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.hasVersion(version) {
+		return fmt.Errorf("no version %q", version)
+	}
+	return b.updateRef(&RefUpdate{Name: name, Version: version})
+}
+
+func (b *Bucket) DeleteRef(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.refs[name]; !ok {
+		return fmt.Errorf("no ref %q", name)
+	}
+	return b.updateRef(&RefUpdate{Name: name})
+}
+
+// b.mu must be held.
+func (b *Bucket) updateRef(update *RefUpdate) error {
+	if b.PersistRef != nil {
+		if err := b.PersistRef(update); err != nil {
+			return err
+		}
+	}
+	b.applyRef(update)
+	return nil
+}
+
+// ApplyRef applies a change to a ref made earlier, e.g. when replaying
+// persisted records. It must be applied in order with the records.
+func (b *Bucket) ApplyRef(update *RefUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.applyRef(update)
+}
+
+// b.mu must be held.
+func (b *Bucket) applyRef(update *RefUpdate) {
+	if update.Version == "" {
+		delete(b.refs, update.Name)
+		return
+	}
+	b.refs[update.Name] = update.Version
+}
+
+func (b *Bucket) Ref(name string) (filesystem.Version, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	version, ok := b.refs[name]
+	if !ok {
+		return "", fmt.Errorf("no ref %q", name)
+	}
+	return version, nil
+}
+
+func (b *Bucket) Refs() ([]filesystem.Ref, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	refs := make([]filesystem.Ref, 0, len(b.refs))
+	for name, version := range b.refs {
+		refs = append(refs, filesystem.Ref{Name: name, Version: version})
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs, nil
+}
+
+// refTo returns the name of a ref pointing at version, or "" if there is
+// none.
+// b.mu must be held.
+func (b *Bucket) refTo(version filesystem.Version) string {
+	var names []string
+	for name, v := range b.refs {
+		if v == version {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
@@ -0,0 +1,467 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/selector"
+)
+
+type bucketSelector struct {
+	path    string
+	isFile  bool
+	version filesystem.Version
+	follow  bool
+	rng     selector.Range
+	glob    string
+	err     error // set if the selector couldn't be resolved
+	bucket  *Bucket
+}
+
+func (s *bucketSelector) List() ([]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.isFile {
+		return nil, fmt.Errorf("List() may only be applied to directories")
+	}
+	s.bucket.mu.RLock()
+	defer s.bucket.mu.RUnlock()
+	path, err := s.resolve(s.bucket.dirVersions)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDir(path); err != nil {
+		return nil, err
+	}
+
+	inRange := s.inRange()
+	results := map[string]bool{}
+	for child, h := range s.bucket.dirVersions {
+		if inDir(child, path) && s.visible(h, inRange) != nil {
+			results[oneLevelPath(child, path)] = true
+		}
+	}
+	for child, h := range s.bucket.fileVersions {
+		if inDir(child, path) && s.visible(h, inRange) != nil {
+			results[oneLevelPath(child, path)] = true
+		}
+	}
+
+	var finalResults []string
+	for key := range results {
+		finalResults = append(finalResults, key)
+	}
+	sort.Strings(finalResults)
+	return finalResults, nil
+}
+
+func (s *bucketSelector) ListEntries(opts filesystem.ListOptions) (*filesystem.EntryPage, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.isFile {
+		return nil, fmt.Errorf("ListEntries() may only be applied to directories")
+	}
+	after, err := PageStart(opts.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	s.bucket.mu.RLock()
+	defer s.bucket.mu.RUnlock()
+	path, err := s.resolve(s.bucket.dirVersions)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDir(path); err != nil {
+		return nil, err
+	}
+
+	// The names below path are sorted, so the page starts right after the
+	// token's name and ends once an entry past the limit shows that
+	// another page follows.
+	inRange := s.inRange()
+	names := s.bucket.children[path]
+	var entries []filesystem.WalkEntry
+	for i := sort.SearchStrings(names, after); i < len(names); i++ {
+		if opts.Limit > 0 && len(entries) > opts.Limit {
+			break
+		}
+		if names[i] == after {
+			continue
+		}
+		child := filepath.Join(path, names[i])
+		// A path that was both a dir and a file is listed as the newer.
+		dir := s.visible(s.bucket.dirVersions[child], inRange)
+		file := s.visible(s.bucket.fileVersions[child], inRange)
+		switch {
+		case file != nil && (dir == nil || file.Version.Compare(dir.Version) > 0):
+			entries = append(entries, filesystem.WalkEntry{Path: child, StoredBlobRef: file.StoredBlobRef})
+		case dir != nil:
+			entries = append(entries, filesystem.WalkEntry{Path: child, IsDir: true, StoredBlobRef: dir.StoredBlobRef})
+		}
+	}
+	return Page(entries, opts.Limit), nil
+}
+
+func (s *bucketSelector) Walk(fn filesystem.WalkFunc) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.isFile {
+		return fmt.Errorf("Walk() may only be applied to directories")
+	}
+	s.bucket.mu.RLock()
+	path, err := s.resolve(s.bucket.dirVersions)
+	if err == nil {
+		err = s.checkDir(path)
+	}
+	if err != nil {
+		s.bucket.mu.RUnlock()
+		return err
+	}
+	entries := s.below(path)
+	// fn may use the bucket.
+	s.bucket.mu.RUnlock()
+	return Walk(path, entries, fn)
+}
+
+func (s *bucketSelector) Diff(v1, v2 filesystem.Version) ([]filesystem.Change, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.isFile {
+		return nil, fmt.Errorf("Diff() may only be applied to directories")
+	}
+	s.bucket.mu.RLock()
+	defer s.bucket.mu.RUnlock()
+	before, after := *s, *s
+	before.version, after.version = v1, v2
+	dir := s.bucket.dirVersions[s.path]
+	if before.visible(dir, nil) == nil && after.visible(dir, nil) == nil {
+		return nil, fmt.Errorf("dir %q not found at %s or %s", s.path, v1, v2)
+	}
+	return Diff(before.below(s.path), after.below(s.path)), nil
+}
+
+// below returns the entries below the dir at path that the selector sees.
+// s.bucket.mu must be held.
+func (s *bucketSelector) below(path string) []filesystem.WalkEntry {
+	inRange := s.inRange()
+	var entries []filesystem.WalkEntry
+	for child, h := range s.bucket.dirVersions {
+		if inDir(child, path) {
+			if e := s.visible(h, inRange); e != nil {
+				entries = append(entries, filesystem.WalkEntry{Path: child, IsDir: true, StoredBlobRef: e.StoredBlobRef})
+			}
+		}
+	}
+	for child, h := range s.bucket.fileVersions {
+		if inDir(child, path) {
+			if e := s.visible(h, inRange); e != nil {
+				entries = append(entries, filesystem.WalkEntry{Path: child, StoredBlobRef: e.StoredBlobRef})
+			}
+		}
+	}
+	return entries
+}
+
+// checkDir fails unless the dir at path has versions, and exists now if no
+// version or range is selected.
+// s.bucket.mu must be held.
+func (s *bucketSelector) checkDir(path string) error {
+	dir, ok := s.bucket.dirVersions[path]
+	if !ok || len(dir.versions()) == 0 || (s.version == "" && !s.rng.IsSet() && !dir.live()) {
+		return fmt.Errorf("dir not found: %v", s.path)
+	}
+	return nil
+}
+
+// inRange returns the versions of s.path in s.rng, or nil if no range is
+// selected.
+// s.bucket.mu must be held.
+func (s *bucketSelector) inRange() map[filesystem.Version]bool {
+	if !s.rng.IsSet() {
+		return nil
+	}
+	inRange := map[filesystem.Version]bool{}
+	for _, version := range s.rng.Filter(s.bucket.dirVersions[s.path].versions()) {
+		inRange[version] = true
+	}
+	return inRange
+}
+
+// visible returns the entry of h that the selector sees, or nil. Without a
+// version, paths that exist now are seen at their newest entry. At a
+// version, paths written by it are, and in a range those written by any
+// version in it, at the newest such. h may be nil.
+func (s *bucketSelector) visible(h *history, inRange map[filesystem.Version]bool) *entry {
+	var e *entry
+	switch {
+	case h == nil:
+	case inRange != nil:
+		for _, entry := range h.entries {
+			if inRange[entry.Version] && !entry.removed {
+				e = entry
+			}
+		}
+	case s.version != "":
+		e = h.at(s.version)
+	default:
+		e = h.latest()
+	}
+	if e == nil || e.removed {
+		return nil
+	}
+	return e
+}
+
+func (s *bucketSelector) BlobRef() (filesystem.StoredBlobRef, error) {
+	if s.err != nil {
+		return filesystem.StoredBlobRef{}, s.err
+	}
+	if s.version == "" {
+		return filesystem.StoredBlobRef{}, fmt.Errorf("version must be specified for BlobRef()")
+	}
+	if !s.isFile {
+		return filesystem.StoredBlobRef{}, fmt.Errorf("BlobRef() may only be applied to files")
+	}
+	s.bucket.mu.RLock()
+	defer s.bucket.mu.RUnlock()
+	path, err := s.resolve(s.bucket.fileVersions)
+	if err != nil {
+		return filesystem.StoredBlobRef{}, err
+	}
+	file, ok := s.bucket.fileVersions[path]
+	if !ok {
+		return filesystem.StoredBlobRef{}, fmt.Errorf("File not found")
+	}
+	entry := file.at(s.version)
+	if entry == nil || entry.removed {
+		return filesystem.StoredBlobRef{}, fmt.Errorf("file %q has no version %q", s.path, s.version)
+	}
+	return entry.StoredBlobRef, nil
+}
+
+func (s *bucketSelector) Versions() ([]filesystem.Version, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.bucket.mu.RLock()
+	defer s.bucket.mu.RUnlock()
+	histories := s.bucket.dirVersions
+	if s.isFile {
+		histories = s.bucket.fileVersions
+	}
+	var versions []filesystem.Version
+	if s.follow {
+		lineage, err := Lineage(s.path, revisions(histories))
+		if err != nil {
+			return nil, err
+		}
+		for _, rev := range lineage {
+			versions = append(versions, rev.Version)
+		}
+	} else if h, ok := histories[s.path]; ok {
+		versions = h.versions()
+	} else {
+		return nil, nil
+	}
+	if s.version == "" {
+		return s.rng.Filter(versions), nil
+	}
+	for _, version := range versions {
+		if version == s.version {
+			return []filesystem.Version{version}, nil
+		}
+	}
+	return nil, fmt.Errorf("no results found")
+}
+
+func (s *bucketSelector) Match() ([]filesystem.MatchedFile, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.bucket.mu.RLock()
+	defer s.bucket.mu.RUnlock()
+	inRange := s.inRange()
+	root := selector.GlobRoot(s.glob)
+	var results []filesystem.MatchedFile
+	for path, h := range s.bucket.fileVersions {
+		if !inDir(path, root) || !selector.MatchGlob(s.glob, path) {
+			continue
+		}
+		if e := s.visible(h, inRange); e != nil {
+			results = append(results, filesystem.MatchedFile{Path: path, StoredBlobRef: e.StoredBlobRef})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+	return results, nil
+}
+
+func (s *bucketSelector) IterVersions(opts filesystem.VersionOptions) filesystem.VersionIterator {
+	if s.err != nil {
+		return filesystem.FailedVersionIterator(s.err)
+	}
+	if s.follow || s.version != "" {
+		// A lineage spans several histories, and a single version needs no
+		// paging.
+		versions, err := s.Versions()
+		if err != nil {
+			return filesystem.FailedVersionIterator(err)
+		}
+		return NewVersionIterator(SlicePages(versions), selector.Range{}, opts)
+	}
+	return NewVersionIterator(s.pages, s.rng, opts)
+}
+
+// pages pages through the history of s.path, which is ordered by version.
+func (s *bucketSelector) pages(newestFirst bool, after filesystem.Version, n int) ([]filesystem.Version, error) {
+	s.bucket.mu.RLock()
+	defer s.bucket.mu.RUnlock()
+	h := s.bucket.dirVersions[s.path]
+	if s.isFile {
+		h = s.bucket.fileVersions[s.path]
+	}
+	if h == nil {
+		return nil, nil
+	}
+	entries := h.entries
+	i, step := 0, 1
+	if after != "" {
+		i = sort.Search(len(entries), func(i int) bool { return entries[i].Version.Compare(after) > 0 })
+	}
+	if newestFirst {
+		step = -1
+		i = len(entries) - 1
+		if after != "" {
+			i = sort.Search(len(entries), func(i int) bool { return entries[i].Version.Compare(after) >= 0 }) - 1
+		}
+	}
+	var versions []filesystem.Version
+	for ; i >= 0 && i < len(entries) && len(versions) < n; i += step {
+		if !entries[i].removed {
+			versions = append(versions, entries[i].Version)
+		}
+	}
+	return versions, nil
+}
+
+// resolve returns the path selected at s.version. It is s.path unless the
+// selector follows moves.
+// s.bucket.mu must be held.
+func (s *bucketSelector) resolve(histories map[string]*history) (string, error) {
+	if !s.follow || s.version == "" {
+		return s.path, nil
+	}
+	lineage, err := Lineage(s.path, revisions(histories))
+	if err != nil {
+		return "", err
+	}
+	for _, rev := range lineage {
+		if rev.Version == s.version {
+			return rev.Path, nil
+		}
+	}
+	return s.path, nil
+}
+
+// revisions returns the revisions of paths in histories.
+func revisions(histories map[string]*history) func(path string) ([]Revision, error) {
+	return func(path string) ([]Revision, error) {
+		h, ok := histories[path]
+		if !ok {
+			return nil, nil
+		}
+		var revs []Revision
+		for _, entry := range h.entries {
+			revs = append(revs, Revision{
+				Path:      path,
+				Version:   entry.Version,
+				Removed:   entry.removed,
+				MovedFrom: entry.movedFrom,
+			})
+		}
+		return revs, nil
+	}
+}
+
+// Revision is one entry in the history of a file or dir.
+type Revision struct {
+	Path      string
+	Version   filesystem.Version
+	Removed   bool
+	MovedFrom string // set if a move wrote the revision
+}
+
+// Lineage returns the revisions written to path and, following moves, to the
+// paths it was moved from before it was, oldest first. Removals are left
+// out. revisions returns the revisions of a path, oldest first.
+func Lineage(path string, revisions func(path string) ([]Revision, error)) ([]Revision, error) {
+	seen := map[Revision]bool{}
+	var lineage []Revision
+	var follow func(path string, before filesystem.Version) error
+	follow = func(path string, before filesystem.Version) error {
+		revs, err := revisions(path)
+		if err != nil {
+			return err
+		}
+		for _, rev := range revs {
+			if before != "" && rev.Version.Compare(before) >= 0 {
+				break
+			}
+			if !rev.Removed && !seen[rev] {
+				seen[rev] = true
+				lineage = append(lineage, rev)
+			}
+			if rev.MovedFrom != "" {
+				if err := follow(rev.MovedFrom, rev.Version); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := follow(path, ""); err != nil {
+		return nil, err
+	}
+	sort.Slice(lineage, func(i, j int) bool { return lineage[i].Version.Compare(lineage[j].Version) < 0 })
+	return lineage, nil
+}
+
+func inDir(path, dirPath string) bool {
+	if dirPath == "" {
+		return path != ""
+	}
+	separatoredSubpath := dirPath
+	if len(dirPath) > 0 && dirPath[len(dirPath)-1] != os.PathSeparator {
+		separatoredSubpath += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(path, separatoredSubpath)
+}
+
+func oneLevelName(path, base string) string {
+	if base == "" {
+		return strings.Split(path, string(os.PathSeparator))[0]
+	}
+	prefixLessPath := strings.TrimPrefix(path, base)
+	if prefixLessPath[0] == os.PathSeparator {
+		prefixLessPath = prefixLessPath[1:]
+	}
+	return strings.Split(prefixLessPath, string(os.PathSeparator))[0]
+}
+
+func oneLevelPath(path, base string) string {
+	if base == "" {
+		return oneLevelName(path, base)
+	}
+	suffixPath := base
+	if suffixPath[len(suffixPath)-1] != os.PathSeparator {
+		suffixPath += string(os.PathSeparator)
+	}
+	return suffixPath + oneLevelName(path, base)
+}
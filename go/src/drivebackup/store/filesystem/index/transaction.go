@@ -0,0 +1,178 @@
+package index
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"drivebackup/store/filesystem"
+)
+
+// NewPutTransaction returns a transaction that collects its writes into a
+// Record and passes it to commit. Backends that don't keep an index use it to
+// share the path handling of index buckets. The snapshot's start and duration
+// are read from clock, or from filesystem.SystemClock if it is nil.
+func NewPutTransaction(clock filesystem.Clock, commit func(*Record) error) filesystem.PutTransaction {
+	if clock == nil {
+		clock = filesystem.SystemClock
+	}
+	snapshot := &filesystem.Snapshot{Started: clock.Now()}
+	snapshot.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		snapshot.User = u.Username
+	}
+	return &putTransaction{commit: commit, clock: clock, snapshot: snapshot}
+}
+
+type putTransaction struct {
+	files    map[string]*FileRecord
+	dirs     map[string]bool
+	removals *[]Removal
+	moves    *[]Move
+	commit   func(*Record) error
+	path     string
+	clock    filesystem.Clock     // only set on the root path
+	snapshot *filesystem.Snapshot // only set on the root path
+
+	parent    filesystem.Version
+	hasParent bool
+	version   filesystem.Version // set once committed
+}
+
+// init creates the maps shared by every path of the transaction.
+func (tx *putTransaction) init() {
+	if tx.dirs == nil {
+		tx.dirs = map[string]bool{}
+	}
+	if tx.files == nil {
+		tx.files = map[string]*FileRecord{}
+	}
+	if tx.removals == nil {
+		tx.removals = &[]Removal{}
+	}
+	if tx.moves == nil {
+		tx.moves = &[]Move{}
+	}
+}
+
+// addDirs records path and all of its parents.
+func (tx *putTransaction) addDirs(path string) {
+	parts := strings.Split(path, string(os.PathSeparator))
+	for i := 0; i <= len(parts); i++ {
+		tx.dirs[strings.Join(parts[:i], string(os.PathSeparator))] = true
+	}
+}
+
+func (tx *putTransaction) Dir(path string) filesystem.PutTransactionPath {
+	tx.init()
+	fullPath := filepath.Join(tx.path, path)
+	tx.addDirs(fullPath)
+	return &putTransaction{files: tx.files, dirs: tx.dirs, removals: tx.removals, moves: tx.moves, commit: tx.commit, path: fullPath}
+}
+
+func (tx *putTransaction) File(name string, blobRef filesystem.BlobRef) {
+	tx.FileWithMetadata(name, blobRef, filesystem.Metadata{})
+}
+
+func (tx *putTransaction) FileWithMetadata(name string, blobRef filesystem.BlobRef, metadata filesystem.Metadata) {
+	tx.init()
+	tx.addDirs(tx.path)
+	path := filepath.Join(tx.path, name)
+	tx.files[path] = &FileRecord{Path: path, BlobRef: blobRef, Metadata: metadata}
+}
+
+func (tx *putTransaction) Symlink(name, target string, metadata filesystem.Metadata) {
+	metadata.Type = filesystem.Symlink
+	metadata.LinkTarget = target
+	tx.FileWithMetadata(name, filesystem.BlobRef{}, metadata)
+}
+
+func (tx *putTransaction) Commit() error {
+	rec := tx.record()
+	if err := tx.commit(rec); err != nil {
+		return err
+	}
+	tx.version = rec.Version
+	return nil
+}
+
+func (tx *putTransaction) Version() filesystem.Version {
+	return tx.version
+}
+
+// record returns the transaction's writes in a deterministic order.
+func (tx *putTransaction) record() *Record {
+	rec := &Record{Snapshot: *tx.snapshot, Parent: tx.parent, HasParent: tx.hasParent}
+	rec.Snapshot.Duration = tx.clock.Now().Sub(rec.Snapshot.Started)
+	if tx.removals != nil {
+		rec.Removals = append(rec.Removals, *tx.removals...)
+	}
+	if tx.moves != nil {
+		rec.Moves = append(rec.Moves, *tx.moves...)
+	}
+	for path := range tx.dirs {
+		rec.Dirs = append(rec.Dirs, path)
+	}
+	sort.Strings(rec.Dirs)
+	for _, f := range tx.files {
+		rec.Files = append(rec.Files, *f)
+	}
+	sort.Slice(rec.Files, func(i, j int) bool { return rec.Files[i].Path < rec.Files[j].Path })
+	return rec
+}
+
+func (tx *putTransaction) Remove(name string) {
+	tx.remove(name, false)
+}
+
+func (tx *putTransaction) RemoveAll(name string) {
+	tx.remove(name, true)
+}
+
+// remove records a removal and drops writes of the transaction that it
+// covers. The parents of the removed path are written, like those of files.
+func (tx *putTransaction) remove(name string, recursive bool) {
+	tx.init()
+	removal := Removal{Path: filepath.Join(tx.path, name), Recursive: recursive}
+	for path := range tx.files {
+		if removal.Covers(path) {
+			delete(tx.files, path)
+		}
+	}
+	for path := range tx.dirs {
+		if removal.Covers(path) {
+			delete(tx.dirs, path)
+		}
+	}
+	tx.addDirs(parentDir(removal.Path))
+	*tx.removals = append(*tx.removals, removal)
+}
+
+// Move moves the newest committed version of from, with everything below it,
+// to to. The parents of both paths are written, like those of files.
+func (tx *putTransaction) Move(from, to string) {
+	tx.init()
+	from, to = filepath.Join(tx.path, from), filepath.Join(tx.path, to)
+	tx.addDirs(parentDir(from))
+	tx.addDirs(parentDir(to))
+	*tx.moves = append(*tx.moves, Move{From: from, To: to})
+}
+
+func (tx *putTransaction) SetParent(parent filesystem.Version) {
+	tx.parent = parent
+	tx.hasParent = true
+}
+
+func (tx *putTransaction) Describe(snapshot filesystem.Snapshot) {
+	if snapshot.Hostname != "" {
+		tx.snapshot.Hostname = snapshot.Hostname
+	}
+	if snapshot.User != "" {
+		tx.snapshot.User = snapshot.User
+	}
+	tx.snapshot.Source = snapshot.Source
+	tx.snapshot.Tags = append([]string(nil), snapshot.Tags...)
+	tx.snapshot.Message = snapshot.Message
+}
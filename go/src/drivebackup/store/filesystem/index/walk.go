@@ -0,0 +1,53 @@
+package index
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"drivebackup/store/filesystem"
+)
+
+// Walk calls fn for entries, the files and dirs below root, in the order
+// filesystem.DirSelectorOp.Walk documents, and handles filesystem.SkipDir.
+// Backends fetch the entries in bulk and walk them with it.
+func Walk(root string, entries []filesystem.WalkEntry, fn filesystem.WalkFunc) error {
+	sort.Slice(entries, func(i, j int) bool { return lessPath(entries[i].Path, entries[j].Path) })
+	var skip string
+	var skipping bool
+	for _, entry := range entries {
+		if skipping && inDir(entry.Path, skip) {
+			continue
+		}
+		skipping = false
+		err := fn(entry)
+		if err != filesystem.SkipDir {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		skip = entry.Path
+		if !entry.IsDir {
+			skip = parentDir(entry.Path)
+			if skip == root {
+				return nil
+			}
+		}
+		skipping = true
+	}
+	return nil
+}
+
+// lessPath orders paths name by name, so that the contents of a dir follow
+// it directly.
+func lessPath(a, b string) bool {
+	as := strings.Split(a, string(os.PathSeparator))
+	bs := strings.Split(b, string(os.PathSeparator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,173 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// FileType is the type of a file: anything that isn't a dir.
+type FileType int
+
+const (
+	RegularFile FileType = iota
+	Symlink
+	FIFO
+	CharDevice
+	BlockDevice
+)
+
+func (t FileType) String() string {
+	switch t {
+	case RegularFile:
+		return "file"
+	case Symlink:
+		return "symlink"
+	case FIFO:
+		return "fifo"
+	case CharDevice:
+		return "char device"
+	case BlockDevice:
+		return "block device"
+	}
+	return fmt.Sprintf("FileType(%d)", int(t))
+}
+
+// Metadata describes a file as it was when it was backed up, so that a
+// restore can recreate it. Only regular files have content: the blob refs
+// of other types are empty.
+type Metadata struct {
+	Type    FileType
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	Uid     int
+	Gid     int
+	Xattrs  map[string][]byte `json:",omitempty"`
+	Hash    string            // hex SHA-256 of the content, "" if unknown
+
+	LinkTarget string `json:",omitempty"` // the target of a Symlink
+	Device     uint64 `json:",omitempty"` // the device number of a CharDevice or BlockDevice
+	// LinkGroup is shared by the regular files of a version that are hard
+	// links to each other, "" for files with a single link.
+	LinkGroup string `json:",omitempty"`
+}
+
+// ReadMetadata returns the metadata of the file at path, hashing its
+// content. Symlinks aren't followed.
+func ReadMetadata(path string) (Metadata, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	m := Metadata{
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	switch mode := info.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		m.Type = Symlink
+		if m.LinkTarget, err = os.Readlink(path); err != nil {
+			return Metadata{}, err
+		}
+	case mode&os.ModeNamedPipe != 0:
+		m.Type = FIFO
+	case mode&os.ModeCharDevice != 0:
+		m.Type = CharDevice
+	case mode&os.ModeDevice != 0:
+		m.Type = BlockDevice
+	case mode.IsRegular():
+		m.Size = info.Size()
+	default:
+		return Metadata{}, fmt.Errorf("%s: unsupported file type %v", path, mode.Type())
+	}
+	if err := readSystemMetadata(path, info, &m); err != nil {
+		return Metadata{}, err
+	}
+	if m.Type == RegularFile {
+		f, err := os.Open(path)
+		if err != nil {
+			return Metadata{}, err
+		}
+		defer f.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			return Metadata{}, err
+		}
+		m.Hash = fmt.Sprintf("%x", hash.Sum(nil))
+	}
+	return m, nil
+}
+
+// RestoreMetadata applies m to the restored file at path. Ownership is only
+// restored when permitted: restoring as an unprivileged user leaves the file
+// owned by that user.
+func RestoreMetadata(path string, m Metadata) error {
+	if err := restoreSystemMetadata(path, m); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, m.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(path, m.ModTime, m.ModTime)
+}
+
+// Restorer recreates backed up files on the local filesystem. Hard links
+// are recreated by linking to the first restored file of their link group,
+// so a Restorer should be used for the files of a single version.
+type Restorer struct {
+	// Open returns the content of a blob.
+	Open func(ref BlobRef) (io.Reader, error)
+
+	links map[string]string // link group to the first path restored
+}
+
+// Restore creates the file described by ref at path, which must not exist,
+// and applies its metadata.
+func (r *Restorer) Restore(path string, ref StoredBlobRef) error {
+	m := ref.Metadata
+	switch m.Type {
+	case Symlink:
+		if err := os.Symlink(m.LinkTarget, path); err != nil {
+			return err
+		}
+		// Mode and times of symlinks aren't meaningful on Linux.
+		return restoreSystemMetadata(path, m)
+	case FIFO, CharDevice, BlockDevice:
+		if err := mknod(path, m); err != nil {
+			return err
+		}
+		return RestoreMetadata(path, m)
+	case RegularFile:
+	default:
+		return fmt.Errorf("%s: unsupported file type %v", path, m.Type)
+	}
+
+	if first, ok := r.links[m.LinkGroup]; ok && m.LinkGroup != "" {
+		return os.Link(first, path)
+	}
+	content, err := r.Open(ref.BlobRef)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if m.LinkGroup != "" {
+		if r.links == nil {
+			r.links = map[string]string{}
+		}
+		r.links[m.LinkGroup] = path
+	}
+	return RestoreMetadata(path, m)
+}
@@ -0,0 +1,108 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func readSystemMetadata(path string, info os.FileInfo, m *Metadata) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		m.Uid = int(stat.Uid)
+		m.Gid = int(stat.Gid)
+		if m.Type == CharDevice || m.Type == BlockDevice {
+			m.Device = uint64(stat.Rdev)
+		}
+		if m.Type == RegularFile && stat.Nlink > 1 {
+			m.LinkGroup = fmt.Sprintf("%d:%d", stat.Dev, stat.Ino)
+		}
+	}
+	if m.Type == Symlink {
+		// The xattr calls of package syscall follow symlinks.
+		return nil
+	}
+	names, err := listXattrs(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(path, name)
+		if err != nil {
+			return err
+		}
+		if m.Xattrs == nil {
+			m.Xattrs = map[string][]byte{}
+		}
+		m.Xattrs[name] = value
+	}
+	return nil
+}
+
+func restoreSystemMetadata(path string, m Metadata) error {
+	if err := os.Lchown(path, m.Uid, m.Gid); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	if m.Type == Symlink {
+		return nil
+	}
+	for name, value := range m.Xattrs {
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes of path. Files on
+// filesystems without extended attributes have none.
+func listXattrs(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	return buf[:size], nil
+}
+
+func mknod(path string, m Metadata) error {
+	mode := uint32(m.Mode.Perm())
+	switch m.Type {
+	case FIFO:
+		mode |= syscall.S_IFIFO
+	case CharDevice:
+		mode |= syscall.S_IFCHR
+	case BlockDevice:
+		mode |= syscall.S_IFBLK
+	}
+	if err := syscall.Mknod(path, mode, int(m.Device)); err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+	return nil
+}
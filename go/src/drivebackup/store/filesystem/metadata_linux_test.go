@@ -0,0 +1,150 @@
+package filesystem_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"drivebackup/store/filesystem"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := filepath.Join(dir, "original")
+	if err := ioutil.WriteFile(original, []byte("test"), 0640); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	modTime := time.Unix(1500000000, 0)
+	if err := os.Chtimes(original, modTime, modTime); err != nil {
+		t.Fatalf("error setting times: %v", err)
+	}
+	xattrs := true
+	if err := syscall.Setxattr(original, "user.origin", []byte("drive"), 0); err != nil {
+		// Not every filesystem supports user extended attributes.
+		xattrs = false
+	}
+
+	metadata, err := filesystem.ReadMetadata(original)
+	if err != nil {
+		t.Fatalf("error reading metadata: %v", err)
+	}
+	if metadata.Size != 4 || metadata.Mode != 0640 || !metadata.ModTime.Equal(modTime) {
+		t.Errorf("got metadata %+v", metadata)
+	}
+	if want := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"; metadata.Hash != want {
+		t.Errorf("got hash %s, want %s", metadata.Hash, want)
+	}
+	if xattrs && string(metadata.Xattrs["user.origin"]) != "drive" {
+		t.Errorf("got xattrs %v, want user.origin=drive", metadata.Xattrs)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := ioutil.WriteFile(restored, []byte("test"), 0600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := filesystem.RestoreMetadata(restored, metadata); err != nil {
+		t.Fatalf("error restoring metadata: %v", err)
+	}
+	got, err := filesystem.ReadMetadata(restored)
+	if err != nil {
+		t.Fatalf("error reading metadata: %v", err)
+	}
+	if !reflect.DeepEqual(got, metadata) {
+		t.Errorf("got metadata %+v after restoring, want %+v", got, metadata)
+	}
+}
+
+func TestRestorer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("test"), 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := os.Link(filepath.Join(src, "file"), filepath.Join(src, "link")); err != nil {
+		t.Fatalf("error linking file: %v", err)
+	}
+	if err := os.Symlink("file", filepath.Join(src, "symlink")); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0600); err != nil {
+		t.Fatalf("error creating fifo: %v", err)
+	}
+
+	// Back up the files, keeping the content of regular files by hash.
+	blobs := map[string][]byte{}
+	refs := map[string]filesystem.StoredBlobRef{}
+	for _, name := range []string{"file", "link", "symlink", "fifo"} {
+		metadata, err := filesystem.ReadMetadata(filepath.Join(src, name))
+		if err != nil {
+			t.Fatalf("error reading metadata of %s: %v", name, err)
+		}
+		ref := filesystem.StoredBlobRef{Metadata: metadata}
+		if metadata.Type == filesystem.RegularFile {
+			ref.BlobRef = filesystem.BlobRef{Store: "test", Name: metadata.Hash}
+			blobs[metadata.Hash] = []byte("test")
+		}
+		refs[name] = ref
+	}
+	if refs["file"].Metadata.LinkGroup == "" || refs["file"].Metadata.LinkGroup != refs["link"].Metadata.LinkGroup {
+		t.Errorf("got link groups %q and %q, want the same group", refs["file"].Metadata.LinkGroup, refs["link"].Metadata.LinkGroup)
+	}
+	if refs["symlink"].Metadata.Type != filesystem.Symlink || refs["symlink"].Metadata.LinkTarget != "file" {
+		t.Errorf("got %+v, want a symlink to file", refs["symlink"].Metadata)
+	}
+	if refs["fifo"].Metadata.Type != filesystem.FIFO {
+		t.Errorf("got type %v, want fifo", refs["fifo"].Metadata.Type)
+	}
+
+	restorer := &filesystem.Restorer{Open: func(ref filesystem.BlobRef) (io.Reader, error) {
+		data, ok := blobs[ref.Name]
+		if !ok {
+			return nil, fmt.Errorf("no blob %v", &ref)
+		}
+		return bytes.NewReader(data), nil
+	}}
+	for _, name := range []string{"file", "link", "symlink", "fifo"} {
+		if err := restorer.Restore(filepath.Join(dst, name), refs[name]); err != nil {
+			t.Fatalf("error restoring %s: %v", name, err)
+		}
+	}
+
+	file, err := os.Stat(filepath.Join(dst, "file"))
+	if err != nil {
+		t.Fatalf("error reading restored file: %v", err)
+	}
+	link, err := os.Stat(filepath.Join(dst, "link"))
+	if err != nil {
+		t.Fatalf("error reading restored link: %v", err)
+	}
+	if !os.SameFile(file, link) {
+		t.Errorf("restored hard links are different files")
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "symlink")); err != nil || target != "file" {
+		t.Errorf("got symlink target %q, %v, want file", target, err)
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "fifo")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("restored fifo is %v, %v", info, err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package filesystem
+
+import (
+	"fmt"
+	"os"
+)
+
+// Ownership, extended attributes, hard links and special files are only kept
+// on Linux.
+
+func readSystemMetadata(path string, info os.FileInfo, m *Metadata) error {
+	return nil
+}
+
+func restoreSystemMetadata(path string, m Metadata) error {
+	return nil
+}
+
+func mknod(path string, m Metadata) error {
+	return fmt.Errorf("%s: can't restore a %v on this system", path, m.Type)
+}
@@ -0,0 +1,9 @@
+package filesystem
+
+// Ref is a named version of a bucket, such as "pre-migration". Refs can be
+// moved to another version and deleted. A version a ref points at can't be
+// deleted, so refs also protect versions from pruning.
+type Ref struct {
+	Name    string
+	Version Version
+}
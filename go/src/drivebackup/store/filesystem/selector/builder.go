@@ -1,14 +1,22 @@
 package selector
 
-import "drivebackup/store/filesystem"
+import (
+	"fmt"
+	"time"
 
-func NewSelectorBuilder(buildFunc func(path, latestVersionPath string, isFile bool, version filesystem.Version) filesystem.SelectorOp) *SelectorBuilder {
+	"drivebackup/store/filesystem"
+)
+
+func NewSelectorBuilder(buildFunc func(q Query) filesystem.SelectorOp) *SelectorBuilder {
 	return &SelectorBuilder{Build: buildFunc}
 }
 
 type SelectorBuilder struct {
 	Selector []Constraint
-	Build func(path, latestVersionPath string, isFile bool, version filesystem.Version) filesystem.SelectorOp
+	Build func(q Query) filesystem.SelectorOp
+	// ResolveTag returns the version a tag points at. Tags are unsupported
+	// if it is nil.
+	ResolveTag func(name string) (filesystem.Version, error)
 }
 
 var _ filesystem.Selector = (*SelectorBuilder)(nil)
@@ -20,12 +28,69 @@ func (b *SelectorBuilder) Version(version filesystem.Version) filesystem.Selecto
 	})
 	return b
 }
+func (b *SelectorBuilder) Tag(name string) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: TagConstraint,
+		Tag: name,
+	})
+	return b
+}
 func (b *SelectorBuilder) Latest() filesystem.Selector {
 	b.Selector = append(b.Selector, Constraint{
 		Type: LatestConstraint,
 	})
 	return b
 }
+func (b *SelectorBuilder) AsOf(t time.Time) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: AsOfConstraint,
+		Time: t,
+	})
+	return b
+}
+func (b *SelectorBuilder) Before(t time.Time) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: BeforeConstraint,
+		Time: t,
+	})
+	return b
+}
+func (b *SelectorBuilder) After(t time.Time) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: AfterConstraint,
+		Time: t,
+	})
+	return b
+}
+func (b *SelectorBuilder) Since(version filesystem.Version) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: SinceConstraint,
+		Version: version,
+	})
+	return b
+}
+func (b *SelectorBuilder) Until(version filesystem.Version) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: UntilConstraint,
+		Until: version,
+	})
+	return b
+}
+func (b *SelectorBuilder) Between(from, to filesystem.Version) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: BetweenConstraint,
+		Version: from,
+		Until: to,
+	})
+	return b
+}
+func (b *SelectorBuilder) Last(n int) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: LastConstraint,
+		Count: n,
+	})
+	return b
+}
 func (b *SelectorBuilder) Dir(path string) filesystem.Selector {
 	b.Selector = append(b.Selector, Constraint{
 		Type: DirConstraint,
@@ -40,25 +105,106 @@ func (b *SelectorBuilder) File(name string) filesystem.Selector {
 	})
 	return b
 }
+func (b *SelectorBuilder) Glob(pattern string) filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: GlobConstraint,
+		Location: pattern,
+	})
+	return b
+}
+func (b *SelectorBuilder) Follow() filesystem.Selector {
+	b.Selector = append(b.Selector, Constraint{
+		Type: FollowConstraint,
+	})
+	return b
+}
 
 func (b *SelectorBuilder) Versions() ([]filesystem.Version, error) {
 	if err := validate(b.Selector, NoFlags); err != nil {
 		return nil, err
 	}
-	path, latestVersionPath, isFile, version := extract(b.Selector)
-	return b.Build(path, latestVersionPath, isFile, version).Versions()
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(q).Versions()
+}
+func (b *SelectorBuilder) IterVersions(opts filesystem.VersionOptions) filesystem.VersionIterator {
+	if err := validate(b.Selector, NoFlags); err != nil {
+		return filesystem.FailedVersionIterator(err)
+	}
+	if opts.Limit < 0 {
+		return filesystem.FailedVersionIterator(fmt.Errorf("limit must not be negative, got %d", opts.Limit))
+	}
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return filesystem.FailedVersionIterator(err)
+	}
+	return b.Build(q).IterVersions(opts)
 }
 func (b *SelectorBuilder) List() ([]string, error) {
 	if err := validate(b.Selector, NoFlags); err != nil {
 		return nil, err
 	}
-	path, latestVersionPath, isFile, version := extract(b.Selector)
-	return b.Build(path, latestVersionPath, isFile, version).List()
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(q).List()
+}
+func (b *SelectorBuilder) ListEntries(opts filesystem.ListOptions) (*filesystem.EntryPage, error) {
+	if err := validate(b.Selector, NoFlags); err != nil {
+		return nil, err
+	}
+	if opts.Limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative, got %d", opts.Limit)
+	}
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(q).ListEntries(opts)
+}
+func (b *SelectorBuilder) Walk(fn filesystem.WalkFunc) error {
+	if err := validate(b.Selector, NoFlags); err != nil {
+		return err
+	}
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return err
+	}
+	return b.Build(q).Walk(fn)
+}
+func (b *SelectorBuilder) Diff(v1, v2 filesystem.Version) ([]filesystem.Change, error) {
+	if err := validate(b.Selector, NoFlags); err != nil {
+		return nil, err
+	}
+	if err := validateDiff(b.Selector, v1, v2); err != nil {
+		return nil, err
+	}
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(q).Diff(v1, v2)
 }
 func (b *SelectorBuilder) BlobRef() (filesystem.StoredBlobRef, error) {
 	if err := validate(b.Selector, RequireFile | RequireVersion); err != nil {
 		return filesystem.StoredBlobRef{}, err
 	}
-	path, latestVersionPath, isFile, version := extract(b.Selector)
-	return b.Build(path, latestVersionPath, isFile, version).BlobRef()
-}
\ No newline at end of file
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return filesystem.StoredBlobRef{}, err
+	}
+	return b.Build(q).BlobRef()
+}
+func (b *SelectorBuilder) Match() ([]filesystem.MatchedFile, error) {
+	if err := validate(b.Selector, RequireGlob); err != nil {
+		return nil, err
+	}
+	q, err := extract(b.Selector, b.ResolveTag)
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(q).Match()
+}
@@ -1,51 +1,89 @@
 package selector
 
 import (
-	"drivebackup/store/filesystem"
+	"fmt"
 	"path/filepath"
+
+	"drivebackup/store/filesystem"
 )
 
-func extract(selector []Constraint) (path, latestVersionPath string, isFile bool, version filesystem.Version) {
-	// Handle VersionConstraint
+func extract(selector []Constraint, resolveTag func(name string) (filesystem.Version, error)) (q Query, err error) {
+	// Handle VersionConstraint, and TagConstraint, which is resolved to the
+	// version the tag points at now.
+	for _, constraint := range selector {
+		switch constraint.Type {
+		case VersionConstraint:
+			q.Version = constraint.Version
+		case TagConstraint:
+			if resolveTag == nil {
+				return Query{}, fmt.Errorf("tags are not supported")
+			}
+			if q.Version, err = resolveTag(constraint.Tag); err != nil {
+				return Query{}, err
+			}
+		}
+	}
+
+	// Handle FollowConstraint
 	for _, constraint := range selector {
-		if constraint.Type == VersionConstraint {
-			version = constraint.Version
+		if constraint.Type == FollowConstraint {
+			q.Follow = true
+		}
+	}
+
+	// Handle range constraints
+	for _, constraint := range selector {
+		switch constraint.Type {
+		case SinceConstraint:
+			q.Range.Since = constraint.Version
+		case UntilConstraint:
+			q.Range.Until = constraint.Until
+		case BetweenConstraint:
+			q.Range.Since = constraint.Version
+			q.Range.Until = constraint.Until
+		case LastConstraint:
+			q.Range.Last = constraint.Count
 		}
 	}
 
 	// Determine if file / dir.
 	for _, constraint := range selector {
 		if constraint.Type == FileConstraint {
-			isFile = true
+			q.IsFile = true
 		}
 	}
 
 	// Process up to the version constraint, if any.
 	var pathBeforeVersion string
-	var hasLatestConstraint bool
+	var fileBeforeVersion bool
 	loopPre: for _, constraint := range selector {
 		switch constraint.Type {
 		case FileConstraint, DirConstraint:
 			pathBeforeVersion = filepath.Join(pathBeforeVersion, constraint.Location)
-		case VersionConstraint:
-			hasLatestConstraint = true
+			fileBeforeVersion = constraint.Type == FileConstraint
+		case VersionConstraint, TagConstraint:
 			break loopPre
 		case LatestConstraint:
+			q.Latest = true
+			break loopPre
+		case AsOfConstraint, BeforeConstraint, AfterConstraint:
+			q.TimeConstraint = constraint.Type
+			q.Time = constraint.Time
 			break loopPre
 		}
 	}
 
-	if hasLatestConstraint {
-		latestVersionPath = pathBeforeVersion
+	if q.Resolves() {
+		q.LatestPath = pathBeforeVersion
+		q.LatestIsFile = fileBeforeVersion
 	}
 
 	// Process paths after the version constraint.
 	var seenVersion bool
-	path = pathBeforeVersion
+	path := pathBeforeVersion
 	for _, constraint := range selector {
 		if !seenVersion {
-			switch constraint.Type {
-			case VersionConstraint, LatestConstraint:
+			if constraint.Type.kind() == kindVersion {
 				seenVersion = true
 			}
 			continue
@@ -55,6 +93,15 @@ func extract(selector []Constraint) (path, latestVersionPath string, isFile bool
 			path = filepath.Join(path, constraint.Location)
 		}
 	}
+	q.Path = path
+
+	// A glob is the last location, so the pattern is relative to the full
+	// path.
+	for _, constraint := range selector {
+		if constraint.Type == GlobConstraint {
+			q.Glob = filepath.Join(path, constraint.Location)
+		}
+	}
 
 	return
 }
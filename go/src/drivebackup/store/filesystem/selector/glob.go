@@ -0,0 +1,72 @@
+package selector
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A glob is matched against paths one segment at a time. Within a segment,
+// "*" matches any run of characters, "?" any one character and "[...]" a
+// character class, as in filepath.Match. A "**" segment matches any number
+// of segments, including none.
+
+const globstar = "**"
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, string(os.PathSeparator))
+}
+
+// checkGlob reports a malformed pattern.
+func checkGlob(pattern string) error {
+	for _, segment := range splitPath(pattern) {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchGlob reports whether path matches pattern. Both are relative to the
+// bucket root.
+func MatchGlob(pattern, path string) bool {
+	return matchSegments(splitPath(pattern), splitPath(path))
+}
+
+func matchSegments(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == globstar {
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+// GlobRoot returns the longest leading part of pattern without wildcards:
+// every match is below it, so backends need only search there.
+func GlobRoot(pattern string) string {
+	segments := splitPath(pattern)
+	var root []string
+	for _, segment := range segments[:len(segments)-1] {
+		if strings.ContainsAny(segment, `*?[\`) {
+			break
+		}
+		root = append(root, segment)
+	}
+	return filepath.Join(root...)
+}
@@ -1,6 +1,10 @@
 package selector
 
-import "drivebackup/store/filesystem"
+import (
+	"time"
+
+	"drivebackup/store/filesystem"
+)
 
 type ConstraintType int
 
@@ -9,6 +13,16 @@ const (
 	LatestConstraint
 	DirConstraint
 	FileConstraint
+	FollowConstraint
+	AsOfConstraint
+	BeforeConstraint
+	AfterConstraint
+	SinceConstraint
+	UntilConstraint
+	BetweenConstraint
+	LastConstraint
+	GlobConstraint
+	TagConstraint
 )
 
 func (c ConstraintType) String() string {
@@ -21,16 +35,40 @@ func (c ConstraintType) String() string {
 		return "dir"
 	case FileConstraint:
 		return "file"
+	case FollowConstraint:
+		return "follow"
+	case AsOfConstraint:
+		return "as of"
+	case BeforeConstraint:
+		return "before"
+	case AfterConstraint:
+		return "after"
+	case SinceConstraint:
+		return "since"
+	case UntilConstraint:
+		return "until"
+	case BetweenConstraint:
+		return "between"
+	case LastConstraint:
+		return "last"
+	case GlobConstraint:
+		return "glob"
+	case TagConstraint:
+		return "tag"
 	}
 	panic("unknown type")
 }
 
 func (c ConstraintType) kind() constraintKind {
 	switch c {
-	case VersionConstraint, LatestConstraint:
+	case VersionConstraint, TagConstraint, LatestConstraint, AsOfConstraint, BeforeConstraint, AfterConstraint:
 		return kindVersion
-	case DirConstraint, FileConstraint:
+	case DirConstraint, FileConstraint, GlobConstraint:
 		return kindLocation
+	case FollowConstraint:
+		return kindModifier
+	case SinceConstraint, UntilConstraint, BetweenConstraint, LastConstraint:
+		return kindRange
 	}
 	panic("unknown type")
 }
@@ -40,11 +78,125 @@ type constraintKind int
 const (
 	kindVersion constraintKind = iota
 	kindLocation
+	kindModifier
+	kindRange
 )
 
 type Constraint struct {
 	Type ConstraintType
 
 	Version filesystem.Version
+	Tag string
 	Location string
-}
\ No newline at end of file
+	Time time.Time
+	Until filesystem.Version // the upper bound of BetweenConstraint
+	Count int
+}
+
+// Query is a validated selector in the form passed to a backend's build
+// function.
+type Query struct {
+	Path   string // the selected file or dir, "" for the bucket root
+	IsFile bool
+
+	Version filesystem.Version // the selected version, if given explicitly or by a tag
+
+	// Latest selects the latest version of LatestPath, which is Path or one
+	// of its parents. LatestIsFile is set if LatestPath names a file.
+	Latest       bool
+	LatestPath   string
+	LatestIsFile bool
+
+	// TimeConstraint, if set to AsOfConstraint, BeforeConstraint or
+	// AfterConstraint, selects a version of LatestPath by Time instead.
+	TimeConstraint ConstraintType
+	Time           time.Time
+
+	// Follow follows the history of Path across moves.
+	Follow bool
+
+	// Range restricts the versions of Path that Versions, List and Match
+	// consider.
+	Range Range
+
+	// Glob, if set, is the pattern Match selects files by, relative to the
+	// bucket root. Path is then the dir it was given in.
+	Glob string
+}
+
+// Resolves reports whether the version is selected among the versions of
+// LatestPath, by Latest or a time constraint.
+func (q Query) Resolves() bool {
+	return q.Latest || q.TimeConstraint != VersionConstraint
+}
+
+// Pick returns the index of the version selected by Latest or the time
+// constraint among versions, which are ordered oldest first, or -1 if none
+// matches:
+//
+//   - Latest selects the newest version.
+//   - AsOf selects the newest version at or before Time.
+//   - Before selects the newest version before Time.
+//   - After selects the oldest version after Time.
+func (q Query) Pick(versions []filesystem.Version) int {
+	switch q.TimeConstraint {
+	case AfterConstraint:
+		for i, version := range versions {
+			if version.Time().After(q.Time) {
+				return i
+			}
+		}
+		return -1
+	case AsOfConstraint, BeforeConstraint:
+		for i := len(versions) - 1; i >= 0; i-- {
+			t := versions[i].Time()
+			if t.Before(q.Time) || (q.TimeConstraint == AsOfConstraint && t.Equal(q.Time)) {
+				return i
+			}
+		}
+		return -1
+	}
+	return len(versions) - 1
+}
+
+// Describe names the constraint that resolves q's version, for errors.
+func (q Query) Describe() string {
+	if q.Latest {
+		return "latest"
+	}
+	return q.TimeConstraint.String() + " " + q.Time.Format(time.RFC3339)
+}
+
+// Range is a set of versions selected by Since, Until, Between or Last. The
+// zero Range includes every version.
+type Range struct {
+	Since filesystem.Version // if set, the oldest version included
+	Until filesystem.Version // if set, the newest version included
+	Last  int                // if positive, only the newest Last versions in bounds are included
+}
+
+// IsSet reports whether r excludes any versions.
+func (r Range) IsSet() bool {
+	return r != Range{}
+}
+
+// Filter returns the versions in r, given versions ordered oldest first.
+func (r Range) Filter(versions []filesystem.Version) []filesystem.Version {
+	if !r.IsSet() {
+		return versions
+	}
+	var results []filesystem.Version
+	for _, version := range versions {
+		if r.Since != "" && version.Compare(r.Since) < 0 {
+			continue
+		}
+		if r.Until != "" && version.Compare(r.Until) > 0 {
+			continue
+		}
+		results = append(results, version)
+	}
+	if r.Last > 0 && len(results) > r.Last {
+		results = results[len(results)-r.Last:]
+	}
+	return results
+}
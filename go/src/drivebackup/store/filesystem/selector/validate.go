@@ -1,6 +1,10 @@
 package selector
 
-import "fmt"
+import (
+	"fmt"
+
+	"drivebackup/store/filesystem"
+)
 
 type ValidationFlag int
 
@@ -8,6 +12,7 @@ const (
 	NoFlags ValidationFlag = 0
 	RequireVersion ValidationFlag = 1
 	RequireFile ValidationFlag = 2
+	RequireGlob ValidationFlag = 4
 )
 
 func (f ValidationFlag) IsSet(m ValidationFlag) bool {
@@ -25,7 +30,53 @@ func validate(selector []Constraint, flags ValidationFlag) error {
 	if numVersionConstraints > 1 {
 		return fmt.Errorf("only one version constraint may be specified")
 	}
-	if flags.IsSet(RequireVersion) && numVersionConstraints < 0 {
+	for _, c := range selector {
+		if c.Type == TagConstraint && c.Tag == "" {
+			return fmt.Errorf("tag parameter must be non-empty")
+		}
+	}
+
+	// Range constraints select several versions, so they can't be combined
+	// with a version constraint or with each other, and can't be used to
+	// fetch a BlobRef.
+	numRangeConstraints := 0
+	for _, c := range selector {
+		if c.Type.kind() != kindRange {
+			continue
+		}
+		numRangeConstraints++
+		switch c.Type {
+		case SinceConstraint:
+			if c.Version == "" {
+				return fmt.Errorf("since parameter must be non-empty")
+			}
+		case UntilConstraint:
+			if c.Until == "" {
+				return fmt.Errorf("until parameter must be non-empty")
+			}
+		case BetweenConstraint:
+			if c.Version == "" || c.Until == "" {
+				return fmt.Errorf("between parameters must be non-empty")
+			}
+			if c.Version.Compare(c.Until) > 0 {
+				return fmt.Errorf("between range %s to %s is reversed", c.Version, c.Until)
+			}
+		case LastConstraint:
+			if c.Count < 1 {
+				return fmt.Errorf("last count must be positive, got %d", c.Count)
+			}
+		}
+	}
+	if numRangeConstraints > 1 {
+		return fmt.Errorf("only one range constraint may be specified")
+	}
+	if numRangeConstraints > 0 && numVersionConstraints > 0 {
+		return fmt.Errorf("range and version constraints may not be combined")
+	}
+	if flags.IsSet(RequireVersion) && numRangeConstraints > 0 {
+		return fmt.Errorf("a range constraint selects several versions, a single version must be specified")
+	}
+	if flags.IsSet(RequireVersion) && numVersionConstraints < 1 {
 		return fmt.Errorf("a version constrain must be specified")
 	}
 
@@ -45,6 +96,36 @@ func validate(selector []Constraint, flags ValidationFlag) error {
 		return fmt.Errorf("a file constrain must be specified")
 	}
 
+	// A glob must be the last location, can't be followed by a version
+	// constraint and is only matched by Match().
+	var globSeen bool
+	for _, c := range selector {
+		switch {
+		case c.Type == GlobConstraint:
+			if globSeen {
+				return fmt.Errorf("only one glob constraint may be specified")
+			}
+			if fileSeen {
+				return fmt.Errorf("glob and file constraints may not be combined")
+			}
+			if err := checkGlob(c.Location); err != nil {
+				return fmt.Errorf("bad glob %q: %v", c.Location, err)
+			}
+			globSeen = true
+		case globSeen && (c.Type.kind() == kindVersion || c.Type.kind() == kindLocation):
+			return fmt.Errorf("%s constraints may not come after a glob", c.Type)
+		}
+	}
+	if globSeen && hasFollow(selector) {
+		return fmt.Errorf("a glob can't follow moves")
+	}
+	if flags.IsSet(RequireGlob) && !globSeen {
+		return fmt.Errorf("a glob constraint must be specified")
+	}
+	if !flags.IsSet(RequireGlob) && globSeen {
+		return fmt.Errorf("a glob selector only supports Match()")
+	}
+
 	// Finally, check that all location parameters for location kind are non-empty.
 	for _, c := range selector {
 		if c.Type.kind() == kindLocation && c.Location == "" {
@@ -54,3 +135,26 @@ func validate(selector []Constraint, flags ValidationFlag) error {
 
 	return nil
 }
+
+func hasFollow(selector []Constraint) bool {
+	for _, c := range selector {
+		if c.Type == FollowConstraint {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDiff checks a selector and the versions passed to Diff(). Diff
+// compares the dir at both versions, so the selector can't pick its own.
+func validateDiff(selector []Constraint, v1, v2 filesystem.Version) error {
+	if v1 == "" || v2 == "" {
+		return fmt.Errorf("both versions must be specified for Diff()")
+	}
+	for _, c := range selector {
+		if c.Type.kind() == kindVersion || c.Type.kind() == kindRange || c.Type == FollowConstraint {
+			return fmt.Errorf("%s constraints may not be combined with Diff()", c.Type)
+		}
+	}
+	return nil
+}
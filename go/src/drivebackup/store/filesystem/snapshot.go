@@ -0,0 +1,24 @@
+package filesystem
+
+import "time"
+
+// Snapshot describes a commit of a bucket.
+type Snapshot struct {
+	Version Version
+
+	// Set with PutTransaction.Describe. Hostname and User default to those
+	// of the committing process.
+	Hostname string
+	User     string
+	Source   string // the path that was backed up
+	Tags     []string
+	Message  string
+
+	// Set when committing. Bytes adds up the Metadata.Size of the files
+	// written, so files written with File, whose size isn't known, count as
+	// 0. Started and Duration are read from the backend's Clock.
+	Files    int           // files written by the commit
+	Bytes    int64         // total size of the files written, from their metadata
+	Started  time.Time     // when the transaction was created
+	Duration time.Duration // from the transaction's creation to its commit
+}
@@ -0,0 +1,131 @@
+package filesystem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Versions are hybrid logical clock timestamps: the commit time as Unix
+// seconds zero padded to 12 digits, "." and nanoseconds, then "." and a six
+// digit counter that orders commits of the same bucket within one
+// nanosecond, or whose clocks ran behind the bucket's latest version.
+// Because of the padding, versions sort as strings in commit order.
+//
+// Versions are unique only because each bucket's versions are allocated in
+// one place, as FilesystemService requires: NextVersion callers serialize
+// allocation per bucket. Across hosts, versions follow the order of
+// allocation; their times are only as accurate as the hosts' clocks.
+
+// Clock tells the time when versions are assigned.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the clock used by backends unless another one is injected.
+var SystemClock Clock = systemClock{}
+
+// StepClock is a deterministic Clock for tests: it returns Start on the
+// first call and advances by Step on every call after that.
+type StepClock struct {
+	Start time.Time
+	Step  time.Duration
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *StepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.Start.Add(time.Duration(c.calls) * c.Step)
+	c.calls++
+	return now
+}
+
+// ManualClock is a Clock for tests that returns the time it was last Set
+// to, however often it is read.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func NewVersion(t time.Time, counter int) Version {
+	return Version(fmt.Sprintf("%012d.%09d.%06d", t.Unix(), t.Nanosecond(), counter))
+}
+
+// NextVersion returns the version of a commit made at clock's time to a
+// bucket whose latest version is latest, "" if there is none. It is newer
+// than latest even if the clock is behind. Callers must serialize calls for
+// the same bucket, and see the versions allocated by earlier calls as latest.
+func NextVersion(clock Clock, latest Version) Version {
+	now := clock.Now()
+	if latest == "" {
+		return NewVersion(now, 0)
+	}
+	t, counter, err := latest.parse()
+	if err != nil || now.After(t) {
+		return NewVersion(now, 0)
+	}
+	return NewVersion(t, counter+1)
+}
+
+// parse returns the time and counter of v.
+func (v Version) parse() (t time.Time, counter int, err error) {
+	parts := strings.Split(string(v), ".")
+	var secs, nanos int64
+	if len(parts) != 3 {
+		return time.Time{}, 0, fmt.Errorf("invalid version %q", v)
+	}
+	secs, err = strconv.ParseInt(parts[0], 10, 64)
+	if err == nil {
+		nanos, err = strconv.ParseInt(parts[1], 10, 64)
+	}
+	if err == nil {
+		counter, err = strconv.Atoi(parts[2])
+	}
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid version %q", v)
+	}
+	return time.Unix(secs, nanos), counter, nil
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as or newer than
+// o.
+func (v Version) Compare(o Version) int {
+	return strings.Compare(string(v), string(o))
+}
+
+// Time returns the commit time recorded in v, or the zero time if v is
+// invalid.
+func (v Version) Time() time.Time {
+	t, _, err := v.parse()
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Valid reports whether v is a well-formed version.
+func (v Version) Valid() bool {
+	_, _, err := v.parse()
+	return err == nil
+}
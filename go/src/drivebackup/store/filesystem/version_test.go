@@ -0,0 +1,64 @@
+package filesystem_test
+
+import (
+	"testing"
+	"time"
+
+	"drivebackup/store/filesystem"
+)
+
+func TestNextVersion(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := &filesystem.StepClock{Start: start, Step: time.Second}
+
+	v1 := filesystem.NextVersion(clock, "")
+	v2 := filesystem.NextVersion(clock, v1)
+	if v1.Compare(v2) >= 0 || !v1.Time().Equal(start) || !v2.Time().Equal(start.Add(time.Second)) {
+		t.Errorf("got %v at %v and %v at %v", v1, v1.Time(), v2, v2.Time())
+	}
+
+	// A clock that stands still, or runs behind the latest version, still
+	// gives newer versions.
+	still := &filesystem.StepClock{Start: start}
+	v3 := filesystem.NextVersion(still, v2)
+	v4 := filesystem.NextVersion(still, v3)
+	if v2.Compare(v3) >= 0 || v3.Compare(v4) >= 0 {
+		t.Errorf("got %v, %v, %v, want increasing versions", v2, v3, v4)
+	}
+	if !v4.Time().Equal(v2.Time()) {
+		t.Errorf("got time %v, want %v", v4.Time(), v2.Time())
+	}
+}
+
+func TestVersionOrder(t *testing.T) {
+	// Ordered oldest first, including versions past 10 digits of seconds.
+	versions := []filesystem.Version{
+		filesystem.NewVersion(time.Unix(1500000000, 0), 0),
+		filesystem.NewVersion(time.Unix(1500000000, 0), 1),
+		filesystem.NewVersion(time.Unix(1500000000, 1), 0),
+		filesystem.NewVersion(time.Unix(9999999999, 0), 0),
+		filesystem.NewVersion(time.Unix(10000000000, 0), 0),
+	}
+	for i := range versions {
+		for j := range versions {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := versions[i].Compare(versions[j]); got != want {
+				t.Errorf("%v.Compare(%v) = %d, want %d", versions[i], versions[j], got, want)
+			}
+		}
+	}
+	if got := versions[2].Time(); !got.Equal(time.Unix(1500000000, 1)) {
+		t.Errorf("got time %v, want %v", got, time.Unix(1500000000, 1))
+	}
+	for _, v := range []filesystem.Version{"invalid", "1499999999"} {
+		if got := v.Time(); !got.IsZero() || v.Valid() {
+			t.Errorf("got time %v for invalid version %q", got, v)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// Package prune removes old versions of buckets according to a retention
+// policy, and optionally the blobs only they referenced.
+package prune
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"drivebackup/store/blob"
+	"drivebackup/store/filesystem"
+)
+
+// Policy decides which versions of a bucket to keep. A version is kept if
+// any rule keeps it; every other version is removed. The newest version,
+// every version holding a live file or dir, and every version that removed a
+// path no newer version wrote again are always kept, so pruning never
+// changes what the bucket holds now. So is every version a ref points at.
+type Policy struct {
+	KeepLast int // the newest versions
+
+	// The newest version of each of the most recent hours, days, ISO weeks,
+	// months and years that have a version, in UTC.
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+
+	KeepWithin time.Duration // versions committed within this long of Now
+	KeepTags   []string      // versions whose snapshot has any of these tags
+}
+
+func (p Policy) isEmpty() bool {
+	return p.KeepLast == 0 && p.KeepHourly == 0 && p.KeepDaily == 0 && p.KeepWeekly == 0 &&
+		p.KeepMonthly == 0 && p.KeepYearly == 0 && p.KeepWithin == 0 && len(p.KeepTags) == 0
+}
+
+func (p Policy) validate() error {
+	if p.isEmpty() {
+		return errors.New("empty policy would remove every version")
+	}
+	for _, n := range []int{p.KeepLast, p.KeepHourly, p.KeepDaily, p.KeepWeekly, p.KeepMonthly, p.KeepYearly} {
+		if n < 0 {
+			return fmt.Errorf("negative count %d in policy", n)
+		}
+	}
+	if p.KeepWithin < 0 {
+		return fmt.Errorf("negative duration %v in policy", p.KeepWithin)
+	}
+	return nil
+}
+
+// Engine applies a Policy to a set of buckets. If Blobs is set, blobs of
+// Store referenced only by removed versions are deleted too; every bucket
+// that may reference the store must then be included, or blobs still in use
+// by an omitted bucket may be deleted.
+type Engine struct {
+	Buckets map[string]filesystem.Bucket
+	Policy  Policy
+
+	Store string // the BlobRef.Store name served by Blobs
+	Blobs blob.BlobService
+
+	// Now defaults to time.Now.
+	Now func() time.Time
+}
+
+// Kept is a version a Policy keeps, with the rules that keep it.
+type Kept struct {
+	Version filesystem.Version
+	Reasons []string
+}
+
+// BucketPlan lists the versions of a bucket an Apply would keep and remove,
+// oldest first.
+type BucketPlan struct {
+	Name   string
+	Head   filesystem.Version // the bucket's head when planned
+	Keep   []Kept
+	Remove []filesystem.Snapshot
+}
+
+// Plan lists what an Apply would remove. Its String is a dry-run report.
+type Plan struct {
+	Now     time.Time
+	Buckets []BucketPlan // sorted by name
+	Blobs   []string     // blobs of the store only referenced by removed versions
+}
+
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, bucket := range p.Buckets {
+		fmt.Fprintf(&b, "bucket %s: keeping %d, removing %d versions\n", bucket.Name, len(bucket.Keep), len(bucket.Remove))
+		for _, kept := range bucket.Keep {
+			fmt.Fprintf(&b, "  keep   %s (%s)\n", kept.Version, strings.Join(kept.Reasons, ", "))
+		}
+		for _, snapshot := range bucket.Remove {
+			fmt.Fprintf(&b, "  remove %s (%d files, %d bytes)\n", snapshot.Version, snapshot.Files, snapshot.Bytes)
+		}
+	}
+	fmt.Fprintf(&b, "removing %d blobs\n", len(p.Blobs))
+	for _, name := range p.Blobs {
+		fmt.Fprintf(&b, "  %s\n", name)
+	}
+	return b.String()
+}
+
+func (e *Engine) now() time.Time {
+	if e.Now != nil {
+		return e.Now()
+	}
+	return time.Now()
+}
+
+// Plan computes which versions, and blobs, the policy removes. It reads
+// every version of every bucket: finding the versions that removed a path
+// exports the commit of each, and with Blobs set, every version is walked
+// as well.
+func (e *Engine) Plan() (*Plan, error) {
+	if err := e.Policy.validate(); err != nil {
+		return nil, err
+	}
+	plan := &Plan{Now: e.now()}
+	var names []string
+	for name := range e.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	kept := map[filesystem.BlobRef]bool{}
+	removed := map[string]bool{}
+	for _, name := range names {
+		bucket := e.Buckets[name]
+		bucketPlan, err := e.planBucket(name, bucket, plan.Now)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q: %v", name, err)
+		}
+		plan.Buckets = append(plan.Buckets, *bucketPlan)
+		if e.Blobs == nil {
+			continue
+		}
+		for _, k := range bucketPlan.Keep {
+			err := filesystem.WalkBlobRefs(bucket, k.Version, func(ref filesystem.BlobRef) { kept[ref] = true })
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, snapshot := range bucketPlan.Remove {
+			err := filesystem.WalkBlobRefs(bucket, snapshot.Version, func(ref filesystem.BlobRef) {
+				if ref.Store == e.Store {
+					removed[ref.Name] = true
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name := range removed {
+		if !kept[filesystem.BlobRef{Store: e.Store, Name: name}] {
+			plan.Blobs = append(plan.Blobs, name)
+		}
+	}
+	sort.Strings(plan.Blobs)
+	return plan, nil
+}
+
+func (e *Engine) planBucket(name string, bucket filesystem.Bucket, now time.Time) (*BucketPlan, error) {
+	head, err := bucket.Head()
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := bucket.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	live := map[filesystem.Version]bool{}
+	if len(snapshots) > 0 {
+		err := bucket.Select().Walk(func(entry filesystem.WalkEntry) error {
+			live[entry.Version] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	removals, err := removals(bucket, snapshots)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := bucket.Refs()
+	if err != nil {
+		return nil, err
+	}
+	refNames := map[filesystem.Version][]string{}
+	for _, ref := range refs {
+		refNames[ref.Version] = append(refNames[ref.Version], "ref "+ref.Name)
+	}
+	reasons := e.Policy.reasons(snapshots, now)
+	plan := &BucketPlan{Name: name, Head: head}
+	for i, snapshot := range snapshots {
+		r := reasons[i]
+		if live[snapshot.Version] {
+			r = append(r, "live")
+		}
+		if removals[snapshot.Version] {
+			r = append(r, "removal")
+		}
+		r = append(r, refNames[snapshot.Version]...)
+		if len(r) == 0 {
+			plan.Remove = append(plan.Remove, snapshot)
+			continue
+		}
+		plan.Keep = append(plan.Keep, Kept{Version: snapshot.Version, Reasons: r})
+	}
+	return plan, nil
+}
+
+// removals returns the versions among snapshots, which are oldest first,
+// that removed a path no newer version wrote again. Deleting such a version
+// would bring the path back.
+func removals(bucket filesystem.Bucket, snapshots []filesystem.Snapshot) (map[filesystem.Version]bool, error) {
+	versions := map[filesystem.Version]bool{}
+	written := map[string]bool{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		commit, err := bucket.ExportCommit(snapshots[i].Version)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range commit.Removed {
+			if !written[path] {
+				versions[commit.Snapshot.Version] = true
+			}
+			written[path] = true
+		}
+		for _, path := range commit.Dirs {
+			written[path] = true
+		}
+		for _, f := range commit.Files {
+			written[f.Path] = true
+		}
+	}
+	return versions, nil
+}
+
+// reasons returns the rules keeping each of snapshots, which are oldest
+// first.
+func (p Policy) reasons(snapshots []filesystem.Snapshot, now time.Time) [][]string {
+	reasons := make([][]string, len(snapshots))
+	if len(snapshots) == 0 {
+		return reasons
+	}
+	reasons[len(reasons)-1] = append(reasons[len(reasons)-1], "newest")
+
+	periods := []struct {
+		name   string
+		count  int
+		period func(time.Time) string
+	}{
+		{"last", p.KeepLast, nil},
+		{"hourly", p.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, rule := range periods {
+		if rule.count == 0 {
+			continue
+		}
+		seen := map[string]bool{}
+		for i := len(snapshots) - 1; i >= 0 && len(seen) < rule.count; i-- {
+			key := fmt.Sprint(i)
+			if rule.period != nil {
+				key = rule.period(snapshots[i].Version.Time().UTC())
+			}
+			if !seen[key] {
+				seen[key] = true
+				reasons[i] = append(reasons[i], rule.name)
+			}
+		}
+	}
+
+	if p.KeepWithin > 0 {
+		cutoff := now.Add(-p.KeepWithin)
+		for i, snapshot := range snapshots {
+			if !snapshot.Version.Time().Before(cutoff) {
+				reasons[i] = append(reasons[i], "within "+p.KeepWithin.String())
+			}
+		}
+	}
+	if len(p.KeepTags) > 0 {
+		for i, snapshot := range snapshots {
+			for _, tag := range snapshot.Tags {
+				if hasTag(p.KeepTags, tag) {
+					reasons[i] = append(reasons[i], "tag "+tag)
+					break
+				}
+			}
+		}
+	}
+	return reasons
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply removes the versions in plan, then its blobs. It returns the number
+// of versions and blobs removed before any error. It removes nothing once a
+// bucket of the plan has taken a commit since it was planned, as the commit
+// may reference blobs the plan would delete; plan again instead. Nor does
+// it remove anything if the plan has blobs but the engine no blob service.
+// Commits made while Apply runs must be prevented by the caller.
+func (e *Engine) Apply(plan *Plan) (versions, blobs int, err error) {
+	if len(plan.Blobs) > 0 && e.Blobs == nil {
+		return 0, 0, errors.New("plan removes blobs but the engine has no blob service")
+	}
+	if err := e.checkHeads(plan); err != nil {
+		return 0, 0, err
+	}
+	for _, bucketPlan := range plan.Buckets {
+		if len(bucketPlan.Remove) == 0 {
+			continue
+		}
+		bucket, ok := e.Buckets[bucketPlan.Name]
+		if !ok {
+			return versions, 0, fmt.Errorf("unknown bucket %q", bucketPlan.Name)
+		}
+		remove := make([]filesystem.Version, len(bucketPlan.Remove))
+		for i, snapshot := range bucketPlan.Remove {
+			remove[i] = snapshot.Version
+		}
+		if err := bucket.DeleteVersions(remove...); err != nil {
+			return versions, 0, fmt.Errorf("deleting versions of %q: %v", bucketPlan.Name, err)
+		}
+		versions += len(remove)
+	}
+	if len(plan.Blobs) > 0 {
+		if err := e.checkHeads(plan); err != nil {
+			return versions, 0, err
+		}
+	}
+	for i, name := range plan.Blobs {
+		if err := e.Blobs.Delete(name); err != nil {
+			return versions, i, fmt.Errorf("deleting blob %q: %v", name, err)
+		}
+	}
+	return versions, len(plan.Blobs), nil
+}
+
+// checkHeads fails if the head of a bucket of plan moved since it was
+// planned.
+func (e *Engine) checkHeads(plan *Plan) error {
+	for _, bucketPlan := range plan.Buckets {
+		bucket, ok := e.Buckets[bucketPlan.Name]
+		if !ok {
+			return fmt.Errorf("unknown bucket %q", bucketPlan.Name)
+		}
+		head, err := bucket.Head()
+		if err != nil {
+			return fmt.Errorf("reading the head of %q: %v", bucketPlan.Name, err)
+		}
+		if head != bucketPlan.Head {
+			return fmt.Errorf("bucket %q changed since the plan: head is %s, was %s", bucketPlan.Name, head, bucketPlan.Head)
+		}
+	}
+	return nil
+}
+
+// Run plans and applies the policy.
+func (e *Engine) Run() (*Plan, error) {
+	plan, err := e.Plan()
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = e.Apply(plan)
+	return plan, err
+}
@@ -0,0 +1,345 @@
+package prune_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	blobmock "drivebackup/store/blob/mock"
+	"drivebackup/store/filesystem"
+	"drivebackup/store/filesystem/datastore"
+	dsmock "drivebackup/store/filesystem/datastore/mock"
+	"drivebackup/store/filesystem/disk"
+	fsmock "drivebackup/store/filesystem/mock"
+	"drivebackup/store/prune"
+)
+
+func commit(t *testing.T, bucket filesystem.Bucket, tags []string, files ...string) {
+	tx := bucket.NewPutTransaction()
+	tx.Describe(filesystem.Snapshot{Tags: tags})
+	for i := 0; i < len(files); i += 2 {
+		tx.File(files[i], filesystem.BlobRef{Store: "blobs", Name: files[i+1]})
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+}
+
+func keptVersions(plan prune.BucketPlan) []filesystem.Version {
+	var versions []filesystem.Version
+	for _, kept := range plan.Keep {
+		versions = append(versions, kept.Version)
+	}
+	return versions
+}
+
+func TestPrune(t *testing.T) {
+	blobs := &blobmock.MockBlobService{}
+	for i := 0; i < 6; i++ {
+		blobs.Put(fmt.Sprintf("a%d", i), bytes.NewReader([]byte("data")))
+	}
+	blobs.Put("x", bytes.NewReader([]byte("data")))
+
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	// One commit a day, the first six days ago.
+	clock := &filesystem.ManualClock{}
+	bucket := (&fsmock.MockFilesystemService{Clock: clock}).Bucket("photos")
+	// x.jpg is only written by the first commit, so it stays live.
+	clock.Set(now.Add(-6 * 24 * time.Hour))
+	commit(t, bucket, nil, "a.jpg", "a0", "x.jpg", "x")
+	for i := 1; i < 6; i++ {
+		clock.Set(now.Add(time.Duration(i-6) * 24 * time.Hour))
+		var tags []string
+		if i == 2 {
+			tags = []string{"keep"}
+		}
+		commit(t, bucket, tags, "a.jpg", fmt.Sprintf("a%d", i))
+	}
+	versions, err := bucket.Select().Versions()
+	if err != nil || len(versions) != 6 {
+		t.Fatalf("unexpected versions %v: %v", versions, err)
+	}
+
+	engine := &prune.Engine{
+		Buckets: map[string]filesystem.Bucket{"photos": bucket},
+		Policy:  prune.Policy{KeepLast: 2, KeepTags: []string{"keep"}},
+		Store:   "blobs",
+		Blobs:   blobs,
+		Now:     func() time.Time { return now },
+	}
+	plan, err := engine.Plan()
+	if err != nil {
+		t.Fatalf("error planning: %v", err)
+	}
+	if len(plan.Buckets) != 1 {
+		t.Fatalf("got %d bucket plans, want 1", len(plan.Buckets))
+	}
+	want := []filesystem.Version{versions[0], versions[2], versions[4], versions[5]}
+	if got := keptVersions(plan.Buckets[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	if got := plan.Buckets[0].Keep[0].Reasons; !reflect.DeepEqual(got, []string{"live"}) {
+		t.Errorf("first version kept for %v, want live", got)
+	}
+	if got := plan.Buckets[0].Keep[3].Reasons; !reflect.DeepEqual(got, []string{"newest", "last", "live"}) {
+		t.Errorf("newest version kept for %v", got)
+	}
+	if len(plan.Buckets[0].Remove) != 2 || plan.Buckets[0].Remove[0].Version != versions[1] || plan.Buckets[0].Remove[1].Version != versions[3] {
+		t.Errorf("unexpected removed versions %v", plan.Buckets[0].Remove)
+	}
+	if !reflect.DeepEqual(plan.Blobs, []string{"a1", "a3"}) {
+		t.Errorf("got blobs %v, want a1 and a3", plan.Blobs)
+	}
+	report := plan.String()
+	if !strings.Contains(report, "remove "+string(versions[1])) || !strings.Contains(report, "tag keep") {
+		t.Errorf("unexpected report:\n%s", report)
+	}
+
+	// Planning is a dry run.
+	if got, err := bucket.Select().Versions(); err != nil || len(got) != 6 {
+		t.Errorf("planning changed versions to %v: %v", got, err)
+	}
+
+	if n, m, err := engine.Apply(plan); err != nil || n != 2 || m != 2 {
+		t.Fatalf("Apply got %d versions, %d blobs, %v", n, m, err)
+	}
+	if got, err := bucket.Select().Versions(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got versions %v, %v, want %v", got, err, want)
+	}
+	for _, name := range []string{"a1", "a3"} {
+		if reader, err := blobs.Get(name); reader != nil || err != nil {
+			t.Errorf("blob %q not deleted: %v", name, err)
+		}
+	}
+	for _, name := range []string{"a0", "a2", "a4", "a5", "x"} {
+		if reader, err := blobs.Get(name); reader == nil || err != nil {
+			t.Errorf("blob %q deleted: %v", name, err)
+		}
+	}
+	for file, name := range map[string]string{"a.jpg": "a5", "x.jpg": "x"} {
+		fileVersions, err := bucket.Select().File(file).Versions()
+		if err != nil || len(fileVersions) == 0 {
+			t.Errorf("got versions %v, %v for %s", fileVersions, err, file)
+			continue
+		}
+		latest := fileVersions[len(fileVersions)-1]
+		if ref, err := bucket.Select().Version(latest).File(file).BlobRef(); err != nil || ref.Name != name {
+			t.Errorf("got %v, %v for %s, want %s", ref, err, file, name)
+		}
+	}
+
+	// A second run has nothing left to do.
+	if plan, err = engine.Run(); err != nil || len(plan.Buckets[0].Remove) != 0 || len(plan.Blobs) != 0 {
+		t.Errorf("got plan %v, %v, want empty plan", plan, err)
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	// Four commits a day for ten days.
+	start := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	clock := &filesystem.ManualClock{}
+	bucket := (&fsmock.MockFilesystemService{Clock: clock}).Bucket("photos")
+	for i := 0; i < 40; i++ {
+		clock.Set(start.Add(time.Duration(i) * 6 * time.Hour))
+		commit(t, bucket, nil, "a.jpg", fmt.Sprintf("a%d", i))
+	}
+	versions, err := bucket.Select().Versions()
+	if err != nil || len(versions) != 40 {
+		t.Fatalf("unexpected versions %v: %v", versions, err)
+	}
+
+	now := time.Date(2016, 6, 10, 18, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		policy prune.Policy
+		want   []int
+	}{
+		{prune.Policy{KeepDaily: 3}, []int{31, 35, 39}},
+		{prune.Policy{KeepHourly: 2}, []int{38, 39}},
+		{prune.Policy{KeepWeekly: 2}, []int{19, 39}}, // 2016-06-05 is a Sunday
+		{prune.Policy{KeepMonthly: 5}, []int{39}},
+		{prune.Policy{KeepWithin: 12 * time.Hour}, []int{37, 38, 39}},
+		{prune.Policy{KeepDaily: 1, KeepLast: 2}, []int{38, 39}},
+	} {
+		engine := &prune.Engine{
+			Buckets: map[string]filesystem.Bucket{"photos": bucket},
+			Policy:  test.policy,
+			Now:     func() time.Time { return now },
+		}
+		plan, err := engine.Plan()
+		if err != nil {
+			t.Errorf("error planning %+v: %v", test.policy, err)
+			continue
+		}
+		var want []filesystem.Version
+		for _, i := range test.want {
+			want = append(want, versions[i])
+		}
+		if got := keptVersions(plan.Buckets[0]); !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v kept %v, want %v", test.policy, got, want)
+		}
+	}
+
+	// Refs protect the versions they point at.
+	if err := bucket.SetRef("pre-migration", versions[3]); err != nil {
+		t.Fatalf("error setting ref: %v", err)
+	}
+	engine := &prune.Engine{
+		Buckets: map[string]filesystem.Bucket{"photos": bucket},
+		Policy:  prune.Policy{KeepLast: 1},
+		Now:     func() time.Time { return now },
+	}
+	plan, err := engine.Plan()
+	if err != nil {
+		t.Fatalf("error planning: %v", err)
+	}
+	if got, want := keptVersions(plan.Buckets[0]), []filesystem.Version{versions[3], versions[39]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	if got := plan.Buckets[0].Keep[0].Reasons; !reflect.DeepEqual(got, []string{"ref pre-migration"}) {
+		t.Errorf("tagged version kept for %v", got)
+	}
+
+	for _, policy := range []prune.Policy{{}, {KeepLast: -1}} {
+		engine := &prune.Engine{Buckets: map[string]filesystem.Bucket{"photos": bucket}, Policy: policy}
+		if _, err := engine.Plan(); err == nil {
+			t.Errorf("expected error planning %+v", policy)
+		}
+	}
+}
+
+// live returns the paths of the files the bucket holds now.
+func live(t *testing.T, bucket filesystem.Bucket) []string {
+	var paths []string
+	err := bucket.Select().Walk(func(entry filesystem.WalkEntry) error {
+		if !entry.IsDir {
+			paths = append(paths, entry.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error walking: %v", err)
+	}
+	return paths
+}
+
+func TestPruneKeepsRemovals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	diskService, err := disk.Open(dir)
+	if err != nil {
+		t.Fatalf("error opening disk service: %v", err)
+	}
+	defer diskService.Close()
+
+	for name, service := range map[string]filesystem.FilesystemService{
+		"mock":      &fsmock.MockFilesystemService{},
+		"disk":      diskService,
+		"datastore": datastore.NewFilesystemService(context.Background(), &dsmock.MockClient{}),
+	} {
+		bucket := service.Bucket("photos")
+		commit(t, bucket, nil, "a.jpg", "a", "keep.jpg", "k")
+		tx := bucket.NewPutTransaction()
+		tx.Remove("a.jpg")
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("%s: error committing: %v", name, err)
+		}
+		commit(t, bucket, nil, "c.jpg", "c")
+		versions, err := bucket.Select().Versions()
+		if err != nil || len(versions) != 3 {
+			t.Fatalf("%s: unexpected versions %v: %v", name, versions, err)
+		}
+
+		engine := &prune.Engine{
+			Buckets: map[string]filesystem.Bucket{"photos": bucket},
+			Policy:  prune.Policy{KeepLast: 1},
+		}
+		plan, err := engine.Run()
+		if err != nil {
+			t.Fatalf("%s: error pruning: %v", name, err)
+		}
+		if len(plan.Buckets[0].Remove) != 0 || !reflect.DeepEqual(plan.Buckets[0].Keep[1].Reasons, []string{"removal"}) {
+			t.Errorf("%s: got plan %v, want the removal kept", name, plan)
+		}
+		if got, want := live(t, bucket), []string{"c.jpg", "keep.jpg"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v after pruning, want %v", name, got, want)
+		}
+
+		// Once the path is written again, the removal can go.
+		commit(t, bucket, nil, "a.jpg", "a2")
+		if plan, err = engine.Run(); err != nil {
+			t.Fatalf("%s: error pruning: %v", name, err)
+		}
+		if len(plan.Buckets[0].Remove) != 1 || plan.Buckets[0].Remove[0].Version != versions[1] {
+			t.Errorf("%s: got plan %v, want the removal removed", name, plan)
+		}
+		if got, want := live(t, bucket), []string{"a.jpg", "c.jpg", "keep.jpg"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v after pruning, want %v", name, got, want)
+		}
+	}
+}
+
+func TestApplyRejectsStalePlan(t *testing.T) {
+	blobs := &blobmock.MockBlobService{}
+	for _, name := range []string{"a0", "a1"} {
+		blobs.Put(name, bytes.NewReader([]byte("data")))
+	}
+	bucket := (&fsmock.MockFilesystemService{}).Bucket("photos")
+	commit(t, bucket, nil, "a.jpg", "a0")
+	commit(t, bucket, nil, "a.jpg", "a1")
+	engine := &prune.Engine{
+		Buckets: map[string]filesystem.Bucket{"photos": bucket},
+		Policy:  prune.Policy{KeepLast: 1},
+		Store:   "blobs",
+		Blobs:   blobs,
+	}
+	plan, err := engine.Plan()
+	if err != nil || !reflect.DeepEqual(plan.Blobs, []string{"a0"}) {
+		t.Fatalf("got plan %v, %v, want a0 removed", plan, err)
+	}
+
+	// A commit made after planning references a blob the plan removes.
+	commit(t, bucket, nil, "b.jpg", "a0")
+	if n, m, err := engine.Apply(plan); err == nil || n != 0 || m != 0 {
+		t.Errorf("Apply of a stale plan got %d versions, %d blobs, %v, want an error", n, m, err)
+	}
+	if reader, err := blobs.Get("a0"); reader == nil || err != nil {
+		t.Errorf("blob a0 deleted by a stale plan: %v", err)
+	}
+	if versions, err := bucket.Select().Versions(); err != nil || len(versions) != 3 {
+		t.Errorf("got versions %v, %v after a stale plan, want all three", versions, err)
+	}
+}
+
+func TestApplyWithoutBlobServiceRemovesNothing(t *testing.T) {
+	blobs := &blobmock.MockBlobService{}
+	bucket := (&fsmock.MockFilesystemService{}).Bucket("photos")
+	commit(t, bucket, nil, "a.jpg", "a0")
+	commit(t, bucket, nil, "a.jpg", "a1")
+	engine := &prune.Engine{
+		Buckets: map[string]filesystem.Bucket{"photos": bucket},
+		Policy:  prune.Policy{KeepLast: 1},
+		Store:   "blobs",
+		Blobs:   blobs,
+	}
+	plan, err := engine.Plan()
+	if err != nil || len(plan.Blobs) != 1 {
+		t.Fatalf("got plan %v, %v, want one blob removed", plan, err)
+	}
+
+	engine.Blobs = nil
+	if n, m, err := engine.Apply(plan); err == nil || n != 0 || m != 0 {
+		t.Errorf("Apply without a blob service got %d versions, %d blobs, %v, want an error", n, m, err)
+	}
+	if versions, err := bucket.Select().Versions(); err != nil || len(versions) != 2 {
+		t.Errorf("got versions %v, %v after a failed Apply, want both", versions, err)
+	}
+}
@@ -0,0 +1,159 @@
+package tier
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"drivebackup/store/filesystem"
+)
+
+// Policy decides which blobs belong in the cold tier.
+type Policy struct {
+	// MinAge is how old the newest version referencing a blob must be before
+	// the blob is moved to the cold tier.
+	MinAge time.Duration
+}
+
+// Engine applies a Policy to the blobs of one store, as referenced by a set
+// of buckets. Every bucket that may reference the store must be included, or
+// blobs still in use by a recent version of an omitted bucket may be frozen.
+type Engine struct {
+	Store   string // the BlobRef.Store name served by Router
+	Router  *Router
+	Buckets []filesystem.Bucket
+	Policy  Policy
+
+	// Now defaults to time.Now.
+	Now func() time.Time
+	// VersionTime returns the commit time of a version. It defaults to
+	// Version.Time.
+	VersionTime func(filesystem.Version) (time.Time, error)
+}
+
+// Plan lists the blobs an Apply would move.
+type Plan struct {
+	Freeze []string // hot blobs only referenced by versions older than the cutoff
+	Cutoff time.Time
+}
+
+func versionTime(version filesystem.Version) (time.Time, error) {
+	t := version.Time()
+	if t.IsZero() {
+		return time.Time{}, fmt.Errorf("invalid version %q", version)
+	}
+	return t, nil
+}
+
+func (e *Engine) now() time.Time {
+	if e.Now != nil {
+		return e.Now()
+	}
+	return time.Now()
+}
+
+func (e *Engine) versionTime(version filesystem.Version) (time.Time, error) {
+	if e.VersionTime != nil {
+		return e.VersionTime(version)
+	}
+	return versionTime(version)
+}
+
+// Plan computes which hot blobs of the store should move to the cold tier.
+func (e *Engine) Plan() (*Plan, error) {
+	plan := &Plan{Cutoff: e.now().Add(-e.Policy.MinAge)}
+	newest := map[string]time.Time{}
+	for _, bucket := range e.Buckets {
+		refs, err := collectRefs(bucket)
+		if err != nil {
+			return nil, err
+		}
+		for ref, versions := range refs {
+			if ref.Store != e.Store {
+				continue
+			}
+			for _, version := range versions {
+				t, err := e.versionTime(version)
+				if err != nil {
+					return nil, err
+				}
+				if t.After(newest[ref.Name]) {
+					newest[ref.Name] = t
+				}
+			}
+		}
+	}
+	for name, t := range newest {
+		if !t.Before(plan.Cutoff) {
+			continue
+		}
+		tier, err := e.Router.Tier(name)
+		if err != nil {
+			return nil, err
+		}
+		if tier == Hot {
+			plan.Freeze = append(plan.Freeze, name)
+		}
+	}
+	sort.Strings(plan.Freeze)
+	return plan, nil
+}
+
+// Apply moves the blobs in plan to the cold tier. It returns the number of
+// blobs moved before any error.
+func (e *Engine) Apply(plan *Plan) (int, error) {
+	for i, name := range plan.Freeze {
+		if err := e.Router.Freeze(name); err != nil {
+			return i, fmt.Errorf("freezing %q: %v", name, err)
+		}
+	}
+	return len(plan.Freeze), nil
+}
+
+// Run plans and applies the policy.
+func (e *Engine) Run() (*Plan, error) {
+	plan, err := e.Plan()
+	if err != nil {
+		return nil, err
+	}
+	_, err = e.Apply(plan)
+	return plan, err
+}
+
+// RehydrateVersion moves every blob of the store referenced by version of
+// bucket back to the hot tier, so a restore of that version reads only from
+// the hot tier.
+func (e *Engine) RehydrateVersion(bucket filesystem.Bucket, version filesystem.Version) error {
+	seen := map[string]bool{}
+	var names []string
+	err := filesystem.WalkBlobRefs(bucket, version, func(ref filesystem.BlobRef) {
+		if ref.Store == e.Store && !seen[ref.Name] {
+			seen[ref.Name] = true
+			names = append(names, ref.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	return e.Router.Rehydrate(names...)
+}
+
+// collectRefs returns every blob referenced by bucket with the versions
+// referencing it.
+func collectRefs(bucket filesystem.Bucket) (map[filesystem.BlobRef][]filesystem.Version, error) {
+	refs := map[filesystem.BlobRef][]filesystem.Version{}
+	versions, err := bucket.Select().Versions()
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		err := filesystem.WalkBlobRefs(bucket, version, func(ref filesystem.BlobRef) {
+			refs[ref] = append(refs[ref], version)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
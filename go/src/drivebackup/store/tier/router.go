@@ -0,0 +1,198 @@
+// Package tier moves blobs that are only referenced by old versions from a
+// hot blob service to a cheaper cold one, while keeping them readable under
+// their original BlobRef.
+package tier
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"drivebackup/store/blob"
+)
+
+// Tier identifies where a blob is stored.
+type Tier int
+
+const (
+	Missing Tier = iota
+	Hot
+	Cold
+)
+
+func (t Tier) String() string {
+	switch t {
+	case Missing:
+		return "missing"
+	case Hot:
+		return "hot"
+	case Cold:
+		return "cold"
+	}
+	panic("unknown tier")
+}
+
+// Router is a blob.BlobService over a hot and a cold tier. New blobs are
+// written to the hot tier and reads are served from whichever tier holds the
+// blob, so BlobRefs stay valid when blobs move between tiers.
+type Router struct {
+	Hot, Cold blob.BlobService
+
+	mu     sync.Mutex
+	inCold map[string]bool // blobs known to be in the cold tier
+}
+
+var _ blob.BlobService = (*Router)(nil)
+
+func NewRouter(hot, cold blob.BlobService) *Router {
+	return &Router{Hot: hot, Cold: cold, inCold: map[string]bool{}}
+}
+
+func (r *Router) Put(name string, data io.Reader) error {
+	return r.Hot.Put(name, data)
+}
+
+// Get reads from the tier the blob was last moved to. Blobs the router has
+// not moved itself, e.g. after a restart, are looked up in the hot tier first.
+func (r *Router) Get(name string) (io.Reader, error) {
+	r.mu.Lock()
+	cold := r.inCold[name]
+	r.mu.Unlock()
+	if cold {
+		return r.Cold.Get(name)
+	}
+	reader, err := r.Hot.Get(name)
+	if err != nil || reader != nil {
+		return reader, err
+	}
+	reader, err = r.Cold.Get(name)
+	if err == nil && reader != nil {
+		r.mu.Lock()
+		r.inCold[name] = true
+		r.mu.Unlock()
+	}
+	return reader, err
+}
+
+// Stat looks the blob up like Get.
+func (r *Router) Stat(name string) (int64, bool, error) {
+	r.mu.Lock()
+	cold := r.inCold[name]
+	r.mu.Unlock()
+	if cold {
+		return r.Cold.Stat(name)
+	}
+	size, ok, err := r.Hot.Stat(name)
+	if err != nil || ok {
+		return size, ok, err
+	}
+	return r.Cold.Stat(name)
+}
+
+func (r *Router) Delete(name string) error {
+	if err := r.Hot.Delete(name); err != nil {
+		return err
+	}
+	if err := r.Cold.Delete(name); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.inCold, name)
+	r.mu.Unlock()
+	return nil
+}
+
+// Tier returns the tier holding a blob.
+func (r *Router) Tier(name string) (Tier, error) {
+	_, ok, err := r.Hot.Stat(name)
+	if err != nil {
+		return Missing, err
+	}
+	if ok {
+		return Hot, nil
+	}
+	_, ok, err = r.Cold.Stat(name)
+	if err != nil {
+		return Missing, err
+	}
+	if ok {
+		return Cold, nil
+	}
+	return Missing, nil
+}
+
+// Freeze moves a blob from the hot to the cold tier. The copy is verified
+// before the hot blob is deleted, and reads are routed to the cold tier
+// before the hot copy disappears.
+func (r *Router) Freeze(name string) error {
+	if err := move(name, r.Hot, r.Cold); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.inCold[name] = true
+	r.mu.Unlock()
+	return r.Hot.Delete(name)
+}
+
+// Rehydrate moves blobs back from the cold to the hot tier, e.g. ahead of a
+// bulk restore. Blobs already in the hot tier are left alone.
+func (r *Router) Rehydrate(names ...string) error {
+	for _, name := range names {
+		_, hot, err := r.Hot.Stat(name)
+		if err != nil {
+			return err
+		}
+		if hot {
+			continue
+		}
+		if err := move(name, r.Cold, r.Hot); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		delete(r.inCold, name)
+		r.mu.Unlock()
+		if err := r.Cold.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move copies a blob from one service to another and verifies the copy. A
+// blob that already exists in the destination with the same contents, e.g.
+// from an interrupted earlier move, is accepted.
+func move(name string, from, to blob.BlobService) error {
+	data, err := read(from, name)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("blob %q not found", name)
+	}
+	existing, err := read(to, name)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		if err := to.Put(name, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		if existing, err = read(to, name); err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(data, existing) {
+		return fmt.Errorf("blob %q differs between tiers", name)
+	}
+	return nil
+}
+
+func read(service blob.BlobService, name string) ([]byte, error) {
+	reader, err := service.Get(name)
+	if err != nil || reader == nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
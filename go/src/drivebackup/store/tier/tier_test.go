@@ -0,0 +1,126 @@
+package tier_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	blobmock "drivebackup/store/blob/mock"
+	"drivebackup/store/fault"
+	"drivebackup/store/filesystem"
+	fsmock "drivebackup/store/filesystem/mock"
+	"drivebackup/store/tier"
+)
+
+func expectBlob(t *testing.T, router *tier.Router, name, data string, want tier.Tier) {
+	reader, err := router.Get(name)
+	if err != nil || reader == nil {
+		t.Errorf("Get(%q) failed: %v", name, err)
+		return
+	}
+	out, _ := ioutil.ReadAll(reader)
+	if string(out) != data {
+		t.Errorf("Get(%q) got %q, want %q", name, out, data)
+	}
+	if got, err := router.Tier(name); err != nil || got != want {
+		t.Errorf("Tier(%q) got %v, %v, want %v", name, got, err, want)
+	}
+}
+
+func TestTiering(t *testing.T) {
+	router := tier.NewRouter(&blobmock.MockBlobService{}, &blobmock.MockBlobService{})
+	for _, name := range []string{"old", "shared", "new"} {
+		if err := router.Put(name, bytes.NewReader([]byte(name+"_data"))); err != nil {
+			t.Fatalf("error in Put(%q): %v", name, err)
+		}
+	}
+
+	now := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	// The first commit is 100 days old, the second an hour old.
+	clock := &filesystem.ManualClock{}
+	clock.Set(now.Add(-100 * 24 * time.Hour))
+	bucket := (&fsmock.MockFilesystemService{Clock: clock}).Bucket("photos")
+	tx := bucket.NewPutTransaction()
+	tx.Dir("2015").File("a.jpg", filesystem.BlobRef{Store: "hot", Name: "old"})
+	tx.Dir("2015").File("b.jpg", filesystem.BlobRef{Store: "hot", Name: "shared"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+	clock.Set(now.Add(-time.Hour))
+	tx = bucket.NewPutTransaction()
+	tx.Dir("2015").File("b.jpg", filesystem.BlobRef{Store: "hot", Name: "shared"})
+	tx.Dir("2016").File("c.jpg", filesystem.BlobRef{Store: "hot", Name: "new"})
+	tx.File("d.jpg", filesystem.BlobRef{Store: "other", Name: "old"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing tx2: %v", err)
+	}
+	versions, err := bucket.Select().Dir("2015").File("b.jpg").Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("unexpected versions %v: %v", versions, err)
+	}
+
+	engine := &tier.Engine{
+		Store:   "hot",
+		Router:  router,
+		Buckets: []filesystem.Bucket{bucket},
+		Policy:  tier.Policy{MinAge: 90 * 24 * time.Hour},
+		Now:     func() time.Time { return now },
+	}
+
+	plan, err := engine.Run()
+	if err != nil {
+		t.Fatalf("error running engine: %v", err)
+	}
+	if !reflect.DeepEqual(plan.Freeze, []string{"old"}) {
+		t.Errorf("got plan %v, want only %q frozen", plan.Freeze, "old")
+	}
+	expectBlob(t, router, "old", "old_data", tier.Cold)
+	expectBlob(t, router, "shared", "shared_data", tier.Hot)
+	expectBlob(t, router, "new", "new_data", tier.Hot)
+
+	// A second run has nothing left to do.
+	if plan, err = engine.Plan(); err != nil || len(plan.Freeze) != 0 {
+		t.Errorf("got plan %v, %v, want empty plan", plan.Freeze, err)
+	}
+
+	if err := engine.RehydrateVersion(bucket, versions[0]); err != nil {
+		t.Fatalf("error rehydrating: %v", err)
+	}
+	expectBlob(t, router, "old", "old_data", tier.Hot)
+	expectBlob(t, router, "shared", "shared_data", tier.Hot)
+}
+
+func TestRouterFallsBackToCold(t *testing.T) {
+	hot, cold := &blobmock.MockBlobService{}, &blobmock.MockBlobService{}
+	cold.Put("a", bytes.NewReader([]byte("a_data")))
+
+	// A fresh router doesn't know "a" was frozen, but still finds it.
+	router := tier.NewRouter(hot, cold)
+	expectBlob(t, router, "a", "a_data", tier.Cold)
+	if err := router.Delete("a"); err != nil {
+		t.Fatalf("error in Delete: %v", err)
+	}
+	if reader, err := router.Get("a"); reader != nil || err != nil {
+		t.Errorf("deleted blob still readable: %v", err)
+	}
+}
+
+func TestTierDoesNotReadBlobs(t *testing.T) {
+	// Every Get fails, so only Stat can find the blobs.
+	noGets := fault.NewInjector(0, fault.Rule{Op: fault.Get})
+	hot := fault.NewBlobService(&blobmock.MockBlobService{}, noGets)
+	cold := fault.NewBlobService(&blobmock.MockBlobService{}, noGets)
+	router := tier.NewRouter(hot, cold)
+	hot.Put("hot", bytes.NewReader([]byte("hot_data")))
+	cold.Put("cold", bytes.NewReader([]byte("cold")))
+	for name, want := range map[string]tier.Tier{"hot": tier.Hot, "cold": tier.Cold, "missing": tier.Missing} {
+		if got, err := router.Tier(name); err != nil || got != want {
+			t.Errorf("Tier(%q) got %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if size, ok, err := router.Stat("cold"); err != nil || !ok || size != 4 {
+		t.Errorf("Stat(cold) got %d, %v, %v, want 4", size, ok, err)
+	}
+}
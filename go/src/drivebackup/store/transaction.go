@@ -7,7 +7,8 @@ import (
 	"golang.org/x/net/context"
 	"fmt"
 	"time"
-	"github.com/golang/protobuf/ptypes/timestamp"
+
+	"drivebackup/store/commit"
 )
 
 const BACKUP_BUCKET string = "BACKUP_OBJECTS"
@@ -25,8 +26,11 @@ func (tr *Transaction) Put(path string, file io.ReadSeeker) (error) {
 	return nil
 }
 
-// Not atomic
-func (tr *Transaction) Commit(ctx *context.Context, client *datastore.Client, service *storage.Service) error {
+// Commit stores the objects as one version of the category. The version
+// becomes visible all at once when its commit record is written; if Commit
+// fails or the process dies first, nothing is visible and Recover cleans up
+// or completes the commit later. See package commit for the protocol.
+func (tr *Transaction) Commit(ctx context.Context, client *datastore.Client, service *storage.Service) error {
 	filenameMap := map[string]string{}
 	timestamp := time.Now()
 	for path, obj := range tr.objects {
@@ -35,8 +39,17 @@ func (tr *Transaction) Commit(ctx *context.Context, client *datastore.Client, se
 			return err
 		}
 		filenameMap[path] = name
+	}
+
+	dsClient := NewDatastoreClient(ctx, client)
+	pending, err := commit.Stage(ctx, dsClient, string(tr.category), timestamp, filenameMap)
+	if err != nil {
+		return err
+	}
+
+	for path, obj := range tr.objects {
 		storageObj := &storage.Object{
-			Name: name,
+			Name: filenameMap[path],
 			Metadata: map[string]string{
 				"CATEGORY": string(tr.category),
 				"PATH": path,
@@ -49,19 +62,22 @@ func (tr *Transaction) Commit(ctx *context.Context, client *datastore.Client, se
 		}
 	}
 
-	return putBlobRefs(ctx, client, tr.category, timestamp, filenameMap)
+	return pending.Publish(ctx, dsClient)
 }
 
-func ReadFile(ctx *context.Context, client *datastore.Client, service *storage.Service, category Category, path string) (io.ReadCloser, error) {
-	ref, err := latestBlobRef(ctx, client, category, path)
+func ReadFile(ctx context.Context, client *datastore.Client, service *storage.Service, category Category, path string) (io.ReadCloser, error) {
+	ref, err := commit.Latest(ctx, NewDatastoreClient(ctx, client), string(category), path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	obj := service.Objects.Get(BACKUP_BUCKET, ref.BlobLocation)
+	obj := service.Objects.Get(BACKUP_BUCKET, ref.Blob)
 	response, err := obj.Download()
-	return response.Body, err
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
 }
 
-func ListDir(ctx *context.Context, client *datastore.Client, service *storage.Service, category Category, path string) ([]DirEntry, error) {
+func ListDir(ctx context.Context, client *datastore.Client, service *storage.Service, category Category, path string) ([]DirEntry, error) {
 	return listDir(ctx, client,category,path)
-}
\ No newline at end of file
+}
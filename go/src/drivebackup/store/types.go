@@ -2,6 +2,8 @@ package store
 
 import (
 	"io"
+
+	"drivebackup/store/filesystem"
 )
 
 type Category string
@@ -21,15 +23,9 @@ type Object struct {
 	io.Reader
 }
 
-type FileType int
-
-const (
-	FILE FileType = iota
-	DIR
-)
-
 type DirEntry struct {
 	Category Category
 	FilePath string
-	Type FileType
+	IsDir bool
+	Type filesystem.FileType // the type of a file, RegularFile for dirs
 }
\ No newline at end of file
@@ -0,0 +1,89 @@
+package usage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"drivebackup/store/blob"
+	"drivebackup/store/filesystem"
+)
+
+type meteredBlobService struct {
+	blob.BlobService
+	store string
+	meter *Meter
+}
+
+// BlobService returns service wrapped so that the bytes Put are recorded as
+// physical usage and limited by MaxStoreBytes. store is the BlobRef.Store
+// name under which filesystem entries refer to the service's blobs.
+func (m *Meter) BlobService(store string, service blob.BlobService) blob.BlobService {
+	m.mu.Lock()
+	m.stores[store] = service
+	m.mu.Unlock()
+	return &meteredBlobService{BlobService: service, store: store, meter: m}
+}
+
+func (s *meteredBlobService) Put(name string, data io.Reader) error {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	size := int64(len(b))
+	ref := filesystem.BlobRef{Store: s.store, Name: name}
+	m := s.meter
+
+	// Reserve the space before writing so that concurrent Puts can't
+	// jointly exceed the limit. Putting a stored name again replaces the
+	// blob, so only the difference in size is reserved.
+	m.mu.Lock()
+	reserved := size - m.put[ref]
+	if err := checkLimit("store", "physical", m.limits.MaxStoreBytes, m.stored.PhysicalBytes, reserved); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	m.stored.PhysicalBytes += reserved
+	m.mu.Unlock()
+
+	if err := s.BlobService.Put(name, bytes.NewReader(b)); err != nil {
+		m.mu.Lock()
+		m.stored.PhysicalBytes -= reserved
+		m.mu.Unlock()
+		return err
+	}
+
+	// The stored size may have changed since reserving, if the name was
+	// Put concurrently.
+	m.mu.Lock()
+	old, ok := m.put[ref]
+	m.stored.PhysicalBytes += size - old - reserved
+	m.stored.LogicalBytes += size - old
+	if !ok {
+		m.stored.Blobs++
+	}
+	m.put[ref] = size
+	m.sizes[ref] = size
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete releases the physical bytes of the blob. Buckets that referenced it
+// keep their accounted usage.
+func (s *meteredBlobService) Delete(name string) error {
+	if err := s.BlobService.Delete(name); err != nil {
+		return err
+	}
+	m := s.meter
+	ref := filesystem.BlobRef{Store: s.store, Name: name}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size, ok := m.put[ref]; ok {
+		m.stored.PhysicalBytes -= size
+		m.stored.LogicalBytes -= size
+		m.stored.Blobs--
+		delete(m.put, ref)
+	}
+	delete(m.sizes, ref)
+	return nil
+}
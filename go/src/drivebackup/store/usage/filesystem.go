@@ -0,0 +1,347 @@
+package usage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"drivebackup/store/filesystem"
+)
+
+type meteredFilesystemService struct {
+	filesystem.FilesystemService
+	meter *Meter
+}
+
+// FilesystemService returns service wrapped so that commits are accounted
+// against their bucket and rejected if they would exceed its limits.
+//
+// The usage of the buckets already in service is loaded first, so every
+// blob service they reference must have been added with BlobService. The
+// blobs they reference also count as stored. Blobs Put but never committed
+// before the meter was created aren't counted, and neither are commits made
+// through other meters, such as those of other processes, after loading.
+func (m *Meter) FilesystemService(service filesystem.FilesystemService) (filesystem.FilesystemService, error) {
+	infos, err := service.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if err := m.load(info.Name, service.Bucket(info.Name)); err != nil {
+			return nil, fmt.Errorf("loading the usage of bucket %q: %v", info.Name, err)
+		}
+	}
+	return &meteredFilesystemService{FilesystemService: service, meter: m}, nil
+}
+
+// load records the usage of every version of a bucket the meter doesn't
+// account for yet.
+func (m *Meter) load(name string, bucket filesystem.Bucket) error {
+	m.mu.Lock()
+	_, ok := m.buckets[name]
+	m.mu.Unlock()
+	if ok {
+		return nil
+	}
+	snapshots, err := bucket.Snapshots()
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		commit, err := bucket.ExportCommit(snapshot.Version)
+		if err != nil {
+			return err
+		}
+		sizes := map[filesystem.BlobRef]int64{}
+		u := &Usage{}
+		for _, f := range commit.Files {
+			if f.BlobRef == (filesystem.BlobRef{}) { // special files have no blob
+				continue
+			}
+			size, err := m.sizeOf(f.BlobRef)
+			if err != nil {
+				return fmt.Errorf("sizing %v: %v", &f.BlobRef, err)
+			}
+			sizes[f.BlobRef] = size
+			u.LogicalBytes += size
+			u.Files++
+		}
+
+		m.mu.Lock()
+		bu := m.bucket(name)
+		for ref, size := range sizes {
+			if !bu.blobs[ref] {
+				bu.blobs[ref] = true
+				u.PhysicalBytes += size
+				u.Blobs++
+			}
+			if _, ok := m.put[ref]; !ok {
+				m.put[ref] = size
+				m.stored.LogicalBytes += size
+				m.stored.PhysicalBytes += size
+				m.stored.Blobs++
+			}
+		}
+		bu.LogicalBytes += u.LogicalBytes
+		bu.PhysicalBytes += u.PhysicalBytes
+		bu.Files += u.Files
+		bu.Blobs += u.Blobs
+		bu.versions[snapshot.Version] = u
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *meteredFilesystemService) Bucket(bucket string) filesystem.Bucket {
+	return &meteredBucket{Bucket: s.FilesystemService.Bucket(bucket), name: bucket, meter: s.meter}
+}
+
+func (s *meteredFilesystemService) CreateBucket(name string, opts filesystem.BucketOptions) (filesystem.Bucket, error) {
+	bucket, err := s.FilesystemService.CreateBucket(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredBucket{Bucket: bucket, name: name, meter: s.meter}, nil
+}
+
+// RenameBucket moves the usage of the bucket to its new name.
+func (s *meteredFilesystemService) RenameBucket(from, to string) error {
+	if err := s.FilesystemService.RenameBucket(from, to); err != nil {
+		return err
+	}
+	m := s.meter
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.buckets[from]; ok {
+		m.buckets[to] = b
+		delete(m.buckets, from)
+	}
+	return nil
+}
+
+// DeleteBucket stops accounting for the bucket. As with DeleteVersions, the
+// physical bytes of its blobs stay accounted against the store.
+func (s *meteredFilesystemService) DeleteBucket(name, confirm string) error {
+	if err := s.FilesystemService.DeleteBucket(name, confirm); err != nil {
+		return err
+	}
+	m := s.meter
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets, name)
+	return nil
+}
+
+type meteredBucket struct {
+	filesystem.Bucket
+	name  string
+	meter *Meter
+}
+
+func (b *meteredBucket) NewPutTransaction() filesystem.PutTransaction {
+	return &meteredPutTransaction{
+		PutTransaction: b.Bucket.NewPutTransaction(),
+		bucket:         b,
+		files:          map[string]filesystem.BlobRef{},
+	}
+}
+
+// DeleteVersions stops accounting for the logical bytes and files of the
+// deleted versions. Physical bytes stay accounted: the blobs are still
+// stored until deleted from a metered blob service.
+func (b *meteredBucket) DeleteVersions(versions ...filesystem.Version) error {
+	if err := b.Bucket.DeleteVersions(versions...); err != nil {
+		return err
+	}
+	m := b.meter
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bu := m.bucket(b.name)
+	for _, version := range versions {
+		if u, ok := bu.versions[version]; ok {
+			bu.LogicalBytes -= u.LogicalBytes
+			bu.Files -= u.Files
+			delete(bu.versions, version)
+		}
+	}
+	return nil
+}
+
+type meteredPutTransaction struct {
+	filesystem.PutTransaction
+	bucket *meteredBucket
+	files  map[string]filesystem.BlobRef
+}
+
+func (tx *meteredPutTransaction) Dir(path string) filesystem.PutTransactionPath {
+	return &meteredPutTransactionPath{tx.PutTransaction.Dir(path), tx, path}
+}
+
+func (tx *meteredPutTransaction) File(name string, blobRef filesystem.BlobRef) {
+	tx.files[name] = blobRef
+	tx.PutTransaction.File(name, blobRef)
+}
+
+func (tx *meteredPutTransaction) FileWithMetadata(name string, blobRef filesystem.BlobRef, metadata filesystem.Metadata) {
+	if blobRef != (filesystem.BlobRef{}) { // special files have no blob
+		tx.files[name] = blobRef
+	}
+	tx.PutTransaction.FileWithMetadata(name, blobRef, metadata)
+}
+
+func (tx *meteredPutTransaction) Remove(name string) {
+	tx.remove(name, false)
+	tx.PutTransaction.Remove(name)
+}
+
+func (tx *meteredPutTransaction) RemoveAll(name string) {
+	tx.remove(name, true)
+	tx.PutTransaction.RemoveAll(name)
+}
+
+// remove stops accounting for the files a removal drops from the
+// transaction. Removals free nothing: earlier versions still reference the
+// removed blobs. Moves and symlinks add no usage either: moved files
+// reference blobs already accounted for, and symlinks have no blob.
+func (tx *meteredPutTransaction) remove(path string, recursive bool) {
+	for file := range tx.files {
+		if file == path || (recursive && strings.HasPrefix(file, path+string(filepath.Separator))) {
+			delete(tx.files, file)
+		}
+	}
+}
+
+type meteredPutTransactionPath struct {
+	filesystem.PutTransactionPath
+	tx   *meteredPutTransaction
+	path string
+}
+
+func (p *meteredPutTransactionPath) Dir(path string) filesystem.PutTransactionPath {
+	fullPath := filepath.Join(p.path, path)
+	return &meteredPutTransactionPath{p.PutTransactionPath.Dir(path), p.tx, fullPath}
+}
+
+func (p *meteredPutTransactionPath) File(name string, blobRef filesystem.BlobRef) {
+	p.tx.files[filepath.Join(p.path, name)] = blobRef
+	p.PutTransactionPath.File(name, blobRef)
+}
+
+func (p *meteredPutTransactionPath) FileWithMetadata(name string, blobRef filesystem.BlobRef, metadata filesystem.Metadata) {
+	if blobRef != (filesystem.BlobRef{}) {
+		p.tx.files[filepath.Join(p.path, name)] = blobRef
+	}
+	p.PutTransactionPath.FileWithMetadata(name, blobRef, metadata)
+}
+
+func (p *meteredPutTransactionPath) Remove(name string) {
+	p.tx.remove(filepath.Join(p.path, name), false)
+	p.PutTransactionPath.Remove(name)
+}
+
+func (p *meteredPutTransactionPath) RemoveAll(name string) {
+	p.tx.remove(filepath.Join(p.path, name), true)
+	p.PutTransactionPath.RemoveAll(name)
+}
+
+// Commit checks the transaction against the bucket limits, commits it and
+// records its usage under the version it was committed as.
+func (tx *meteredPutTransaction) Commit() error {
+	return tx.bucket.account(tx.files, func() (filesystem.Version, error) {
+		if err := tx.PutTransaction.Commit(); err != nil {
+			return "", err
+		}
+		return tx.PutTransaction.Version(), nil
+	})
+}
+
+// ImportCommit is accounted like a commit of the files it writes.
+func (b *meteredBucket) ImportCommit(commit *filesystem.Commit) error {
+	files := map[string]filesystem.BlobRef{}
+	for _, f := range commit.Files {
+		if f.BlobRef != (filesystem.BlobRef{}) { // special files have no blob
+			files[f.Path] = f.BlobRef
+		}
+	}
+	return b.account(files, func() (filesystem.Version, error) {
+		return commit.Snapshot.Version, b.Bucket.ImportCommit(commit)
+	})
+}
+
+// account checks a commit of files against the bucket limits and reserves
+// its usage, so that concurrent commits can't jointly exceed them. It then
+// makes the commit with commit and records the usage under the version
+// commit returns, or releases the reservation if commit fails.
+func (b *meteredBucket) account(files map[string]filesystem.BlobRef, commit func() (filesystem.Version, error)) error {
+	m := b.meter
+	sizes := map[filesystem.BlobRef]int64{}
+	var logical int64
+	for _, ref := range files {
+		size, err := m.sizeOf(ref)
+		if err != nil {
+			return fmt.Errorf("sizing %v: %v", &ref, err)
+		}
+		sizes[ref] = size
+		logical += size
+	}
+
+	m.mu.Lock()
+	bu := m.bucket(b.name)
+	u := &Usage{LogicalBytes: logical, Files: len(files)}
+	var pending []filesystem.BlobRef // blobs the bucket doesn't reference yet
+	for ref, size := range sizes {
+		if bu.blobs[ref] {
+			continue
+		}
+		if bu.pending[ref] == 0 {
+			u.PhysicalBytes += size
+			u.Blobs++
+		}
+		pending = append(pending, ref)
+	}
+	limits := m.limits.forBucket(b.name)
+	err := checkLimit(b.name, "logical", limits.MaxLogicalBytes, bu.LogicalBytes, u.LogicalBytes)
+	if err == nil {
+		err = checkLimit(b.name, "physical", limits.MaxPhysicalBytes, bu.PhysicalBytes, u.PhysicalBytes)
+	}
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	for _, ref := range pending {
+		bu.pending[ref]++
+	}
+	bu.LogicalBytes += u.LogicalBytes
+	bu.PhysicalBytes += u.PhysicalBytes
+	bu.Files += u.Files
+	bu.Blobs += u.Blobs
+	m.mu.Unlock()
+
+	version, err := commit()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ref := range pending {
+		if bu.pending[ref]--; bu.pending[ref] == 0 {
+			delete(bu.pending, ref)
+		}
+	}
+	if err != nil {
+		// The physical bytes of a blob are released by the last pending
+		// commit referencing it, unless another one committed it.
+		bu.LogicalBytes -= u.LogicalBytes
+		bu.Files -= u.Files
+		for _, ref := range pending {
+			if !bu.blobs[ref] && bu.pending[ref] == 0 {
+				bu.PhysicalBytes -= sizes[ref]
+				bu.Blobs--
+			}
+		}
+		return err
+	}
+	for _, ref := range pending {
+		bu.blobs[ref] = true
+	}
+	bu.versions[version] = u
+	return nil
+}
@@ -0,0 +1,196 @@
+// Package usage accounts for the bytes stored by blob services and referenced
+// by filesystem buckets, and enforces quotas on them.
+//
+// Logical bytes are the sum of the sizes of every file entry committed, so a
+// blob referenced by ten versions counts ten times. Physical bytes count each
+// distinct blob once, which is what deduplication actually costs.
+package usage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"drivebackup/store/blob"
+	"drivebackup/store/filesystem"
+)
+
+// Usage is a byte and entry count.
+type Usage struct {
+	LogicalBytes  int64
+	PhysicalBytes int64
+	Files         int // file entries committed
+	Blobs         int // distinct blobs
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("logical=%d physical=%d files=%d blobs=%d", u.LogicalBytes, u.PhysicalBytes, u.Files, u.Blobs)
+}
+
+// BucketLimits are the quotas for one bucket. Zero means unlimited.
+type BucketLimits struct {
+	MaxLogicalBytes  int64
+	MaxPhysicalBytes int64
+}
+
+// Limits are the quotas enforced by a Meter. Zero means unlimited.
+type Limits struct {
+	MaxStoreBytes int64                   // physical bytes Put through all metered blob services
+	Bucket        BucketLimits            // default for every bucket
+	Buckets       map[string]BucketLimits // per bucket overrides
+}
+
+func (l Limits) forBucket(bucket string) BucketLimits {
+	if limits, ok := l.Buckets[bucket]; ok {
+		return limits
+	}
+	return l.Bucket
+}
+
+// QuotaError is returned when an operation would exceed a limit.
+type QuotaError struct {
+	Scope     string // "store" or the bucket name
+	Kind      string // "logical" or "physical"
+	Limit     int64
+	Used      int64
+	Requested int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded for %s: %d %s bytes used, %d requested, limit %d", e.Scope, e.Used, e.Kind, e.Requested, e.Limit)
+}
+
+// IsQuotaError reports whether err is a *QuotaError.
+func IsQuotaError(err error) bool {
+	_, ok := err.(*QuotaError)
+	return ok
+}
+
+type bucketUsage struct {
+	Usage
+	blobs    map[filesystem.BlobRef]bool
+	pending  map[filesystem.BlobRef]int // commits in progress adding each blob
+	versions map[filesystem.Version]*Usage
+}
+
+// Meter records usage and enforces Limits. Blob services and filesystem
+// services wrapped by the same meter share its accounting: blob sizes learnt
+// from Put are used to size the file entries committed to buckets.
+type Meter struct {
+	mu      sync.Mutex
+	limits  Limits
+	sizes   map[filesystem.BlobRef]int64 // known blob sizes
+	put     map[filesystem.BlobRef]int64 // the size of every blob Put through the meter or committed before it
+	stores  map[string]blob.BlobService
+	stored  Usage
+	buckets map[string]*bucketUsage
+}
+
+// NewMeter returns a meter enforcing limits.
+func NewMeter(limits Limits) *Meter {
+	return &Meter{
+		limits:  limits,
+		sizes:   map[filesystem.BlobRef]int64{},
+		put:     map[filesystem.BlobRef]int64{},
+		stores:  map[string]blob.BlobService{},
+		buckets: map[string]*bucketUsage{},
+	}
+}
+
+// SetLimits replaces the limits. Existing usage above a new limit is kept but
+// further growth is rejected.
+func (m *Meter) SetLimits(limits Limits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits = limits
+}
+
+// Store returns the physical usage of all metered blob services.
+func (m *Meter) Store() Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stored
+}
+
+// Bucket returns the usage of a bucket.
+func (m *Meter) Bucket(bucket string) Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.buckets[bucket]; ok {
+		return b.Usage
+	}
+	return Usage{}
+}
+
+// Buckets returns the names of buckets with recorded usage, sorted.
+func (m *Meter) Buckets() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Version returns the usage added by one commit to a bucket. Its physical
+// bytes are those of blobs the bucket did not reference before.
+func (m *Meter) Version(bucket string, version filesystem.Version) Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.buckets[bucket]; ok {
+		if u, ok := b.versions[version]; ok {
+			return *u
+		}
+	}
+	return Usage{}
+}
+
+func (m *Meter) bucket(name string) *bucketUsage {
+	b, ok := m.buckets[name]
+	if !ok {
+		b = &bucketUsage{
+			blobs:    map[filesystem.BlobRef]bool{},
+			pending:  map[filesystem.BlobRef]int{},
+			versions: map[filesystem.Version]*Usage{},
+		}
+		m.buckets[name] = b
+	}
+	return b
+}
+
+// sizeOf returns the size of a blob, asking its store if it was not Put
+// through the meter. Blobs in stores not added with BlobService can't be
+// sized, so commits referencing them are rejected rather than left
+// unmetered. m.mu must not be held.
+func (m *Meter) sizeOf(ref filesystem.BlobRef) (int64, error) {
+	m.mu.Lock()
+	size, ok := m.sizes[ref]
+	service := m.stores[ref.Store]
+	m.mu.Unlock()
+	if ok {
+		return size, nil
+	}
+	if service == nil {
+		return 0, fmt.Errorf("store %q is not metered", ref.Store)
+	}
+	size, ok, err := service.Stat(ref.Name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("blob %v not found", &ref)
+	}
+	m.mu.Lock()
+	m.sizes[ref] = size
+	m.mu.Unlock()
+	return size, nil
+}
+
+func checkLimit(scope, kind string, limit, used, requested int64) error {
+	if limit > 0 && used+requested > limit {
+		return &QuotaError{Scope: scope, Kind: kind, Limit: limit, Used: used, Requested: requested}
+	}
+	return nil
+}
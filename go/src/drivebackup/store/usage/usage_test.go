@@ -0,0 +1,320 @@
+package usage_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	blobmock "drivebackup/store/blob/mock"
+	"drivebackup/store/fault"
+	"drivebackup/store/filesystem"
+	fsmock "drivebackup/store/filesystem/mock"
+	"drivebackup/store/usage"
+)
+
+func meteredService(t *testing.T, meter *usage.Meter, service filesystem.FilesystemService) filesystem.FilesystemService {
+	fs, err := meter.FilesystemService(service)
+	if err != nil {
+		t.Fatalf("error metering filesystem service: %v", err)
+	}
+	return fs
+}
+
+func TestAccounting(t *testing.T) {
+	meter := usage.NewMeter(usage.Limits{})
+	blobs := meter.BlobService("store_a", &blobmock.MockBlobService{})
+	fs := meteredService(t, meter, &fsmock.MockFilesystemService{})
+
+	for name, data := range map[string]string{"abcd": "0123456789", "efgh": "01234"} {
+		if err := blobs.Put(name, bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("error in Put(%q): %v", name, err)
+		}
+	}
+	if got, want := meter.Store(), (usage.Usage{LogicalBytes: 15, PhysicalBytes: 15, Blobs: 2}); got != want {
+		t.Errorf("got store usage %v, want %v", got, want)
+	}
+
+	bucket := fs.Bucket("photos")
+	tx := bucket.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "abcd"})
+	tx.File("b", filesystem.BlobRef{Store: "store_a", Name: "abcd"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing tx1: %v", err)
+	}
+	tx = bucket.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "abcd"})
+	tx.File("c", filesystem.BlobRef{Store: "store_a", Name: "efgh"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing tx2: %v", err)
+	}
+
+	if got, want := meter.Bucket("photos"), (usage.Usage{LogicalBytes: 35, PhysicalBytes: 15, Files: 4, Blobs: 2}); got != want {
+		t.Errorf("got bucket usage %v, want %v", got, want)
+	}
+	versions, err := bucket.Select().File("c").Versions()
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("error fetching versions %v: %v", versions, err)
+	}
+	if got, want := meter.Version("photos", versions[0]), (usage.Usage{LogicalBytes: 15, PhysicalBytes: 5, Files: 2, Blobs: 1}); got != want {
+		t.Errorf("got version usage %v, want %v", got, want)
+	}
+	if got := meter.Bucket("other"); got != (usage.Usage{}) {
+		t.Errorf("got usage %v for unused bucket", got)
+	}
+
+	// Deleting the first version frees its logical bytes only.
+	versions, err = bucket.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("error fetching versions %v: %v", versions, err)
+	}
+	if err := bucket.DeleteVersions(versions[0]); err != nil {
+		t.Fatalf("error deleting version: %v", err)
+	}
+	if got, want := meter.Bucket("photos"), (usage.Usage{LogicalBytes: 15, PhysicalBytes: 15, Files: 2, Blobs: 2}); got != want {
+		t.Errorf("got bucket usage %v after deleting a version, want %v", got, want)
+	}
+}
+
+func TestStoreQuota(t *testing.T) {
+	meter := usage.NewMeter(usage.Limits{MaxStoreBytes: 10})
+	blobs := meter.BlobService("store_a", &blobmock.MockBlobService{})
+	if err := blobs.Put("a", bytes.NewReader(make([]byte, 8))); err != nil {
+		t.Fatalf("error in Put: %v", err)
+	}
+	err := blobs.Put("b", bytes.NewReader(make([]byte, 3)))
+	if !usage.IsQuotaError(err) {
+		t.Fatalf("got %v, want quota error", err)
+	}
+	if qe := err.(*usage.QuotaError); qe.Scope != "store" || qe.Used != 8 || qe.Requested != 3 || qe.Limit != 10 {
+		t.Errorf("unexpected quota error: %v", qe)
+	}
+	if r, _ := blobs.Get("b"); r != nil {
+		t.Errorf("rejected blob was stored")
+	}
+	if err := blobs.Put("c", bytes.NewReader(make([]byte, 2))); err != nil {
+		t.Errorf("error in Put within quota: %v", err)
+	}
+}
+
+func TestBucketQuota(t *testing.T) {
+	meter := usage.NewMeter(usage.Limits{
+		Bucket:  usage.BucketLimits{MaxPhysicalBytes: 10},
+		Buckets: map[string]usage.BucketLimits{"small": {MaxLogicalBytes: 5}},
+	})
+	blobs := meter.BlobService("store_a", &blobmock.MockBlobService{})
+	fs := meteredService(t, meter, &fsmock.MockFilesystemService{})
+	blobs.Put("eight", bytes.NewReader(make([]byte, 8)))
+	blobs.Put("four", bytes.NewReader(make([]byte, 4)))
+
+	big := fs.Bucket("big")
+	tx := big.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	// Referencing an already stored blob again costs no physical bytes.
+	tx = big.NewPutTransaction()
+	tx.File("b", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing deduplicated blob: %v", err)
+	}
+	tx = big.NewPutTransaction()
+	tx.File("c", filesystem.BlobRef{Store: "store_a", Name: "four"})
+	if err := tx.Commit(); !usage.IsQuotaError(err) {
+		t.Fatalf("got %v, want quota error", err)
+	}
+	if versions, _ := big.Select().File("c").Versions(); len(versions) != 0 {
+		t.Errorf("rejected commit created versions %v", versions)
+	}
+
+	small := fs.Bucket("small")
+	tx = small.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+	if err := tx.Commit(); !usage.IsQuotaError(err) {
+		t.Fatalf("got %v, want quota error from bucket override", err)
+	}
+}
+
+func TestUnmeteredStoreIsRejected(t *testing.T) {
+	meter := usage.NewMeter(usage.Limits{Bucket: usage.BucketLimits{MaxLogicalBytes: 10}})
+	meter.BlobService("store_a", &blobmock.MockBlobService{})
+	bucket := meteredService(t, meter, &fsmock.MockFilesystemService{}).Bucket("photos")
+	tx := bucket.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_b", Name: "abcd"})
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("committed a blob of an unmetered store")
+	}
+	if versions, _ := bucket.Select().Versions(); len(versions) != 0 {
+		t.Errorf("rejected commit created versions %v", versions)
+	}
+}
+
+func TestLoadsExistingUsage(t *testing.T) {
+	store := &blobmock.MockBlobService{}
+	store.Put("eight", bytes.NewReader(make([]byte, 8)))
+	store.Put("four", bytes.NewReader(make([]byte, 4)))
+	service := &fsmock.MockFilesystemService{}
+	bucket := service.Bucket("photos")
+	for _, names := range [][]string{{"eight"}, {"eight", "four"}} {
+		tx := bucket.NewPutTransaction()
+		for _, name := range names {
+			tx.File(name, filesystem.BlobRef{Store: "store_a", Name: name})
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("error committing: %v", err)
+		}
+	}
+
+	meter := usage.NewMeter(usage.Limits{Bucket: usage.BucketLimits{MaxLogicalBytes: 25}})
+	blobs := meter.BlobService("store_a", store)
+	bucket = meteredService(t, meter, service).Bucket("photos")
+	if got, want := meter.Bucket("photos"), (usage.Usage{LogicalBytes: 20, PhysicalBytes: 12, Files: 3, Blobs: 2}); got != want {
+		t.Errorf("got loaded bucket usage %v, want %v", got, want)
+	}
+	if got, want := meter.Store(), (usage.Usage{LogicalBytes: 12, PhysicalBytes: 12, Blobs: 2}); got != want {
+		t.Errorf("got loaded store usage %v, want %v", got, want)
+	}
+
+	// The loaded usage counts towards the limit.
+	tx := bucket.NewPutTransaction()
+	tx.File("again", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+	if err := tx.Commit(); !usage.IsQuotaError(err) {
+		t.Errorf("got %v, want quota error", err)
+	}
+	versions, err := bucket.Select().Versions()
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("got versions %v, %v, want two", versions, err)
+	}
+	if err := bucket.DeleteVersions(versions[0]); err != nil {
+		t.Fatalf("error deleting version: %v", err)
+	}
+	if got, want := meter.Bucket("photos"), (usage.Usage{LogicalBytes: 12, PhysicalBytes: 12, Files: 2, Blobs: 2}); got != want {
+		t.Errorf("got bucket usage %v after deleting a loaded version, want %v", got, want)
+	}
+	if err := blobs.Delete("four"); err != nil {
+		t.Fatalf("error in Delete: %v", err)
+	}
+	if got, want := meter.Store(), (usage.Usage{LogicalBytes: 8, PhysicalBytes: 8, Blobs: 1}); got != want {
+		t.Errorf("got store usage %v after deleting a loaded blob, want %v", got, want)
+	}
+}
+
+// overwritingBlobService replaces blobs Put under a stored name, unlike the
+// mock.
+type overwritingBlobService struct {
+	blobmock.MockBlobService
+}
+
+func (s *overwritingBlobService) Put(name string, data io.Reader) error {
+	s.MockBlobService.Delete(name)
+	return s.MockBlobService.Put(name, data)
+}
+
+func TestPutAgain(t *testing.T) {
+	meter := usage.NewMeter(usage.Limits{MaxStoreBytes: 12})
+	blobs := meter.BlobService("store_a", &overwritingBlobService{})
+	if err := blobs.Put("a", bytes.NewReader(make([]byte, 10))); err != nil {
+		t.Fatalf("error in Put: %v", err)
+	}
+	// Replacing the blob only needs the difference in size.
+	if err := blobs.Put("a", bytes.NewReader(make([]byte, 12))); err != nil {
+		t.Fatalf("error replacing blob: %v", err)
+	}
+	if err := blobs.Put("a", bytes.NewReader(make([]byte, 4))); err != nil {
+		t.Fatalf("error replacing blob: %v", err)
+	}
+	if got, want := meter.Store(), (usage.Usage{LogicalBytes: 4, PhysicalBytes: 4, Blobs: 1}); got != want {
+		t.Errorf("got store usage %v after replacing a blob, want %v", got, want)
+	}
+	if err := blobs.Delete("a"); err != nil {
+		t.Fatalf("error in Delete: %v", err)
+	}
+	if got := meter.Store(); got != (usage.Usage{}) {
+		t.Errorf("got store usage %v after deleting the blob, want none", got)
+	}
+}
+
+// blockingService is a filesystem service whose commits wait for release
+// after signalling entered.
+type blockingService struct {
+	filesystem.FilesystemService
+	entered, release chan bool
+}
+
+func (s *blockingService) Bucket(name string) filesystem.Bucket {
+	return &blockingBucket{s.FilesystemService.Bucket(name), s}
+}
+
+type blockingBucket struct {
+	filesystem.Bucket
+	service *blockingService
+}
+
+func (b *blockingBucket) NewPutTransaction() filesystem.PutTransaction {
+	return &blockingTransaction{b.Bucket.NewPutTransaction(), b.service}
+}
+
+type blockingTransaction struct {
+	filesystem.PutTransaction
+	service *blockingService
+}
+
+func (tx *blockingTransaction) Commit() error {
+	tx.service.entered <- true
+	<-tx.service.release
+	return tx.PutTransaction.Commit()
+}
+
+func TestConcurrentCommitsShareQuota(t *testing.T) {
+	meter := usage.NewMeter(usage.Limits{Bucket: usage.BucketLimits{MaxLogicalBytes: 10}})
+	blobs := meter.BlobService("store_a", &blobmock.MockBlobService{})
+	blobs.Put("eight", bytes.NewReader(make([]byte, 8)))
+	service := &blockingService{&fsmock.MockFilesystemService{}, make(chan bool), make(chan bool)}
+	bucket := meteredService(t, meter, service).Bucket("photos")
+
+	errs := make(chan error)
+	go func() {
+		tx := bucket.NewPutTransaction()
+		tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+		errs <- tx.Commit()
+	}()
+	<-service.entered
+	// The first commit holds its reservation while it is in progress.
+	tx := bucket.NewPutTransaction()
+	tx.File("b", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+	if err := tx.Commit(); !usage.IsQuotaError(err) {
+		t.Errorf("got %v committing alongside a reservation, want quota error", err)
+	}
+	service.release <- true
+	if err := <-errs; err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if got, want := meter.Bucket("photos"), (usage.Usage{LogicalBytes: 8, PhysicalBytes: 8, Files: 1, Blobs: 1}); got != want {
+		t.Errorf("got bucket usage %v, want %v", got, want)
+	}
+}
+
+func TestFailedCommitReleasesReservation(t *testing.T) {
+	meter := usage.NewMeter(usage.Limits{})
+	blobs := meter.BlobService("store_a", &blobmock.MockBlobService{})
+	blobs.Put("eight", bytes.NewReader(make([]byte, 8)))
+	injector := fault.NewInjector(0, fault.Rule{Op: fault.Commit, Nth: 1})
+	bucket := meteredService(t, meter, fault.NewFilesystemService(&fsmock.MockFilesystemService{}, injector)).Bucket("photos")
+
+	tx := bucket.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+	if err := tx.Commit(); err != fault.ErrInjected {
+		t.Fatalf("got %v, want injected error", err)
+	}
+	if got := meter.Bucket("photos"); got != (usage.Usage{}) {
+		t.Errorf("got bucket usage %v after a failed commit, want none", got)
+	}
+	tx = bucket.NewPutTransaction()
+	tx.File("a", filesystem.BlobRef{Store: "store_a", Name: "eight"})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if got, want := meter.Version("photos", tx.Version()), (usage.Usage{LogicalBytes: 8, PhysicalBytes: 8, Files: 1, Blobs: 1}); got != want {
+		t.Errorf("got version usage %v, want %v", got, want)
+	}
+}